@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// アクセスログの形式 (ISUCON13_ACCESS_LOG_FORMAT)
+// 未指定なら echo の標準のロガーを使う
+const (
+	accessLogFormatLTSV = "ltsv"
+	accessLogFormatJSON = "json"
+)
+
+// 書き込み待ちのログの数。溢れた分は捨てて数だけ数える
+const accessLogBufferSize = 4096
+
+type accessLogEntry struct {
+	Time    string  `json:"time"`
+	Host    string  `json:"host"`
+	Method  string  `json:"method"`
+	URI     string  `json:"uri"`
+	Route   string  `json:"route"`
+	Status  int     `json:"status"`
+	Size    int64   `json:"size"`
+	ReqTime float64 `json:"reqtime"`
+	UA      string  `json:"ua"`
+	Referer string  `json:"referer"`
+	// Cookie のセッションのユーザ名 (replay でユーザごとに順序を保つのに使う)
+	User string `json:"user,omitempty"`
+	// ベンチマークのフェーズ (bench_phase.go)
+	Phase string `json:"phase,omitempty"`
+}
+
+// 値にタブや改行が入ると LTSV が壊れるので空白にする
+var ltsvValueReplacer = strings.NewReplacer("\t", " ", "\n", " ")
+
+// ltsv は alp で集計しやすいよう uri にルートのパターン (/api/user/:username など) を入れ、実際の URI は raw_uri に入れます。
+func (e accessLogEntry) ltsv() string {
+	uri := e.Route
+	if uri == "" {
+		uri = e.URI
+	}
+	var b strings.Builder
+	fields := [][2]string{
+		{"time", e.Time},
+		{"host", e.Host},
+		{"method", e.Method},
+		{"uri", uri},
+		{"raw_uri", e.URI},
+		{"status", strconv.Itoa(e.Status)},
+		{"size", strconv.FormatInt(e.Size, 10)},
+		{"reqtime", strconv.FormatFloat(e.ReqTime, 'f', 6, 64)},
+		{"ua", e.UA},
+		{"referer", e.Referer},
+		{"user", e.User},
+		{"phase", e.Phase},
+	}
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte('\t')
+		}
+		b.WriteString(f[0])
+		b.WriteByte(':')
+		b.WriteString(ltsvValueReplacer.Replace(f[1]))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// accessLogWriter はハンドラを待たせないよう、別の goroutine でまとめて書き込みます。
+type accessLogWriter struct {
+	format  string
+	entries chan accessLogEntry
+	dropped atomic.Int64
+}
+
+func newAccessLogWriter(format string, w io.Writer) *accessLogWriter {
+	lw := &accessLogWriter{
+		format:  format,
+		entries: make(chan accessLogEntry, accessLogBufferSize),
+	}
+	go lw.run(w)
+	return lw
+}
+
+func (lw *accessLogWriter) run(w io.Writer) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-lw.entries:
+			if lw.format == accessLogFormatJSON {
+				_ = enc.Encode(entry)
+			} else {
+				_, _ = bw.WriteString(entry.ltsv())
+			}
+		case <-ticker.C:
+			if n := lw.dropped.Swap(0); n > 0 {
+				log.Printf("access log: dropped %d entries", n)
+			}
+			if err := bw.Flush(); err != nil {
+				log.Printf("access log: failed to flush: %v", err)
+			}
+		}
+	}
+}
+
+func (lw *accessLogWriter) write(entry accessLogEntry) {
+	select {
+	case lw.entries <- entry:
+	default:
+		lw.dropped.Add(1)
+	}
+}
+
+func accessLogUser(c echo.Context) string {
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return ""
+	}
+	name, _ := sess.Values[defaultUsernameKey].(string)
+	return name
+}
+
+// accessLogMiddleware は ISUCON13_ACCESS_LOG_FORMAT に応じたアクセスログのミドルウェアを返します。
+// 出力先は ISUCON13_ACCESS_LOG_PATH (未指定なら標準出力) です。
+func accessLogMiddleware() echo.MiddlewareFunc {
+	format := os.Getenv("ISUCON13_ACCESS_LOG_FORMAT")
+	if format != accessLogFormatLTSV && format != accessLogFormatJSON {
+		return middleware.Logger()
+	}
+
+	var out io.Writer = os.Stdout
+	if path := os.Getenv("ISUCON13_ACCESS_LOG_PATH"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Printf("access log: failed to open %s, using stdout: %v", path, err)
+		} else {
+			out = f
+		}
+	}
+	lw := newAccessLogWriter(format, out)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				// ステータスコードを確定させるため、echo の Logger と同じくここでエラーレスポンスを書く
+				c.Error(err)
+			}
+
+			req, res := c.Request(), c.Response()
+			lw.write(accessLogEntry{
+				Time:    start.Format(time.RFC3339),
+				Host:    c.RealIP(),
+				Method:  req.Method,
+				URI:     req.RequestURI,
+				Route:   c.Path(),
+				Status:  res.Status,
+				Size:    res.Size,
+				ReqTime: time.Since(start).Seconds(),
+				UA:      req.UserAgent(),
+				Referer: req.Referer(),
+				User:    accessLogUser(c),
+				Phase:   benchPhase(c),
+			})
+			return err
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// アクセスログ (ISUCON13_ACCESS_LOG_FORMAT=json / ltsv) を読んで、同じリクエストを同じ間隔で別のサーバに送り直す
+// 公式のベンチマーカーなしで、手元で本番に近い負荷を再現するためのもの。
+// ユーザ (ログインしていなければ接続元) ごとにログの順で 1 本ずつ送るので、同じセッションの中の順序は保たれる。
+// アクセスログにはリクエストボディが残らないので、送り直すのは GET / HEAD だけ (それ以外は数だけ数える)。
+// -password を指定すると、ログに出てくるユーザでそのパスワードを使ってログインしてから送る
+type replayEntry struct {
+	at     time.Time
+	method string
+	uri    string
+	route  string
+	// 順序を保つ単位 (ユーザ名か接続元)
+	session string
+}
+
+// readReplayEntries はアクセスログを読み、時刻順に並べて返します。JSON と LTSV のどちらの行も読めます。
+func readReplayEntries(r io.Reader) ([]replayEntry, error) {
+	var entries []replayEntry
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e accessLogEntry
+		if line[0] == '{' {
+			if err := json.Unmarshal(line, &e); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+		} else {
+			e = parseLTSVAccessLog(string(line))
+		}
+		at, err := time.Parse(time.RFC3339, e.Time)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid time %q", lineNo, e.Time)
+		}
+		session := "ip:" + e.Host
+		if e.User != "" {
+			session = "user:" + e.User
+		}
+		entries = append(entries, replayEntry{
+			at:      at,
+			method:  e.Method,
+			uri:     e.URI,
+			route:   e.Route,
+			session: session,
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].at.Before(entries[j].at) })
+	return entries, nil
+}
+
+// parseLTSVAccessLog は accessLogEntry.ltsv の逆です。uri にはルートが、raw_uri に実際の URI が入っている。
+func parseLTSVAccessLog(line string) accessLogEntry {
+	var e accessLogEntry
+	for _, field := range strings.Split(line, "\t") {
+		key, value, _ := strings.Cut(field, ":")
+		switch key {
+		case "time":
+			e.Time = value
+		case "host":
+			e.Host = value
+		case "method":
+			e.Method = value
+		case "uri":
+			e.Route = value
+		case "raw_uri":
+			e.URI = value
+		case "status":
+			e.Status, _ = strconv.Atoi(value)
+		case "user":
+			e.User = value
+		}
+	}
+	if e.URI == "" {
+		e.URI = e.Route
+	}
+	return e
+}
+
+type replayRouteStats struct {
+	Count   int64
+	Errors  int64
+	TotalMS float64
+	MaxMS   float64
+}
+
+type replayer struct {
+	target   string
+	speed    float64
+	password string
+	client   *http.Client
+
+	mu       sync.Mutex
+	statuses map[int]int64
+	routes   map[string]*replayRouteStats
+	skipped  int64
+	failed   int64
+	// ログインに失敗してログインなしで送ったユーザ
+	loginFailed int64
+}
+
+func (r *replayer) record(route string, status int, elapsed time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.routes[route]
+	if !ok {
+		s = &replayRouteStats{}
+		r.routes[route] = s
+	}
+	s.Count++
+	ms := durationMS(elapsed)
+	s.TotalMS += ms
+	s.MaxMS = max(s.MaxMS, ms)
+	if err != nil {
+		s.Errors++
+		r.failed++
+		return
+	}
+	if status >= 500 {
+		s.Errors++
+	}
+	r.statuses[status]++
+}
+
+// replaySession はひとつのセッションのリクエストを順に送ります。
+// 前のリクエストが遅れて予定の時刻を過ぎていれば、待たずに次を送る (順序を優先する)
+func (r *replayer) replaySession(ctx context.Context, start, origin time.Time, user string, entries []replayEntry) {
+	cookies := map[string]string{}
+	if user != "" && r.password != "" {
+		if err := r.login(ctx, user, cookies); err != nil {
+			r.mu.Lock()
+			r.loginFailed++
+			r.mu.Unlock()
+		}
+	}
+
+	for _, e := range entries {
+		if r.speed > 0 {
+			at := start.Add(time.Duration(float64(e.at.Sub(origin)) / r.speed))
+			select {
+			case <-time.After(time.Until(at)):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if e.method != http.MethodGet && e.method != http.MethodHead {
+			r.mu.Lock()
+			r.skipped++
+			r.mu.Unlock()
+			continue
+		}
+
+		reqStart := time.Now()
+		status, err := r.send(ctx, e.method, e.uri, nil, cookies)
+		r.record(e.method+" "+e.route, status, time.Since(reqStart), err)
+	}
+}
+
+func (r *replayer) login(ctx context.Context, user string, cookies map[string]string) error {
+	body, err := json.Marshal(LoginRequest{Username: user, Password: r.password})
+	if err != nil {
+		return err
+	}
+	status, err := r.send(ctx, http.MethodPost, "/api/login", body, cookies)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("login returned %d", status)
+	}
+	return nil
+}
+
+// send はリクエストを送り、返ってきた Cookie を cookies に反映します。
+// Cookie の Domain は本番のドメインなので、cookiejar は使わずに名前と値だけ持ち回る
+func (r *replayer) send(ctx context.Context, method, uri string, body []byte, cookies map[string]string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, r.target+uri, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	for _, cookie := range res.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	return res.StatusCode, nil
+}
+
+func (r *replayer) run(ctx context.Context, entries []replayEntry) time.Duration {
+	sessions := map[string][]replayEntry{}
+	for _, e := range entries {
+		sessions[e.session] = append(sessions[e.session], e)
+	}
+
+	start := time.Now()
+	origin := entries[0].at
+	var wg sync.WaitGroup
+	for session, sessionEntries := range sessions {
+		user, _ := strings.CutPrefix(session, "user:")
+		if user == session {
+			user = ""
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.replaySession(ctx, start, origin, user, sessionEntries)
+		}()
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func (r *replayer) printSummary(w io.Writer, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sent int64
+	for _, s := range r.routes {
+		sent += s.Count
+	}
+	fmt.Fprintf(w, "replayed %d requests in %s (%d skipped, %d failed to send, %d users failed to log in)\n",
+		sent, elapsed.Round(time.Millisecond), r.skipped, r.failed, r.loginFailed)
+
+	codes := make([]int, 0, len(r.statuses))
+	for code := range r.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d: %d\n", code, r.statuses[code])
+	}
+
+	routes := make([]string, 0, len(r.routes))
+	for route := range r.routes {
+		routes = append(routes, route)
+	}
+	// 合計時間の長い順 (alp と同じく、効いているところから見る)
+	sort.Slice(routes, func(i, j int) bool { return r.routes[routes[i]].TotalMS > r.routes[routes[j]].TotalMS })
+	fmt.Fprintf(w, "\n%8s %8s %10s %10s  %s\n", "count", "errors", "avg(ms)", "max(ms)", "route")
+	for _, route := range routes {
+		s := r.routes[route]
+		fmt.Fprintf(w, "%8d %8d %10.2f %10.2f  %s\n", s.Count, s.Errors, s.TotalMS/float64(s.Count), s.MaxMS, route)
+	}
+}
+
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "http://"+net.JoinHostPort("127.0.0.1", strconv.Itoa(listenPort)), "送り先")
+	speed := fs.Float64("speed", 1, "再生速度の倍率 (0 なら待たずに送る)")
+	password := fs.String("password", "", "ログに出てくるユーザでログインするときのパスワード (空ならログインしない)")
+	timeout := fs.Duration("timeout", 10*time.Second, "1 リクエストあたりのタイムアウト")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: isupipe replay [flags] <access log> (- なら標準入力)")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("access log is required")
+	}
+	if *speed < 0 {
+		return fmt.Errorf("speed must be non-negative")
+	}
+
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	entries, err := readReplayEntries(in)
+	if err != nil {
+		return fmt.Errorf("failed to read access log: %w", err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no requests in access log")
+	}
+
+	r := &replayer{
+		target:   strings.TrimRight(*target, "/"),
+		speed:    *speed,
+		password: *password,
+		client: &http.Client{
+			Timeout: *timeout,
+			// リダイレクトもログに別の行として残っているので追わない
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		statuses: map[int]int64{},
+		routes:   map[string]*replayRouteStats{},
+	}
+	elapsed := r.run(context.Background(), entries)
+	r.printSummary(os.Stdout, elapsed)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	adminTokenHeader       = "X-Admin-Token"
+	dashboardPushInterval  = 1 * time.Second
+	dashboardWriteDeadline = 5 * time.Second
+)
+
+// adminToken が空の場合は管理者APIをすべて無効にします。
+var adminToken = os.Getenv("ISUCON13_ADMIN_TOKEN")
+
+// verifyAdmin は管理者トークンを検証します。
+// ブラウザの WebSocket はヘッダを付けられないので、クエリパラメータ token も受け付けます。
+func verifyAdmin(c echo.Context) error {
+	if adminToken == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "admin api is disabled")
+	}
+
+	token := c.Request().Header.Get(adminTokenHeader)
+	if token == "" {
+		token = c.QueryParam("token")
+	}
+	if !validAdminToken(token) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid admin token")
+	}
+	return nil
+}
+
+// validAdminToken は管理者トークンが正しいかを、比較にかかる時間から推測されないように確かめます。
+func validAdminToken(token string) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// 管理者向けリアルタイムダッシュボード
+// GET /api/admin/dashboard/ws
+func getAdminDashboardWSHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	server := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			ticker := time.NewTicker(dashboardPushInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				ws.SetWriteDeadline(time.Now().Add(dashboardWriteDeadline))
+				if err := websocket.JSON.Send(ws, metrics.snapshot()); err != nil {
+					c.Logger().Infof("admin dashboard disconnected: %v", err)
+					return
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 1リクエストで受け付けるイベント数の上限
+	analyticsMaxEventsPerRequest = 100
+	// 書き込み待ちイベントのバッファサイズ。溢れた場合は 503 を返してクライアントに再送させる
+	analyticsBufferSize = 10000
+	// まとめて INSERT する件数と間隔
+	analyticsFlushSize     = 500
+	analyticsFlushInterval = 1 * time.Second
+)
+
+var analyticsEventTypes = []string{
+	"page_view",
+	"watch_heartbeat",
+}
+
+type AnalyticsEvent struct {
+	Type         string          `json:"type"`
+	LivestreamID int64           `json:"livestream_id"`
+	Path         string          `json:"path"`
+	Payload      json.RawMessage `json:"payload"`
+	OccurredAt   int64           `json:"occurred_at"`
+}
+
+type PostAnalyticsEventsRequest struct {
+	Events []AnalyticsEvent `json:"events"`
+}
+
+type PostAnalyticsEventsResponse struct {
+	Accepted int `json:"accepted"`
+}
+
+type AnalyticsEventModel struct {
+	UserID       int64  `db:"user_id"`
+	EventType    string `db:"event_type"`
+	LivestreamID int64  `db:"livestream_id"`
+	Path         string `db:"path"`
+	Payload      string `db:"payload"`
+	OccurredAt   int64  `db:"occurred_at"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+// analyticsEvents はDB書き込み待ちのイベントを保持するバッファです。
+var analyticsEvents = make(chan AnalyticsEventModel, analyticsBufferSize)
+
+// クライアントイベント送信API
+// POST /api/analytics/events
+func postAnalyticsEventsHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	// 未ログインでも送信できるようにし、ログインしていればユーザを紐付ける
+	var userID int64
+	if err := verifyUserSession(c); err == nil {
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		userID = sess.Values[defaultUserIDKey].(int64)
+	}
+
+	var req PostAnalyticsEventsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if len(req.Events) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "events must not be empty")
+	}
+	if len(req.Events) > analyticsMaxEventsPerRequest {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "too many events in a request")
+	}
+
+	now := time.Now().Unix()
+	models := make([]AnalyticsEventModel, len(req.Events))
+	for i, ev := range req.Events {
+		if !isValidAnalyticsEventType(ev.Type) {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown event type: "+ev.Type)
+		}
+		occurredAt := ev.OccurredAt
+		if occurredAt == 0 {
+			occurredAt = now
+		}
+		models[i] = AnalyticsEventModel{
+			UserID:       userID,
+			EventType:    ev.Type,
+			LivestreamID: ev.LivestreamID,
+			Path:         ev.Path,
+			Payload:      string(ev.Payload),
+			OccurredAt:   occurredAt,
+			CreatedAt:    now,
+		}
+	}
+
+	// バッファに空きがなければ書き込みが追いついていないので受け付けない
+	if len(analyticsEvents)+len(models) > cap(analyticsEvents) {
+		c.Response().Header().Set("Retry-After", "1")
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "analytics buffer is full")
+	}
+	accepted := 0
+	for _, m := range models {
+		select {
+		case analyticsEvents <- m:
+			accepted++
+		default:
+		}
+	}
+
+	return c.JSON(http.StatusAccepted, &PostAnalyticsEventsResponse{
+		Accepted: accepted,
+	})
+}
+
+func isValidAnalyticsEventType(t string) bool {
+	for _, v := range analyticsEventTypes {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// runAnalyticsAppender はバッファに溜まったイベントを定期的にまとめて analytics_events に書き込みます。
+func runAnalyticsAppender() {
+	ticker := time.NewTicker(analyticsFlushInterval)
+	defer ticker.Stop()
+
+	buf := make([]AnalyticsEventModel, 0, analyticsFlushSize)
+	for {
+		select {
+		case ev := <-analyticsEvents:
+			buf = append(buf, ev)
+			if len(buf) >= analyticsFlushSize {
+				flushAnalyticsEvents(buf)
+				buf = buf[:0]
+			}
+		case <-ticker.C:
+			if len(buf) > 0 {
+				flushAnalyticsEvents(buf)
+				buf = buf[:0]
+			}
+		}
+	}
+}
+
+func flushAnalyticsEvents(events []AnalyticsEventModel) {
+	if dbConn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := bulkInsert(ctx, dbConn, "INSERT INTO analytics_events (user_id, event_type, livestream_id, path, payload, occurred_at, created_at) VALUES (:user_id, :event_type, :livestream_id, :path, :payload, :occurred_at, :created_at)", events); err != nil {
+		log.Printf("failed to insert analytics events (%d events dropped): %v", len(events), err)
+	}
+}
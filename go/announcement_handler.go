@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const announcementListLimit = 50
+
+type PostAnnouncementRequest struct {
+	Message string `json:"message"`
+}
+
+type AnnouncementModel struct {
+	ID        int64  `db:"id" json:"id"`
+	Message   string `db:"message" json:"message"`
+	CreatedAt int64  `db:"created_at" json:"created_at"`
+}
+
+// お知らせ配信API (管理者向け)
+// POST /api/admin/announcements
+func postAnnouncementHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	var req *PostAnnouncementRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Message == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "message must not be empty")
+	}
+
+	announcement := AnnouncementModel{
+		Message:   req.Message,
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO announcements (message, created_at) VALUES (:message, :created_at)", announcement)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert announcement: "+err.Error())
+	}
+	announcementID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted announcement id: "+err.Error())
+	}
+	announcement.ID = announcementID
+	resetHomeCache()
+
+	hub.broadcast(HubMessage{
+		Type: "announcement",
+		Data: announcement,
+	})
+
+	return c.JSON(http.StatusCreated, announcement)
+}
+
+// お知らせ一覧API (ポーリング用)
+// GET /api/announcements?since_id=
+func getAnnouncementsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var sinceID int64
+	if c.QueryParam("since_id") != "" {
+		id, err := strconv.ParseInt(c.QueryParam("since_id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "since_id query parameter must be integer")
+		}
+		sinceID = id
+	}
+
+	announcements := []AnnouncementModel{}
+	if err := dbConn.SelectContext(ctx, &announcements, "SELECT * FROM announcements WHERE id > ? ORDER BY id DESC LIMIT ?", sinceID, announcementListLimit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get announcements: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, announcements)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// OBS のオーバーレイやチャットボット向けのアクセストークン
+// Authorization: Bearer <token> を付けたリクエストは、Cookie のセッションの代わりにトークンの持ち主として扱う
+const (
+	// GET のみ
+	apiTokenScopeRead = "read"
+	// read に加えてライブコメント・リアクションの投稿
+	apiTokenScopeChat = "chat"
+)
+
+const (
+	apiTokenPrefix = "isu_"
+	// トークンで認証したリクエストであることを echo.Context に記録するキー
+	apiTokenContextKey = "api_token"
+	// ユーザごとに発行できるトークンの数
+	maxAPITokensPerUser = 20
+)
+
+type APITokenModel struct {
+	ID         int64         `db:"id"`
+	UserID     int64         `db:"user_id"`
+	Name       string        `db:"name"`
+	Scope      string        `db:"scope"`
+	TokenHash  string        `db:"token_hash"`
+	CreatedAt  int64         `db:"created_at"`
+	LastUsedAt sql.NullInt64 `db:"last_used_at"`
+}
+
+type APIToken struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Scope      string `json:"scope"`
+	CreatedAt  int64  `json:"created_at"`
+	LastUsedAt *int64 `json:"last_used_at,omitempty"`
+	// 発行時にだけ返す
+	Token string `json:"token,omitempty"`
+}
+
+type PostAPITokenRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// chat スコープで投稿できるルート
+var apiTokenChatRoutes = map[string]bool{
+	"/api/livestream/:livestream_id/livecomment": true,
+	"/api/livestream/:livestream_id/reaction":    true,
+}
+
+func (t APITokenModel) allows(method, path string) bool {
+	if method == http.MethodGet || method == http.MethodHead {
+		return true
+	}
+	return t.Scope == apiTokenScopeChat && method == http.MethodPost && apiTokenChatRoutes[path]
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type cachedAPIToken struct {
+	token     APITokenModel
+	expiresAt time.Time
+}
+
+// apiTokens はトークンのハッシュごとの検証結果のキャッシュです。
+var apiTokens sync.Map
+
+func resetAPITokens() {
+	apiTokens.Range(func(key, _ interface{}) bool {
+		apiTokens.Delete(key)
+		return true
+	})
+}
+
+func isAPITokenRequest(c echo.Context) bool {
+	_, ok := c.Get(apiTokenContextKey).(APITokenModel)
+	return ok
+}
+
+// apiTokenMiddleware は Bearer トークンを検証し、持ち主のセッションがあるものとして後続のハンドラに渡します。
+// セッションは保存しないので Set-Cookie はされません。
+func apiTokenMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		if !strings.HasPrefix(auth, "Bearer "+apiTokenPrefix) {
+			return next(c)
+		}
+		hash := hashAPIToken(strings.TrimPrefix(auth, "Bearer "))
+
+		var token APITokenModel
+		if v, ok := apiTokens.Load(hash); ok && time.Now().Before(v.(cachedAPIToken).expiresAt) {
+			token = v.(cachedAPIToken).token
+		} else {
+			ctx := c.Request().Context()
+			if err := dbConn.GetContext(ctx, &token, "SELECT * FROM api_tokens WHERE token_hash = ?", hash); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return echo.NewHTTPError(http.StatusUnauthorized, "invalid api token")
+				} else {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to get api token: "+err.Error())
+				}
+			}
+			if _, err := dbConn.ExecContext(ctx, "UPDATE api_tokens SET last_used_at = ? WHERE id = ?", time.Now().Unix(), token.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update api token: "+err.Error())
+			}
+			apiTokens.Store(hash, cachedAPIToken{token: token, expiresAt: time.Now().Add(currentConfig().APITokenCacheTTL.duration())})
+		}
+
+		if !token.allows(c.Request().Method, c.Path()) {
+			return echo.NewHTTPError(http.StatusForbidden, "api token scope does not allow this request")
+		}
+
+		sess, err := session.Get(defaultSessionIDKey, c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+		}
+		sess.Values[defaultUserIDKey] = token.UserID
+		sess.Values[defaultSessionExpiresKey] = time.Now().Add(currentConfig().SessionTTL.duration()).Unix()
+		c.Set(apiTokenContextKey, token)
+
+		return next(c)
+	}
+}
+
+func fillAPITokenResponse(tokenModel APITokenModel) APIToken {
+	token := APIToken{
+		ID:        tokenModel.ID,
+		Name:      tokenModel.Name,
+		Scope:     tokenModel.Scope,
+		CreatedAt: tokenModel.CreatedAt,
+	}
+	if tokenModel.LastUsedAt.Valid {
+		token.LastUsedAt = &tokenModel.LastUsedAt.Int64
+	}
+	return token
+}
+
+// アクセストークン発行API
+// トークンの管理はトークン自身ではできない (Cookie のセッションが必要)
+// POST /api/user/me/tokens
+func postAPITokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+	if isAPITokenRequest(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "api tokens can't be managed with an api token")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostAPITokenRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Scope != apiTokenScopeRead && req.Scope != apiTokenScopeChat {
+		return echo.NewHTTPError(http.StatusBadRequest, "scope must be read or chat")
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 255 {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must be 1 to 255 bytes")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate api token: "+err.Error())
+	}
+	plain := apiTokenPrefix + hex.EncodeToString(b)
+
+	var tokenModel APITokenModel
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var count int64
+		if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM api_tokens WHERE user_id = ? FOR UPDATE", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count api tokens: "+err.Error())
+		}
+		if count >= maxAPITokensPerUser {
+			return echo.NewHTTPError(http.StatusBadRequest, "too many api tokens; revoke unused ones first")
+		}
+
+		tokenModel = APITokenModel{
+			UserID:    userID,
+			Name:      name,
+			Scope:     req.Scope,
+			TokenHash: hashAPIToken(plain),
+			CreatedAt: time.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO api_tokens (user_id, name, scope, token_hash, created_at) VALUES (:user_id, :name, :scope, :token_hash, :created_at)", &tokenModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert api token: "+err.Error())
+		}
+		tokenID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted api token id: "+err.Error())
+		}
+		tokenModel.ID = tokenID
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	token := fillAPITokenResponse(tokenModel)
+	token.Token = plain
+	return c.JSON(http.StatusCreated, token)
+}
+
+// アクセストークン一覧API
+// GET /api/user/me/tokens
+func getAPITokensHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+	if isAPITokenRequest(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "api tokens can't be managed with an api token")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var tokenModels []APITokenModel
+	if err := dbConn.SelectContext(ctx, &tokenModels, "SELECT * FROM api_tokens WHERE user_id = ? ORDER BY id", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get api tokens: "+err.Error())
+	}
+
+	tokens := make([]APIToken, len(tokenModels))
+	for i := range tokenModels {
+		tokens[i] = fillAPITokenResponse(tokenModels[i])
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// アクセストークン失効API
+// DELETE /api/user/me/tokens/:token_id
+func deleteAPITokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+	if isAPITokenRequest(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "api tokens can't be managed with an api token")
+	}
+
+	tokenID, err := strconv.Atoi(c.Param("token_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "token_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var tokenModel APITokenModel
+	if err := dbConn.GetContext(ctx, &tokenModel, "SELECT * FROM api_tokens WHERE id = ? AND user_id = ?", tokenID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "api token not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get api token: "+err.Error())
+		}
+	}
+	if _, err := dbConn.ExecContext(ctx, "DELETE FROM api_tokens WHERE id = ?", tokenModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete api token: "+err.Error())
+	}
+	apiTokens.Delete(tokenModel.TokenHash)
+
+	return c.NoContent(http.StatusNoContent)
+}
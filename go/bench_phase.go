@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ベンチマークのどのフェーズ (整合性チェック・負荷走行・最終チェック) のリクエストかをメトリクスとログに付ける
+// 失敗が負荷走行中に偏っているのか、整合性チェックで出ているのかを見分けるためのもの。
+// X-Bench-Phase ヘッダか bench_phase クエリパラメータで指定されていればそれを使い、
+// なければ initialize からの経過時間で決める (設定の bench_pretest_duration / bench_load_duration)
+const (
+	benchPhaseHeader = "X-Bench-Phase"
+	benchPhaseParam  = "bench_phase"
+	// echo.Context に記録するキー
+	benchPhaseContextKey = "bench_phase"
+	// 指定されたフェーズ名の長さの上限 (メトリクスのキーが増えすぎないように)
+	benchPhaseMaxLength = 32
+)
+
+const (
+	benchPhaseIdle     = "idle"
+	benchPhasePretest  = "pretest"
+	benchPhaseLoad     = "load"
+	benchPhasePosttest = "posttest"
+)
+
+// 最後に initialize した時刻 (UnixNano)。0 ならまだ initialize されていない
+var lastInitializedAt atomic.Int64
+
+func markInitialized() {
+	lastInitializedAt.Store(time.Now().UnixNano())
+}
+
+// benchPhaseAt は initialize からの経過時間でフェーズを決めます。
+func benchPhaseAt(now time.Time) string {
+	initializedAt := lastInitializedAt.Load()
+	if initializedAt == 0 {
+		return benchPhaseIdle
+	}
+	conf := currentConfig()
+	elapsed := now.Sub(time.Unix(0, initializedAt))
+	switch {
+	case elapsed < conf.BenchPretestDuration.duration():
+		return benchPhasePretest
+	case elapsed < conf.BenchPretestDuration.duration()+conf.BenchLoadDuration.duration():
+		return benchPhaseLoad
+	default:
+		return benchPhasePosttest
+	}
+}
+
+// sanitizeBenchPhase は指定されたフェーズ名を英小文字・数字・_・- だけにします。使えなければ空を返します。
+func sanitizeBenchPhase(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" || len(v) > benchPhaseMaxLength {
+		return ""
+	}
+	for _, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return ""
+		}
+	}
+	return v
+}
+
+// benchPhaseMiddleware はリクエストのフェーズを決めて echo.Context に記録します。
+// アクセスログなど外側のミドルウェアからも読めるよう、最初に登録する
+func benchPhaseMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		phase := sanitizeBenchPhase(c.Request().Header.Get(benchPhaseHeader))
+		if phase == "" {
+			phase = sanitizeBenchPhase(c.QueryParam(benchPhaseParam))
+		}
+		if phase == "" {
+			phase = benchPhaseAt(time.Now())
+		}
+		c.Set(benchPhaseContextKey, phase)
+		return next(c)
+	}
+}
+
+// benchPhase はリクエストのフェーズを返します。
+func benchPhase(c echo.Context) string {
+	if phase, ok := c.Get(benchPhaseContextKey).(string); ok {
+		return phase
+	}
+	return benchPhaseAt(time.Now())
+}
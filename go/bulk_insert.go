@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 1 回の INSERT にまとめる行数 (プレースホルダの上限 65535 を超えないように)
+const bulkInsertBatchSize = 1000
+
+// bulkInsert は rows を bulkInsertBatchSize 件ずつ複数行の INSERT で書き込みます。
+// query は 1 行分の名前付きクエリ ("INSERT INTO t (a, b) VALUES (:a, :b)") で、sqlx が VALUES を行数分に展開する。
+// db には *sqlx.DB も *sqlx.Tx も渡せます。rows が空なら何もしません。
+func bulkInsert[T any](ctx context.Context, db sqlx.ExtContext, query string, rows []T) error {
+	for len(rows) > 0 {
+		n := min(len(rows), bulkInsertBatchSize)
+		if _, err := sqlx.NamedExecContext(ctx, db, query, rows[:n]); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
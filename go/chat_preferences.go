@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 視聴者ごとのライブコメント表示設定
+// ライブコメント一覧APIと WebSocket / SSE の配信にサーバ側で適用します。
+type ChatPreferences struct {
+	// 投げ銭付きのコメントのうち、MinTip 未満のものを表示しない (0 なら無効)
+	MinTip int64 `json:"min_tip"`
+	// 表示しないユーザ (ユーザ名)
+	HiddenUsers []string `json:"hidden_users"`
+	// 絵文字だけのコメントのみ表示する
+	EmojiOnly bool `json:"emoji_only"`
+}
+
+type ChatPreferencesModel struct {
+	ID        int64 `db:"id"`
+	UserID    int64 `db:"user_id"`
+	MinTip    int64 `db:"min_tip"`
+	EmojiOnly bool  `db:"emoji_only"`
+}
+
+// chatFilter はメモリに載せておく表示設定です。
+// ブロックしたユーザ (user_block.go) もここに載せ、ライブコメントに加えてリアクションも隠す
+type chatFilter struct {
+	minTip         int64
+	hiddenUserIDs  map[int64]struct{}
+	blockedUserIDs map[int64]struct{}
+	emojiOnly      bool
+}
+
+func (f *chatFilter) empty() bool {
+	return f.minTip <= 0 && len(f.hiddenUserIDs) == 0 && len(f.blockedUserIDs) == 0 && !f.emojiOnly
+}
+
+// hidesUser はユーザのライブコメントを隠すかを返します。
+func (f *chatFilter) hidesUser(userID int64) bool {
+	if f == nil {
+		return false
+	}
+	if _, ok := f.hiddenUserIDs[userID]; ok {
+		return true
+	}
+	_, ok := f.blockedUserIDs[userID]
+	return ok
+}
+
+// reactionVisible はリアクションを表示してよいかを返します。
+func (f *chatFilter) reactionVisible(userID int64) bool {
+	if f == nil {
+		return true
+	}
+	_, blocked := f.blockedUserIDs[userID]
+	return !blocked
+}
+
+// visible はライブコメントを表示してよいかを返します。
+func (f *chatFilter) visible(userID, tip int64, comment string) bool {
+	if f == nil {
+		return true
+	}
+	if tip > 0 && tip < f.minTip {
+		return false
+	}
+	if f.hidesUser(userID) {
+		return false
+	}
+	if f.emojiOnly && !isEmojiOnlyComment(comment) {
+		return false
+	}
+	return true
+}
+
+type cachedChatFilter struct {
+	filter    *chatFilter
+	expiresAt time.Time
+}
+
+// chatFilters は userID ごとの chatFilter のキャッシュです。設定の更新時に消します。
+var chatFilters sync.Map
+
+func resetChatFilters() {
+	chatFilters.Range(func(key, _ interface{}) bool {
+		chatFilters.Delete(key)
+		return true
+	})
+}
+
+// getChatFilter はユーザの表示設定を返します。設定がなければ nil を返します。
+func getChatFilter(ctx context.Context, userID int64) (*chatFilter, error) {
+	if v, ok := chatFilters.Load(userID); ok {
+		if cached := v.(cachedChatFilter); time.Now().Before(cached.expiresAt) {
+			return cached.filter, nil
+		}
+	}
+
+	filter := &chatFilter{hiddenUserIDs: map[int64]struct{}{}, blockedUserIDs: map[int64]struct{}{}}
+	var prefs ChatPreferencesModel
+	if err := dbConn.GetContext(ctx, &prefs, "SELECT * FROM chat_preferences WHERE user_id = ?", userID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	filter.minTip = prefs.MinTip
+	filter.emojiOnly = prefs.EmojiOnly
+
+	var hiddenUserIDs []int64
+	if err := dbConn.SelectContext(ctx, &hiddenUserIDs, "SELECT hidden_user_id FROM chat_hidden_users WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, id := range hiddenUserIDs {
+		filter.hiddenUserIDs[id] = struct{}{}
+	}
+
+	var blockedUserIDs []int64
+	if err := dbConn.SelectContext(ctx, &blockedUserIDs, "SELECT blocked_user_id FROM user_blocks WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, id := range blockedUserIDs {
+		filter.blockedUserIDs[id] = struct{}{}
+	}
+
+	if filter.empty() {
+		filter = nil
+	}
+	chatFilters.Store(userID, cachedChatFilter{filter: filter, expiresAt: time.Now().Add(currentConfig().ChatFilterTTL.duration())})
+	return filter, nil
+}
+
+// sessionChatFilter はログイン中のユーザの表示設定を返します。未ログインなら nil です。
+func sessionChatFilter(c echo.Context) (*chatFilter, error) {
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return nil, nil
+	}
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
+	if !ok {
+		return nil, nil
+	}
+	return getChatFilter(c.Request().Context(), userID)
+}
+
+var emojiShortcodePattern = regexp.MustCompile(`:[a-z0-9_+\-]+:`)
+
+// isEmojiOnlyComment はコメントが絵文字 (Unicode の絵文字か :tada: 形式のショートコード) だけでできているかを返します。
+func isEmojiOnlyComment(comment string) bool {
+	rest := emojiShortcodePattern.ReplaceAllString(comment, "")
+	if strings.TrimSpace(comment) == "" {
+		return false
+	}
+	for _, r := range rest {
+		switch {
+		case unicode.IsSpace(r):
+		case unicode.Is(unicode.So, r), unicode.Is(unicode.Sk, r):
+		case r == '\u200d' || (r >= '\ufe00' && r <= '\ufe0f'):
+			// ZWJ と異体字セレクタ
+		case r >= 0x1f3fb && r <= 0x1f3ff:
+			// 肌の色
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ライブコメント表示設定取得API
+// GET /api/user/me/chat_preferences
+func getChatPreferencesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	prefs, err := loadChatPreferences(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get chat preferences: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, prefs)
+}
+
+// ライブコメント表示設定更新API
+// PUT /api/user/me/chat_preferences
+func putChatPreferencesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ChatPreferences
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.MinTip < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "min_tip must be non-negative")
+	}
+	hiddenUsers := []string{}
+	seen := map[string]struct{}{}
+	for _, name := range req.HiddenUsers {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			hiddenUsers = append(hiddenUsers, name)
+		}
+	}
+
+	var prefs ChatPreferences
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO chat_preferences (user_id, min_tip, emoji_only) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE min_tip = VALUES(min_tip), emoji_only = VALUES(emoji_only)", userID, req.MinTip, req.EmojiOnly); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update chat preferences: "+err.Error())
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM chat_hidden_users WHERE user_id = ?", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete hidden users: "+err.Error())
+		}
+		if len(hiddenUsers) > 0 {
+			query, params, err := sqlx.In("SELECT id FROM users WHERE name IN (?)", hiddenUsers)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			}
+			var hiddenUserIDs []int64
+			if err := tx.SelectContext(ctx, &hiddenUserIDs, query, params...); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get hidden users: "+err.Error())
+			}
+			if len(hiddenUserIDs) != len(hiddenUsers) {
+				return echo.NewHTTPError(http.StatusBadRequest, "hidden_users contains unknown user")
+			}
+			for _, hiddenUserID := range hiddenUserIDs {
+				if _, err := tx.ExecContext(ctx, "INSERT INTO chat_hidden_users (user_id, hidden_user_id) VALUES (?, ?)", userID, hiddenUserID); err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert hidden user: "+err.Error())
+				}
+			}
+		}
+
+		var err error
+		prefs, err = loadChatPreferences(ctx, tx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get chat preferences: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	chatFilters.Delete(userID)
+
+	return c.JSON(http.StatusOK, prefs)
+}
+
+func loadChatPreferences(ctx context.Context, tx *sqlx.Tx, userID int64) (ChatPreferences, error) {
+	var prefsModel ChatPreferencesModel
+	if err := tx.GetContext(ctx, &prefsModel, "SELECT * FROM chat_preferences WHERE user_id = ?", userID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return ChatPreferences{}, err
+	}
+
+	hiddenUsers := []string{}
+	query := "SELECT u.name FROM chat_hidden_users h INNER JOIN users u ON u.id = h.hidden_user_id WHERE h.user_id = ? ORDER BY u.name"
+	if err := tx.SelectContext(ctx, &hiddenUsers, query, userID); err != nil {
+		return ChatPreferences{}, err
+	}
+
+	return ChatPreferences{
+		MinTip:      prefsModel.MinTip,
+		HiddenUsers: hiddenUsers,
+		EmojiOnly:   prefsModel.EmojiOnly,
+	}, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 運用タスク
+// サーバのメモリ上の状態 (DNS のサブドメイン一覧やキャッシュ) を触るタスクは inServer にして、
+// CLI からは起動中のサーバの管理APIを叩いて実行させる
+type opsTask struct {
+	name        string
+	description string
+	inServer    bool
+	run         func(ctx context.Context) (string, error)
+}
+
+var opsTasks = []opsTask{
+	{
+		name:        "rebuild-scores",
+		description: "視聴履歴ストアなど、非正規化した集計を MySQL から作り直す",
+		inServer:    true,
+		run:         rebuildScoresTask,
+	},
+	{
+		name:        "warm-caches",
+		description: "InnoDB のバッファプールとアプリのキャッシュを温める",
+		inServer:    true,
+		run:         warmCachesTask,
+	},
+	{
+		name:        "recompute-icon-hashes",
+		description: "icons.hash を画像から計算し直す",
+		run:         recomputeIconHashesTask,
+	},
+	{
+		name:        "register-dns-all",
+		description: "登録済みの全ユーザのサブドメインを DNS に登録する",
+		inServer:    true,
+		run:         registerDNSAllTask,
+	},
+	{
+		name:        "vacuum-spam",
+		description: "NGワードにヒットする既存のライブコメントを削除する",
+		inServer:    true,
+		run:         vacuumSpamTask,
+	},
+}
+
+func findOpsTask(name string) (opsTask, bool) {
+	for _, task := range opsTasks {
+		if task.name == name {
+			return task, true
+		}
+	}
+	return opsTask{}, false
+}
+
+// subcommand は isupipe <name> で実行できるコマンドです。引数なしの場合はサーバを起動します。
+type subcommand struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+func subcommands() []subcommand {
+	cmds := []subcommand{
+		{name: "serve", description: "HTTP / DNS サーバを起動する (デフォルト)", run: func([]string) error {
+			runServer()
+			return nil
+		}},
+		{name: "migrate", description: "スキーマのマイグレーションを適用する (up|down N|version|force V)", run: runMigrateCommand},
+		{name: "seed", description: "負荷試験用のユーザ・配信・コメント・リアクションを生成する", run: runSeedCommand},
+		{name: "replay", description: "アクセスログのリクエストを同じ間隔で送り直す (GET のみ、ユーザごとの順序を保つ)", run: runReplayCommand},
+	}
+	for _, task := range opsTasks {
+		task := task
+		cmds = append(cmds, subcommand{
+			name:        task.name,
+			description: task.description,
+			run: func(args []string) error {
+				return runOpsTaskCommand(task, args)
+			},
+		})
+	}
+	return cmds
+}
+
+// runCLI はサブコマンドを実行します。該当するサブコマンドがなければ false を返します。
+func runCLI(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(os.Stdout)
+		return true
+	}
+	for _, cmd := range subcommands() {
+		if cmd.name == args[0] {
+			if err := cmd.run(args[1:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+				os.Exit(1)
+			}
+			return true
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	printUsage(os.Stderr)
+	os.Exit(2)
+	return true
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: isupipe [command]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	cmds := subcommands()
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].name < cmds[j].name })
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "  %-24s %s\n", cmd.name, cmd.description)
+	}
+}
+
+func runOpsTaskCommand(task opsTask, args []string) error {
+	fs := flag.NewFlagSet(task.name, flag.ExitOnError)
+	server := fs.String("server", "http://"+net.JoinHostPort("127.0.0.1", strconv.Itoa(listenPort)), "サーバ内で実行するタスクの送り先")
+	timeout := fs.Duration("timeout", 10*time.Minute, "タイムアウト")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if task.inServer {
+		return requestOpsTask(ctx, *server, task.name)
+	}
+
+	if err := setupCLIDB(); err != nil {
+		return err
+	}
+	out, err := task.run(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println(out)
+	return nil
+}
+
+// setupCLIDB はサーバと同じ環境変数で DB などに接続します。
+func setupCLIDB() error {
+	conn, err := connectDB(nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect db: %w", err)
+	}
+	dbConn = conn
+	if err := connectSplitDBs(); err != nil {
+		return err
+	}
+	if err := setupIconStorage(); err != nil {
+		return err
+	}
+	return setupViewerHistoryStore()
+}
+
+func requestOpsTask(ctx context.Context, server, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server+"/api/admin/tasks/"+name, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(adminTokenHeader, adminToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %d: %s", res.StatusCode, body)
+	}
+	fmt.Println(string(body))
+	return nil
+}
+
+type OpsTaskResponse struct {
+	Task   string `json:"task"`
+	Result string `json:"result"`
+}
+
+// 運用タスク実行API
+// POST /api/admin/tasks/:name
+func postOpsTaskHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	task, ok := findOpsTask(c.Param("name"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown task")
+	}
+	out, err := task.run(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to run task: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, &OpsTaskResponse{
+		Task:   task.name,
+		Result: out,
+	})
+}
+
+func rebuildScoresTask(ctx context.Context) (string, error) {
+	if err := viewerHistory.rebuild(ctx); err != nil {
+		return "", err
+	}
+	return "viewer history rebuilt", nil
+}
+
+func warmCachesTask(ctx context.Context) (string, error) {
+	// 全件舐めてバッファプールに載せる
+	tables := []string{"users", "themes", "livestreams", "livestream_tags", "tags", "livecomments", "reactions", "ng_words", "livecomment_reports"}
+	for _, table := range tables {
+		var cnt int64
+		if err := dbConn.GetContext(ctx, &cnt, "SELECT COUNT(*) FROM "+table); err != nil {
+			return "", err
+		}
+	}
+	fallbackIconHash()
+	if err := recommendations.refresh(ctx); err != nil {
+		return "", err
+	}
+	if err := livestreamTagIndex.ensureLoaded(ctx); err != nil {
+		return "", err
+	}
+	if err := livestreamRegistryCache.ensureLoaded(ctx); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("warmed %d tables", len(tables)), nil
+}
+
+func recomputeIconHashesTask(ctx context.Context) (string, error) {
+	type iconRow struct {
+		ID    int64  `db:"id"`
+		Image []byte `db:"image"`
+		Hash  string `db:"hash"`
+	}
+	var rows []iconRow
+	if err := dbFor(tableIcons).SelectContext(ctx, &rows, "SELECT id, image, hash FROM icons"); err != nil {
+		return "", err
+	}
+
+	updated := 0
+	for _, row := range rows {
+		hash := fmt.Sprintf("%x", sha256.Sum256(row.Image))
+		if iconStorage != nil {
+			if err := iconStorage.put(ctx, hash, row.Image); err != nil {
+				return "", err
+			}
+		}
+		if hash == row.Hash {
+			continue
+		}
+		if _, err := dbFor(tableIcons).ExecContext(ctx, "UPDATE icons SET hash = ? WHERE id = ?", hash, row.ID); err != nil {
+			return "", err
+		}
+		updated++
+	}
+	return fmt.Sprintf("%d/%d icon hashes updated", updated, len(rows)), nil
+}
+
+func registerDNSAllTask(ctx context.Context) (string, error) {
+	var names []string
+	if err := dbConn.SelectContext(ctx, &names, "SELECT name FROM users"); err != nil {
+		return "", err
+	}
+	added := 0
+	for _, name := range names {
+		if registerSubdomainIfAbsent(name + ".t.isucon.pw.") {
+			added++
+		}
+	}
+	return fmt.Sprintf("%d subdomains registered", added), nil
+}
+
+func vacuumSpamTask(ctx context.Context) (string, error) {
+	// moderateHandler と同じく、配信ごとのNGワードを部分一致で含むコメントを消す
+	// 配信者が NG ワードで消したのと同じ扱いにして、配信者を deleted_by に入れる
+	query := `
+	UPDATE livecomments lc
+	INNER JOIN ng_words w ON w.livestream_id = lc.livestream_id
+	SET lc.deleted_at = ?, lc.deleted_by = w.user_id, lc.delete_reason = ?
+	WHERE lc.deleted_at IS NULL AND lc.comment LIKE CONCAT('%', w.word, '%')
+	`
+	rs, err := dbConn.ExecContext(ctx, query, time.Now().Unix(), livecommentDeleteReasonVacuum)
+	if err != nil {
+		return "", err
+	}
+	n, err := rs.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	// 消したコメントが最新コメントやモデレーションの集計に残らないようにする
+	livecommentRings.reset()
+	resetModerationSummaries()
+	return fmt.Sprintf("%d livecomments soft-deleted", n), nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	clipMaxDurationSeconds = 180
+	clipRankingDefaultSize = 20
+	clipRankingMaxSize     = 100
+)
+
+type PostClipRequest struct {
+	Title              string `json:"title"`
+	StartOffsetSeconds int64  `json:"start_offset_seconds"`
+	EndOffsetSeconds   int64  `json:"end_offset_seconds"`
+}
+
+type ClipModel struct {
+	ID                 int64  `db:"id"`
+	LivestreamID       int64  `db:"livestream_id"`
+	UserID             int64  `db:"user_id"`
+	Title              string `db:"title"`
+	StartOffsetSeconds int64  `db:"start_offset_seconds"`
+	EndOffsetSeconds   int64  `db:"end_offset_seconds"`
+	CreatedAt          int64  `db:"created_at"`
+}
+
+type Clip struct {
+	ID                 int64      `json:"id"`
+	Livestream         Livestream `json:"livestream"`
+	Creator            User       `json:"creator"`
+	Title              string     `json:"title"`
+	StartOffsetSeconds int64      `json:"start_offset_seconds"`
+	EndOffsetSeconds   int64      `json:"end_offset_seconds"`
+	// クリップ自身へのリアクション数
+	Score     int64 `json:"score"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+type ClipDetail struct {
+	Clip
+	// クリップ全体の中での順位
+	Rank int64 `json:"rank"`
+}
+
+type ClipReactionModel struct {
+	ID        int64  `db:"id"`
+	ClipID    int64  `db:"clip_id"`
+	UserID    int64  `db:"user_id"`
+	EmojiName string `db:"emoji_name"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type ClipRankingEntry struct {
+	ClipID int64
+	Score  int64
+}
+type ClipRanking []ClipRankingEntry
+
+func (r ClipRanking) Len() int      { return len(r) }
+func (r ClipRanking) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r ClipRanking) Less(i, j int) bool {
+	if r[i].Score == r[j].Score {
+		return r[i].ClipID < r[j].ClipID
+	} else {
+		return r[i].Score < r[j].Score
+	}
+}
+
+// クリップ作成API
+// POST /api/livestream/:livestream_id/clips
+func postClipHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostClipRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Title == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "title is required")
+	}
+	if req.StartOffsetSeconds < 0 || req.EndOffsetSeconds <= req.StartOffsetSeconds {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_offset_seconds must be non-negative and less than end_offset_seconds")
+	}
+	if req.EndOffsetSeconds-req.StartOffsetSeconds > clipMaxDurationSeconds {
+		return echo.NewHTTPError(http.StatusBadRequest, "clip is too long")
+	}
+
+	var clip Clip
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			}
+		}
+		if req.EndOffsetSeconds > livestreamModel.EndAt-livestreamModel.StartAt {
+			return echo.NewHTTPError(http.StatusBadRequest, "end_offset_seconds exceeds the livestream duration")
+		}
+
+		clipModel := ClipModel{
+			LivestreamID:       livestreamModel.ID,
+			UserID:             userID,
+			Title:              req.Title,
+			StartOffsetSeconds: req.StartOffsetSeconds,
+			EndOffsetSeconds:   req.EndOffsetSeconds,
+			CreatedAt:          time.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO clips (livestream_id, user_id, title, start_offset_seconds, end_offset_seconds, created_at) VALUES (:livestream_id, :user_id, :title, :start_offset_seconds, :end_offset_seconds, :created_at)", clipModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert clip: "+err.Error())
+		}
+		clipID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted clip id: "+err.Error())
+		}
+		clipModel.ID = clipID
+
+		clip, err = fillClipResponse(ctx, tx, clipModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill clip: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, clip)
+}
+
+// 配信のクリップ一覧API
+// GET /api/livestream/:livestream_id/clips
+func getLivestreamClipsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var clipModels []ClipModel
+	if err := tx.SelectContext(ctx, &clipModels, "SELECT * FROM clips WHERE livestream_id = ? ORDER BY start_offset_seconds, id", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get clips: "+err.Error())
+	}
+
+	clips := make([]Clip, len(clipModels))
+	for i := range clipModels {
+		clip, err := fillClipResponse(ctx, tx, clipModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill clip: "+err.Error())
+		}
+		clips[i] = clip
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, clips)
+}
+
+// クリップ詳細API
+// GET /api/clips/:clip_id
+func getClipHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	clipID, err := strconv.ParseInt(c.Param("clip_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "clip_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var clipModel ClipModel
+	if err := tx.GetContext(ctx, &clipModel, "SELECT * FROM clips WHERE id = ?", clipID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "clip not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get clip: "+err.Error())
+		}
+	}
+
+	clip, err := fillClipResponse(ctx, tx, clipModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill clip: "+err.Error())
+	}
+
+	ranking, err := getClipRanking(ctx, tx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get clip ranking: "+err.Error())
+	}
+	var rank int64 = 1
+	for i := len(ranking) - 1; i >= 0; i-- {
+		if ranking[i].ClipID == clipID {
+			break
+		}
+		rank++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, ClipDetail{
+		Clip: clip,
+		Rank: rank,
+	})
+}
+
+// クリップランキングAPI
+// GET /api/clips/ranking?limit=
+func getClipRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	limit := clipRankingDefaultSize
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 || l > clipRankingMaxSize {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(clipRankingMaxSize))
+		}
+		limit = l
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	ranking, err := getClipRanking(ctx, tx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get clip ranking: "+err.Error())
+	}
+
+	// 上位のクリップはまとめて取る
+	topIDs := make([]int64, 0, min(limit, len(ranking)))
+	for i := len(ranking) - 1; i >= 0 && len(topIDs) < limit; i-- {
+		topIDs = append(topIDs, ranking[i].ClipID)
+	}
+	clipModelByID := make(map[int64]ClipModel, len(topIDs))
+	if len(topIDs) > 0 {
+		query, params, err := sqlx.In("SELECT * FROM clips WHERE id IN (?)", topIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var clipModels []ClipModel
+		if err := tx.SelectContext(ctx, &clipModels, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get clips: "+err.Error())
+		}
+		for _, m := range clipModels {
+			clipModelByID[m.ID] = m
+		}
+	}
+
+	clips := make([]ClipDetail, 0, len(topIDs))
+	for _, id := range topIDs {
+		clipModel, ok := clipModelByID[id]
+		if !ok {
+			continue
+		}
+		clip, err := fillClipResponse(ctx, tx, clipModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill clip: "+err.Error())
+		}
+		clips = append(clips, ClipDetail{
+			Clip: clip,
+			Rank: int64(len(clips) + 1),
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, clips)
+}
+
+// クリップへのリアクションAPI
+// POST /api/clips/:clip_id/reactions
+func postClipReactionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	clipID, err := strconv.ParseInt(c.Param("clip_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "clip_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostReactionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.EmojiName == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "emoji_name must not be empty")
+	}
+
+	var clip Clip
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var clipModel ClipModel
+		if err := tx.GetContext(ctx, &clipModel, "SELECT * FROM clips WHERE id = ?", clipID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "clip not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get clip: "+err.Error())
+			}
+		}
+
+		reactionModel := ClipReactionModel{
+			ClipID:    clipID,
+			UserID:    userID,
+			EmojiName: req.EmojiName,
+			CreatedAt: time.Now().Unix(),
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO clip_reactions (clip_id, user_id, emoji_name, created_at) VALUES (:clip_id, :user_id, :emoji_name, :created_at)", reactionModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert clip reaction: "+err.Error())
+		}
+
+		var err error
+		clip, err = fillClipResponse(ctx, tx, clipModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill clip: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, clip)
+}
+
+// getClipRanking はクリップごとのリアクション数で昇順に並べたランキングを返します (LivestreamRanking と同じ並び)。
+func getClipRanking(ctx context.Context, tx *sqlx.Tx) (ClipRanking, error) {
+	var ranking ClipRanking
+	query := `
+	SELECT c.id AS clip_id, COUNT(r.id) AS score
+	FROM clips c
+	LEFT JOIN clip_reactions r ON r.clip_id = c.id
+	GROUP BY c.id
+	`
+	var rows []struct {
+		ClipID int64 `db:"clip_id"`
+		Score  int64 `db:"score"`
+	}
+	if err := tx.SelectContext(ctx, &rows, query); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		ranking = append(ranking, ClipRankingEntry{ClipID: row.ClipID, Score: row.Score})
+	}
+	sort.Sort(ranking)
+	return ranking, nil
+}
+
+func fillClipResponse(ctx context.Context, tx *sqlx.Tx, clipModel ClipModel) (Clip, error) {
+	creatorModel := UserModel{}
+	if err := tx.GetContext(ctx, &creatorModel, "SELECT * FROM users WHERE id = ?", clipModel.UserID); err != nil {
+		return Clip{}, err
+	}
+	creator, err := fillUserResponse(ctx, tx, creatorModel)
+	if err != nil {
+		return Clip{}, err
+	}
+
+	livestreamModel, ok, err := livestreamRegistryCache.get(ctx, clipModel.LivestreamID)
+	if err != nil {
+		return Clip{}, err
+	}
+	if !ok {
+		return Clip{}, sql.ErrNoRows
+	}
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return Clip{}, err
+	}
+
+	var score int64
+	if err := tx.GetContext(ctx, &score, "SELECT COUNT(*) FROM clip_reactions WHERE clip_id = ?", clipModel.ID); err != nil {
+		return Clip{}, err
+	}
+
+	return Clip{
+		ID:                 clipModel.ID,
+		Livestream:         livestream,
+		Creator:            creator,
+		Title:              clipModel.Title,
+		StartOffsetSeconds: clipModel.StartOffsetSeconds,
+		EndOffsetSeconds:   clipModel.EndOffsetSeconds,
+		Score:              score,
+		CreatedAt:          clipModel.CreatedAt,
+	}, nil
+}
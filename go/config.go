@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 実行中に調整したい値 (キャッシュの TTL・レートリミット・プールの大きさ・機能フラグ) をまとめた設定
+// デフォルト < 環境変数 < 設定ファイル (ISUCON13_CONFIG_FILE に JSON) の順に上書きする。
+// SIGHUP か POST /api/admin/config/reload で読み直すので、再起動せずに調整できる。
+// 環境変数は起動時のまま変わらないので、実行中の調整は設定ファイルで行う
+// DB や Redis の接続先、TLS、HTTP サーバの設定など起動時にしか効かないものはここには含めない
+type Config struct {
+	// キャッシュの TTL (他のサーバでの更新はこの時間が経てば反映される)
+	APITokenCacheTTL      configDuration `json:"api_token_cache_ttl"`
+	ChatFilterTTL         configDuration `json:"chat_filter_ttl"`
+	HomeCacheTTL          configDuration `json:"home_cache_ttl"`
+	LivestreamSettingsTTL configDuration `json:"livestream_settings_ttl"`
+	// モデレーションの集計は重いので少し古くても良いことにする
+	ModerationSummaryTTL configDuration `json:"moderation_summary_ttl"`
+	LivecommentRingTTL   configDuration `json:"livecomment_ring_ttl"`
+	ReactionRingTTL      configDuration `json:"reaction_ring_ttl"`
+	ActiveSessionTTL     configDuration `json:"active_session_ttl"`
+	PrivacySettingsTTL   configDuration `json:"privacy_settings_ttl"`
+	LivestreamBanTTL     configDuration `json:"livestream_ban_ttl"`
+	TagStatsTTL          configDuration `json:"tag_stats_ttl"`
+	// 停止中のユーザの一覧を読み直す間隔 (user_suspension.go)
+	UserSuspensionCacheTTL configDuration `json:"user_suspension_cache_ttl"`
+	// 存在しないユーザ名・配信を覚えておく時間
+	NegativeCacheTTL configDuration `json:"negative_cache_ttl"`
+
+	// セッションの有効期間と、残りがこれを下回ったら延ばす閾値 (0 なら延ばさない)
+	SessionTTL              configDuration `json:"session_ttl"`
+	SessionRefreshThreshold configDuration `json:"session_refresh_threshold"`
+
+	// 1 分あたりの通報数の上限 (0 なら制限しない)。デフォルトは無効で、嫌がらせが起きたら設定する
+	ReportLimitPerUser int64 `json:"report_limit_per_user"`
+	ReportLimitPerIP   int64 `json:"report_limit_per_ip"`
+
+	// 画像のデコードなどを同時に実行する数と、視聴履歴をまとめて書き込む件数
+	ImageWorkers           int `json:"image_workers"`
+	ViewerHistoryBatchSize int `json:"viewer_history_batch_size"`
+	// JSON のレスポンスで、要素数がこれを超える配列は全体をメモリに組み立てずに 1 要素ずつ書き出す (0 ならしない)
+	JSONStreamThreshold int `json:"json_stream_threshold"`
+	// 配信ごとにメモリに持つ最新のライブコメント・リアクションの件数 (0 なら持たない) (recent_ring.go)
+	LivecommentRingSize int `json:"livecomment_ring_size"`
+	ReactionRingSize    int `json:"reaction_ring_size"`
+
+	// サービス全体の投げ銭の下限・上限 (投げ銭なし (0) は常に許可する) (tip_tier.go)
+	TipMin int64 `json:"tip_min"`
+	TipMax int64 `json:"tip_max"`
+	// ランキングで値が同じときの順位の付け方 (legacy / lower_id / higher_id) (ranking.go)
+	RankingTieBreak string `json:"ranking_tie_break"`
+
+	// 再生情報APIで発行する視聴トークンの有効期間 (playlist.go)
+	ViewerTokenTTL configDuration `json:"viewer_token_ttl"`
+
+	// ライブコメントを投稿してから投稿者が編集できる時間 (0 なら編集できない)
+	LivecommentEditWindow configDuration `json:"livecomment_edit_window"`
+
+	// 配信予約の期間の判定と配信予定表で使うタイムゾーン (IANA の名前。読めなければ Asia/Tokyo)
+	TimeZone string `json:"time_zone"`
+	location *time.Location
+	// 同じ配信者の時間の重なった予約を確かめない (off) か、断る (reject) か、予約した上で知らせる (warn) か (reservation_overlap.go)
+	ReservationOverlap string `json:"reservation_overlap"`
+
+	// 他のサーバの初期化を待つ時間
+	PeerInitTimeout configDuration `json:"peer_init_timeout"`
+	// 整合性チェックを定期的に実行する間隔 (0 ならしない) (consistency_checker.go)
+	ConsistencyCheckInterval configDuration `json:"consistency_check_interval"`
+
+	// 機能フラグ
+	CSRFEnabled             bool  `json:"csrf_enabled"`
+	VerboseLogSamplePercent int64 `json:"verbose_log_sample_percent"`
+	VerboseLogSlowMS        int64 `json:"verbose_log_slow_ms"`
+	// DNS の問い合わせを 1 件ずつログに出す (水責めの最中は大量に出るので調査のときだけ)
+	DNSQueryLog bool `json:"dns_query_log"`
+	// 頻出クエリを接続ごとに Prepare して使い回す (stmt_cache.go)
+	MySQLStmtCache bool `json:"mysql_stmt_cache"`
+	// 視聴履歴が MySQL のとき、入室の書き込みをまとめる (viewer_history_buffer.go)
+	ViewerHistoryWriteBehind bool `json:"viewer_history_write_behind"`
+	// 新旧両方の実装を実行して比較するハンドラ名 ("*" ならすべて) (shadow_read.go)
+	ShadowRead []string `json:"shadow_read"`
+
+	// DNS の水責め対策 (dns_guard.go)
+	// 存在しない名前への応答 (drop / nxdomain / refused)、送信元ごとの 1 秒あたりの上限 (0 なら制限しない) と超えたときの応答
+	DNSNegativeResponse    string `json:"dns_negative_response"`
+	DNSNXDomainLimitPerSec int64  `json:"dns_nxdomain_limit_per_sec"`
+	DNSLimitedResponse     string `json:"dns_limited_response"`
+
+	// initialize からの経過時間でベンチマークのフェーズを決めるときの、整合性チェックと負荷走行の長さ
+	BenchPretestDuration configDuration `json:"bench_pretest_duration"`
+	BenchLoadDuration    configDuration `json:"bench_load_duration"`
+
+	// ルートごとのタイムアウト・同時実行数など (route_policy.go)
+	RoutePolicies []RoutePolicy `json:"route_policies"`
+	// ルート ("GET /api/..." のようにメソッドとルート) ごとのクエリの実行時間・ロック待ちの上限 (query_hints.go)
+	QueryHints map[string]queryHints `json:"query_hints"`
+}
+
+// configDuration は設定ファイルでは "5s" のような文字列 (数値なら秒) で書く時間です。
+type configDuration time.Duration
+
+func (d configDuration) duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *configDuration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = configDuration(time.Duration(v * float64(time.Second)))
+	case string:
+		parsed, err := parseConfigDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = parsed
+	default:
+		return fmt.Errorf("invalid duration: %s", b)
+	}
+	return nil
+}
+
+// parseConfigDuration は "5s" のような文字列か、秒数を読みます。
+func parseConfigDuration(v string) (configDuration, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return configDuration(time.Duration(sec) * time.Second), nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	return configDuration(d), nil
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		APITokenCacheTTL:        configDuration(10 * time.Second),
+		ChatFilterTTL:           configDuration(10 * time.Second),
+		HomeCacheTTL:            configDuration(5 * time.Second),
+		LivestreamSettingsTTL:   configDuration(5 * time.Second),
+		ModerationSummaryTTL:    configDuration(30 * time.Second),
+		LivecommentRingTTL:      configDuration(10 * time.Second),
+		ReactionRingTTL:         configDuration(10 * time.Second),
+		ActiveSessionTTL:        configDuration(5 * time.Second),
+		PrivacySettingsTTL:      configDuration(5 * time.Second),
+		LivestreamBanTTL:        configDuration(5 * time.Second),
+		TagStatsTTL:             configDuration(30 * time.Second),
+		UserSuspensionCacheTTL:  configDuration(2 * time.Second),
+		NegativeCacheTTL:        configDuration(2 * time.Second),
+		SessionTTL:              configDuration(time.Hour),
+		SessionRefreshThreshold: configDuration(30 * time.Minute),
+		ReportLimitPerUser:      0,
+		ReportLimitPerIP:        0,
+		ImageWorkers:            max(1, runtime.GOMAXPROCS(0)/2),
+		ViewerHistoryBatchSize:  500,
+		JSONStreamThreshold:     1000,
+		LivecommentRingSize:     100,
+		ReactionRingSize:        100,
+		LivecommentEditWindow:   configDuration(5 * time.Minute),
+		ViewerTokenTTL:          configDuration(5 * time.Minute),
+		TipMin:                  1,
+		TipMax:                  1000000,
+		RankingTieBreak:         rankingTieBreakLegacy,
+		TimeZone:                defaultTimeZone,
+		ReservationOverlap:      reservationOverlapOff,
+		PeerInitTimeout:         configDuration(20 * time.Second),
+		BenchPretestDuration:    configDuration(20 * time.Second),
+		BenchLoadDuration:       configDuration(60 * time.Second),
+		DNSNegativeResponse:     dnsResponseDrop,
+		DNSNXDomainLimitPerSec:  100,
+		DNSLimitedResponse:      dnsResponseRefused,
+	}
+}
+
+// applyEnv は環境変数で指定された値で上書きします。読めない値は無視します。
+func (conf *Config) applyEnv() {
+	durations := []struct {
+		key string
+		dst *configDuration
+	}{
+		{"ISUCON13_API_TOKEN_CACHE_TTL", &conf.APITokenCacheTTL},
+		{"ISUCON13_CHAT_FILTER_TTL", &conf.ChatFilterTTL},
+		{"ISUCON13_HOME_CACHE_TTL", &conf.HomeCacheTTL},
+		{"ISUCON13_LIVESTREAM_SETTINGS_TTL", &conf.LivestreamSettingsTTL},
+		{"ISUCON13_MODERATION_SUMMARY_TTL", &conf.ModerationSummaryTTL},
+		{"ISUCON13_LIVECOMMENT_RING_TTL", &conf.LivecommentRingTTL},
+		{"ISUCON13_REACTION_RING_TTL", &conf.ReactionRingTTL},
+		{"ISUCON13_ACTIVE_SESSION_TTL", &conf.ActiveSessionTTL},
+		{"ISUCON13_PRIVACY_SETTINGS_TTL", &conf.PrivacySettingsTTL},
+		{"ISUCON13_LIVESTREAM_BAN_TTL", &conf.LivestreamBanTTL},
+		{"ISUCON13_TAG_STATS_TTL", &conf.TagStatsTTL},
+		{"ISUCON13_USER_SUSPENSION_CACHE_TTL", &conf.UserSuspensionCacheTTL},
+		{"ISUCON13_NEGATIVE_CACHE_TTL", &conf.NegativeCacheTTL},
+		{"ISUCON13_SESSION_TTL_SECONDS", &conf.SessionTTL},
+		{"ISUCON13_SESSION_REFRESH_THRESHOLD_SECONDS", &conf.SessionRefreshThreshold},
+		{"ISUCON13_LIVECOMMENT_EDIT_WINDOW", &conf.LivecommentEditWindow},
+		{"ISUCON13_VIEWER_TOKEN_TTL", &conf.ViewerTokenTTL},
+		{"ISUCON13_PEER_INIT_TIMEOUT_SECONDS", &conf.PeerInitTimeout},
+		{"ISUCON13_CONSISTENCY_CHECK_INTERVAL", &conf.ConsistencyCheckInterval},
+		{"ISUCON13_BENCH_PRETEST_DURATION", &conf.BenchPretestDuration},
+		{"ISUCON13_BENCH_LOAD_DURATION", &conf.BenchLoadDuration},
+	}
+	for _, d := range durations {
+		if v, ok := os.LookupEnv(d.key); ok {
+			if parsed, err := parseConfigDuration(v); err == nil {
+				*d.dst = parsed
+			}
+		}
+	}
+
+	conf.ReportLimitPerUser = envInt64("ISUCON13_REPORT_LIMIT_PER_USER", conf.ReportLimitPerUser)
+	conf.ReportLimitPerIP = envInt64("ISUCON13_REPORT_LIMIT_PER_IP", conf.ReportLimitPerIP)
+	conf.ImageWorkers = int(envInt64("ISUCON13_IMAGE_WORKERS", int64(conf.ImageWorkers)))
+	conf.ViewerHistoryBatchSize = int(envInt64("ISUCON13_VIEWER_HISTORY_BATCH_SIZE", int64(conf.ViewerHistoryBatchSize)))
+	conf.JSONStreamThreshold = int(envInt64("ISUCON13_JSON_STREAM_THRESHOLD", int64(conf.JSONStreamThreshold)))
+	conf.LivecommentRingSize = int(envInt64("ISUCON13_LIVECOMMENT_RING_SIZE", int64(conf.LivecommentRingSize)))
+	conf.ReactionRingSize = int(envInt64("ISUCON13_REACTION_RING_SIZE", int64(conf.ReactionRingSize)))
+	conf.TipMin = envInt64("ISUCON13_TIP_MIN", conf.TipMin)
+	conf.TipMax = envInt64("ISUCON13_TIP_MAX", conf.TipMax)
+	conf.VerboseLogSamplePercent = envInt64("ISUCON13_VERBOSE_LOG_SAMPLE_PERCENT", conf.VerboseLogSamplePercent)
+	conf.VerboseLogSlowMS = envInt64("ISUCON13_VERBOSE_LOG_SLOW_MS", conf.VerboseLogSlowMS)
+	if v, ok := os.LookupEnv("ISUCON13_CSRF_ENABLED"); ok {
+		conf.CSRFEnabled = v == "true"
+	}
+	if v, ok := os.LookupEnv("ISUCON13_DNS_QUERY_LOG"); ok {
+		conf.DNSQueryLog = v == "true"
+	}
+	if v, ok := os.LookupEnv("ISUCON13_MYSQL_STMT_CACHE"); ok {
+		conf.MySQLStmtCache, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_VIEWER_HISTORY_WRITE_BEHIND"); ok {
+		conf.ViewerHistoryWriteBehind, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_SHADOW_READ"); ok {
+		conf.ShadowRead = strings.Split(v, ",")
+	}
+	if v, ok := os.LookupEnv("ISUCON13_RANKING_TIE_BREAK"); ok {
+		conf.RankingTieBreak = v
+	}
+	if v, ok := os.LookupEnv("ISUCON13_QUERY_HINTS"); ok {
+		conf.QueryHints = parseRouteQueryHints(v)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_DNS_NEGATIVE_RESPONSE"); ok {
+		conf.DNSNegativeResponse = v
+	}
+	if v, ok := os.LookupEnv("ISUCON13_DNS_LIMITED_RESPONSE"); ok {
+		conf.DNSLimitedResponse = v
+	}
+	if v, ok := os.LookupEnv("ISUCON13_TIME_ZONE"); ok {
+		conf.TimeZone = v
+	}
+	if v, ok := os.LookupEnv("ISUCON13_RESERVATION_OVERLAP"); ok {
+		conf.ReservationOverlap = v
+	}
+	conf.DNSNXDomainLimitPerSec = envInt64("ISUCON13_DNS_NXDOMAIN_LIMIT_PER_SEC", conf.DNSNXDomainLimitPerSec)
+}
+
+// applyFile は設定ファイルに書かれた項目だけを上書きします。
+func (conf *Config) applyFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, conf); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// normalize は範囲外の値を丸めます。
+func (conf *Config) normalize() {
+	if conf.ImageWorkers < 1 {
+		conf.ImageWorkers = 1
+	}
+	if conf.ViewerHistoryBatchSize < 1 {
+		conf.ViewerHistoryBatchSize = 1
+	}
+	conf.VerboseLogSamplePercent = min(max(conf.VerboseLogSamplePercent, 0), 100)
+	conf.VerboseLogSlowMS = max(conf.VerboseLogSlowMS, 0)
+	conf.JSONStreamThreshold = max(conf.JSONStreamThreshold, 0)
+	conf.LivecommentRingSize = max(conf.LivecommentRingSize, 0)
+	conf.ReactionRingSize = max(conf.ReactionRingSize, 0)
+	conf.DNSNegativeResponse = normalizeDNSResponse(conf.DNSNegativeResponse, dnsResponseDrop)
+	conf.DNSLimitedResponse = normalizeDNSResponse(conf.DNSLimitedResponse, dnsResponseRefused)
+	conf.RoutePolicies = normalizeRoutePolicies(conf.RoutePolicies)
+	conf.ReservationOverlap = normalizeReservationOverlap(conf.ReservationOverlap)
+	conf.RankingTieBreak = normalizeRankingTieBreak(conf.RankingTieBreak)
+	conf.QueryHints = normalizeRouteQueryHints(conf.QueryHints)
+	conf.ShadowRead = normalizeShadowReadTargets(conf.ShadowRead)
+	conf.TipMin = max(conf.TipMin, 1)
+	conf.TipMax = max(conf.TipMax, conf.TipMin)
+	conf.ConsistencyCheckInterval = max(conf.ConsistencyCheckInterval, 0)
+	if conf.UserSuspensionCacheTTL < 0 {
+		conf.UserSuspensionCacheTTL = 0
+	}
+	if conf.ViewerTokenTTL <= 0 {
+		conf.ViewerTokenTTL = configDuration(5 * time.Minute)
+	}
+	loc, err := time.LoadLocation(conf.TimeZone)
+	if err != nil || conf.TimeZone == "" {
+		conf.TimeZone = defaultTimeZone
+		loc, _ = time.LoadLocation(defaultTimeZone)
+	}
+	conf.location = loc
+}
+
+const defaultTimeZone = "Asia/Tokyo"
+
+// timeLocation は設定のタイムゾーンを返します。
+func (conf *Config) timeLocation() *time.Location {
+	return conf.location
+}
+
+func loadConfig() (*Config, error) {
+	conf := defaultConfig()
+	conf.applyEnv()
+	if path := os.Getenv("ISUCON13_CONFIG_FILE"); path != "" {
+		if err := conf.applyFile(path); err != nil {
+			return nil, err
+		}
+	}
+	conf.normalize()
+	return conf, nil
+}
+
+var (
+	activeConfig     atomic.Pointer[Config]
+	activeConfigOnce sync.Once
+)
+
+// currentConfig は今の設定を返します。返した値は書き換えないこと (読み直すと別の値に差し替わる)。
+func currentConfig() *Config {
+	activeConfigOnce.Do(func() {
+		conf, err := loadConfig()
+		if err != nil {
+			log.Printf("failed to load config file, using defaults and environment: %v", err)
+			conf = defaultConfig()
+			conf.applyEnv()
+			conf.normalize()
+		}
+		activeConfig.Store(conf)
+	})
+	return activeConfig.Load()
+}
+
+// reloadConfig は設定を読み直して反映します。読めなかった場合は今の設定のままにします。
+func reloadConfig() (*Config, error) {
+	currentConfig()
+	conf, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	activeConfig.Store(conf)
+
+	// 作成時に値を渡しているものは個別に反映する
+	reportUserLimiter.setLimit(conf.ReportLimitPerUser)
+	reportIPLimiter.setLimit(conf.ReportLimitPerIP)
+	imagePool.resize(conf.ImageWorkers)
+	dnsNXDomainLimiter.setLimit(conf.DNSNXDomainLimitPerSec)
+	log.Printf("config reloaded")
+	return conf, nil
+}
+
+// watchConfigReload は SIGHUP を受けるたびに設定を読み直します。
+func watchConfigReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if _, err := reloadConfig(); err != nil {
+			log.Printf("failed to reload config: %v", err)
+		}
+	}
+}
+
+// 設定取得API
+// GET /api/admin/config
+func getConfigHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, currentConfig())
+}
+
+// 設定再読み込みAPI
+// POST /api/admin/config/reload
+func postConfigReloadHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+	conf, err := reloadConfig()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reload config: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, conf)
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 1チェックあたりに返す不一致の上限
+const consistencyMaxDiscrepancies = 100
+
+type Discrepancy struct {
+	Key      string `json:"key"`
+	Expected int64  `json:"expected"`
+	Actual   int64  `json:"actual"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+type ConsistencyCheckResult struct {
+	Name          string        `json:"name"`
+	Checked       int           `json:"checked"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	Error         string        `json:"error,omitempty"`
+}
+
+type ConsistencyReport struct {
+	CheckedAt int64                    `json:"checked_at"`
+	OK        bool                     `json:"ok"`
+	Results   []ConsistencyCheckResult `json:"results"`
+}
+
+// consistencyCheck は生テーブルから計算し直した値と、非正規化した値を突き合わせます。
+type consistencyCheck struct {
+	name string
+	run  func(ctx context.Context, result *ConsistencyCheckResult) error
+}
+
+var consistencyChecks = []consistencyCheck{
+	{name: "trending_scores", run: checkTrendingScores},
+	{name: "livestream_ranking", run: checkLivestreamRanking},
+	{name: "user_ranking", run: checkUserRanking},
+	{name: "metrics_stream_scores", run: checkMetricsStreamScores},
+	{name: "tag_stats", run: checkTagStats},
+	{name: "unique_viewers", run: checkUniqueViewers},
+	{name: "icon_hashes", run: checkIconHashes},
+	{name: "poll_votes", run: checkPollVotes},
+	{name: "question_votes", run: checkQuestionVotes},
+}
+
+func (r *ConsistencyCheckResult) add(d Discrepancy) {
+	if len(r.Discrepancies) < consistencyMaxDiscrepancies {
+		r.Discrepancies = append(r.Discrepancies, d)
+	}
+}
+
+func runConsistencyChecks(ctx context.Context) ConsistencyReport {
+	report := ConsistencyReport{
+		CheckedAt: time.Now().Unix(),
+		OK:        true,
+	}
+	for _, check := range consistencyChecks {
+		result := ConsistencyCheckResult{
+			Name:          check.name,
+			Discrepancies: []Discrepancy{},
+		}
+		if err := check.run(ctx, &result); err != nil {
+			result.Error = err.Error()
+		}
+		if result.Error != "" || len(result.Discrepancies) > 0 {
+			report.OK = false
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
+
+// rawLivestreamScores は統計APIと同じ定義 (リアクション数 + チップ合計) で全配信のスコアを求めます。
+func rawLivestreamScores(ctx context.Context) (map[int64]int64, error) {
+	var rows []trendingLivestream
+	query := `
+	SELECT l.id, l.user_id,
+		(SELECT COUNT(*) FROM reactions r WHERE r.livestream_id = l.id) +
+		(SELECT IFNULL(SUM(tip), 0) FROM livecomments c WHERE c.livestream_id = l.id AND c.deleted_at IS NULL) AS score
+	FROM livestreams l
+	`
+	if err := dbConn.SelectContext(ctx, &rows, query); err != nil {
+		return nil, err
+	}
+	scores := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		scores[row.LivestreamID] = row.Score
+	}
+	return scores, nil
+}
+
+// rawUserScores は配信者ごとに、持っている配信のスコアの合計をユーザのスコアとして求めます。
+func rawUserScores(ctx context.Context) (map[int64]int64, error) {
+	var rows []struct {
+		UserID int64 `db:"id"`
+		Score  int64 `db:"score"`
+	}
+	query := `
+	SELECT u.id,
+		(SELECT COUNT(*) FROM reactions r INNER JOIN livestreams l ON l.id = r.livestream_id WHERE l.user_id = u.id) +
+		(SELECT IFNULL(SUM(c.tip), 0) FROM livecomments c INNER JOIN livestreams l ON l.id = c.livestream_id WHERE l.user_id = u.id AND c.deleted_at IS NULL) AS score
+	FROM users u
+	`
+	if err := dbConn.SelectContext(ctx, &rows, query); err != nil {
+		return nil, err
+	}
+	scores := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		scores[row.UserID] = row.Score
+	}
+	return scores, nil
+}
+
+// livestreamsChangedSince は since (unix 秒) 以降にリアクション・ライブコメント・入室のあった配信の ID を返します。
+// サーバが持っている値は生テーブルと同時には読めないので、その間に変わったものは比べずに外すのに使う
+func livestreamsChangedSince(ctx context.Context, since int64) (map[int64]bool, error) {
+	var ids []int64
+	query := `
+	SELECT livestream_id FROM reactions WHERE created_at >= ?
+	UNION SELECT livestream_id FROM livecomments WHERE created_at >= ? OR deleted_at >= ?
+	`
+	if err := dbConn.SelectContext(ctx, &ids, query, since, since, since); err != nil {
+		return nil, err
+	}
+	if viewerHistoryOnMySQL() {
+		var viewed []int64
+		if err := dbFor(tableLivestreamViewersHistory).SelectContext(ctx, &viewed, "SELECT DISTINCT livestream_id FROM livestream_viewers_history WHERE created_at >= ?", since); err != nil {
+			return nil, err
+		}
+		ids = append(ids, viewed...)
+	}
+	changed := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		changed[id] = true
+	}
+	return changed, nil
+}
+
+// checkTrendingScores はおすすめ用にキャッシュしているトレンドのスコアが生テーブルとずれていないかを見ます。
+// スナップショットは定期更新なので、作った後にリアクションや投げ銭のあった配信は比べない
+func checkTrendingScores(ctx context.Context, result *ConsistencyCheckResult) error {
+	recommendations.mu.RLock()
+	trending := recommendations.trending
+	recommendations.mu.RUnlock()
+	if trending == nil {
+		return nil
+	}
+
+	raw, err := rawLivestreamScores(ctx)
+	if err != nil {
+		return err
+	}
+	changed, err := livestreamsChangedSince(ctx, trending.loadedAt.Unix())
+	if err != nil {
+		return err
+	}
+	for _, ls := range trending.livestreams {
+		if changed[ls.LivestreamID] {
+			continue
+		}
+		result.Checked++
+		expected, ok := raw[ls.LivestreamID]
+		if !ok {
+			result.add(Discrepancy{Key: fmt.Sprintf("livestream:%d", ls.LivestreamID), Actual: ls.Score, Detail: "livestream not found"})
+			continue
+		}
+		if expected != ls.Score {
+			result.add(Discrepancy{Key: fmt.Sprintf("livestream:%d", ls.LivestreamID), Expected: expected, Actual: ls.Score})
+		}
+	}
+	return nil
+}
+
+// checkLivestreamRanking は配信のランキングAPIが返すスコアを生テーブルと比べます (ランキングは読み取り用の DB から集計する)。
+func checkLivestreamRanking(ctx context.Context, result *ConsistencyCheckResult) error {
+	since := time.Now().Unix()
+	entries, err := livestreamLeaderboard(ctx, rankingOrderScore)
+	if err != nil {
+		return err
+	}
+	raw, err := rawLivestreamScores(ctx)
+	if err != nil {
+		return err
+	}
+	changed, err := livestreamsChangedSince(ctx, since)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if changed[e.LivestreamID] {
+			continue
+		}
+		result.Checked++
+		if expected := raw[e.LivestreamID]; expected != e.Score {
+			result.add(Discrepancy{Key: fmt.Sprintf("livestream:%d", e.LivestreamID), Expected: expected, Actual: e.Score})
+		}
+	}
+	return nil
+}
+
+// checkUserRanking はユーザのランキングAPIが返すスコアを生テーブルと比べます。
+func checkUserRanking(ctx context.Context, result *ConsistencyCheckResult) error {
+	since := time.Now().Unix()
+	entries, err := userLeaderboard(ctx, rankingOrderScore)
+	if err != nil {
+		return err
+	}
+	raw, err := rawUserScores(ctx)
+	if err != nil {
+		return err
+	}
+	changed, err := livestreamsChangedSince(ctx, since)
+	if err != nil {
+		return err
+	}
+	changedUsers := map[int64]bool{}
+	if len(changed) > 0 {
+		ids := make([]int64, 0, len(changed))
+		for id := range changed {
+			ids = append(ids, id)
+		}
+		livestreamModels, err := livestreamRegistryCache.getMany(ctx, ids)
+		if err != nil {
+			return err
+		}
+		for _, m := range livestreamModels {
+			changedUsers[m.UserID] = true
+		}
+	}
+	for _, e := range entries {
+		if changedUsers[e.UserID] {
+			continue
+		}
+		result.Checked++
+		if expected := raw[e.UserID]; expected != e.Score {
+			result.add(Discrepancy{Key: fmt.Sprintf("user:%d", e.UserID), Expected: expected, Actual: e.Score})
+		}
+	}
+	return nil
+}
+
+// checkMetricsStreamScores はメトリクスが initialize から数えている配信ごとのスコア (リアクション数 + 投げ銭) を生テーブルと比べます。
+// メトリクスは投稿した時点で数えるので、後から削除・保留したライブコメントも含めて比べる。
+// 他のサーバ (ISUCON13_PEERS) があるときは、このサーバが受けた分しか数えていないので、生テーブルを超えていないかだけを見る
+func checkMetricsStreamScores(ctx context.Context, result *ConsistencyCheckResult) error {
+	initializedAt := lastInitializedAt.Load()
+	if initializedAt == 0 {
+		return nil
+	}
+	initializedAtUnix := time.Unix(0, initializedAt).Unix()
+
+	since := time.Now().Unix()
+	livecommentCounters.flush()
+	scores := metrics.streamScoresSnapshot()
+
+	var rows []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Score        int64 `db:"score"`
+	}
+	query := `
+	SELECT livestream_id, SUM(score) AS score FROM (
+		SELECT livestream_id, COUNT(*) AS score FROM reactions WHERE created_at >= ? GROUP BY livestream_id
+		UNION ALL
+		SELECT livestream_id, SUM(tip) AS score FROM livecomments WHERE created_at >= ? GROUP BY livestream_id
+	) AS s GROUP BY livestream_id
+	`
+	if err := dbConn.SelectContext(ctx, &rows, query, initializedAtUnix, initializedAtUnix); err != nil {
+		return err
+	}
+	changed, err := livestreamsChangedSince(ctx, since)
+	if err != nil {
+		return err
+	}
+	raw := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		raw[row.LivestreamID] = row.Score
+	}
+
+	partial := len(peerServers()) > 0
+	compare := func(livestreamID, expected, actual int64) {
+		if changed[livestreamID] {
+			return
+		}
+		result.Checked++
+		switch {
+		case !partial && actual != expected:
+			result.add(Discrepancy{Key: fmt.Sprintf("livestream:%d", livestreamID), Expected: expected, Actual: actual})
+		case partial && actual > expected:
+			result.add(Discrepancy{Key: fmt.Sprintf("livestream:%d", livestreamID), Expected: expected, Actual: actual, Detail: "counted more than recorded"})
+		}
+	}
+	for livestreamID, actual := range scores {
+		compare(livestreamID, raw[livestreamID], actual)
+	}
+	for livestreamID, expected := range raw {
+		if _, ok := scores[livestreamID]; !ok && expected > 0 {
+			compare(livestreamID, expected, 0)
+		}
+	}
+	return nil
+}
+
+// checkTagStats はタグ統計 (tag_stats.go) が足していったタグごとの視聴者数・投げ銭の合計を生テーブルと比べます。
+// 比べている間に変わった配信を含むタグは比べない
+func checkTagStats(ctx context.Context, result *ConsistencyCheckResult) error {
+	since := time.Now().Unix()
+	totals, ok := tagStats.snapshot()
+	if !ok {
+		return nil
+	}
+
+	var tipRows []struct {
+		TagID int64 `db:"tag_id"`
+		Tips  int64 `db:"tips"`
+	}
+	query := `
+	SELECT lt.tag_id, IFNULL(SUM(c.tip), 0) AS tips
+	FROM livestream_tags lt
+	INNER JOIN livecomments c ON c.livestream_id = lt.livestream_id AND c.deleted_at IS NULL AND c.held_at IS NULL
+	GROUP BY lt.tag_id
+	`
+	if err := dbConn.SelectContext(ctx, &tipRows, query); err != nil {
+		return err
+	}
+	var livestreamTags []*LivestreamTagModel
+	if err := dbConn.SelectContext(ctx, &livestreamTags, "SELECT * FROM livestream_tags"); err != nil {
+		return err
+	}
+	viewers, err := viewerHistory.countAll(ctx)
+	if err != nil {
+		return err
+	}
+	changed, err := livestreamsChangedSince(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	raw := map[int64]tagTotals{}
+	changedTags := map[int64]bool{}
+	for _, row := range tipRows {
+		t := raw[row.TagID]
+		t.tips = row.Tips
+		raw[row.TagID] = t
+	}
+	for _, lt := range livestreamTags {
+		t := raw[lt.TagID]
+		t.viewers += viewers[lt.LivestreamID]
+		raw[lt.TagID] = t
+		if changed[lt.LivestreamID] {
+			changedTags[lt.TagID] = true
+		}
+	}
+
+	for tagID, expected := range raw {
+		if changedTags[tagID] || expected == (tagTotals{}) {
+			continue
+		}
+		result.Checked++
+		actual := totals[tagID]
+		if actual.tips != expected.tips {
+			result.add(Discrepancy{Key: fmt.Sprintf("tag:%d", tagID), Expected: expected.tips, Actual: actual.tips, Detail: "total tips"})
+		}
+		if actual.viewers != expected.viewers {
+			result.add(Discrepancy{Key: fmt.Sprintf("tag:%d", tagID), Expected: expected.viewers, Actual: actual.viewers, Detail: "total viewers"})
+		}
+	}
+	return nil
+}
+
+// checkUniqueViewers はユニーク視聴者数の概算を視聴履歴から正確に数え直した値と比べます。
+// 退室すると履歴は消えるので、正確な値は「現在履歴に残っているユーザ数」で、概算はそれ以上になるのが正しい。
+// HyperLogLog の誤差 (標準誤差の 3 倍) を超えて下回っているものを不一致とします。
+func checkUniqueViewers(ctx context.Context, result *ConsistencyCheckResult) error {
+	var rows []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"cnt"`
+	}
+	if err := dbFor(tableLivestreamViewersHistory).SelectContext(ctx, &rows, "SELECT livestream_id, COUNT(DISTINCT user_id) AS cnt FROM livestream_viewers_history GROUP BY livestream_id"); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		result.Checked++
+		actual, err := viewerHistory.approxUniqueViewers(ctx, row.LivestreamID)
+		if err != nil {
+			return err
+		}
+		tolerance := int64(3*hllStdError*float64(row.Count)) + 1
+		if actual < row.Count-tolerance {
+			result.add(Discrepancy{Key: fmt.Sprintf("livestream:%d", row.LivestreamID), Expected: row.Count, Actual: actual, Detail: "approx unique viewers is below the exact count"})
+		}
+	}
+	return nil
+}
+
+// checkIconHashes は icons.hash が画像の sha256 と一致しているかを見ます。
+func checkIconHashes(ctx context.Context, result *ConsistencyCheckResult) error {
+	rows, err := dbFor(tableIcons).QueryxContext(ctx, "SELECT id, image, hash FROM icons")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id    int64
+			image []byte
+			hash  string
+		)
+		if err := rows.Scan(&id, &image, &hash); err != nil {
+			return err
+		}
+		result.Checked++
+		if expected := fmt.Sprintf("%x", sha256.Sum256(image)); expected != hash {
+			result.add(Discrepancy{Key: fmt.Sprintf("icon:%d", id), Detail: fmt.Sprintf("expected %s, got %q", expected, hash)})
+		}
+	}
+	return rows.Err()
+}
+
+// checkPollVotes は poll_options.votes (カウンタキャッシュ) と poll_votes の件数を比べます。
+func checkPollVotes(ctx context.Context, result *ConsistencyCheckResult) error {
+	var rows []struct {
+		OptionID int64 `db:"id"`
+		Votes    int64 `db:"votes"`
+		Count    int64 `db:"cnt"`
+	}
+	query := `
+	SELECT o.id, o.votes, (SELECT COUNT(*) FROM poll_votes v WHERE v.option_id = o.id) AS cnt
+	FROM poll_options o
+	`
+	if err := dbConn.SelectContext(ctx, &rows, query); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		result.Checked++
+		if row.Votes != row.Count {
+			result.add(Discrepancy{Key: fmt.Sprintf("poll_option:%d", row.OptionID), Expected: row.Count, Actual: row.Votes})
+		}
+	}
+	return nil
+}
+
+// checkQuestionVotes は questions.votes (カウンタキャッシュ) と question_votes の件数を比べます。
+func checkQuestionVotes(ctx context.Context, result *ConsistencyCheckResult) error {
+	var rows []struct {
+		QuestionID int64 `db:"id"`
+		Votes      int64 `db:"votes"`
+		Count      int64 `db:"cnt"`
+	}
+	query := `
+	SELECT q.id, q.votes, (SELECT COUNT(*) FROM question_votes v WHERE v.question_id = q.id) AS cnt
+	FROM questions q
+	`
+	if err := dbConn.SelectContext(ctx, &rows, query); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		result.Checked++
+		if row.Votes != row.Count {
+			result.add(Discrepancy{Key: fmt.Sprintf("question:%d", row.QuestionID), Expected: row.Count, Actual: row.Votes})
+		}
+	}
+	return nil
+}
+
+// 整合性チェックAPI
+// GET /api/admin/consistency
+func getConsistencyReportHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, runConsistencyChecks(c.Request().Context()))
+}
+
+// 定期チェックが無効のときに、設定が変わっていないかを見る間隔
+const consistencyCheckerIdleInterval = 10 * time.Second
+
+// runConsistencyChecker は設定の consistency_check_interval (ISUCON13_CONSISTENCY_CHECK_INTERVAL) ごとにチェックし、不一致をログに出します。
+// 間隔は毎回設定から読むので、読み直せば再起動せずに有効・無効や間隔を変えられます。
+func runConsistencyChecker() {
+	for {
+		interval := currentConfig().ConsistencyCheckInterval.duration()
+		if interval <= 0 {
+			time.Sleep(consistencyCheckerIdleInterval)
+			continue
+		}
+		time.Sleep(interval)
+		if currentConfig().ConsistencyCheckInterval <= 0 {
+			continue
+		}
+
+		report := runConsistencyChecks(context.Background())
+		if report.OK {
+			continue
+		}
+		for _, result := range report.Results {
+			if result.Error != "" {
+				log.Printf("consistency check %s failed: %s", result.Name, result.Error)
+			}
+			for _, d := range result.Discrepancies {
+				log.Printf("consistency check %s: %s expected=%d actual=%d %s", result.Name, d.Key, d.Expected, d.Actual, d.Detail)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Cookie のセッションで認証する書き込みリクエストを CSRF から守ります (double submit cookie)。
+// フロントエンドは csrfCookieName の Cookie の値を csrfHeaderName ヘッダに入れて送る必要があるので、
+// 設定の csrf_enabled (ISUCON13_CSRF_ENABLED=true) のときだけ有効にします。
+const (
+	csrfCookieName = "_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// ISUCON13_FRONTEND_ORIGIN はカンマ区切りで、書き込みリクエストの Origin として許可するオリジンです。
+// 空なら Origin は検証しません。
+func frontendOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("ISUCON13_FRONTEND_ORIGIN"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// skipCSRF は Cookie のセッションを使っていないリクエストを除外します。
+// アクセストークンや管理者トークンはブラウザが自動で付けるものではないので CSRF の対象外です。
+// 管理者トークンはヘッダを付けただけで素通りできないよう、正しいときだけ除外します。
+func skipCSRF(c echo.Context) bool {
+	if isAPITokenRequest(c) || validAdminToken(c.Request().Header.Get(adminTokenHeader)) {
+		return true
+	}
+	if _, err := c.Cookie(defaultSessionIDKey); err != nil {
+		return true
+	}
+	return false
+}
+
+func csrfMiddleware() echo.MiddlewareFunc {
+	csrf := middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper:        skipCSRF,
+		TokenLookup:    "header:" + csrfHeaderName,
+		CookieName:     csrfCookieName,
+		CookieDomain:   "t.isucon.pw",
+		CookiePath:     "/",
+		CookieSameSite: http.SameSiteLaxMode,
+	})
+	origins := frontendOrigins()
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := csrf(next)
+		return func(c echo.Context) error {
+			// 設定は読み直しで変わるので、リクエストごとに見る
+			if !currentConfig().CSRFEnabled {
+				return next(c)
+			}
+			if len(origins) > 0 && !isSafeMethod(c.Request().Method) && !skipCSRF(c) {
+				origin := c.Request().Header.Get(echo.HeaderOrigin)
+				if origin != "" && !slices.Contains(origins, origin) {
+					return echo.NewHTTPError(http.StatusForbidden, "origin not allowed")
+				}
+			}
+			return h(c)
+		}
+	}
+}
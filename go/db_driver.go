@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"time"
+)
+
+// instrumentedConnector は MySQL ドライバの接続をラップし、発行したクエリを観測できるようにします。
+type instrumentedConnector struct {
+	driver.Connector
+}
+
+func (ic *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := ic.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn}, nil
+}
+
+type instrumentedConn struct {
+	driver.Conn
+	// 使い回す準備済みステートメント (stmt_cache.go)
+	stmts map[string]driver.Stmt
+}
+
+var (
+	_ driver.ConnBeginTx        = (*instrumentedConn)(nil)
+	_ driver.ConnPrepareContext = (*instrumentedConn)(nil)
+	_ driver.QueryerContext     = (*instrumentedConn)(nil)
+	_ driver.ExecerContext      = (*instrumentedConn)(nil)
+	_ driver.Pinger             = (*instrumentedConn)(nil)
+	_ driver.SessionResetter    = (*instrumentedConn)(nil)
+	_ driver.Validator          = (*instrumentedConn)(nil)
+	_ driver.NamedValueChecker  = (*instrumentedConn)(nil)
+)
+
+func (ic *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return ic.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (ic *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	start := time.Now()
+	stmt, err := ic.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, applyQueryHints(ctx, query))
+	if err != nil {
+		return nil, err
+	}
+	onQuery(ctx, query, time.Since(start))
+	return &instrumentedStmt{Stmt: stmt}, nil
+}
+
+func (ic *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	hinted := applyQueryHints(ctx, query)
+	stmt, err := ic.cachedStmt(ctx, hinted, args)
+	if err != nil {
+		return nil, err
+	}
+	if stmt != nil {
+		start := time.Now()
+		rows, err := stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+		onQuery(ctx, query, time.Since(start))
+		markTxError(ctx, err)
+		if err != nil && isRetryableConnError(err) {
+			ic.dropStmt(hinted)
+			return nil, driver.ErrBadConn
+		}
+		return rows, err
+	}
+
+	queryer, ok := ic.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, hinted, args)
+	// ErrSkip の場合は database/sql が Prepare し直すので、そちらで数える
+	if !errors.Is(err, driver.ErrSkip) {
+		onQuery(ctx, query, time.Since(start))
+		markTxError(ctx, err)
+	}
+	// 参照クエリは冪等なので、切断されていた場合は database/sql に別の接続でやり直させる
+	if err != nil && isRetryableConnError(err) {
+		return nil, driver.ErrBadConn
+	}
+	return rows, err
+}
+
+func (ic *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	hinted := applyQueryHints(ctx, query)
+	stmt, err := ic.cachedStmt(ctx, hinted, args)
+	if err != nil {
+		return nil, err
+	}
+	if stmt != nil {
+		start := time.Now()
+		result, err := stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+		onQuery(ctx, query, time.Since(start))
+		markTxError(ctx, err)
+		// 書き込みは冪等とは限らないので ErrBadConn にはせず、ステートメントだけ捨てる
+		if err != nil && isRetryableConnError(err) {
+			ic.dropStmt(hinted)
+		}
+		return result, err
+	}
+
+	execer, ok := ic.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, hinted, args)
+	if !errors.Is(err, driver.ErrSkip) {
+		onQuery(ctx, query, time.Since(start))
+		markTxError(ctx, err)
+	}
+	return result, err
+}
+
+func (ic *instrumentedConn) Close() error {
+	ic.closeStmts()
+	return ic.Conn.Close()
+}
+
+func (ic *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := ic.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (ic *instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := ic.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (ic *instrumentedConn) IsValid() bool {
+	if validator, ok := ic.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (ic *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := ic.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// instrumentedStmt は Prepare したステートメントの実行エラーをトランザクションのやり直し判定 (db_tx.go) に伝えます。
+type instrumentedStmt struct {
+	driver.Stmt
+}
+
+var (
+	_ driver.StmtQueryContext = (*instrumentedStmt)(nil)
+	_ driver.StmtExecContext  = (*instrumentedStmt)(nil)
+)
+
+func (is *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := is.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	markTxError(ctx, err)
+	return rows, err
+}
+
+func (is *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	result, err := is.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	markTxError(ctx, err)
+	return result, err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	dbConnectMaxAttempts    = 8
+	dbConnectInitialBackoff = 100 * time.Millisecond
+	dbConnectMaxBackoff     = 2 * time.Second
+
+	// ER_SERVER_SHUTDOWN
+	mysqlErrServerShutdown = 1053
+)
+
+// failoverConnector は複数の MySQL に対して先頭から順に接続を試み、
+// 全滅した場合はバックオフしながらやり直します。
+// MySQL の再起動中でもアプリを再起動せずに復帰できるようにするためのものです。
+type failoverConnector struct {
+	connectors []driver.Connector
+	addrs      []string
+}
+
+func newFailoverConnector(confs []*mysql.Config) (*failoverConnector, error) {
+	fc := &failoverConnector{}
+	for _, conf := range confs {
+		connector, err := mysql.NewConnector(conf)
+		if err != nil {
+			return nil, err
+		}
+		fc.connectors = append(fc.connectors, connector)
+		fc.addrs = append(fc.addrs, conf.Addr)
+	}
+	return fc, nil
+}
+
+func (fc *failoverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	backoff := dbConnectInitialBackoff
+	var lastErr error
+	for attempt := 0; attempt < dbConnectMaxAttempts; attempt++ {
+		for i, connector := range fc.connectors {
+			conn, err := connector.Connect(ctx)
+			if err == nil {
+				if i > 0 {
+					log.Printf("connected to fallback mysql %s", fc.addrs[i])
+				}
+				return conn, nil
+			}
+			if !isRetryableConnError(err) {
+				return nil, err
+			}
+			lastErr = err
+		}
+
+		log.Printf("failed to connect to mysql (attempt %d): %v", attempt+1, lastErr)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > dbConnectMaxBackoff {
+			backoff = dbConnectMaxBackoff
+		}
+	}
+	return nil, lastErr
+}
+
+func (fc *failoverConnector) Driver() driver.Driver {
+	return fc.connectors[0].Driver()
+}
+
+// isRetryableConnError は接続拒否や "server has gone away" のように、繋ぎ直せば回復しうるエラーかを判定します。
+func isRetryableConnError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrServerShutdown {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// parseDSNList はカンマ区切りの DSN を先頭から優先順に解釈します。
+func parseDSNList(v string) ([]*mysql.Config, error) {
+	var confs []*mysql.Config
+	for _, dsn := range strings.Split(v, ",") {
+		dsn = strings.TrimSpace(dsn)
+		if dsn == "" {
+			continue
+		}
+		conf, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		confs = append(confs, conf)
+	}
+	if len(confs) == 0 {
+		return nil, errors.New("empty dsn list")
+	}
+	return confs, nil
+}
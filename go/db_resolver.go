@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	tableIcons                    = "icons"
+	tableLivestreamViewersHistory = "livestream_viewers_history"
+)
+
+// 別ホストに切り出せるテーブルと、その DSN を指定する環境変数
+// 切り出し先にも同じスキーマ (10_schema.sql) を流しておくこと。migrations/ のうちそのテーブルへの変更は splitTableChanges で起動時に適用します
+var splittableTableDSNEnvKeys = map[string]string{
+	tableIcons:                    "ISUCON13_MYSQL_ICONS_DSN",
+	tableLivestreamViewersHistory: "ISUCON13_MYSQL_VIEWERS_HISTORY_DSN",
+}
+
+// replicaDBConn は参照専用のレプリカへの接続です。ISUCON13_MYSQL_REPLICA_DSN が未設定なら nil で、readDB は dbConn を返します。
+// レプリカは遅延するので、書き込んだ直後に読み返すハンドラでは使わないこと
+var replicaDBConn *sqlx.DB
+
+// tableDBConns はテーブルごとに切り出した DB 接続です。未設定のテーブルは dbConn を使います。
+// 切り出したテーブルは dbConn のトランザクションや JOIN に含められないので、必ず dbFor 経由で単独で引くこと
+var tableDBConns = map[string]*sqlx.DB{}
+
+// connectSplitDBs は環境変数で DSN が指定されたテーブルの接続を開きます。
+func connectSplitDBs() error {
+	for table, envKey := range splittableTableDSNEnvKeys {
+		v, ok := os.LookupEnv(envKey)
+		if !ok || v == "" {
+			continue
+		}
+		confs, err := parseDSNList(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s': %+v", envKey, err)
+		}
+		db, err := openDB(confs)
+		if err != nil {
+			return fmt.Errorf("failed to connect db for %s: %+v", table, err)
+		}
+		tableDBConns[table] = db
+	}
+
+	if v, ok := os.LookupEnv("ISUCON13_MYSQL_REPLICA_DSN"); ok && v != "" {
+		confs, err := parseDSNList(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable 'ISUCON13_MYSQL_REPLICA_DSN': %+v", err)
+		}
+		db, err := openDB(confs)
+		if err != nil {
+			return fmt.Errorf("failed to connect replica db: %+v", err)
+		}
+		replicaDBConn = db
+	}
+	return nil
+}
+
+// splitTableChange は migrations/ にある切り出し対象テーブルへの変更です。
+// golang-migrate は dbConn にしか流れないので、切り出し先にはここから同じ変更を適用します。
+// migrations/ に切り出し対象テーブルの変更を足したらここにも足すこと
+type splitTableChange struct {
+	table  string
+	column string // 追加するカラム。インデックスの変更なら空
+	index  string // 追加するインデックス。カラムの変更なら空
+	ddl    string
+}
+
+var splitTableChanges = []splitTableChange{
+	// 000001_add_indexes
+	{table: tableIcons, index: "icons_user_id", ddl: "ALTER TABLE `icons` ADD INDEX `icons_user_id` (`user_id`)"},
+	{table: tableLivestreamViewersHistory, index: "livestream_viewers_history_user_id_livestream_id", ddl: "ALTER TABLE `livestream_viewers_history` ADD INDEX `livestream_viewers_history_user_id_livestream_id` (`user_id`, `livestream_id`)"},
+	// 000027_analytics_announcements_icon_hash
+	{table: tableIcons, column: "hash", ddl: "ALTER TABLE `icons` ADD COLUMN `hash` VARCHAR(64) NOT NULL DEFAULT ''"},
+}
+
+// migrateSplitDBs は切り出し先の DB に splitTableChanges のうち未適用のものを適用します。
+// apply が false なら適用せず、足りない変更があればエラーにします (ISUCON13_MIGRATE_ON_STARTUP=false のとき)。
+func migrateSplitDBs(ctx context.Context, apply bool) error {
+	for _, change := range splitTableChanges {
+		db, ok := tableDBConns[change.table]
+		if !ok {
+			continue
+		}
+		var cnt int64
+		var err error
+		if change.column != "" {
+			err = db.GetContext(ctx, &cnt, "SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", change.table, change.column)
+		} else {
+			err = db.GetContext(ctx, &cnt, "SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?", change.table, change.index)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to inspect schema of %s: %w", change.table, err)
+		}
+		if cnt > 0 {
+			continue
+		}
+		if !apply {
+			return fmt.Errorf("split db for %s is missing schema change: %s (run isupipe migrate up)", change.table, change.ddl)
+		}
+		if _, err := db.ExecContext(ctx, change.ddl); err != nil {
+			return fmt.Errorf("failed to migrate split db for %s: %w", change.table, err)
+		}
+	}
+	return nil
+}
+
+func closeSplitDBs() {
+	for _, db := range tableDBConns {
+		db.Close()
+	}
+	if replicaDBConn != nil {
+		replicaDBConn.Close()
+	}
+}
+
+// readDB は参照だけのハンドラが使う接続を返します。
+// トランザクションを張らずに接続プールから 1 クエリずつ引くので、接続を握り続けません。
+func readDB() *sqlx.DB {
+	if replicaDBConn != nil {
+		return replicaDBConn
+	}
+	return dbConn
+}
+
+// dbFor はテーブルを格納している DB の接続を返します。
+func dbFor(table string) *sqlx.DB {
+	if db, ok := tableDBConns[table]; ok {
+		return db
+	}
+	return dbConn
+}
+
+// truncateSplitTables は init.sh の対象外になる切り出し先のテーブルを初期化します。
+func truncateSplitTables(ctx context.Context) error {
+	for table, db := range tableDBConns {
+		if _, err := db.ExecContext(ctx, "TRUNCATE TABLE "+table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// ER_LOCK_WAIT_TIMEOUT
+	mysqlErrLockWaitTimeout = 1205
+	// ER_LOCK_DEADLOCK
+	mysqlErrDeadlock = 1213
+	// ER_DUP_ENTRY
+	mysqlErrDuplicateEntry = 1062
+
+	txMaxAttempts    = 3
+	txInitialBackoff = 10 * time.Millisecond
+)
+
+// txAttempt はトランザクション内のクエリがデッドロック・ロック待ちタイムアウトで失敗したかを記録します。
+// ハンドラはエラーを echo.HTTPError の文字列に包んでしまうので、ドライバ側 (db_driver.go) で印を付けておく
+type txAttempt struct {
+	retryable atomic.Bool
+}
+
+type txAttemptKey struct{}
+
+// isRetryableTxError はトランザクションをやり直せば通りうるエラーかを判定します。
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == mysqlErrDeadlock || mysqlErr.Number == mysqlErrLockWaitTimeout)
+}
+
+// isDuplicateEntryError は UNIQUE 制約に違反したエラーかを判定します。
+func isDuplicateEntryError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry
+}
+
+// markTxError はクエリのエラーがやり直せるものなら、実行中のトランザクションに印を付けます。
+func markTxError(ctx context.Context, err error) {
+	if err == nil || !isRetryableTxError(err) {
+		return
+	}
+	if attempt, ok := ctx.Value(txAttemptKey{}).(*txAttempt); ok {
+		attempt.retryable.Store(true)
+	}
+}
+
+// runInTx は fn をトランザクション内で実行してコミットします。
+// デッドロック (1213)・ロック待ちタイムアウト (1205) で失敗した場合は、少し待ってから txMaxAttempts 回までやり直します。
+// fn はやり直しで何度も呼ばれるので、コミットするまで外部 (hub やキャッシュなど) に副作用を出さないこと。
+// また fn に渡す ctx でクエリを発行すること (ドライバがその ctx を見てエラーを記録する)。
+func runInTx(ctx context.Context, fn func(ctx context.Context, tx *sqlx.Tx) error) error {
+	backoff := txInitialBackoff
+	for i := 1; ; i++ {
+		attempt := &txAttempt{}
+		err := runTxOnce(context.WithValue(ctx, txAttemptKey{}, attempt), fn)
+		if err == nil {
+			return nil
+		}
+		if i >= txMaxAttempts || !(attempt.retryable.Load() || isRetryableTxError(err)) {
+			return err
+		}
+
+		log.Printf("retrying transaction (attempt %d): %v", i+1, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff)))):
+		}
+		backoff *= 2
+	}
+}
+
+func runTxOnce(ctx context.Context, fn func(ctx context.Context, tx *sqlx.Tx) error) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := fn(ctx, tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		markTxError(ctx, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	return nil
+}
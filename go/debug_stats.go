@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// レイテンシのヒストグラムは 50us から 1.25 倍刻みのバケットで持つ (最後のバケットは約 60s 以上)
+const (
+	latencyBucketBase   = 50 * time.Microsecond
+	latencyBucketGrowth = 1.25
+	latencyBucketCount  = 64
+)
+
+var latencyBucketBounds = func() [latencyBucketCount]time.Duration {
+	var bounds [latencyBucketCount]time.Duration
+	for i := range bounds {
+		bounds[i] = time.Duration(float64(latencyBucketBase) * math.Pow(latencyBucketGrowth, float64(i)))
+	}
+	return bounds
+}()
+
+type routeStats struct {
+	count       int64
+	queries     int64
+	totalNanos  int64
+	buckets     [latencyBucketCount]int64
+	statusCodes map[int]int64
+	// レスポンスのエンコードのためにメモリに載せたバイト数 (リクエストごとの最大値の合計と最大) (json_stream.go)
+	bufferedBytes    int64
+	maxBufferedBytes int64
+}
+
+// percentile は p (0-1) に対応するバケットの上限を返します。
+func (rs *routeStats) percentile(p float64) time.Duration {
+	target := int64(math.Ceil(float64(rs.count) * p))
+	var acc int64
+	for i, n := range rs.buckets {
+		acc += n
+		if acc >= target {
+			return latencyBucketBounds[i]
+		}
+	}
+	return latencyBucketBounds[latencyBucketCount-1]
+}
+
+// latencyBucketIndex は elapsed が入るヒストグラムのバケットを返します。
+func latencyBucketIndex(elapsed time.Duration) int {
+	idx := sort.Search(latencyBucketCount, func(i int) bool {
+		return latencyBucketBounds[i] >= elapsed
+	})
+	if idx == latencyBucketCount {
+		idx = latencyBucketCount - 1
+	}
+	return idx
+}
+
+func (rs *routeStats) add(idx, status int, elapsed time.Duration, queries int64) {
+	rs.count++
+	rs.queries += queries
+	rs.totalNanos += int64(elapsed)
+	rs.buckets[idx]++
+	rs.statusCodes[status]++
+}
+
+func (rs *routeStats) addBuffered(n int64) {
+	rs.bufferedBytes += n
+	rs.maxBufferedBytes = max(rs.maxBufferedBytes, n)
+}
+
+// requestStats はルートごと・ベンチマークのフェーズごとのレイテンシ・ステータスコード・クエリ数を最後のリセットから集計します。
+type requestStats struct {
+	mu      sync.Mutex
+	since   time.Time
+	byRoute map[string]*routeStats
+	byPhase map[string]*routeStats
+}
+
+var debugStats = &requestStats{
+	since:   time.Now(),
+	byRoute: map[string]*routeStats{},
+	byPhase: map[string]*routeStats{},
+}
+
+func (s *requestStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since = time.Now()
+	s.byRoute = map[string]*routeStats{}
+	s.byPhase = map[string]*routeStats{}
+	jsonBufferStats.reset()
+}
+
+func (s *requestStats) record(route, phase string, status int, elapsed time.Duration, queries, bufferedBytes int64) {
+	idx := latencyBucketIndex(elapsed)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs, ok := s.byRoute[route]
+	if !ok {
+		rs = &routeStats{statusCodes: map[int]int64{}}
+		s.byRoute[route] = rs
+	}
+	rs.add(idx, status, elapsed, queries)
+	rs.addBuffered(bufferedBytes)
+	ps, ok := s.byPhase[phase]
+	if !ok {
+		ps = &routeStats{statusCodes: map[int]int64{}}
+		s.byPhase[phase] = ps
+	}
+	ps.add(idx, status, elapsed, queries)
+}
+
+type RouteStatsResponse struct {
+	Route         string           `json:"route"`
+	Count         int64            `json:"count"`
+	P50Ms         float64          `json:"p50_ms"`
+	P95Ms         float64          `json:"p95_ms"`
+	P99Ms         float64          `json:"p99_ms"`
+	AvgMs         float64          `json:"avg_ms"`
+	SumMs         float64          `json:"sum_ms"`
+	StatusCodes   map[string]int64 `json:"status_codes"`
+	Queries       int64            `json:"queries"`
+	QueriesPerReq float64          `json:"queries_per_req"`
+	// レスポンスのエンコードでメモリに載せたバイト数 (リクエストごとの最大値) の平均と最大
+	AvgBufferedBytes int64 `json:"avg_buffered_bytes"`
+	MaxBufferedBytes int64 `json:"max_buffered_bytes"`
+}
+
+type PhaseStatsResponse struct {
+	Phase       string           `json:"phase"`
+	Count       int64            `json:"count"`
+	P99Ms       float64          `json:"p99_ms"`
+	AvgMs       float64          `json:"avg_ms"`
+	StatusCodes map[string]int64 `json:"status_codes"`
+}
+
+type DebugStatsResponse struct {
+	Since  int64                `json:"since"`
+	Routes []RouteStatsResponse `json:"routes"`
+	// ベンチマークのフェーズごと (bench_phase.go)
+	Phases []PhaseStatsResponse `json:"phases"`
+	// レスポンスのエンコードに使うバッファのプール (json_stream.go)
+	JSONBufferPool JSONBufferPoolStatsResponse `json:"json_buffer_pool"`
+}
+
+func (rs *routeStats) statusCodeCounts() map[string]int64 {
+	codes := make(map[string]int64, len(rs.statusCodes))
+	for code, n := range rs.statusCodes {
+		codes[strconv.Itoa(code)] = n
+	}
+	return codes
+}
+
+func (s *requestStats) snapshot() DebugStatsResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := DebugStatsResponse{
+		Since:          s.since.Unix(),
+		Routes:         make([]RouteStatsResponse, 0, len(s.byRoute)),
+		Phases:         make([]PhaseStatsResponse, 0, len(s.byPhase)),
+		JSONBufferPool: jsonBufferStats.snapshot(),
+	}
+	for route, rs := range s.byRoute {
+		res.Routes = append(res.Routes, RouteStatsResponse{
+			Route:            route,
+			Count:            rs.count,
+			P50Ms:            toMillis(rs.percentile(0.50)),
+			P95Ms:            toMillis(rs.percentile(0.95)),
+			P99Ms:            toMillis(rs.percentile(0.99)),
+			AvgMs:            toMillis(time.Duration(rs.totalNanos / rs.count)),
+			SumMs:            toMillis(time.Duration(rs.totalNanos)),
+			StatusCodes:      rs.statusCodeCounts(),
+			Queries:          rs.queries,
+			QueriesPerReq:    float64(rs.queries) / float64(rs.count),
+			AvgBufferedBytes: rs.bufferedBytes / rs.count,
+			MaxBufferedBytes: rs.maxBufferedBytes,
+		})
+	}
+	// 合計時間の長い順 (kataribe と同じ観点)
+	sort.Slice(res.Routes, func(i, j int) bool {
+		return res.Routes[i].SumMs > res.Routes[j].SumMs
+	})
+	for phase, ps := range s.byPhase {
+		res.Phases = append(res.Phases, PhaseStatsResponse{
+			Phase:       phase,
+			Count:       ps.count,
+			P99Ms:       toMillis(ps.percentile(0.99)),
+			AvgMs:       toMillis(time.Duration(ps.totalNanos / ps.count)),
+			StatusCodes: ps.statusCodeCounts(),
+		})
+	}
+	sort.Slice(res.Phases, func(i, j int) bool {
+		return res.Phases[i].Phase < res.Phases[j].Phase
+	})
+	return res
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type queryCounterKey struct{}
+
+// onQuery はリクエストのコンテキストに紐づくクエリ数を数え、詳細ログ用にクエリを記録します。
+func onQuery(ctx context.Context, query string, elapsed time.Duration) {
+	if counter, ok := ctx.Value(queryCounterKey{}).(*int64); ok {
+		atomic.AddInt64(counter, 1)
+	}
+	if trace, ok := ctx.Value(requestTraceKey{}).(*requestTrace); ok {
+		trace.addQuery(query, elapsed)
+	}
+}
+
+// debugStatsMiddleware はルートごとのレイテンシとクエリ数を記録します。
+func debugStatsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var queries, bufferedBytes int64
+		req := c.Request()
+		ctx := context.WithValue(req.Context(), queryCounterKey{}, &queries)
+		ctx = context.WithValue(ctx, responseBufferKey{}, &bufferedBytes)
+		c.SetRequest(req.WithContext(ctx))
+
+		start := time.Now()
+		err := next(c)
+		elapsed := time.Since(start)
+
+		status := c.Response().Status
+		if err != nil {
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			} else {
+				status = http.StatusInternalServerError
+			}
+		}
+		debugStats.record(req.Method+" "+c.Path(), benchPhase(c), status, elapsed, atomic.LoadInt64(&queries), atomic.LoadInt64(&bufferedBytes))
+		scoreEstimate.recordRequest(req.Method+" "+c.Path(), status)
+		return err
+	}
+}
+
+// debugStatsHandler は pprof と同じポートで集計結果を返します。POST でリセットします。
+// GET|POST /debug/stats
+func debugStatsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(debugStats.snapshot())
+	case http.MethodPost:
+		debugStats.reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"golang.org/x/exp/slices"
@@ -1312,8 +1312,10 @@ var (
 		"tomoya450.t.isucon.pw.",
 	}
 	// subdomains は現在有効なサブドメインのスライスです。
-	subdomains   = defaultSubdomains
-	muSubdomains = sync.RWMutex{}
+	subdomains = defaultSubdomains
+	// subdomainFilter は subdomains のブルームフィルタです (dns_guard.go)。
+	subdomainFilter = newSubdomainBloom(defaultSubdomains)
+	muSubdomains    = sync.RWMutex{}
 )
 
 // resetSubdomains はサブドメインを初期状態にリセットします。
@@ -1321,49 +1323,92 @@ func resetSubdomains() {
 	muSubdomains.Lock()
 	defer muSubdomains.Unlock()
 	subdomains = defaultSubdomains
+	subdomainFilter = newSubdomainBloom(defaultSubdomains)
+	dnsZone.bumpSerial()
+}
+
+// appendSubdomainLocked はサブドメインを一覧とブルームフィルタに追加します。muSubdomains を取ってから呼ぶこと。
+func appendSubdomainLocked(subdomain string) {
+	subdomains = append(subdomains, subdomain)
+	dnsZone.bumpSerial()
+	if subdomainFilter.full() {
+		subdomainFilter = newSubdomainBloom(subdomains)
+		return
+	}
+	subdomainFilter.add(subdomain)
 }
 
 // addSubdomain は新しいサブドメインを追加します。
 func addSubdomain(subdomain string) {
 	muSubdomains.Lock()
 	defer muSubdomains.Unlock()
-	subdomains = append(subdomains, subdomain)
+	appendSubdomainLocked(subdomain)
+}
+
+// registerSubdomainIfAbsent は未登録の場合だけサブドメインを追加し、追加したかどうかを返します。
+func registerSubdomainIfAbsent(subdomain string) bool {
+	muSubdomains.Lock()
+	defer muSubdomains.Unlock()
+	if subdomainFilter.mayContain(subdomain) && slices.Contains(subdomains, subdomain) {
+		return false
+	}
+	appendSubdomainLocked(subdomain)
+	return true
 }
 
-// DNSHandler は DNS リクエストを処理します。
+// subdomainBloomFillRatio はブルームフィルタのビットが立っている割合を返します。
+func subdomainBloomFillRatio() float64 {
+	muSubdomains.RLock()
+	defer muSubdomains.RUnlock()
+	return subdomainFilter.fillRatio()
+}
+
+// DNSHandler は DNS リクエストを処理し、問い合わせを集計します。
 func DNSHandler(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	result := answerDNS(w, r)
+	dnsMetrics.record(r.Question[0], result, time.Since(start))
+}
+
+// answerDNS は DNS リクエストに応答し、応答の種類 (dnsResult*) を返します。
+func answerDNS(w dns.ResponseWriter, r *dns.Msg) string {
 	m := new(dns.Msg)
 	m.SetReply(r)
 	question := r.Question[0]
+	result := dnsResultEmpty
+
+	// TTL・アドレス・NS・SOA は dns_zone.go の設定
+	settings, serial := dnsZone.get()
 
 	switch question.Qtype {
 	case dns.TypeNS:
-		if question.Name == "t.isucon.pw." {
-			m.Answer = []dns.RR{
-				newRR("t.isucon.pw. 120 IN NS ns1.t.isucon.pw."),
-			}
-			m.Extra = []dns.RR{
-				newRR("ns1.t.isucon.pw. 120 IN A 192.168.0.11"),
-			}
+		if question.Name == dnsZoneName {
+			m.Answer, m.Extra = settings.nsRecords()
+			result = dnsResultAnswered
+		}
+
+	case dns.TypeSOA:
+		if question.Name == dnsZoneName {
+			m.Answer = []dns.RR{settings.soaRecord(serial)}
+			result = dnsResultAnswered
 		}
 
 	case dns.TypeA:
 		muSubdomains.RLock()
 		defer muSubdomains.RUnlock()
 
-		isPresent := slices.Contains(subdomains, question.Name)
+		// ブルームフィルタで確実にないとわかる名前 (水責めのほとんど) は一覧を走査しない
+		isPresent := subdomainFilter.mayContain(question.Name) && slices.Contains(subdomains, question.Name)
 		if isPresent {
-			m.Answer = []dns.RR{
-				newRR(fmt.Sprintf("%s 120 IN A 192.168.0.11", question.Name)),
-			}
+			m.Answer = []dns.RR{settings.aRecord(question.Name)}
+			result = dnsResultAnswered
 		} else {
-			return
-			// NXDOMAIN を返す場合は以下を有効にしてください
-			// m.Rcode = dns.RcodeNameError
-			// m.Ns = []dns.RR{
-			// 	newRR("t.isucon.pw. 60 IN SOA ns1.t.isucon.pw. hostmaster.t.isucon.pw. 2023100201 10800 3600 604800 3600"),
-			// }
-			// ここでは無回答にしています。
+			// 応答するかどうか (NXDOMAIN / REFUSED / 無回答) は設定による (dns_guard.go)
+			var respond bool
+			respond, result = negativeDNSResponse(w, m)
+			if !respond {
+				return result
+			}
 		}
 
 	default:
@@ -1371,6 +1416,7 @@ func DNSHandler(w dns.ResponseWriter, r *dns.Msg) {
 	}
 
 	w.WriteMsg(m)
+	return result
 }
 
 func runDNS() error {
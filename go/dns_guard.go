@@ -0,0 +1,142 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS の水責め攻撃 (存在しないランダムなサブドメインの大量の問い合わせ) への対策
+//   - 登録済みのサブドメインをブルームフィルタにも入れておき、確実に存在しない名前は一覧を走査せずに弾く
+//   - 存在しない名前の問い合わせを送信元ごとに 1 秒あたり dns_nxdomain_limit_per_sec 件までにし、超えた分には dns_limited_response を返す
+//
+// 存在しない名前への応答は dns_negative_response (デフォルトは今まで通り応答しない)。
+// 応答しないと相手のリゾルバがタイムアウトまで待つので、水責めの速度が落ちる
+const (
+	dnsResponseDrop     = "drop"
+	dnsResponseNXDomain = "nxdomain"
+	dnsResponseRefused  = "refused"
+)
+
+var dnsNXDomainLimiter = newRateLimiter(currentConfig().DNSNXDomainLimitPerSec, time.Second)
+
+// ブルームフィルタのハッシュ関数の数と、要素あたりのビット数 (偽陽性率は 1% 程度)
+const (
+	subdomainBloomHashes      = 7
+	subdomainBloomBitsPerItem = 10
+	subdomainBloomMinBits     = 1 << 16
+)
+
+// subdomainBloom は登録済みのサブドメインのブルームフィルタです。
+// 件数が作成時の想定を超えたら作り直す (呼び出し側で muSubdomains を取ること)
+type subdomainBloom struct {
+	bits     []uint64
+	capacity int
+	count    int
+}
+
+func newSubdomainBloom(names []string) *subdomainBloom {
+	capacity := max(len(names)*2, subdomainBloomMinBits/subdomainBloomBitsPerItem)
+	nbits := capacity * subdomainBloomBitsPerItem
+	b := &subdomainBloom{
+		bits:     make([]uint64, (nbits+63)/64),
+		capacity: capacity,
+	}
+	for _, name := range names {
+		b.add(name)
+	}
+	return b
+}
+
+// full は想定した件数を超えて偽陽性が増えてきたかを返します。
+func (b *subdomainBloom) full() bool {
+	return b.count >= b.capacity
+}
+
+// positions は name のビット位置を double hashing (h1 + i*h2) で求めます。
+func (b *subdomainBloom) positions(name string, fn func(word int, mask uint64) bool) bool {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	nbits := uint64(len(b.bits) * 64)
+	for i := uint64(0); i < subdomainBloomHashes; i++ {
+		pos := (h1 + i*h2) % nbits
+		if !fn(int(pos/64), 1<<(pos%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *subdomainBloom) add(name string) {
+	b.positions(name, func(word int, mask uint64) bool {
+		b.bits[word] |= mask
+		return true
+	})
+	b.count++
+}
+
+// mayContain が false なら name は確実に登録されていません。
+func (b *subdomainBloom) mayContain(name string) bool {
+	return b.positions(name, func(word int, mask uint64) bool {
+		return b.bits[word]&mask != 0
+	})
+}
+
+// fillRatio は立っているビットの割合です (デバッグ用)。
+func (b *subdomainBloom) fillRatio() float64 {
+	set := 0
+	for _, w := range b.bits {
+		set += bits.OnesCount64(w)
+	}
+	return float64(set) / float64(len(b.bits)*64)
+}
+
+// dnsClientKey は送信元の IP アドレスを返します。
+func dnsClientKey(w dns.ResponseWriter) string {
+	addr := w.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// negativeDNSResponse は存在しない名前への応答を m に書き、応答の種類を返します。
+// 送信元ごとの上限を超えていれば dns_limited_response、そうでなければ dns_negative_response に従う
+func negativeDNSResponse(w dns.ResponseWriter, m *dns.Msg) (respond bool, result string) {
+	conf := currentConfig()
+	action, result := conf.DNSNegativeResponse, dnsResultNXDomain
+	if ok, _ := dnsNXDomainLimiter.allow(dnsClientKey(w)); !ok {
+		action, result = conf.DNSLimitedResponse, dnsResultLimited
+	}
+
+	switch action {
+	case dnsResponseNXDomain:
+		settings, serial := dnsZone.get()
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{settings.soaRecord(serial)}
+		return true, result
+	case dnsResponseRefused:
+		m.Rcode = dns.RcodeRefused
+		return true, result
+	default:
+		return false, result
+	}
+}
+
+// normalizeDNSResponse は応答の種類の設定を検証し、不明なものは def にします。
+func normalizeDNSResponse(v, def string) string {
+	switch v {
+	case dnsResponseDrop, dnsResponseNXDomain, dnsResponseRefused:
+		return v
+	}
+	return def
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS の問い合わせの集計
+// ベンチマーカーは存在しないサブドメインを大量に引く (水責め攻撃) ので、名前ごとの問い合わせ数・存在しない名前の数・応答時間を数える。
+// 水責めでは名前が際限なく増えるので、名前ごとに数えるのは dnsMetricsMaxNames 個までにして、それ以降の名前は件数だけ数える
+const (
+	dnsMetricsMaxNames = 10000
+	dnsMetricsTopNames = 20
+)
+
+// DNSHandler の応答の種類
+const (
+	dnsResultAnswered = "answered"
+	// 存在しない名前 (応答は設定の dns_negative_response)
+	dnsResultNXDomain = "nxdomain"
+	// 存在しない名前で、送信元ごとの上限を超えたもの (応答は設定の dns_limited_response)
+	dnsResultLimited = "limited"
+	// 答えるレコードがない (A / NS 以外の問い合わせなど)
+	dnsResultEmpty = "empty"
+)
+
+type dnsNameStats struct {
+	queries  int64
+	nxdomain int64
+}
+
+type dnsQueryStats struct {
+	mu    sync.Mutex
+	since time.Time
+	// 応答時間のヒストグラム (ステータスは使わない)
+	latency  routeStats
+	results  map[string]int64
+	qtypes   map[string]int64
+	names    map[string]*dnsNameStats
+	overflow int64
+}
+
+var dnsMetrics = newDNSQueryStats()
+
+func newDNSQueryStats() *dnsQueryStats {
+	return &dnsQueryStats{
+		since:   time.Now(),
+		latency: routeStats{statusCodes: map[int]int64{}},
+		results: map[string]int64{},
+		qtypes:  map[string]int64{},
+		names:   map[string]*dnsNameStats{},
+	}
+}
+
+// reset は initialize で DNS の状態を作り直すときに呼びます。
+func (s *dnsQueryStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since = time.Now()
+	s.latency = routeStats{statusCodes: map[int]int64{}}
+	s.results = map[string]int64{}
+	s.qtypes = map[string]int64{}
+	s.names = map[string]*dnsNameStats{}
+	s.overflow = 0
+}
+
+func (s *dnsQueryStats) record(question dns.Question, result string, elapsed time.Duration) {
+	qtype := dns.TypeToString[question.Qtype]
+	if currentConfig().DNSQueryLog {
+		log.Printf("dns: %s %s %s %.3fms", question.Name, qtype, result, durationMS(elapsed))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency.add(latencyBucketIndex(elapsed), 0, elapsed, 0)
+	s.results[result]++
+	s.qtypes[qtype]++
+	ns, ok := s.names[question.Name]
+	if !ok {
+		if len(s.names) >= dnsMetricsMaxNames {
+			s.overflow++
+			return
+		}
+		ns = &dnsNameStats{}
+		s.names[question.Name] = ns
+	}
+	ns.queries++
+	if result == dnsResultNXDomain || result == dnsResultLimited {
+		ns.nxdomain++
+	}
+}
+
+type DNSNameStats struct {
+	Name     string `json:"name"`
+	Queries  int64  `json:"queries"`
+	NXDomain int64  `json:"nxdomain"`
+}
+
+type DNSQueryStatsResponse struct {
+	Since    int64            `json:"since"`
+	Queries  int64            `json:"queries"`
+	NXDomain int64            `json:"nxdomain"`
+	Results  map[string]int64 `json:"results"`
+	Qtypes   map[string]int64 `json:"qtypes"`
+	P50Ms    float64          `json:"p50_ms"`
+	P99Ms    float64          `json:"p99_ms"`
+	AvgMs    float64          `json:"avg_ms"`
+	// 問い合わせのあった名前の数と、dnsMetricsMaxNames を超えて名前ごとに数えられなかった問い合わせの数
+	DistinctNames    int            `json:"distinct_names"`
+	UntrackedQueries int64          `json:"untracked_queries"`
+	TopNames         []DNSNameStats `json:"top_names"`
+	TopNXDomainNames []DNSNameStats `json:"top_nxdomain_names"`
+	// 登録済みサブドメインのブルームフィルタのビットが立っている割合 (dns_guard.go)
+	BloomFillRatio float64 `json:"bloom_fill_ratio"`
+}
+
+func (s *dnsQueryStats) snapshot() DNSQueryStatsResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := DNSQueryStatsResponse{
+		Since:            s.since.Unix(),
+		Queries:          s.latency.count,
+		NXDomain:         s.results[dnsResultNXDomain] + s.results[dnsResultLimited],
+		Results:          make(map[string]int64, len(s.results)),
+		Qtypes:           make(map[string]int64, len(s.qtypes)),
+		DistinctNames:    len(s.names),
+		UntrackedQueries: s.overflow,
+		TopNXDomainNames: []DNSNameStats{},
+		BloomFillRatio:   subdomainBloomFillRatio(),
+	}
+	for result, n := range s.results {
+		res.Results[result] = n
+	}
+	for qtype, n := range s.qtypes {
+		res.Qtypes[qtype] = n
+	}
+	if s.latency.count > 0 {
+		res.P50Ms = toMillis(s.latency.percentile(0.50))
+		res.P99Ms = toMillis(s.latency.percentile(0.99))
+		res.AvgMs = toMillis(time.Duration(s.latency.totalNanos / s.latency.count))
+	}
+
+	names := make([]DNSNameStats, 0, len(s.names))
+	for name, ns := range s.names {
+		names = append(names, DNSNameStats{Name: name, Queries: ns.queries, NXDomain: ns.nxdomain})
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Queries > names[j].Queries })
+	res.TopNames = append([]DNSNameStats{}, names[:min(len(names), dnsMetricsTopNames)]...)
+	sort.Slice(names, func(i, j int) bool { return names[i].NXDomain > names[j].NXDomain })
+	for _, n := range names[:min(len(names), dnsMetricsTopNames)] {
+		if n.NXDomain > 0 {
+			res.TopNXDomainNames = append(res.TopNXDomainNames, n)
+		}
+	}
+	return res
+}
+
+// metricsHandler は pprof と同じポートで、ダッシュボードと同じメトリクスに DNS の集計を加えて返します。
+// GET /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		MetricsSnapshot
+		DNS DNSQueryStatsResponse `json:"dns"`
+	}{
+		MetricsSnapshot: metrics.snapshot(),
+		DNS:             dnsMetrics.snapshot(),
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ユーザ登録時の DNS 登録は、ユーザの INSERT と同じトランザクションで dns_registration_outbox に書いておき、
+// コミットしてから DNS に反映する。ロールバックされたユーザのサブドメインが DNS に残ることも、
+// コミットしたのに DNS に載らないこともないようにする。
+// 行は消さずに各サーバが処理済みの id を覚えておくので、他のサーバで登録されたユーザも定期的な反映で自分の DNS に載る
+const dnsOutboxPollInterval = time.Second
+
+// id は INSERT した順に振られるがコミットの順とは限らないので、処理済みの id より前でも直近の行は読み直す
+// (サブドメインの登録は何度やっても同じ)
+const dnsOutboxRescanWindow = 10 * time.Second
+
+type dnsOutboxEntry struct {
+	ID        int64  `db:"id"`
+	UserID    int64  `db:"user_id"`
+	Subdomain string `db:"subdomain"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type dnsOutboxDispatcher struct {
+	// 反映は一度に 1 つだけ (処理済みの id を前後させない)
+	mu     sync.Mutex
+	lastID int64
+}
+
+var dnsOutbox = &dnsOutboxDispatcher{}
+
+// enqueueDNSRegistration はユーザ登録のトランザクションの中で呼び、サブドメインの登録を記録します。
+func enqueueDNSRegistration(ctx context.Context, tx *sqlx.Tx, userID int64, subdomain string) error {
+	_, err := tx.NamedExecContext(ctx, "INSERT INTO dns_registration_outbox (user_id, subdomain, created_at) VALUES (:user_id, :subdomain, :created_at)", dnsOutboxEntry{
+		UserID:    userID,
+		Subdomain: subdomain,
+		CreatedAt: time.Now().Unix(),
+	})
+	return err
+}
+
+// reset は initialize で DNS の状態を作り直すときに呼びます (テーブルも空になっている)。
+func (d *dnsOutboxDispatcher) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastID = 0
+}
+
+// drain はまだ反映していない行を DNS に登録し、登録した数を返します。
+func (d *dnsOutboxDispatcher) drain(ctx context.Context) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var entries []dnsOutboxEntry
+	since := time.Now().Add(-dnsOutboxRescanWindow).Unix()
+	if err := dbConn.SelectContext(ctx, &entries, "SELECT * FROM dns_registration_outbox WHERE id > ? OR created_at >= ? ORDER BY id", d.lastID, since); err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, e := range entries {
+		if registerSubdomainIfAbsent(e.Subdomain) {
+			added++
+		}
+		d.lastID = max(d.lastID, e.ID)
+	}
+	return added, nil
+}
+
+// runDNSOutboxDispatcher は他のサーバで登録されたユーザのサブドメインを定期的に反映します。
+func runDNSOutboxDispatcher() {
+	ticker := time.NewTicker(dnsOutboxPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := dnsOutbox.drain(context.Background()); err != nil {
+			log.Printf("failed to apply dns registrations: %v", err)
+		}
+	}
+}
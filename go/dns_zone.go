@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/miekg/dns"
+)
+
+// 組み込みの DNS サーバが返す t.isucon.pw ゾーンの設定 (TTL・A レコードのアドレス・NS・SOA)
+// pdns のゾーンファイルに書いていた値を、環境変数と管理APIで変えられるようにする。
+// SOA のシリアルはサブドメインの追加・初期化・この設定の変更のたびに自動で上げる (YYYYMMDDnn 形式)
+const dnsZoneName = "t.isucon.pw."
+
+type DNSNameServer struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type DNSSOASettings struct {
+	TTL     uint32 `json:"ttl"`
+	MName   string `json:"mname"`
+	RName   string `json:"rname"`
+	Refresh uint32 `json:"refresh"`
+	Retry   uint32 `json:"retry"`
+	Expire  uint32 `json:"expire"`
+	// ネガティブキャッシュの TTL
+	Minimum uint32 `json:"minimum"`
+}
+
+type DNSZoneSettings struct {
+	// A / NS レコードの TTL
+	TTL uint32 `json:"ttl"`
+	// サブドメインの A レコードのアドレス
+	Address     string          `json:"address"`
+	NameServers []DNSNameServer `json:"name_servers"`
+	SOA         DNSSOASettings  `json:"soa"`
+}
+
+type DNSZoneResponse struct {
+	DNSZoneSettings
+	Serial uint32 `json:"serial"`
+}
+
+func defaultDNSZoneSettings() DNSZoneSettings {
+	address := "192.168.0.11"
+	if v := os.Getenv("ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"); v != "" {
+		address = v
+	}
+	s := DNSZoneSettings{
+		TTL:         120,
+		Address:     address,
+		NameServers: []DNSNameServer{{Name: "ns1." + dnsZoneName, Address: address}},
+		SOA: DNSSOASettings{
+			TTL:     60,
+			MName:   "ns1." + dnsZoneName,
+			RName:   "hostmaster." + dnsZoneName,
+			Refresh: 10800,
+			Retry:   3600,
+			Expire:  604800,
+			Minimum: 3600,
+		},
+	}
+
+	if v := os.Getenv("ISUCON13_DNS_ADDRESS"); v != "" {
+		s.Address = v
+	}
+	s.TTL = uint32(envInt64("ISUCON13_DNS_TTL", int64(s.TTL)))
+	// ISUCON13_DNS_NAME_SERVERS="ns1.t.isucon.pw.=192.168.0.11,ns2.t.isucon.pw.=192.168.0.12"
+	if v := os.Getenv("ISUCON13_DNS_NAME_SERVERS"); v != "" {
+		var nameServers []DNSNameServer
+		for _, entry := range strings.Split(v, ",") {
+			name, addr, _ := strings.Cut(strings.TrimSpace(entry), "=")
+			if name != "" {
+				nameServers = append(nameServers, DNSNameServer{Name: dns.Fqdn(name), Address: addr})
+			}
+		}
+		s.NameServers = nameServers
+	}
+	s.SOA.TTL = uint32(envInt64("ISUCON13_DNS_SOA_TTL", int64(s.SOA.TTL)))
+	s.SOA.Minimum = uint32(envInt64("ISUCON13_DNS_SOA_MINIMUM", int64(s.SOA.Minimum)))
+	if len(s.NameServers) > 0 {
+		s.SOA.MName = s.NameServers[0].Name
+	}
+	return s
+}
+
+func (s DNSZoneSettings) validate() error {
+	if s.TTL == 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+	if net.ParseIP(s.Address).To4() == nil {
+		return fmt.Errorf("address must be an IPv4 address")
+	}
+	if len(s.NameServers) == 0 {
+		return fmt.Errorf("name_servers must not be empty")
+	}
+	for _, ns := range s.NameServers {
+		if !dns.IsFqdn(ns.Name) {
+			return fmt.Errorf("name server %q must be fully qualified", ns.Name)
+		}
+		if net.ParseIP(ns.Address).To4() == nil {
+			return fmt.Errorf("address of name server %q must be an IPv4 address", ns.Name)
+		}
+	}
+	if !dns.IsFqdn(s.SOA.MName) || !dns.IsFqdn(s.SOA.RName) {
+		return fmt.Errorf("soa mname and rname must be fully qualified")
+	}
+	return nil
+}
+
+type dnsZoneState struct {
+	mu       sync.RWMutex
+	settings DNSZoneSettings
+	serial   uint32
+}
+
+var dnsZone = &dnsZoneState{
+	settings: defaultDNSZoneSettings(),
+	serial:   dnsSerialBase(time.Now()),
+}
+
+// dnsSerialBase はその日の最初のシリアル (YYYYMMDD00) を返します。
+func dnsSerialBase(now time.Time) uint32 {
+	y, m, d := now.Date()
+	return uint32(y*1000000 + int(m)*10000 + d*100)
+}
+
+func (z *dnsZoneState) get() (DNSZoneSettings, uint32) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.settings, z.serial
+}
+
+// bumpSerial はレコードが変わったときに呼び、シリアルを上げます。
+// 日付が変わっていればその日の 00 から、同じ日なら 1 ずつ上げる
+// (サブドメインの登録は 1 日 100 回を超えるので日付の桁に繰り上がるが、セカンダリが見るのは単調に増えることだけ)
+func (z *dnsZoneState) bumpSerial() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.serial = max(z.serial+1, dnsSerialBase(time.Now()))
+}
+
+func (z *dnsZoneState) update(s DNSZoneSettings) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.settings = s
+	z.serial = max(z.serial+1, dnsSerialBase(time.Now()))
+	return nil
+}
+
+func (s DNSZoneSettings) aRecord(name string) dns.RR {
+	return newRR(fmt.Sprintf("%s %d IN A %s", name, s.TTL, s.Address))
+}
+
+func (s DNSZoneSettings) nsRecords() (answer, extra []dns.RR) {
+	for _, ns := range s.NameServers {
+		answer = append(answer, newRR(fmt.Sprintf("%s %d IN NS %s", dnsZoneName, s.TTL, ns.Name)))
+		extra = append(extra, newRR(fmt.Sprintf("%s %d IN A %s", ns.Name, s.TTL, ns.Address)))
+	}
+	return answer, extra
+}
+
+// soaRecord はシリアルが変わるたびに文字列が変わるので、newRR のキャッシュを通さずに組み立てます。
+func (s DNSZoneSettings) soaRecord(serial uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dnsZoneName, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.SOA.TTL},
+		Ns:      s.SOA.MName,
+		Mbox:    s.SOA.RName,
+		Serial:  serial,
+		Refresh: s.SOA.Refresh,
+		Retry:   s.SOA.Retry,
+		Expire:  s.SOA.Expire,
+		Minttl:  s.SOA.Minimum,
+	}
+}
+
+// DNSゾーン設定取得API
+// GET /api/admin/dns/zone
+func getDNSZoneHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+	settings, serial := dnsZone.get()
+	return c.JSON(http.StatusOK, &DNSZoneResponse{DNSZoneSettings: settings, Serial: serial})
+}
+
+// DNSゾーン設定変更API
+// PUT /api/admin/dns/zone
+// 設定はこのサーバのプロセス内にだけ持つ (再起動すると環境変数の値に戻る)
+func putDNSZoneHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	var req DNSZoneSettings
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	for i := range req.NameServers {
+		req.NameServers[i].Name = dns.Fqdn(req.NameServers[i].Name)
+	}
+	if err := dnsZone.update(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid dns zone settings: "+err.Error())
+	}
+
+	settings, serial := dnsZone.get()
+	return c.JSON(http.StatusOK, &DNSZoneResponse{DNSZoneSettings: settings, Serial: serial})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 一覧APIで同じユーザ・配信を何度も引かないよう、重複を除いた ID を IN 句でまとめて取得する
+
+// uniqueInt64s は重複を除いた ID を出現順に返します。
+func uniqueInt64s(ids []int64) []int64 {
+	seen := make(map[int64]struct{}, len(ids))
+	unique := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+	return unique
+}
+
+// fillUsersByID は ids のユーザをまとめて取得し、ID をキーにして返します。
+// 見つからないユーザがあればエラーを返します。
+func fillUsersByID(ctx context.Context, tx *sqlx.Tx, ids []int64) (map[int64]User, error) {
+	ids = uniqueInt64s(ids)
+	users := make(map[int64]User, len(ids))
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	query, params, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", ids)
+	if err != nil {
+		return nil, err
+	}
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, query, params...); err != nil {
+		return nil, err
+	}
+	for _, m := range userModels {
+		user, err := fillUserResponse(ctx, tx, m)
+		if err != nil {
+			return nil, err
+		}
+		users[m.ID] = user
+	}
+	for _, id := range ids {
+		if _, ok := users[id]; !ok {
+			return nil, fmt.Errorf("user %d not found", id)
+		}
+	}
+	return users, nil
+}
+
+// fillLivestreamsByID は ids の配信をまとめて取得し、ID をキーにして返します。
+// 見つからない配信があればエラーを返します。
+func fillLivestreamsByID(ctx context.Context, tx *sqlx.Tx, ids []int64) (map[int64]Livestream, error) {
+	ids = uniqueInt64s(ids)
+	livestreams := make(map[int64]Livestream, len(ids))
+	if len(ids) == 0 {
+		return livestreams, nil
+	}
+
+	livestreamModels, err := livestreamRegistryCache.getMany(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, m)
+		if err != nil {
+			return nil, err
+		}
+		livestreams[m.ID] = livestream
+	}
+	for _, id := range ids {
+		if _, ok := livestreams[id]; !ok {
+			return nil, fmt.Errorf("livestream %d not found", id)
+		}
+	}
+	return livestreams, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"sync"
+)
+
+// hyperLogLog はユニーク数をおおよそで数えるためのスケッチです。
+// 2^12 個のレジスタ (4KiB) で標準誤差は約 1.6% です。
+const (
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+)
+
+// hllStdError は hllPrecision での標準誤差 (1.04 / sqrt(m)) です。
+var hllStdError = 1.04 / math.Sqrt(hllRegisters)
+
+type hyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+func (h *hyperLogLog) add(x uint64) {
+	hash := hllMix(x)
+	idx := hash >> (64 - hllPrecision)
+	// 残りのビットの先頭から数えた 0 の数 + 1
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) count() int64 {
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	m := float64(hllRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// 少ないうちは線形カウンティングの方が正確
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// hllMix は連番の ID でもレジスタに散らばるよう混ぜます (splitmix64)。
+func hllMix(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// uniqueViewerSketches は配信ごとのユニーク視聴者数のスケッチをプロセス内に持ちます。
+type uniqueViewerSketches struct {
+	mu       sync.Mutex
+	sketches map[int64]*hyperLogLog
+}
+
+func newUniqueViewerSketches() *uniqueViewerSketches {
+	return &uniqueViewerSketches{sketches: map[int64]*hyperLogLog{}}
+}
+
+func (s *uniqueViewerSketches) add(livestreamID, userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.sketches[livestreamID]
+	if !ok {
+		h = &hyperLogLog{}
+		s.sketches[livestreamID] = h
+	}
+	h.add(uint64(userID))
+}
+
+func (s *uniqueViewerSketches) count(livestreamID int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.sketches[livestreamID]
+	if !ok {
+		return 0
+	}
+	return h.count()
+}
+
+func (s *uniqueViewerSketches) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sketches = map[int64]*hyperLogLog{}
+}
+
+// redisUniqueViewersKey は Redis の HyperLogLog (PFADD / PFCOUNT) のキーです。
+func redisUniqueViewersKey(livestreamID int64) string {
+	return redisViewerHistoryKeyPrefix + "hll:" + strconv.FormatInt(livestreamID, 10)
+}
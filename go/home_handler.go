@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	homeTrendingLimit     = 10
+	homeTopTagLimit       = 10
+	homeFollowingLimit    = 10
+	homeAnnouncementLimit = 5
+)
+
+type TagCount struct {
+	Tag
+	LivestreamCount int64 `json:"livestream_count"`
+}
+
+type HomeResponse struct {
+	Trending  []Livestream `json:"trending"`
+	TopTags   []TagCount   `json:"top_tags"`
+	Following []Livestream `json:"following"`
+	// 未ログインなら false (following は空)
+	LoggedIn      bool                `json:"logged_in"`
+	Announcements []AnnouncementModel `json:"announcements"`
+}
+
+// homeCommonPart はユーザによらないトップページの内容です。
+type homeCommonPart struct {
+	trending      []Livestream
+	topTags       []TagCount
+	announcements []AnnouncementModel
+	expiresAt     time.Time
+}
+
+var (
+	homeCacheMu sync.Mutex
+	// トレンドを絞り込む配信の状態ごと ("" は絞り込みなし)
+	homeCache = map[string]*homeCommonPart{}
+)
+
+func resetHomeCache() {
+	homeCacheMu.Lock()
+	defer homeCacheMu.Unlock()
+	homeCache = map[string]*homeCommonPart{}
+}
+
+// getHomeCommonPart はトレンドの集計結果をもとにユーザによらない部分を組み立て、短い間キャッシュします。
+// status を指定するとその状態の配信だけをトレンドに含めます (状態はトレンドの再集計時点のもの)。
+func getHomeCommonPart(ctx context.Context, trending *trendingSnapshot, status string) (*homeCommonPart, error) {
+	homeCacheMu.Lock()
+	defer homeCacheMu.Unlock()
+	if cached, ok := homeCache[status]; ok && time.Now().Before(cached.expiresAt) {
+		return cached, nil
+	}
+
+	// 停止中のユーザの配信はトレンドに出さない
+	suspended, err := userSuspensions.set(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ranked := make([]trendingLivestream, 0, len(trending.livestreams))
+	for _, ls := range trending.livestreams {
+		if suspended[ls.UserID] {
+			continue
+		}
+		if status == "" || ls.Status == status {
+			ranked = append(ranked, ls)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score == ranked[j].Score {
+			return ranked[i].LivestreamID > ranked[j].LivestreamID
+		}
+		return ranked[i].Score > ranked[j].Score
+	})
+	if len(ranked) > homeTrendingLimit {
+		ranked = ranked[:homeTrendingLimit]
+	}
+	trendingIDs := make([]int64, len(ranked))
+	for i := range ranked {
+		trendingIDs[i] = ranked[i].LivestreamID
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	trendingLivestreams, err := fillLivestreamsByIDs(ctx, tx, trendingIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var tagModels []*TagModel
+	if err := tx.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+		return nil, err
+	}
+	counts := map[int64]int64{}
+	for _, tagIDs := range trending.tagsByID {
+		for _, tagID := range tagIDs {
+			counts[tagID]++
+		}
+	}
+	topTags := make([]TagCount, 0, len(tagModels))
+	for _, t := range tagModels {
+		if counts[t.ID] == 0 {
+			continue
+		}
+		topTags = append(topTags, TagCount{Tag: Tag{ID: t.ID, Name: t.Name}, LivestreamCount: counts[t.ID]})
+	}
+	sort.Slice(topTags, func(i, j int) bool {
+		if topTags[i].LivestreamCount == topTags[j].LivestreamCount {
+			return topTags[i].ID < topTags[j].ID
+		}
+		return topTags[i].LivestreamCount > topTags[j].LivestreamCount
+	})
+	if len(topTags) > homeTopTagLimit {
+		topTags = topTags[:homeTopTagLimit]
+	}
+
+	announcements := []AnnouncementModel{}
+	if err := tx.SelectContext(ctx, &announcements, "SELECT * FROM announcements ORDER BY id DESC LIMIT ?", homeAnnouncementLimit); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	common := &homeCommonPart{
+		trending:      trendingLivestreams,
+		topTags:       topTags,
+		announcements: announcements,
+		expiresAt:     time.Now().Add(currentConfig().HomeCacheTTL.duration()),
+	}
+	homeCache[status] = common
+	return common, nil
+}
+
+// fillLivestreamsByIDs は ids の順に配信を取得します。見つからない配信は飛ばします。
+func fillLivestreamsByIDs(ctx context.Context, tx *sqlx.Tx, ids []int64) ([]Livestream, error) {
+	livestreams := make([]Livestream, 0, len(ids))
+	if len(ids) == 0 {
+		return livestreams, nil
+	}
+
+	modelByID, err := livestreamRegistryCache.getMany(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		m, ok := modelByID[id]
+		if !ok {
+			continue
+		}
+		livestream, err := fillLivestreamResponse(ctx, tx, m)
+		if err != nil {
+			return nil, err
+		}
+		livestreams = append(livestreams, livestream)
+	}
+	return livestreams, nil
+}
+
+// followingLivestreamIDs はフォロー相当 (過去に視聴した配信の配信者) の配信を新しい順に返します。
+func followingLivestreamIDs(ctx context.Context, trending *trendingSnapshot, userID int64) ([]int64, error) {
+	watchedIDs, err := viewerHistory.watchedLivestreamIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerByID := make(map[int64]int64, len(trending.livestreams))
+	for _, ls := range trending.livestreams {
+		ownerByID[ls.LivestreamID] = ls.UserID
+	}
+	streamers := map[int64]struct{}{}
+	for _, id := range watchedIDs {
+		if owner, ok := ownerByID[id]; ok && owner != userID {
+			streamers[owner] = struct{}{}
+		}
+	}
+
+	var ids []int64
+	for _, ls := range trending.livestreams {
+		if _, ok := streamers[ls.UserID]; ok {
+			ids = append(ids, ls.LivestreamID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	if len(ids) > homeFollowingLimit {
+		ids = ids[:homeFollowingLimit]
+	}
+	return ids, nil
+}
+
+// トップページ取得API
+// トレンド・人気のタグ・フォロー中の配信者の配信・お知らせをまとめて返す
+// GET /api/home?status=
+func getHomeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	status := c.QueryParam("status")
+	if status != "" && !isValidLivestreamStatus(status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be reserved, live or ended")
+	}
+
+	trending, err := recommendations.trendingSnapshot(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get trending: "+err.Error())
+	}
+
+	common, err := getHomeCommonPart(ctx, trending, status)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get home: "+err.Error())
+	}
+
+	res := HomeResponse{
+		Trending:      common.trending,
+		TopTags:       common.topTags,
+		Following:     []Livestream{},
+		Announcements: common.announcements,
+	}
+
+	// 未ログインでもトップページは見られる
+	if verifyUserSession(c) != nil {
+		return c.JSON(http.StatusOK, res)
+	}
+	res.LoggedIn = true
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	ids, err := followingLivestreamIDs(ctx, trending, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get following livestreams: "+err.Error())
+	}
+	if len(ids) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	following, err := fillLivestreamsByIDs(ctx, tx, ids)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	res.Following = following
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/http2"
+)
+
+// HTTPサーバの調整用の設定 (すべて環境変数で指定し、未指定なら Go のデフォルトのまま)
+//
+//	ISUCON13_HTTP_READ_TIMEOUT_SECONDS
+//	ISUCON13_HTTP_READ_HEADER_TIMEOUT_SECONDS
+//	ISUCON13_HTTP_WRITE_TIMEOUT_SECONDS  (SSE や WebSocket の接続もこの時間で切れるので注意)
+//	ISUCON13_HTTP_IDLE_TIMEOUT_SECONDS   (keep-alive の接続を保つ時間)
+//	ISUCON13_HTTP_MAX_HEADER_BYTES
+//	ISUCON13_HTTP2                       (true/false。TLS ならデフォルトで有効、平文なら h2c を有効にする)
+//	ISUCON13_HTTP2_MAX_CONCURRENT_STREAMS
+type httpServerConfig struct {
+	readTimeout          time.Duration
+	readHeaderTimeout    time.Duration
+	writeTimeout         time.Duration
+	idleTimeout          time.Duration
+	maxHeaderBytes       int
+	http2                bool
+	maxConcurrentStreams uint32
+}
+
+func loadHTTPServerConfig(useTLS bool) httpServerConfig {
+	seconds := func(key string) time.Duration {
+		return time.Duration(envInt64(key, 0)) * time.Second
+	}
+	conf := httpServerConfig{
+		readTimeout:          seconds("ISUCON13_HTTP_READ_TIMEOUT_SECONDS"),
+		readHeaderTimeout:    seconds("ISUCON13_HTTP_READ_HEADER_TIMEOUT_SECONDS"),
+		writeTimeout:         seconds("ISUCON13_HTTP_WRITE_TIMEOUT_SECONDS"),
+		idleTimeout:          seconds("ISUCON13_HTTP_IDLE_TIMEOUT_SECONDS"),
+		maxHeaderBytes:       int(envInt64("ISUCON13_HTTP_MAX_HEADER_BYTES", 0)),
+		http2:                useTLS,
+		maxConcurrentStreams: uint32(envInt64("ISUCON13_HTTP2_MAX_CONCURRENT_STREAMS", 0)),
+	}
+	switch os.Getenv("ISUCON13_HTTP2") {
+	case "true":
+		conf.http2 = true
+	case "false":
+		conf.http2 = false
+	}
+	return conf
+}
+
+// startHTTPServer は設定を反映して echo のサーバを起動します。tlsConfig が nil なら平文で待ち受けます。
+func startHTTPServer(e *echo.Echo, addr string, tlsConfig *tls.Config) error {
+	conf := loadHTTPServerConfig(tlsConfig != nil)
+
+	server := e.Server
+	server.Addr = addr
+	server.ReadTimeout = conf.readTimeout
+	server.ReadHeaderTimeout = conf.readHeaderTimeout
+	server.WriteTimeout = conf.writeTimeout
+	server.IdleTimeout = conf.idleTimeout
+	server.MaxHeaderBytes = conf.maxHeaderBytes
+	// TLSConfig があれば echo は TLS で待ち受ける
+	server.TLSConfig = tlsConfig
+
+	h2s := &http2.Server{
+		MaxConcurrentStreams: conf.maxConcurrentStreams,
+		IdleTimeout:          conf.idleTimeout,
+	}
+	if tlsConfig == nil {
+		if conf.http2 {
+			return e.StartH2CServer(addr, h2s)
+		}
+		return e.StartServer(server)
+	}
+
+	if conf.http2 {
+		if err := http2.ConfigureServer(server, h2s); err != nil {
+			return err
+		}
+	} else {
+		e.DisableHTTP2 = true
+		// TLSNextProto が nil でなければ net/http は HTTP/2 を自動で有効にしない
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return e.StartServer(server)
+}
+
+// shutdownOnSignal は SIGINT・SIGTERM を受けたらサーバを止め、処理中のリクエストが終わるのを待ちます。
+// 返すチャネルは停止が終わると閉じられます。
+func shutdownOnSignal(e *echo.Echo) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := e.Shutdown(ctx); err != nil {
+			e.Logger.Errorf("failed to shutdown HTTP server: %v", err)
+		}
+	}()
+	return done
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// 各クライアントの送信待ちメッセージ数。溢れたメッセージはそのクライアントには送らない
+	hubClientBufferSize  = 64
+	hubWriteDeadline     = 5 * time.Second
+	sseKeepAliveInterval = 15 * time.Second
+)
+
+const (
+	hubMessageLivecomment = "livecomment"
+	hubMessageReaction    = "reaction"
+	// 投稿者がライブコメントを編集した (Data は編集後の Livecomment)
+	hubMessageLivecommentEdit = "livecomment_edit"
+)
+
+// HubMessage は WebSocket / SSE クライアントに配信するメッセージです。
+type HubMessage struct {
+	Type         string      `json:"type"`
+	LivestreamID int64       `json:"livestream_id,omitempty"`
+	Data         interface{} `json:"data"`
+}
+
+type hubClient struct {
+	livestreamID int64
+	// 視聴者のライブコメント表示設定。接続時点のものを使うので、変更は再接続後に反映される
+	chatFilter *chatFilter
+	send       chan HubMessage
+}
+
+// streamHub は接続中の WebSocket / SSE クライアントを管理します。
+// livestreamID が 0 のクライアントは全体向けのメッセージだけを受け取ります。
+type streamHub struct {
+	mu      sync.RWMutex
+	clients map[*hubClient]struct{}
+	// このサーバで配信するすべてのメッセージ (他のサーバから中継されたものを含む) を受け取る関数。集計に使う
+	listeners []func(HubMessage)
+}
+
+var hub = &streamHub{
+	clients: map[*hubClient]struct{}{},
+}
+
+func (h *streamHub) subscribe(livestreamID int64, filter *chatFilter) *hubClient {
+	client := &hubClient{
+		livestreamID: livestreamID,
+		chatFilter:   filter,
+		send:         make(chan HubMessage, hubClientBufferSize),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[client] = struct{}{}
+	return client
+}
+
+// listen はメッセージを受け取る関数を登録します。起動時に呼ぶこと。
+// 関数はメッセージを送る側のゴルーチンで呼ばれるので、すぐに返すこと
+func (h *streamHub) listen(fn func(HubMessage)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners = append(h.listeners, fn)
+}
+
+func (h *streamHub) unsubscribe(client *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, client)
+}
+
+// broadcast はすべてのクライアントにメッセージを送ります。中継が有効なら他のサーバにも送ります。
+func (h *streamHub) broadcast(msg HubMessage) {
+	h.broadcastLocal(msg)
+	if fanout != nil {
+		fanout.send(true, msg)
+	}
+}
+
+// broadcastLocal はこのサーバに接続しているすべてのクライアントにメッセージを送ります。
+func (h *streamHub) broadcastLocal(msg HubMessage) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, fn := range h.listeners {
+		fn(msg)
+	}
+	for client := range h.clients {
+		client.trySend(msg)
+	}
+}
+
+// publish は指定した配信を購読しているクライアントにメッセージを送ります。中継が有効なら他のサーバにも送ります。
+func (h *streamHub) publish(livestreamID int64, msg HubMessage) {
+	msg.LivestreamID = livestreamID
+	h.publishLocal(livestreamID, msg)
+	if fanout != nil {
+		fanout.send(false, msg)
+	}
+}
+
+// publishLocal はこのサーバで指定した配信を購読しているクライアントにメッセージを送ります。
+func (h *streamHub) publishLocal(livestreamID int64, msg HubMessage) {
+	msg.LivestreamID = livestreamID
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, fn := range h.listeners {
+		fn(msg)
+	}
+	for client := range h.clients {
+		if client.livestreamID == livestreamID && client.accepts(msg) {
+			client.trySend(msg)
+		}
+	}
+}
+
+func (h *streamHub) count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// accepts は視聴者の表示設定で隠すメッセージなら false を返します。
+func (client *hubClient) accepts(msg HubMessage) bool {
+	if client.chatFilter == nil {
+		return true
+	}
+	switch data := msg.Data.(type) {
+	case Livecomment:
+		if msg.Type == hubMessageLivecomment || msg.Type == hubMessageLivecommentEdit {
+			return client.chatFilter.visible(data.User.ID, data.Tip, data.Comment)
+		}
+	case Reaction:
+		if msg.Type == hubMessageReaction {
+			return client.chatFilter.reactionVisible(data.User.ID)
+		}
+	}
+	return true
+}
+
+func (client *hubClient) trySend(msg HubMessage) {
+	select {
+	case client.send <- msg:
+	default:
+		// 遅いクライアントのために全体を止めない
+	}
+}
+
+func parseStreamLivestreamID(c echo.Context) (int64, error) {
+	if c.QueryParam("livestream_id") == "" {
+		return 0, nil
+	}
+	livestreamID, err := strconv.ParseInt(c.QueryParam("livestream_id"), 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "livestream_id query parameter must be integer")
+	}
+	return livestreamID, nil
+}
+
+// WebSocketによるイベント購読
+// GET /api/ws
+func getStreamWSHandler(c echo.Context) error {
+	livestreamID, err := parseStreamLivestreamID(c)
+	if err != nil {
+		return err
+	}
+	filter, err := sessionChatFilter(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get chat preferences: "+err.Error())
+	}
+
+	server := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			client := hub.subscribe(livestreamID, filter)
+			defer hub.unsubscribe(client)
+
+			// クライアントからの切断を検知するために読み捨てる
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				var discard []byte
+				for {
+					if err := websocket.Message.Receive(ws, &discard); err != nil {
+						return
+					}
+				}
+			}()
+
+			for {
+				select {
+				case msg := <-client.send:
+					ws.SetWriteDeadline(time.Now().Add(hubWriteDeadline))
+					if err := websocket.JSON.Send(ws, msg); err != nil {
+						return
+					}
+				case <-closed:
+					return
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// Server-Sent Eventsによるイベント購読
+// GET /api/sse
+func getStreamSSEHandler(c echo.Context) error {
+	livestreamID, err := parseStreamLivestreamID(c)
+	if err != nil {
+		return err
+	}
+	filter, err := sessionChatFilter(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get chat preferences: "+err.Error())
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	client := hub.subscribe(livestreamID, filter)
+	defer hub.unsubscribe(client)
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case msg := <-client.send:
+			b, err := json.Marshal(msg)
+			if err != nil {
+				return nil
+			}
+			if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", msg.Type, b); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 複数台構成で、他のサーバでの書き込みもこのサーバの WebSocket / SSE クライアントに届けるため、
+// ISUCON13_HUB_FANOUT=redis のときは hub のメッセージを Redis の pub/sub で全サーバに中継する
+const (
+	hubFanoutChannel = "isupipe:hub"
+	// Redis への送信待ちメッセージ数。溢れたメッセージは他のサーバには届かない
+	hubFanoutBufferSize = 1024
+	// 他のサーバの最新コメント (recent_ring.go) を捨てさせる。クライアントには配信しない
+	hubMessageLivecommentRingInvalidate = "livecomment_ring_invalidate"
+)
+
+type hubFanoutEnvelope struct {
+	// 送信元のサーバ。自分が送ったメッセージは受け取っても配信しない
+	Origin string `json:"origin"`
+	// true なら全クライアント向け (broadcast)
+	Broadcast bool            `json:"broadcast,omitempty"`
+	Message   json.RawMessage `json:"message"`
+}
+
+type hubFanout struct {
+	client *redis.Client
+	origin string
+	out    chan hubFanoutEnvelope
+}
+
+// fanout が nil なら中継しない
+var fanout *hubFanout
+
+func setupHubFanout() error {
+	if os.Getenv("ISUCON13_HUB_FANOUT") != "redis" {
+		return nil
+	}
+	addr := "127.0.0.1:6379"
+	if v, ok := os.LookupEnv("ISUCON13_REDIS_ADDR"); ok {
+		addr = v
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return fmt.Errorf("failed to connect redis: %w", err)
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	f := &hubFanout{
+		client: client,
+		origin: hex.EncodeToString(b),
+		out:    make(chan hubFanoutEnvelope, hubFanoutBufferSize),
+	}
+	// 購読が始まってから中継を有効にする
+	pubsub := client.Subscribe(context.Background(), hubFanoutChannel)
+	if _, err := pubsub.Receive(context.Background()); err != nil {
+		return fmt.Errorf("failed to subscribe %s: %w", hubFanoutChannel, err)
+	}
+	go f.runPublisher()
+	go f.runSubscriber(pubsub)
+	fanout = f
+	log.Printf("hub fanout: redis (%s)", addr)
+	return nil
+}
+
+// send は書き込みのリクエストを待たせないよう、別の goroutine で Redis に送ります。
+func (f *hubFanout) send(broadcast bool, msg HubMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("hub fanout: failed to marshal message: %v", err)
+		return
+	}
+	select {
+	case f.out <- hubFanoutEnvelope{Origin: f.origin, Broadcast: broadcast, Message: b}:
+	default:
+		log.Printf("hub fanout: dropped %s message", msg.Type)
+	}
+}
+
+func (f *hubFanout) runPublisher() {
+	ctx := context.Background()
+	for envelope := range f.out {
+		b, err := json.Marshal(envelope)
+		if err != nil {
+			continue
+		}
+		if err := f.client.Publish(ctx, hubFanoutChannel, b).Err(); err != nil {
+			log.Printf("hub fanout: failed to publish: %v", err)
+		}
+	}
+}
+
+func (f *hubFanout) runSubscriber(pubsub *redis.PubSub) {
+	for m := range pubsub.Channel() {
+		var envelope hubFanoutEnvelope
+		if err := json.Unmarshal([]byte(m.Payload), &envelope); err != nil {
+			log.Printf("hub fanout: failed to unmarshal envelope: %v", err)
+			continue
+		}
+		if envelope.Origin == f.origin {
+			continue
+		}
+		msg, err := decodeHubMessage(envelope.Message)
+		if err != nil {
+			log.Printf("hub fanout: failed to unmarshal message: %v", err)
+			continue
+		}
+		if msg.Type == hubMessageLivecommentRingInvalidate {
+			livecommentRings.invalidate(msg.LivestreamID)
+			continue
+		}
+		if msg.Type == hubMessageLivestreamSettings {
+			// 他のサーバで更新された配信の設定をこのサーバのキャッシュからも消す
+			livestreamSettingsCache.Delete(msg.LivestreamID)
+		}
+		if msg.Type == hubMessageLivecomment {
+			// 他のサーバで投稿・承認されたコメントをこのサーバの最新コメント (recent_ring.go) にも足す
+			if livecomment, ok := msg.Data.(Livecomment); ok && !livecomment.Held {
+				addLivecommentToRing(livecommentModelFromResponse(livecomment))
+			}
+		}
+		if msg.Type == hubMessageLivecommentEdit {
+			if livecomment, ok := msg.Data.(Livecomment); ok {
+				livecommentRings.update(livecomment.Livestream.ID, livecommentModelFromResponse(livecomment))
+			}
+		}
+		if msg.Type == hubMessageReaction {
+			if reaction, ok := msg.Data.(Reaction); ok {
+				reactionRings.add(reaction.Livestream.ID, ReactionModel{
+					ID:           reaction.ID,
+					EmojiName:    reaction.EmojiName,
+					UserID:       reaction.User.ID,
+					LivestreamID: reaction.Livestream.ID,
+					CreatedAt:    reaction.CreatedAt,
+				})
+			}
+		}
+		if msg.Type == hubMessageLivestreamStatus {
+			// 他のサーバでの配信の状態の変更をこのサーバの配信一覧にも反映する
+			if livestream, ok := msg.Data.(Livestream); ok {
+				livestreamRegistryCache.setStatus(livestream.ID, livestream.Status)
+			}
+		}
+		if msg.Type == hubMessageLivestreamThumbnail {
+			if livestream, ok := msg.Data.(Livestream); ok {
+				livestreamRegistryCache.setThumbnailUrl(livestream.ID, livestream.ThumbnailUrl)
+			}
+		}
+		if envelope.Broadcast {
+			hub.broadcastLocal(msg)
+		} else {
+			hub.publishLocal(msg.LivestreamID, msg)
+		}
+	}
+}
+
+// invalidateLivecommentRing は配信の最新コメントを捨てます。中継が有効なら他のサーバのものも捨てさせます。
+// 削除やモデレーションのようにリングから個別に消せない変更のあとに呼ぶこと
+func invalidateLivecommentRing(livestreamID int64) {
+	livecommentRings.invalidate(livestreamID)
+	if fanout != nil {
+		fanout.send(false, HubMessage{Type: hubMessageLivecommentRingInvalidate, LivestreamID: livestreamID})
+	}
+}
+
+// decodeHubMessage は中継されたメッセージを戻します。
+// ライブコメントは視聴者の表示設定で絞り込み、配信の状態とサムネイルは配信一覧 (livestream_registry.go) に反映するので型を戻す。それ以外はそのまま JSON として流します。
+func decodeHubMessage(b []byte) (HubMessage, error) {
+	var raw struct {
+		Type         string          `json:"type"`
+		LivestreamID int64           `json:"livestream_id"`
+		Data         json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return HubMessage{}, err
+	}
+	msg := HubMessage{Type: raw.Type, LivestreamID: raw.LivestreamID, Data: raw.Data}
+	switch raw.Type {
+	case hubMessageLivecomment, hubMessageLivecommentEdit:
+		var livecomment Livecomment
+		if err := json.Unmarshal(raw.Data, &livecomment); err != nil {
+			return HubMessage{}, err
+		}
+		msg.Data = livecomment
+	case hubMessageReaction:
+		var reaction Reaction
+		if err := json.Unmarshal(raw.Data, &reaction); err != nil {
+			return HubMessage{}, err
+		}
+		msg.Data = reaction
+	case hubMessageLivestreamStatus, hubMessageLivestreamThumbnail:
+		var livestream Livestream
+		if err := json.Unmarshal(raw.Data, &livestream); err != nil {
+			return HubMessage{}, err
+		}
+		msg.Data = livestream
+	}
+	return msg, nil
+}
+
+// livecommentModelFromResponse は中継されたライブコメントを最新コメント (recent_ring.go) に持つ形に戻します。
+func livecommentModelFromResponse(livecomment Livecomment) LivecommentModel {
+	m := LivecommentModel{
+		ID:           livecomment.ID,
+		UserID:       livecomment.User.ID,
+		LivestreamID: livecomment.Livestream.ID,
+		Comment:      livecomment.Comment,
+		Tip:          livecomment.Tip,
+		CreatedAt:    livecomment.CreatedAt,
+		SpamScore:    livecomment.SpamScore,
+	}
+	if livecomment.EditedAt != nil {
+		m.EditedAt = sql.NullInt64{Int64: *livecomment.EditedAt, Valid: true}
+	}
+	return m
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	iconObjectPrefix      = "icons/"
+	iconPresignExpiry     = 1 * time.Hour
+	iconUploadConcurrency = 16
+)
+
+// iconObjectStorage は S3 互換ストレージ (MinIO など) にアイコン画像を置くためのものです。
+// キーは画像の sha256 なので、同じ画像は1つのオブジェクトを共有し、一度置いたら書き換えません。
+type iconObjectStorage struct {
+	client *minio.Client
+	bucket string
+	// presign が true なら GET を署名付き URL へのリダイレクトにし、false ならアプリが中継します
+	presign bool
+}
+
+// iconStorage が nil の場合は従来どおり MySQL の icons テーブルから返します。
+var iconStorage *iconObjectStorage
+
+// setupIconStorage は ISUCON13_ICON_S3_ENDPOINT が設定されていればオブジェクトストレージを使うようにします。
+func setupIconStorage() error {
+	endpoint := os.Getenv("ISUCON13_ICON_S3_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+
+	useSSL := false
+	if v, ok := os.LookupEnv("ISUCON13_ICON_S3_USE_SSL"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable 'ISUCON13_ICON_S3_USE_SSL' as bool: %+v", err)
+		}
+		useSSL = b
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("ISUCON13_ICON_S3_ACCESS_KEY"), os.Getenv("ISUCON13_ICON_S3_SECRET_KEY"), ""),
+		Secure: useSSL,
+		Region: os.Getenv("ISUCON13_ICON_S3_REGION"),
+	})
+	if err != nil {
+		return err
+	}
+
+	bucket := "isupipe"
+	if v, ok := os.LookupEnv("ISUCON13_ICON_S3_BUCKET"); ok {
+		bucket = v
+	}
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			return err
+		}
+	}
+
+	iconStorage = &iconObjectStorage{
+		client:  client,
+		bucket:  bucket,
+		presign: os.Getenv("ISUCON13_ICON_S3_MODE") != "proxy",
+	}
+	log.Printf("icon storage: s3 %s/%s (presign=%v)", endpoint, bucket, iconStorage.presign)
+	return nil
+}
+
+func iconObjectKey(hash string) string {
+	return iconObjectPrefix + hash + ".jpg"
+}
+
+// put は画像を content-addressed なキーで保存します。既にあれば何もしません。
+func (s *iconObjectStorage) put(ctx context.Context, hash string, image []byte) error {
+	return s.putObject(ctx, iconObjectKey(hash), "image/jpeg", image)
+}
+
+func (s *iconObjectStorage) presignedURL(ctx context.Context, hash string) (*url.URL, error) {
+	return s.presignedObjectURL(ctx, iconObjectKey(hash))
+}
+
+func (s *iconObjectStorage) open(ctx context.Context, hash string) (io.ReadCloser, error) {
+	return s.openObject(ctx, iconObjectKey(hash))
+}
+
+// putObject などはアイコン以外の画像 (配信のサムネイルなど) でも使います。キーは画像のハッシュから作ること。
+func (s *iconObjectStorage) putObject(ctx context.Context, key, contentType string, image []byte) error {
+	if _, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{}); err == nil {
+		return nil
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(image), int64(len(image)), minio.PutObjectOptions{
+		ContentType:  contentType,
+		CacheControl: "public, max-age=31536000, immutable",
+	})
+	return err
+}
+
+func (s *iconObjectStorage) presignedObjectURL(ctx context.Context, key string) (*url.URL, error) {
+	return s.client.PresignedGetObject(ctx, s.bucket, key, iconPresignExpiry, url.Values{})
+}
+
+func (s *iconObjectStorage) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+}
+
+type iconUploadRow struct {
+	Image []byte `db:"image"`
+	Hash  string `db:"hash"`
+}
+
+// uploadAll は initialize 時に NoImage と既存のアイコンをまとめて置きます。
+func (s *iconObjectStorage) uploadAll(ctx context.Context) error {
+	fallback, err := os.ReadFile(fallbackImage)
+	if err != nil {
+		return err
+	}
+	if err := s.put(ctx, fallbackIconHash(), fallback); err != nil {
+		return err
+	}
+
+	var rows []iconUploadRow
+	if err := dbFor(tableIcons).SelectContext(ctx, &rows, "SELECT image, hash FROM icons"); err != nil {
+		return err
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(iconUploadConcurrency)
+	for _, row := range rows {
+		row := row
+		eg.Go(func() error {
+			return s.put(ctx, row.Hash, row.Image)
+		})
+	}
+	return eg.Wait()
+}
+
+var (
+	fallbackIconHashOnce  sync.Once
+	fallbackIconHashValue string
+)
+
+// fallbackIconHash はアイコン未登録のユーザに返す NoImage の sha256 です。
+func fallbackIconHash() string {
+	fallbackIconHashOnce.Do(func() {
+		image, err := os.ReadFile(fallbackImage)
+		if err != nil {
+			log.Printf("failed to read fallback image: %v", err)
+			return
+		}
+		fallbackIconHashValue = fmt.Sprintf("%x", sha256.Sum256(image))
+	})
+	return fallbackIconHashValue
+}
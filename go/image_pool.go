@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// 画像のデコード (JSON の base64) やハッシュ計算のような CPU を食う処理の同時実行数を絞る
+// アイコンのアップロードが集中しても、他のハンドラの CPU を使い切らないようにする
+var imagePool = newWorkerPool(currentConfig().ImageWorkers)
+
+type workerPool struct {
+	// 大きさを変えるときは新しいチャネルに差し替える (実行中の処理は取得したチャネルに返す)
+	sem atomic.Pointer[chan struct{}]
+
+	waiting   atomic.Int64
+	running   atomic.Int64
+	completed atomic.Int64
+	canceled  atomic.Int64
+	// 空きを待った時間の合計
+	waitNanos atomic.Int64
+}
+
+func newWorkerPool(size int) *workerPool {
+	p := &workerPool{}
+	p.resize(size)
+	return p
+}
+
+// resize は同時実行数を変えます。差し替える前から実行中の処理は数に入らないので、一時的に size を超えることがある
+func (p *workerPool) resize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	if sem := p.sem.Load(); sem != nil && cap(*sem) == size {
+		return
+	}
+	sem := make(chan struct{}, size)
+	p.sem.Store(&sem)
+}
+
+// do は空きができるまで待ってから fn を実行します。
+// 待っている間に ctx がキャンセルされたら fn を実行せずにエラーを返します。
+func (p *workerPool) do(ctx context.Context, fn func()) error {
+	start := time.Now()
+	sem := *p.sem.Load()
+	p.waiting.Add(1)
+	select {
+	case sem <- struct{}{}:
+		p.waiting.Add(-1)
+	case <-ctx.Done():
+		p.waiting.Add(-1)
+		p.canceled.Add(1)
+		return ctx.Err()
+	}
+	p.waitNanos.Add(int64(time.Since(start)))
+	p.running.Add(1)
+	defer func() {
+		p.running.Add(-1)
+		p.completed.Add(1)
+		<-sem
+	}()
+
+	fn()
+	return nil
+}
+
+// tryDo は空きがあれば fn を実行して true を返します。空きがなければ待たずに false を返します。
+func (p *workerPool) tryDo(fn func()) bool {
+	sem := *p.sem.Load()
+	select {
+	case sem <- struct{}{}:
+	default:
+		p.canceled.Add(1)
+		return false
+	}
+	p.running.Add(1)
+	defer func() {
+		p.running.Add(-1)
+		p.completed.Add(1)
+		<-sem
+	}()
+
+	fn()
+	return true
+}
+
+type WorkerPoolStats struct {
+	Size          int     `json:"size"`
+	Waiting       int64   `json:"waiting"`
+	Running       int64   `json:"running"`
+	Completed     int64   `json:"completed"`
+	Canceled      int64   `json:"canceled"`
+	AverageWaitMS float64 `json:"average_wait_ms"`
+}
+
+func (p *workerPool) stats() WorkerPoolStats {
+	s := WorkerPoolStats{
+		Size:      cap(*p.sem.Load()),
+		Waiting:   p.waiting.Load(),
+		Running:   p.running.Load(),
+		Completed: p.completed.Load(),
+		Canceled:  p.canceled.Load(),
+	}
+	if started := s.Completed + s.Running; started > 0 {
+		s.AverageWaitMS = durationMS(time.Duration(p.waitNanos.Load() / started))
+	}
+	return s
+}
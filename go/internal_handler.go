@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// /api/initialize のうち、DB の初期化後にサーバごとに必要な処理
+// ベンチマーカーの initialize は 1 台にしか来ないので、他のサーバはこれらを個別に叩いて同じ状態にする
+
+// rebuildCounters は視聴履歴ストア (Redis やプロセス内のスケッチ) を MySQL から作り直します。
+// initialize 前に溜めていた入室は作り直したテーブルには不要なので捨てる
+func rebuildCounters(ctx context.Context) error {
+	discardViewerHistoryBuffer()
+	return viewerHistory.rebuild(ctx)
+}
+
+// rebuildDNSState は DNS のサブドメイン一覧と応答キャッシュを初期状態に戻します。
+func rebuildDNSState() {
+	resetSubdomains()
+	rrCache = sync.Map{}
+	dnsMetrics.reset()
+	dnsNXDomainLimiter.reset()
+	dnsOutbox.reset()
+}
+
+// resetCaches はプロセス内のキャッシュ・レートリミッタ・メトリクスを捨てます。
+func resetCaches() {
+	resetChatFilters()
+	resetPrivacySettingsCache()
+	resetLivestreamSettingsCache()
+	resetLivestreamBans()
+	resetModerationSummaries()
+	reportUserLimiter.reset()
+	reportIPLimiter.reset()
+	resetActiveSessions()
+	resetAPITokens()
+	recommendations.reset()
+	resetHomeCache()
+	livestreamTagIndex.reset()
+	livestreamRegistryCache.reset()
+	livecommentRings.reset()
+	reactionRings.reset()
+	usernameIndex.reset()
+	userSuspensions.reset()
+	livecommentCounters.reset()
+	metrics.reset()
+	livestreamActivity.reset()
+	tagStats.reset()
+	scoreEstimate.reset()
+	markInitialized()
+}
+
+type InternalTaskResponse struct {
+	Task      string  `json:"task"`
+	Result    string  `json:"result"`
+	ElapsedMS float64 `json:"elapsed_ms"`
+}
+
+func runInternalTask(c echo.Context, name string, run func(ctx context.Context) (string, error)) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	out, err := run(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to "+name+": "+err.Error())
+	}
+	return c.JSON(http.StatusOK, &InternalTaskResponse{
+		Task:      name,
+		Result:    out,
+		ElapsedMS: durationMS(time.Since(start)),
+	})
+}
+
+// キャッシュ初期化・ウォームアップAPI
+// POST /internal/warm/caches
+func postInternalWarmCachesHandler(c echo.Context) error {
+	return runInternalTask(c, "warm caches", func(ctx context.Context) (string, error) {
+		resetCaches()
+		return warmCachesTask(ctx)
+	})
+}
+
+// カウンタ再構築API
+// POST /internal/rebuild/counters
+func postInternalRebuildCountersHandler(c echo.Context) error {
+	return runInternalTask(c, "rebuild counters", func(ctx context.Context) (string, error) {
+		if err := rebuildCounters(ctx); err != nil {
+			return "", err
+		}
+		return "viewer history rebuilt", nil
+	})
+}
+
+// DNS 初期化API
+// POST /internal/rebuild/dns
+func postInternalRebuildDNSHandler(c echo.Context) error {
+	return runInternalTask(c, "rebuild dns", func(ctx context.Context) (string, error) {
+		rebuildDNSState()
+		return "subdomains reset", nil
+	})
+}
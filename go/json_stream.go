@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+// c.JSON の書き出し
+// echo の標準の JSONSerializer はレスポンス全体をメモリ上でエンコードしてから書き出すので、
+// アイコンの一覧やライブコメントの全履歴のような大きな配列ではその分だけメモリを使う。
+// 要素数が設定の json_stream_threshold を超える配列は 1 要素ずつエンコードして書き出す (出力は同じ)。
+// リクエストごとにエンコードのためにメモリに載せた最大のバイト数を数え、/debug/stats に出す
+type boundedJSONSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+// エンコードに使うバッファはプールで使い回す。大きくなりすぎたものはプールに戻さずに捨てる
+const jsonBufferPoolMaxCap = 1 << 20
+
+type jsonBufferPoolStats struct {
+	gets   atomic.Int64
+	misses atomic.Int64
+}
+
+var (
+	jsonBufferStats jsonBufferPoolStats
+	jsonBufferPool  = sync.Pool{
+		New: func() interface{} {
+			jsonBufferStats.misses.Add(1)
+			return new(bytes.Buffer)
+		},
+	}
+)
+
+func getJSONBuffer() *bytes.Buffer {
+	jsonBufferStats.gets.Add(1)
+	buf := jsonBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putJSONBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > jsonBufferPoolMaxCap {
+		return
+	}
+	jsonBufferPool.Put(buf)
+}
+
+type JSONBufferPoolStatsResponse struct {
+	Gets     int64   `json:"gets"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+func (s *jsonBufferPoolStats) snapshot() JSONBufferPoolStatsResponse {
+	gets, misses := s.gets.Load(), s.misses.Load()
+	res := JSONBufferPoolStatsResponse{Gets: gets, Misses: misses, Hits: max(gets-misses, 0)}
+	if gets > 0 {
+		res.HitRatio = float64(res.Hits) / float64(gets)
+	}
+	return res
+}
+
+func (s *jsonBufferPoolStats) reset() {
+	s.gets.Store(0)
+	s.misses.Store(0)
+}
+
+type responseBufferKey struct{}
+
+// recordResponseBuffer はリクエストのコンテキストに紐づく、エンコードのためにメモリに載せたバイト数の最大値を更新します。
+func recordResponseBuffer(ctx context.Context, n int64) {
+	peak, ok := ctx.Value(responseBufferKey{}).(*int64)
+	if !ok {
+		return
+	}
+	for {
+		cur := atomic.LoadInt64(peak)
+		if n <= cur || atomic.CompareAndSwapInt64(peak, cur, n) {
+			return
+		}
+	}
+}
+
+func (s boundedJSONSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	ctx := c.Request().Context()
+
+	if threshold := currentConfig().JSONStreamThreshold; threshold > 0 && indent == "" {
+		v := reflect.ValueOf(i)
+		for v.Kind() == reflect.Pointer && !v.IsNil() {
+			v = v.Elem()
+		}
+		if v.Kind() == reflect.Slice && !v.IsNil() && v.Len() > threshold {
+			return streamJSONArray(ctx, c, v)
+		}
+	}
+
+	buf := getJSONBuffer()
+	defer putJSONBuffer(buf)
+	enc := json.NewEncoder(buf)
+	if indent != "" {
+		enc.SetIndent("", indent)
+	}
+	if err := enc.Encode(i); err != nil {
+		return err
+	}
+	recordResponseBuffer(ctx, int64(buf.Len()))
+	_, err := c.Response().Write(buf.Bytes())
+	return err
+}
+
+// streamJSONArray は配列を 1 要素ずつエンコードして書き出します。
+func streamJSONArray(ctx context.Context, c echo.Context, v reflect.Value) error {
+	w := c.Response()
+	buf := getJSONBuffer()
+	defer putJSONBuffer(buf)
+	enc := json.NewEncoder(buf)
+
+	buf.WriteByte('[')
+	for k := 0; k < v.Len(); k++ {
+		if k > 0 {
+			buf.WriteByte(',')
+		}
+		if err := enc.Encode(v.Index(k).Interface()); err != nil {
+			return err
+		}
+		// Encode が付ける改行を除く
+		buf.Truncate(buf.Len() - 1)
+		recordResponseBuffer(ctx, int64(buf.Len()))
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		buf.Reset()
+	}
+	buf.WriteString("]\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ライブコメントの投稿ごとに更新していたカウンタ (メトリクス・人気のタグ・スコアの概算) の更新をまとめる
+// 投稿のたびに 3 つのロックを取る代わりに、配信ごとの投げ銭の合計だけを溜めて livecommentCounterFlushInterval ごとに反映する。
+// どれも監視・集計用なので、この間隔だけ遅れても困らない
+const livecommentCounterFlushInterval = 100 * time.Millisecond
+
+type livecommentCounterBatch struct {
+	mu sync.Mutex
+	// 配信ごとの投げ銭の合計 (投げ銭なしのコメントも 0 として入れる)
+	tips map[int64]int64
+	// 投げ銭のあったコメントの数と合計
+	tipped   int64
+	tipTotal int64
+	// 反映し終えたマップを使い回す (投稿のたびにマップを作らないように)
+	spare map[int64]int64
+}
+
+var livecommentCounters = &livecommentCounterBatch{
+	tips:  map[int64]int64{},
+	spare: map[int64]int64{},
+}
+
+func (b *livecommentCounterBatch) add(livestreamID, tip int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tips[livestreamID] += tip
+	if tip > 0 {
+		b.tipped++
+		b.tipTotal += tip
+	}
+}
+
+// reset は initialize 時に呼び、溜めている分を捨てます。
+func (b *livecommentCounterBatch) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.tips)
+	b.tipped = 0
+	b.tipTotal = 0
+}
+
+// flush は溜めている分を各カウンタに反映します。
+func (b *livecommentCounterBatch) flush() {
+	b.mu.Lock()
+	tips, tipped, tipTotal := b.tips, b.tipped, b.tipTotal
+	b.tips, b.spare = b.spare, nil
+	b.tipped = 0
+	b.tipTotal = 0
+	b.mu.Unlock()
+
+	for livestreamID, tip := range tips {
+		metrics.recordTip(livestreamID, tip)
+		livestreamActivity.add(livestreamID, tip)
+	}
+	scoreEstimate.recordTips(tipTotal, tipped)
+
+	clear(tips)
+	b.mu.Lock()
+	b.spare = tips
+	b.mu.Unlock()
+}
+
+func runLivecommentCounterFlusher() {
+	ticker := time.NewTicker(livecommentCounterFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		livecommentCounters.flush()
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+type PatchLivecommentRequest struct {
+	Comment string `json:"comment"`
+	// 投げ銭の額は変えられない。指定するなら今の額と同じであること
+	Tip *int64 `json:"tip"`
+}
+
+// 編集前の本文の履歴
+type LivecommentEditModel struct {
+	ID            int64  `db:"id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	Comment       string `db:"comment"`
+	EditedAt      int64  `db:"edited_at"`
+}
+
+type LivecommentEdit struct {
+	ID int64 `json:"id"`
+	// 編集前の本文
+	Comment  string `json:"comment"`
+	EditedAt int64  `json:"edited_at"`
+}
+
+// ライブコメント編集API (投稿者のみ)
+// PATCH /api/livestream/:livestream_id/livecomment/:livecomment_id
+// 投稿から設定の livecomment_edit_window の間だけ本文を変えられる。投げ銭の額は変えられない
+func patchLivecommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := verifyNotBanned(ctx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	var req PatchLivecommentRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	var (
+		livecommentModel LivecommentModel
+		livecomment      Livecomment
+		edited           bool
+	)
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ? AND deleted_at IS NULL FOR UPDATE", livecommentID, livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+			}
+		}
+		if livecommentModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't edit other user's livecomment")
+		}
+		now := time.Now().Unix()
+		if window := currentConfig().LivecommentEditWindow.duration(); now-livecommentModel.CreatedAt > int64(window/time.Second) {
+			return echo.NewHTTPError(http.StatusForbidden, "livecomment can no longer be edited")
+		}
+		if req.Tip != nil && *req.Tip != livecommentModel.Tip {
+			return echo.NewHTTPError(http.StatusBadRequest, "tip can't be changed")
+		}
+
+		if req.Comment != livecommentModel.Comment {
+			livestreamModel, ok, err := livestreamRegistryCache.get(ctx, livecommentModel.LivestreamID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			}
+			if !ok {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			}
+
+			// 投稿と同じ判定をする
+			settings, err := getLivestreamSettings(ctx, livestreamModel.ID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream settings: "+err.Error())
+			}
+			if settings.EmojiOnlyChat && !isEmojiOnlyComment(req.Comment) {
+				return echo.NewHTTPError(http.StatusForbidden, "this livestream accepts emoji-only livecomments")
+			}
+			var ngwords []*NGWord
+			if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+			}
+			hitSpam, err := countNGWordHits(ctx, tx, req.Comment, ngwords)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get hitspam: "+err.Error())
+			}
+			if hitSpam >= 1 {
+				c.Logger().Infof("[hitSpam=%d] comment = %s", hitSpam, req.Comment)
+				return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
+			}
+
+			if _, err := tx.ExecContext(ctx, "INSERT INTO livecomment_edits (livecomment_id, comment, edited_at) VALUES (?, ?, ?)", livecommentModel.ID, livecommentModel.Comment, now); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment edit: "+err.Error())
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE livecomments SET comment = ?, edited_at = ? WHERE id = ?", req.Comment, now, livecommentModel.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livecomment: "+err.Error())
+			}
+			livecommentModel.Comment = req.Comment
+			livecommentModel.EditedAt = sql.NullInt64{Int64: now, Valid: true}
+			edited = true
+		}
+
+		var err error
+		livecomment, err = fillLivecommentResponse(ctx, tx, livecommentModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	if edited {
+		livecommentRings.update(livecommentModel.LivestreamID, livecommentModel)
+		// NGワードにヒットするコメントの集計 (moderation_summary.go) が変わりうる
+		moderationSummaries.Delete(livecommentModel.LivestreamID)
+		// 保留中のコメントはまだ配信していない
+		if !livecomment.Held {
+			hub.publish(livecommentModel.LivestreamID, HubMessage{
+				Type: hubMessageLivecommentEdit,
+				Data: livecomment,
+			})
+		}
+	}
+
+	return c.JSON(http.StatusOK, livecomment)
+}
+
+// ライブコメント編集履歴API (投稿者と配信者のみ)
+// GET /api/livestream/:livestream_id/livecomment/:livecomment_id/edits
+// 編集前の本文を新しい順に返す
+func getLivecommentEditsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livecommentModel LivecommentModel
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ?", livecommentID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+		}
+	}
+	if livecommentModel.UserID != userID {
+		livestreamModel, ok, err := livestreamRegistryCache.get(ctx, livecommentModel.LivestreamID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		if !ok || livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't get edits of other user's livecomment")
+		}
+	}
+
+	var editModels []LivecommentEditModel
+	if err := tx.SelectContext(ctx, &editModels, "SELECT * FROM livecomment_edits WHERE livecomment_id = ? ORDER BY id DESC", livecommentModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment edits: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	edits := make([]LivecommentEdit, len(editModels))
+	for i := range editModels {
+		edits[i] = LivecommentEdit{
+			ID:       editModels[i].ID,
+			Comment:  editModels[i].Comment,
+			EditedAt: editModels[i].EditedAt,
+		}
+	}
+	return c.JSON(http.StatusOK, edits)
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -20,6 +22,24 @@ type PostLivecommentRequest struct {
 	Tip     int64  `json:"tip"`
 }
 
+// ライブコメントの投稿はベンチマーカーから最も多く呼ばれるので、リクエスト・レスポンスの構造体を使い回す
+// (レスポンスは配信に流すときに値でコピーするので、返し終えたら戻してよい)
+var (
+	postLivecommentRequestPool = sync.Pool{
+		New: func() interface{} { return new(PostLivecommentRequest) },
+	}
+	postLivecommentResponsePool = sync.Pool{
+		New: func() interface{} { return new(Livecomment) },
+	}
+)
+
+// 削除理由
+const (
+	livecommentDeleteReasonNGWord = "ng_word"
+	livecommentDeleteReasonOwner  = "owner"
+	livecommentDeleteReasonVacuum = "vacuum_spam"
+)
+
 type LivecommentModel struct {
 	ID           int64  `db:"id"`
 	UserID       int64  `db:"user_id"`
@@ -27,6 +47,15 @@ type LivecommentModel struct {
 	Comment      string `db:"comment"`
 	Tip          int64  `db:"tip"`
 	CreatedAt    int64  `db:"created_at"`
+	// 論理削除 (削除されていなければ NULL)
+	DeletedAt    sql.NullInt64  `db:"deleted_at"`
+	DeletedBy    sql.NullInt64  `db:"deleted_by"`
+	DeleteReason sql.NullString `db:"delete_reason"`
+	// 0 から 1。配信の spam_hold_threshold 以上なら保留され、配信者が承認するまで表示しない
+	SpamScore float64       `db:"spam_score"`
+	HeldAt    sql.NullInt64 `db:"held_at"`
+	// 投稿者が最後に編集した時刻 (編集されていなければ NULL)
+	EditedAt sql.NullInt64 `db:"edited_at"`
 }
 
 type Livecomment struct {
@@ -35,7 +64,41 @@ type Livecomment struct {
 	Livestream Livestream `json:"livestream"`
 	Comment    string     `json:"comment"`
 	Tip        int64      `json:"tip"`
-	CreatedAt  int64      `json:"created_at"`
+	// 投げ銭の段階。投げ銭がなければ null
+	TipTier   *TipTier `json:"tip_tier"`
+	CreatedAt int64    `json:"created_at"`
+	SpamScore float64  `json:"spam_score"`
+	// 保留中 (配信者の承認待ち) なら true
+	Held bool `json:"held,omitempty"`
+	// 投稿者が最後に編集した時刻。編集されていなければ省略
+	EditedAt *int64 `json:"edited_at,omitempty"`
+}
+
+type DeletedLivecomment struct {
+	Livecomment Livecomment `json:"livecomment"`
+	DeletedAt   int64       `json:"deleted_at"`
+	DeletedBy   int64       `json:"deleted_by"`
+	Reason      string      `json:"reason"`
+}
+
+type DeleteLivecommentRequest struct {
+	Reason string `json:"reason"`
+}
+
+// 通報の対応状況
+const (
+	livecommentReportStatusOpen      = "open"
+	livecommentReportStatusReviewed  = "reviewed"
+	livecommentReportStatusDismissed = "dismissed"
+	livecommentReportStatusActioned  = "actioned"
+)
+
+func isValidLivecommentReportStatus(status string) bool {
+	switch status {
+	case livecommentReportStatusOpen, livecommentReportStatusReviewed, livecommentReportStatusDismissed, livecommentReportStatusActioned:
+		return true
+	}
+	return false
 }
 
 type LivecommentReport struct {
@@ -43,20 +106,45 @@ type LivecommentReport struct {
 	Reporter    User        `json:"reporter"`
 	Livecomment Livecomment `json:"livecomment"`
 	CreatedAt   int64       `json:"created_at"`
+	Status      string      `json:"status"`
+	ReviewedAt  *int64      `json:"reviewed_at,omitempty"`
 }
 
 type LivecommentReportModel struct {
-	ID            int64 `db:"id"`
-	UserID        int64 `db:"user_id"`
-	LivestreamID  int64 `db:"livestream_id"`
-	LivecommentID int64 `db:"livecomment_id"`
-	CreatedAt     int64 `db:"created_at"`
+	ID            int64         `db:"id"`
+	UserID        int64         `db:"user_id"`
+	LivestreamID  int64         `db:"livestream_id"`
+	LivecommentID int64         `db:"livecomment_id"`
+	CreatedAt     int64         `db:"created_at"`
+	Status        string        `db:"status"`
+	ReviewedBy    sql.NullInt64 `db:"reviewed_by"`
+	ReviewedAt    sql.NullInt64 `db:"reviewed_at"`
 }
 
+type PutLivecommentReportStatusRequest struct {
+	Status string `json:"status"`
+}
+
+// 通報によるライバル配信者への嫌がらせを防ぐため、1分あたりの通報数をユーザごと・IPごとに制限する
+// 上限は設定 (config.go) の report_limit_per_user / report_limit_per_ip で指定する。デフォルトの 0 なら制限しない
+var (
+	reportUserLimiter = newRateLimiter(currentConfig().ReportLimitPerUser, time.Minute)
+	reportIPLimiter   = newRateLimiter(currentConfig().ReportLimitPerIP, time.Minute)
+)
+
 type ModerateRequest struct {
 	NGWord string `json:"ng_word"`
 }
 
+type ImportNGWordsRequest struct {
+	NGWords []string `json:"ng_words"`
+}
+
+type ImportNGWordsResponse struct {
+	Imported int   `json:"imported"`
+	Deleted  int64 `json:"deleted"`
+}
+
 type NGWord struct {
 	ID           int64  `json:"id" db:"id"`
 	UserID       int64  `json:"user_id" db:"user_id"`
@@ -84,17 +172,103 @@ func getLivecommentsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
+	filter, err := sessionChatFilter(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get chat preferences: "+err.Error())
+	}
+
+	// 視聴者の表示設定のうち SQL で絞れるものは SQL で絞る
+	query := "SELECT * FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL AND held_at IS NULL"
+	args := []interface{}{livestreamID}
+	if filter != nil {
+		if filter.minTip > 0 {
+			query += " AND NOT (tip > 0 AND tip < ?)"
+			args = append(args, filter.minTip)
+		}
+		for hiddenUserID := range filter.hiddenUserIDs {
+			query += " AND user_id != ?"
+			args = append(args, hiddenUserID)
+		}
+		for blockedUserID := range filter.blockedUserIDs {
+			query += " AND user_id != ?"
+			args = append(args, blockedUserID)
+		}
+	}
+	// ?before=<livecomment_id> ならそれより前のコメント (履歴) を返す
+	before := c.QueryParam("before")
+	if before != "" {
+		beforeID, err := strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	query += " ORDER BY created_at DESC"
+	// 絵文字だけのコメントかどうかは SQL では絞れないので、その設定のときは LIMIT を付けずに
+	// 読みながら絞り込み、limit 件集まったところで打ち切る
+	overFetch := filter != nil && filter.emojiOnly
+	limit := -1
 	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
 		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+		if !overFetch || limit < 0 {
+			query += fmt.Sprintf(" LIMIT %d", limit)
+		}
+	}
+
+	// 最新のコメントはメモリに持っている分から返す (recent_ring.go)
+	if before == "" && limit >= -1 && !wantsNDJSON(c) {
+		models, ok, err := livecommentRings.latest(ctx, int64(livestreamID), limit, func(m *LivecommentModel) bool {
+			return filter.visible(m.UserID, m.Tip, m.Comment)
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+		if ok {
+			return respondLivecomments(c, tx, filter, models)
+		}
+	}
+
+	if wantsNDJSON(c) {
+		rows, err := dbConn.QueryxContext(ctx, query, args...)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+		// LIMIT を付けずに読んでいるときは、表示するものが limit 件になったところで打ち切る
+		remaining := -1
+		if overFetch {
+			remaining = limit
+		}
+		return streamNDJSON(c, rows, func(models []LivecommentModel) ([]Livecomment, error) {
+			visibleModels := make([]LivecommentModel, 0, len(models))
+			for i := range models {
+				if remaining == 0 {
+					break
+				}
+				if filter.visible(models[i].UserID, models[i].Tip, models[i].Comment) {
+					visibleModels = append(visibleModels, models[i])
+					if remaining > 0 {
+						remaining--
+					}
+				}
+			}
+			return fillLivecommentResponses(ctx, tx, visibleModels)
+		})
+	}
+
+	if overFetch && limit >= 0 {
+		livecommentModels, err := selectVisibleLivecomments(ctx, tx, filter, limit, query, args...)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+		return respondLivecomments(c, tx, filter, livecommentModels)
 	}
 
 	livecommentModels := []LivecommentModel{}
-	err = tx.SelectContext(ctx, &livecommentModels, query, livestreamID)
+	err = tx.SelectContext(ctx, &livecommentModels, query, args...)
 	if errors.Is(err, sql.ErrNoRows) {
 		return c.JSON(http.StatusOK, []*Livecomment{})
 	}
@@ -102,14 +276,44 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
 
-	livecomments := make([]Livecomment, len(livecommentModels))
-	for i := range livecommentModels {
-		livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
+	return respondLivecomments(c, tx, filter, livecommentModels)
+}
+
+// selectVisibleLivecomments は query の結果を先頭から読み、視聴者に表示するものを limit 件まで返します。
+func selectVisibleLivecomments(ctx context.Context, tx *sqlx.Tx, filter *chatFilter, limit int, query string, args ...interface{}) ([]LivecommentModel, error) {
+	rows, err := tx.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	livecommentModels := make([]LivecommentModel, 0, limit)
+	for len(livecommentModels) < limit && rows.Next() {
+		var m LivecommentModel
+		if err := rows.StructScan(&m); err != nil {
+			return nil, err
 		}
+		if filter.visible(m.UserID, m.Tip, m.Comment) {
+			livecommentModels = append(livecommentModels, m)
+		}
+	}
+	return livecommentModels, rows.Err()
+}
 
-		livecomments[i] = livecomment
+// respondLivecomments は視聴者の表示設定で絞り込んだライブコメント一覧を返します。
+func respondLivecomments(c echo.Context, tx *sqlx.Tx, filter *chatFilter, livecommentModels []LivecommentModel) error {
+	ctx := c.Request().Context()
+
+	visibleModels := make([]LivecommentModel, 0, len(livecommentModels))
+	for i := range livecommentModels {
+		if !filter.visible(livecommentModels[i].UserID, livecommentModels[i].Tip, livecommentModels[i].Comment) {
+			continue
+		}
+		visibleModels = append(visibleModels, livecommentModels[i])
+	}
+	livecomments, err := fillLivecommentResponses(ctx, tx, visibleModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -176,83 +380,149 @@ func postLivecommentHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var req *PostLivecommentRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := verifyNotBanned(ctx, int64(livestreamID), userID); err != nil {
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	// リクエストボディは JSON のエンコードと同じプールのバッファに読む
+	body := getJSONBuffer()
+	defer putJSONBuffer(body)
+	if _, err := body.ReadFrom(c.Request().Body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read the request body")
+	}
+	req := postLivecommentRequestPool.Get().(*PostLivecommentRequest)
+	*req = PostLivecommentRequest{}
+	defer postLivecommentRequestPool.Put(req)
+	if err := json.Unmarshal(body.Bytes(), req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
-	defer tx.Rollback()
 
-	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
-		} else {
+	livecomment := postLivecommentResponsePool.Get().(*Livecomment)
+	*livecomment = Livecomment{}
+	defer postLivecommentResponsePool.Put(livecomment)
+
+	var livecommentModel LivecommentModel
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		livestreamModel, ok, err := livestreamRegistryCache.get(ctx, int64(livestreamID))
+		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
-	}
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
 
-	// スパム判定
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
-	}
+		// 絵文字のみモードの配信ではテキストのコメントを受け付けない
+		settings, err := getLivestreamSettings(ctx, livestreamModel.ID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream settings: "+err.Error())
+		}
+		if settings.EmojiOnlyChat && !isEmojiOnlyComment(req.Comment) {
+			return echo.NewHTTPError(http.StatusForbidden, "this livestream accepts emoji-only livecomments")
+		}
+		if err := validateTip(ctx, tx, settings, userID, req.Tip); err != nil {
+			return err
+		}
 
-	var hitSpam int
-	for _, ngword := range ngwords {
-		query := `
-		SELECT COUNT(*)
-		FROM
-		(SELECT ? AS text) AS texts
-		INNER JOIN
-		(SELECT CONCAT('%', ?, '%')	AS pattern) AS patterns
-		ON texts.text LIKE patterns.pattern;
-		`
-		if err := tx.GetContext(ctx, &hitSpam, query, req.Comment, ngword.Word); err != nil {
+		// スパム判定
+		var ngwords []*NGWord
+		if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+		}
+
+		hitSpam, err := countNGWordHits(ctx, tx, req.Comment, ngwords)
+		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get hitspam: "+err.Error())
 		}
-		c.Logger().Infof("[hitSpam=%d] comment = %s", hitSpam, req.Comment)
 		if hitSpam >= 1 {
+			c.Logger().Infof("[hitSpam=%d] comment = %s", hitSpam, req.Comment)
 			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
 		}
-	}
 
-	now := time.Now().Unix()
-	livecommentModel := LivecommentModel{
-		UserID:       userID,
-		LivestreamID: int64(livestreamID),
-		Comment:      req.Comment,
-		Tip:          req.Tip,
-		CreatedAt:    now,
-	}
+		now := time.Now().Unix()
+		score, err := spamScore(ctx, tx, userID, livestreamModel.ID, req.Comment, ngwords, now)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to score livecomment: "+err.Error())
+		}
+		livecommentModel = LivecommentModel{
+			UserID:       userID,
+			LivestreamID: int64(livestreamID),
+			Comment:      req.Comment,
+			Tip:          req.Tip,
+			CreatedAt:    now,
+			SpamScore:    score,
+		}
+		if settings.SpamHoldThreshold > 0 && score >= settings.SpamHoldThreshold {
+			livecommentModel.HeldAt = sql.NullInt64{Int64: now, Valid: true}
+		}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecommentModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
-	}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at, spam_score, held_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at, :spam_score, :held_at)", livecommentModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
+		}
 
-	livecommentID, err := rs.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
-	}
-	livecommentModel.ID = livecommentID
+		livecommentID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
+		}
+		livecommentModel.ID = livecommentID
 
-	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
-	}
+		filled, err := fillLivecommentResponse(ctx, tx, livecommentModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+		}
+		*livecomment = filled
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
+	}
+	livecommentCounters.add(livecommentModel.LivestreamID, livecommentModel.Tip)
+	addLivecommentToRing(livecommentModel)
+	// 保留したコメントは承認されたときに配信する
+	if !livecomment.Held {
+		hub.publish(livecommentModel.LivestreamID, HubMessage{
+			Type: hubMessageLivecomment,
+			Data: *livecomment,
+		})
 	}
 
 	return c.JSON(http.StatusCreated, livecomment)
 }
 
+// countNGWordHits はコメントに含まれる NGワードの数を返します。
+// 照合順序による大文字小文字などの扱いを変えないよう、判定は今まで通り MySQL の LIKE で行うが、
+// NGワードごとに問い合わせずに 1 回のクエリでまとめて数える
+func countNGWordHits(ctx context.Context, tx *sqlx.Tx, comment string, ngwords []*NGWord) (int, error) {
+	if len(ngwords) == 0 {
+		return 0, nil
+	}
+	var query strings.Builder
+	query.Grow(len(ngwordHitQueryHead) + len(ngwords)*len(ngwordHitQueryPattern) + len(ngwordHitQueryTail))
+	query.WriteString(ngwordHitQueryHead)
+	args := make([]interface{}, 0, len(ngwords)+1)
+	args = append(args, comment)
+	for i, ngword := range ngwords {
+		if i > 0 {
+			query.WriteString(" UNION ALL ")
+		}
+		query.WriteString(ngwordHitQueryPattern)
+		args = append(args, ngword.Word)
+	}
+	query.WriteString(ngwordHitQueryTail)
+
+	var hits int
+	if err := tx.GetContext(ctx, &hits, query.String(), args...); err != nil {
+		return 0, err
+	}
+	return hits, nil
+}
+
+const (
+	ngwordHitQueryHead    = "SELECT COUNT(*) FROM (SELECT ? AS text) AS texts INNER JOIN ("
+	ngwordHitQueryPattern = "SELECT CONCAT('%', ?, '%') AS pattern"
+	ngwordHitQueryTail    = ") AS patterns ON texts.text LIKE patterns.pattern"
+)
+
 func reportLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -275,56 +545,152 @@ func reportLivecommentHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	if ok, retryAfter := reportUserLimiter.allow(strconv.FormatInt(userID, 10)); !ok {
+		return tooManyRequests(c, retryAfter, "too many reports from this user")
+	}
+	if ok, retryAfter := reportIPLimiter.allow(c.RealIP()); !ok {
+		return tooManyRequests(c, retryAfter, "too many reports from this address")
 	}
-	defer tx.Rollback()
 
-	var livestreamModel LivestreamModel
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	var report LivecommentReport
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			}
 		}
-	}
 
-	var livecommentModel LivecommentModel
-	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", livecommentID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+		var livecommentModel LivecommentModel
+		if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND deleted_at IS NULL", livecommentID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+			}
+		}
+
+		now := time.Now().Unix()
+		reportModel := LivecommentReportModel{
+			UserID:        int64(userID),
+			LivestreamID:  int64(livestreamID),
+			LivecommentID: int64(livecommentID),
+			CreatedAt:     now,
+			Status:        livecommentReportStatusOpen,
+		}
+		// 同じユーザは同じコメントを一度しか通報できない
+		rs, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusConflict, "already reported this livecomment")
+		}
+		reportID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment report id: "+err.Error())
+		}
+		reportModel.ID = reportID
+
+		report, err = fillLivecommentReportResponse(ctx, tx, reportModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
 		}
+
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	now := time.Now().Unix()
-	reportModel := LivecommentReportModel{
-		UserID:        int64(userID),
-		LivestreamID:  int64(livestreamID),
-		LivecommentID: int64(livecommentID),
-		CreatedAt:     now,
+	return c.JSON(http.StatusCreated, report)
+}
+
+// 通報の対応状況更新API (配信者のみ)
+// PUT /api/livestream/:livestream_id/report/:report_id
+func putLivecommentReportStatusHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
 	}
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
-	reportID, err := rs.LastInsertId()
+
+	reportID, err := strconv.Atoi(c.Param("report_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment report id: "+err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, "report_id in path must be integer")
 	}
-	reportModel.ID = reportID
 
-	report, err := fillLivecommentReportResponse(ctx, tx, reportModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PutLivecommentReportStatusRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	if !isValidLivecommentReportStatus(req.Status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "status must be one of open, reviewed, dismissed, actioned")
 	}
 
-	return c.JSON(http.StatusCreated, report)
+	var report LivecommentReport
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			}
+		}
+		if livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't update other streamer's livecomment reports")
+		}
+
+		var reportModel LivecommentReportModel
+		if err := tx.GetContext(ctx, &reportModel, "SELECT * FROM livecomment_reports WHERE id = ? AND livestream_id = ? FOR UPDATE", reportID, livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livecomment report not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment report: "+err.Error())
+			}
+		}
+
+		// open に戻す場合は対応記録も消す
+		reportModel.Status = req.Status
+		if req.Status == livecommentReportStatusOpen {
+			reportModel.ReviewedBy = sql.NullInt64{}
+			reportModel.ReviewedAt = sql.NullInt64{}
+		} else {
+			reportModel.ReviewedBy = sql.NullInt64{Int64: userID, Valid: true}
+			reportModel.ReviewedAt = sql.NullInt64{Int64: time.Now().Unix(), Valid: true}
+		}
+		if _, err := tx.NamedExecContext(ctx, "UPDATE livecomment_reports SET status = :status, reviewed_by = :reviewed_by, reviewed_at = :reviewed_at WHERE id = :id", &reportModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livecomment report: "+err.Error())
+		}
+
+		var err error
+		report, err = fillLivecommentReportResponse(ctx, tx, reportModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	moderationSummaries.Delete(int64(livestreamID))
+
+	return c.JSON(http.StatusOK, report)
 }
 
 // NGワードを登録
@@ -351,78 +717,302 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	var wordID int64
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		// 配信者自身の配信に対するmoderateなのかを検証
+		var ownedLivestreams []LivestreamModel
+		if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		if len(ownedLivestreams) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
+		}
+
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
+			UserID:       int64(userID),
+			LivestreamID: int64(livestreamID),
+			Word:         req.NGWord,
+			CreatedAt:    time.Now().Unix(),
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
+		}
+
+		wordID, err = rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
+		}
+
+		var ngwords []*NGWord
+		if err := tx.SelectContext(ctx, &ngwords, "SELECT * FROM ng_words WHERE livestream_id = ?", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+		}
+
+		// NGワードにヒットする過去の投稿も全削除する (論理削除)
+		now := time.Now().Unix()
+		for _, ngword := range ngwords {
+			// ライブコメント一覧取得
+			var livecomments []*LivecommentModel
+			if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE deleted_at IS NULL"); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+			}
+
+			for _, livecomment := range livecomments {
+				query := `
+				UPDATE livecomments
+				SET deleted_at = ?, deleted_by = ?, delete_reason = ?
+				WHERE
+				id = ? AND
+				livestream_id = ? AND
+				(SELECT COUNT(*)
+				FROM
+				(SELECT ? AS text) AS texts
+				INNER JOIN
+				(SELECT CONCAT('%', ?, '%')	AS pattern) AS patterns
+				ON texts.text LIKE patterns.pattern) >= 1;
+				`
+				if _, err := tx.ExecContext(ctx, query, now, userID, livecommentDeleteReasonNGWord, livecomment.ID, livestreamID, livecomment.Comment, ngword.Word); err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+				}
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	invalidateLivecommentRing(int64(livestreamID))
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"word_id": wordID,
+	})
+}
+
+// NGワード一括登録API (配信者のみ)
+// POST /api/livestream/:livestream_id/moderate/import
+// 他の配信で使っている NG ワードをまとめて持ち込むためのもので、1 件ずつの moderate と同じく過去の投稿も削除する
+func importNGWordsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
-	defer tx.Rollback()
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ImportNGWordsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
-	if len(ownedLivestreams) == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
+
+	now := time.Now().Unix()
+	seen := make(map[string]struct{}, len(req.NGWords))
+	ngwords := make([]NGWord, 0, len(req.NGWords))
+	for _, word := range req.NGWords {
+		if _, ok := seen[word]; word == "" || ok {
+			continue
+		}
+		seen[word] = struct{}{}
+		ngwords = append(ngwords, NGWord{
+			UserID:       userID,
+			LivestreamID: int64(livestreamID),
+			Word:         word,
+			CreatedAt:    now,
+		})
+	}
+	if len(ngwords) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "ng_words must not be empty")
+	}
+
+	var deleted int64
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		deleted = 0
+
+		var ownerID int64
+		if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		if ownerID != userID {
+			return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
+		}
+
+		if err := bulkInsert(ctx, tx, "INSERT INTO ng_words (user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", ngwords); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert NG words: "+err.Error())
+		}
+
+		// NGワードにヒットする過去の投稿も全削除する (論理削除)
+		for _, ngword := range ngwords {
+			rs, err := tx.ExecContext(ctx, "UPDATE livecomments SET deleted_at = ?, deleted_by = ?, delete_reason = ? WHERE livestream_id = ? AND deleted_at IS NULL AND comment LIKE CONCAT('%', ?, '%')", now, userID, livecommentDeleteReasonNGWord, livestreamID, ngword.Word)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+			}
+			n, err := rs.RowsAffected()
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+			}
+			deleted += n
+		}
+
+		return nil
+	}); err != nil {
+		return err
 	}
+	invalidateLivecommentRing(int64(livestreamID))
+	moderationSummaries.Delete(int64(livestreamID))
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		Word:         req.NGWord,
-		CreatedAt:    time.Now().Unix(),
+	return c.JSON(http.StatusCreated, &ImportNGWordsResponse{
+		Imported: len(ngwords),
+		Deleted:  deleted,
 	})
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
+}
+
+// ライブコメント削除API (配信者のみ)
+// DELETE /api/livestream/:livestream_id/livecomment/:livecomment_id
+func deleteLivecommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
 	}
 
-	wordID, err := rs.LastInsertId()
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT * FROM ng_words WHERE livestream_id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
 	}
 
-	// NGワードにヒットする過去の投稿も全削除する
-	for _, ngword := range ngwords {
-		// ライブコメント一覧取得
-		var livecomments []*LivecommentModel
-		if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments"); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	// 理由は任意
+	req := DeleteLivecommentRequest{}
+	if c.Request().ContentLength > 0 {
+		if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 		}
+	}
+	reason := livecommentDeleteReasonOwner
+	if req.Reason != "" {
+		reason = livecommentDeleteReasonOwner + ": " + req.Reason
+	}
 
-		for _, livecomment := range livecomments {
-			query := `
-			DELETE FROM livecomments
-			WHERE
-			id = ? AND
-			livestream_id = ? AND
-			(SELECT COUNT(*)
-			FROM
-			(SELECT ? AS text) AS texts
-			INNER JOIN
-			(SELECT CONCAT('%', ?, '%')	AS pattern) AS patterns
-			ON texts.text LIKE patterns.pattern) >= 1;
-			`
-			if _, err := tx.ExecContext(ctx, query, livecomment.ID, livestreamID, livecomment.Comment, ngword.Word); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 			}
 		}
+		if livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't delete livecomments on other streamer's livestream")
+		}
+
+		rs, err := tx.ExecContext(ctx, "UPDATE livecomments SET deleted_at = ?, deleted_by = ?, delete_reason = ? WHERE id = ? AND livestream_id = ? AND deleted_at IS NULL", time.Now().Unix(), userID, reason, livecommentID, livestreamID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomment: "+err.Error())
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	invalidateLivecommentRing(int64(livestreamID))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 削除済みライブコメント一覧API (配信者のみ)
+// GET /api/livestream/:livestream_id/livecomment/deleted
+func getDeletedLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get deleted livecomments of other streamer's livestream")
+	}
+
+	var livecommentModels []LivecommentModel
+	if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND deleted_at IS NOT NULL ORDER BY deleted_at DESC", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get deleted livecomments: "+err.Error())
+	}
+
+	filled, err := fillLivecommentResponses(ctx, tx, livecommentModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+	}
+	livecomments := make([]DeletedLivecomment, len(livecommentModels))
+	for i := range livecommentModels {
+		livecomments[i] = DeletedLivecomment{
+			Livecomment: filled[i],
+			DeletedAt:   livecommentModels[i].DeletedAt.Int64,
+			DeletedBy:   livecommentModels[i].DeletedBy.Int64,
+			Reason:      livecommentModels[i].DeleteReason.String,
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"word_id": wordID,
-	})
+	return c.JSON(http.StatusOK, livecomments)
 }
 
 func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel) (Livecomment, error) {
+	defer traceFill(ctx, "fillLivecommentResponse")()
+
 	commentOwnerModel := UserModel{}
 	if err := tx.GetContext(ctx, &commentOwnerModel, "SELECT * FROM users WHERE id = ?", livecommentModel.UserID); err != nil {
 		return Livecomment{}, err
@@ -432,28 +1022,70 @@ func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel
 		return Livecomment{}, err
 	}
 
-	livestreamModel := LivestreamModel{}
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livecommentModel.LivestreamID); err != nil {
+	livestreamModel, ok, err := livestreamRegistryCache.get(ctx, livecommentModel.LivestreamID)
+	if err != nil {
 		return Livecomment{}, err
 	}
+	if !ok {
+		return Livecomment{}, sql.ErrNoRows
+	}
 	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
 	if err != nil {
 		return Livecomment{}, err
 	}
 
+	return newLivecomment(livecommentModel, commentOwner, livestream), nil
+}
+
+func newLivecomment(livecommentModel LivecommentModel, commentOwner User, livestream Livestream) Livecomment {
 	livecomment := Livecomment{
 		ID:         livecommentModel.ID,
 		User:       commentOwner,
 		Livestream: livestream,
 		Comment:    livecommentModel.Comment,
 		Tip:        livecommentModel.Tip,
+		TipTier:    tipTierFor(livecommentModel.Tip),
 		CreatedAt:  livecommentModel.CreatedAt,
+		SpamScore:  livecommentModel.SpamScore,
+		Held:       livecommentModel.HeldAt.Valid,
+	}
+	if livecommentModel.EditedAt.Valid {
+		livecomment.EditedAt = &livecommentModel.EditedAt.Int64
+	}
+	return livecomment
+}
+
+// fillLivecommentResponses は fillLivecommentResponse の一覧版です。
+// コメントしたユーザと配信を重複を除いてまとめて取得してから組み立てます。
+func fillLivecommentResponses(ctx context.Context, tx *sqlx.Tx, livecommentModels []LivecommentModel) ([]Livecomment, error) {
+	defer traceFill(ctx, "fillLivecommentResponses")()
+
+	userIDs := make([]int64, len(livecommentModels))
+	livestreamIDs := make([]int64, len(livecommentModels))
+	for i := range livecommentModels {
+		userIDs[i] = livecommentModels[i].UserID
+		livestreamIDs[i] = livecommentModels[i].LivestreamID
+	}
+	users, err := fillUsersByID(ctx, tx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	livestreams, err := fillLivestreamsByID(ctx, tx, livestreamIDs)
+	if err != nil {
+		return nil, err
 	}
 
-	return livecomment, nil
+	livecomments := make([]Livecomment, len(livecommentModels))
+	for i := range livecommentModels {
+		m := livecommentModels[i]
+		livecomments[i] = newLivecomment(m, users[m.UserID], livestreams[m.LivestreamID])
+	}
+	return livecomments, nil
 }
 
 func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel LivecommentReportModel) (LivecommentReport, error) {
+	defer traceFill(ctx, "fillLivecommentReportResponse")()
+
 	reporterModel := UserModel{}
 	if err := tx.GetContext(ctx, &reporterModel, "SELECT * FROM users WHERE id = ?", reportModel.UserID); err != nil {
 		return LivecommentReport{}, err
@@ -472,11 +1104,66 @@ func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel
 		return LivecommentReport{}, err
 	}
 
+	return newLivecommentReport(reportModel, reporter, livecomment), nil
+}
+
+func newLivecommentReport(reportModel LivecommentReportModel, reporter User, livecomment Livecomment) LivecommentReport {
 	report := LivecommentReport{
 		ID:          reportModel.ID,
 		Reporter:    reporter,
 		Livecomment: livecomment,
 		CreatedAt:   reportModel.CreatedAt,
+		Status:      reportModel.Status,
+	}
+	if reportModel.ReviewedAt.Valid {
+		report.ReviewedAt = &reportModel.ReviewedAt.Int64
+	}
+	return report
+}
+
+// fillLivecommentReportResponses は fillLivecommentReportResponse の一覧版です。
+// 報告者と報告されたライブコメントをまとめて取得してから組み立てます。
+func fillLivecommentReportResponses(ctx context.Context, tx *sqlx.Tx, reportModels []LivecommentReportModel) ([]LivecommentReport, error) {
+	defer traceFill(ctx, "fillLivecommentReportResponses")()
+
+	reporterIDs := make([]int64, len(reportModels))
+	livecommentIDs := make([]int64, len(reportModels))
+	for i := range reportModels {
+		reporterIDs[i] = reportModels[i].UserID
+		livecommentIDs[i] = reportModels[i].LivecommentID
+	}
+	reporters, err := fillUsersByID(ctx, tx, reporterIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	livecommentByID := map[int64]Livecomment{}
+	if livecommentIDs = uniqueInt64s(livecommentIDs); len(livecommentIDs) > 0 {
+		query, params, err := sqlx.In("SELECT * FROM livecomments WHERE id IN (?)", livecommentIDs)
+		if err != nil {
+			return nil, err
+		}
+		var livecommentModels []LivecommentModel
+		if err := tx.SelectContext(ctx, &livecommentModels, query, params...); err != nil {
+			return nil, err
+		}
+		livecomments, err := fillLivecommentResponses(ctx, tx, livecommentModels)
+		if err != nil {
+			return nil, err
+		}
+		for _, livecomment := range livecomments {
+			livecommentByID[livecomment.ID] = livecomment
+		}
+	}
+
+	reports := make([]LivecommentReport, len(reportModels))
+	for i := range reportModels {
+		m := reportModels[i]
+		livecomment, ok := livecommentByID[m.LivecommentID]
+		if !ok {
+			return nil, fmt.Errorf("livecomment %d not found", m.LivecommentID)
+		}
+		reports[i] = newLivecommentReport(m, reporters[m.UserID], livecomment)
 	}
-	return report, nil
+	return reports, nil
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livecommentSearchDefaultSize = 50
+	livecommentSearchMaxSize     = 100
+	livecommentSearchMaxQueryLen = 100
+)
+
+type LivecommentSearchResult struct {
+	Livecomments []Livecomment `json:"livecomments"`
+	// 次のページを取るときの before。これ以上なければ null
+	NextBefore *int64 `json:"next_before"`
+}
+
+// escapeLikePattern は LIKE のワイルドカード (% と _) とエスケープ文字をエスケープします。
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ライブコメント検索API (配信者のみ)
+// GET /api/livestream/:livestream_id/livecomment/search?q=&before=&limit=
+// 配信のライブコメント (削除されたものを除く、保留中のものを含む) のうち q を含むものを新しい順に返す
+// 通報の確認で特定のコメントを探すためのもの。部分一致は LIKE で行い、照合順序に従う
+func searchLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	q := strings.TrimSpace(c.QueryParam("q"))
+	if q == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "q query parameter is required")
+	}
+	if len([]rune(q)) > livecommentSearchMaxQueryLen {
+		return echo.NewHTTPError(http.StatusBadRequest, "q query parameter must be at most "+strconv.Itoa(livecommentSearchMaxQueryLen)+" characters")
+	}
+
+	limit := livecommentSearchDefaultSize
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 || l > livecommentSearchMaxSize {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(livecommentSearchMaxSize))
+		}
+		limit = l
+	}
+
+	query := "SELECT * FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL AND comment LIKE ?"
+	args := []interface{}{livestreamID, "%" + escapeLikePattern(q) + "%"}
+	// ?before=<livecomment_id> ならそれより前のコメントを返す
+	if v := c.QueryParam("before"); v != "" {
+		beforeID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	// 次のページがあるかを知るために 1 件多く読む
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't search livecomments of other streamer's livestream")
+	}
+
+	var livecommentModels []LivecommentModel
+	if err := tx.SelectContext(ctx, &livecommentModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to search livecomments: "+err.Error())
+	}
+
+	res := LivecommentSearchResult{}
+	if len(livecommentModels) > limit {
+		livecommentModels = livecommentModels[:limit]
+		next := livecommentModels[limit-1].ID
+		res.NextBefore = &next
+	}
+	res.Livecomments, err = fillLivecommentResponses(ctx, tx, livecommentModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
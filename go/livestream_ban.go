@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信ごとの投稿禁止
+// 配信者が禁止したユーザはその配信にライブコメント・リアクションを投稿できない (403)。
+// 投稿のたびに DB を引かないよう、配信ごとの禁止されたユーザの集合をメモリに持つ
+// 禁止・解除は livestream_ban_logs に 1 件ずつ記録する
+const (
+	livestreamBanActionBan   = "ban"
+	livestreamBanActionUnban = "unban"
+)
+
+type LivestreamBanModel struct {
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	Reason       string `db:"reason"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type LivestreamBanLogModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	ActorID      int64  `db:"actor_id"`
+	Action       string `db:"action"`
+	Reason       string `db:"reason"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type LivestreamBan struct {
+	User      User   `json:"user"`
+	Reason    string `json:"reason"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type LivestreamBanLog struct {
+	ID        int64  `json:"id"`
+	User      User   `json:"user"`
+	Actor     User   `json:"actor"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type PutLivestreamBanRequest struct {
+	Reason string `json:"reason"`
+}
+
+type cachedLivestreamBans struct {
+	userIDs   map[int64]struct{}
+	expiresAt time.Time
+}
+
+// livestreamBans は livestreamID ごとの禁止されたユーザの集合のキャッシュです。禁止・解除時に消します。
+var livestreamBans sync.Map
+
+func resetLivestreamBans() {
+	livestreamBans.Range(func(key, _ interface{}) bool {
+		livestreamBans.Delete(key)
+		return true
+	})
+}
+
+// isBannedFromLivestream はユーザが配信への投稿を禁止されているかを返します。
+func isBannedFromLivestream(ctx context.Context, livestreamID, userID int64) (bool, error) {
+	if v, ok := livestreamBans.Load(livestreamID); ok {
+		if cached := v.(cachedLivestreamBans); time.Now().Before(cached.expiresAt) {
+			_, banned := cached.userIDs[userID]
+			return banned, nil
+		}
+	}
+
+	var bannedUserIDs []int64
+	if err := dbConn.SelectContext(ctx, &bannedUserIDs, "SELECT user_id FROM livestream_bans WHERE livestream_id = ?", livestreamID); err != nil {
+		return false, err
+	}
+	userIDs := make(map[int64]struct{}, len(bannedUserIDs))
+	for _, id := range bannedUserIDs {
+		userIDs[id] = struct{}{}
+	}
+	livestreamBans.Store(livestreamID, cachedLivestreamBans{userIDs: userIDs, expiresAt: time.Now().Add(currentConfig().LivestreamBanTTL.duration())})
+	_, banned := userIDs[userID]
+	return banned, nil
+}
+
+// verifyNotBanned は投稿を禁止されていれば 403 を返します。
+func verifyNotBanned(ctx context.Context, livestreamID, userID int64) error {
+	banned, err := isBannedFromLivestream(ctx, livestreamID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream bans: "+err.Error())
+	}
+	if banned {
+		return echo.NewHTTPError(http.StatusForbidden, "you are banned from this livestream")
+	}
+	return nil
+}
+
+// verifyLivestreamOwner は配信が存在し、ログイン中のユーザの配信であることを確かめます。
+func verifyLivestreamOwner(ctx context.Context, livestreamID, userID int64) error {
+	livestreamModel, ok, err := livestreamRegistryCache.get(ctx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't manage other streamer's livestream")
+	}
+	return nil
+}
+
+// 投稿禁止一覧API (配信者のみ)
+// GET /api/livestream/:livestream_id/bans
+func getLivestreamBansHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := verifyLivestreamOwner(ctx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var banModels []LivestreamBanModel
+	if err := tx.SelectContext(ctx, &banModels, "SELECT * FROM livestream_bans WHERE livestream_id = ? ORDER BY created_at DESC", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream bans: "+err.Error())
+	}
+
+	userIDs := make([]int64, len(banModels))
+	for i := range banModels {
+		userIDs[i] = banModels[i].UserID
+	}
+	users, err := fillUsersByID(ctx, tx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	bans := make([]LivestreamBan, len(banModels))
+	for i := range banModels {
+		bans[i] = LivestreamBan{
+			User:      users[banModels[i].UserID],
+			Reason:    banModels[i].Reason,
+			CreatedAt: banModels[i].CreatedAt,
+		}
+	}
+	return c.JSON(http.StatusOK, bans)
+}
+
+// 投稿禁止API (配信者のみ)
+// PUT /api/livestream/:livestream_id/bans/:username
+func putLivestreamBanHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	var req PutLivestreamBanRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if len([]rune(req.Reason)) > 255 {
+		return echo.NewHTTPError(http.StatusBadRequest, "reason must be at most 255 characters")
+	}
+	return changeLivestreamBan(c, livestreamBanActionBan, req.Reason)
+}
+
+// 投稿禁止解除API (配信者のみ)
+// DELETE /api/livestream/:livestream_id/bans/:username
+func deleteLivestreamBanHandler(c echo.Context) error {
+	return changeLivestreamBan(c, livestreamBanActionUnban, "")
+}
+
+func changeLivestreamBan(c echo.Context, action string, reason string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := verifyLivestreamOwner(ctx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	targetUserID, ok, err := usernameIndex.userIDByName(ctx, c.Param("username"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+	}
+	if targetUserID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't ban yourself")
+	}
+
+	now := time.Now().Unix()
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var rs sql.Result
+		var err error
+		if action == livestreamBanActionBan {
+			rs, err = tx.ExecContext(ctx, "INSERT INTO livestream_bans (livestream_id, user_id, reason, created_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE reason = VALUES(reason)", livestreamID, targetUserID, reason, now)
+		} else {
+			rs, err = tx.ExecContext(ctx, "DELETE FROM livestream_bans WHERE livestream_id = ? AND user_id = ?", livestreamID, targetUserID)
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream ban: "+err.Error())
+		}
+		// 何も変わらなかった (解除済みのユーザの解除など) なら記録しない
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+		} else if n == 0 {
+			return nil
+		}
+
+		logModel := LivestreamBanLogModel{
+			LivestreamID: int64(livestreamID),
+			UserID:       targetUserID,
+			ActorID:      userID,
+			Action:       action,
+			Reason:       reason,
+			CreatedAt:    now,
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_ban_logs (livestream_id, user_id, actor_id, action, reason, created_at) VALUES (:livestream_id, :user_id, :actor_id, :action, :reason, :created_at)", logModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream ban log: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	livestreamBans.Delete(int64(livestreamID))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 投稿禁止の記録API (配信者のみ)
+// GET /api/livestream/:livestream_id/bans/logs
+// 禁止・解除の記録を新しい順に返す
+func getLivestreamBanLogsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := verifyLivestreamOwner(ctx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var logModels []LivestreamBanLogModel
+	if err := tx.SelectContext(ctx, &logModels, "SELECT * FROM livestream_ban_logs WHERE livestream_id = ? ORDER BY id DESC", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream ban logs: "+err.Error())
+	}
+
+	userIDs := make([]int64, 0, len(logModels)*2)
+	for i := range logModels {
+		userIDs = append(userIDs, logModels[i].UserID, logModels[i].ActorID)
+	}
+	users, err := fillUsersByID(ctx, tx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	logs := make([]LivestreamBanLog, len(logModels))
+	for i := range logModels {
+		logs[i] = LivestreamBanLog{
+			ID:        logModels[i].ID,
+			User:      users[logModels[i].UserID],
+			Actor:     users[logModels[i].ActorID],
+			Action:    logModels[i].Action,
+			Reason:    logModels[i].Reason,
+			CreatedAt: logModels[i].CreatedAt,
+		}
+	}
+	return c.JSON(http.StatusOK, logs)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 連続配信の一括予約
+// 同じ曜日・時間帯の配信を weeks 週分まとめて予約する。
+// 予約枠の確認と減算は通常の予約 (bookLivestream) と同じで、1 件でも予約できなければすべて取り消す
+const maxBulkReservationWeeks = 52
+
+type BulkReserveLivestreamRequest struct {
+	ReserveLivestreamRequest
+	// 何週分予約するか (1 週目は start_at / end_at そのもの)
+	Weeks int `json:"weeks"`
+}
+
+// 連続配信予約API
+// POST /api/livestream/reservation/bulk
+func bulkReserveLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *BulkReserveLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json: "+err.Error())
+	}
+	if req.Weeks < 1 || req.Weeks > maxBulkReservationWeeks {
+		return echo.NewHTTPError(http.StatusBadRequest, "weeks must be between 1 and "+strconv.Itoa(maxBulkReservationWeeks))
+	}
+	if inactive, err := livestreamTagIndex.inactiveTagIDs(ctx, req.Tags); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	} else if len(inactive) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tags contains inactive tag")
+	}
+
+	// 週をまたぐ日付の計算は設定のタイムゾーンで行う (夏時間があっても同じ時刻になるように)
+	loc := currentConfig().timeLocation()
+	firstStartAt, firstEndAt := int64(req.StartAt), int64(req.EndAt)
+	type occurrence struct{ startAt, endAt int64 }
+	occurrences := make([]occurrence, req.Weeks)
+	for i := range occurrences {
+		startAt := time.Unix(firstStartAt, 0).In(loc).AddDate(0, 0, 7*i).Unix()
+		occurrences[i] = occurrence{startAt: startAt, endAt: startAt + (firstEndAt - firstStartAt)}
+		if err := validateReservationTime(occurrences[i].startAt, occurrences[i].endAt); err != nil {
+			return err
+		}
+	}
+
+	var (
+		bookings    []bookedLivestream
+		livestreams []Livestream
+	)
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		// リトライでやり直すときのために毎回作り直す
+		bookings = make([]bookedLivestream, 0, len(occurrences))
+		livestreams = make([]Livestream, 0, len(occurrences))
+
+		for _, o := range occurrences {
+			booked, err := bookLivestream(ctx, c, tx, userID, &req.ReserveLivestreamRequest, o.startAt, o.endAt)
+			if err != nil {
+				return err
+			}
+			bookings = append(bookings, booked)
+		}
+
+		for _, b := range bookings {
+			livestream, err := fillLivestreamResponse(ctx, tx, *b.model)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+			}
+			livestream.StreamKey = b.streamKey
+			livestreams = append(livestreams, livestream)
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, b := range bookings {
+		livestreamTagIndex.add(b.model.ID, req.Tags)
+		livestreamActivity.add(b.model.ID, 0)
+		livestreamRegistryCache.put(*b.model)
+		if b.overlapWarning != "" {
+			c.Response().Header().Add("Warning", b.overlapWarning)
+		}
+	}
+	return c.JSON(http.StatusCreated, livestreams)
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -21,8 +21,9 @@ type ReserveLivestreamRequest struct {
 	Description  string  `json:"description"`
 	PlaylistUrl  string  `json:"playlist_url"`
 	ThumbnailUrl string  `json:"thumbnail_url"`
-	StartAt      int64   `json:"start_at"`
-	EndAt        int64   `json:"end_at"`
+	// unix 秒かオフセット付きの RFC3339 (reservation_time.go)
+	StartAt reservationTime `json:"start_at"`
+	EndAt   reservationTime `json:"end_at"`
 }
 
 type LivestreamViewerModel struct {
@@ -40,6 +41,7 @@ type LivestreamModel struct {
 	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
 	StartAt      int64  `db:"start_at" json:"start_at"`
 	EndAt        int64  `db:"end_at" json:"end_at"`
+	Status       string `db:"status" json:"status"`
 }
 
 type Livestream struct {
@@ -52,6 +54,9 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	Status       string `json:"status"`
+	// 予約APIのレスポンスで持ち主にだけ返す (stream_key.go)
+	StreamKey string `json:"stream_key,omitempty"`
 }
 
 type LivestreamTagModel struct {
@@ -84,68 +89,110 @@ func reserveLivestreamHandler(c echo.Context) error {
 
 	var req *ReserveLivestreamRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json: "+err.Error())
 	}
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	startAt, endAt := int64(req.StartAt), int64(req.EndAt)
+	// 2023/11/25 10:00からの１年間の期間内であるかチェック
+	if err := validateReservationTime(startAt, endAt); err != nil {
+		return err
+	}
+	// 管理者が無効にしたタグ (tag_admin.go) は付けられない
+	if inactive, err := livestreamTagIndex.inactiveTagIDs(ctx, req.Tags); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	} else if len(inactive) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tags contains inactive tag")
 	}
-	defer tx.Rollback()
 
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
 	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
+		booked     bookedLivestream
+		livestream Livestream
 	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		booked, err = bookLivestream(ctx, c, tx, userID, req, startAt, endAt)
+		if err != nil {
+			return err
+		}
+
+		livestream, err = fillLivestreamResponse(ctx, tx, *booked.model)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestream.StreamKey = booked.streamKey
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	livestreamTagIndex.add(booked.model.ID, req.Tags)
+	livestreamActivity.add(booked.model.ID, 0)
+	livestreamRegistryCache.put(*booked.model)
+
+	if booked.overlapWarning != "" {
+		c.Response().Header().Set("Warning", booked.overlapWarning)
 	}
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+type bookedLivestream struct {
+	model *LivestreamModel
+	// 配信キーの平文 (stream_key.go)
+	streamKey string
+	// 時間の重なった自分の予約を許したときに Warning ヘッダに入れる文言
+	overlapWarning string
+}
+
+// bookLivestream は予約枠を確かめて減らし、配信とタグを登録して配信キーを発行します。予約の時刻は検証済みであること。
+func bookLivestream(ctx context.Context, c echo.Context, tx *sqlx.Tx, userID int64, req *ReserveLivestreamRequest, startAt, endAt int64) (bookedLivestream, error) {
+	termStartAt, termEndAt := reservationTerm()
 
 	// 予約枠をみて、予約が可能か調べる
 	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
 	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", startAt, endAt); err != nil {
 		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+		return bookedLivestream{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
 	}
 	for _, slot := range slots {
 		var count int
 		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+			return bookedLivestream{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
 		}
 		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
 		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
+			return bookedLivestream{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), startAt, endAt))
 		}
 	}
 
-	var (
-		livestreamModel = &LivestreamModel{
-			UserID:       int64(userID),
-			Title:        req.Title,
-			Description:  req.Description,
-			PlaylistUrl:  req.PlaylistUrl,
-			ThumbnailUrl: req.ThumbnailUrl,
-			StartAt:      req.StartAt,
-			EndAt:        req.EndAt,
-		}
-	)
+	// 自分の他の予約と時間が重なっていないか (reservation_overlap.go)
+	overlapWarning, err := checkReservationOverlap(ctx, tx, userID, startAt, endAt, c.QueryParam("force") == "true")
+	if err != nil {
+		return bookedLivestream{}, err
+	}
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	livestreamModel := &LivestreamModel{
+		UserID:       int64(userID),
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		StartAt:      startAt,
+		EndAt:        endAt,
+		Status:       livestreamStatusReserved,
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return bookedLivestream{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, status) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :status)", livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+		return bookedLivestream{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
 	}
 
 	livestreamID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+		return bookedLivestream{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
 	}
 	livestreamModel.ID = livestreamID
 
@@ -155,20 +202,22 @@ func reserveLivestreamHandler(c echo.Context) error {
 			LivestreamID: livestreamID,
 			TagID:        tagID,
 		}); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+			return bookedLivestream{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
 		}
 	}
 
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	streamKey, err := issueStreamKey(ctx, tx, livestreamID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		return bookedLivestream{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to issue stream key: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
+	return bookedLivestream{model: livestreamModel, streamKey: streamKey, overlapWarning: overlapWarning}, nil
+}
 
-	return c.JSON(http.StatusCreated, livestream)
+// facets=true のときの検索結果
+type SearchLivestreamsResponse struct {
+	Livestreams []Livestream `json:"livestreams"`
+	Facets      []TagFacet   `json:"facets"`
 }
 
 func searchLivestreamsHandler(c echo.Context) error {
@@ -181,45 +230,151 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		var tagIDList []int
-		if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	status := c.QueryParam("status")
+	if status != "" && !isValidLivestreamStatus(status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be reserved, live or ended")
+	}
+
+	// 停止中のユーザの配信は検索結果に出さない (ページングや facets より前に除く)
+	suspended, err := userSuspensions.set(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user suspensions: "+err.Error())
+	}
+
+	var (
+		livestreamModels []*LivestreamModel
+		// ページングする前の検索結果 (facets 用)。nil なら livestreamModels と同じ
+		matchedIDs []int64
+	)
+	if c.QueryParam("tags") != "" {
+		// 複数タグによる取得
+		op := c.QueryParam("op")
+		if op == "" {
+			op = "or"
+		}
+		if op != "and" && op != "or" {
+			return echo.NewHTTPError(http.StatusBadRequest, "op query parameter must be and or or")
+		}
+		var tagNames []string
+		for _, name := range strings.Split(c.QueryParam("tags"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				tagNames = append(tagNames, name)
+			}
+		}
+		if len(tagNames) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "tags query parameter must not be empty")
 		}
 
-		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDList)
+		var (
+			offset = 0
+			limit  = -1
+		)
+		if c.QueryParam("offset") != "" {
+			o, err := strconv.Atoi(c.QueryParam("offset"))
+			if err != nil || o < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "offset query parameter must be non-negative integer")
+			}
+			offset = o
+		}
+		if c.QueryParam("limit") != "" {
+			l, err := strconv.Atoi(c.QueryParam("limit"))
+			if err != nil || l < 1 {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+			}
+			limit = l
+		}
+
+		ids, err := livestreamTagIndex.search(ctx, tagNames, op == "and")
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to search tags: "+err.Error())
+		}
+		if (status != "" || len(suspended) > 0) && len(ids) > 0 {
+			ids, err = livestreamRegistryCache.filter(ctx, ids, status, suspended)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to filter livestreams: "+err.Error())
+			}
+		}
+		trending, err := recommendations.trendingSnapshot(ctx)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get trending: "+err.Error())
+		}
+		// スコアの高い順、同じなら新しい順
+		sort.Slice(ids, func(i, j int) bool {
+			si, sj := trending.scoreByID[ids[i]], trending.scoreByID[ids[j]]
+			if si == sj {
+				return ids[i] > ids[j]
+			}
+			return si > sj
+		})
+		matchedIDs = ids
+
+		if offset > len(ids) {
+			offset = len(ids)
 		}
-		var keyTaggedLivestreams []*LivestreamTagModel
-		if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
+		page := ids[offset:]
+		if limit >= 0 && len(page) > limit {
+			page = page[:limit]
 		}
 
-		for _, keyTaggedLivestream := range keyTaggedLivestreams {
-			ls := LivestreamModel{}
-			if err := tx.GetContext(ctx, &ls, "SELECT * FROM livestreams WHERE id = ?", keyTaggedLivestream.LivestreamID); err != nil {
+		if len(page) > 0 {
+			modelByID, err := livestreamRegistryCache.getMany(ctx, page)
+			if err != nil {
 				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 			}
+			for _, id := range page {
+				if m, ok := modelByID[id]; ok {
+					livestreamModels = append(livestreamModels, &m)
+				}
+			}
+		}
+	} else if c.QueryParam("tag") != "" {
+		// タグによる取得 (無効にされたタグでは検索できない)
+		var tagIDList []int
+		if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ? AND id NOT IN (SELECT tag_id FROM inactive_tags)", keyTagName); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+		}
+
+		// 有効なタグがなければ空で返す
+		if len(tagIDList) > 0 {
+			query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDList)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			}
+			var keyTaggedLivestreams []*LivestreamTagModel
+			if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
+			}
+
+			for _, keyTaggedLivestream := range keyTaggedLivestreams {
+				ls, ok, err := livestreamRegistryCache.get(ctx, keyTaggedLivestream.LivestreamID)
+				if err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+				}
+				if !ok || (status != "" && ls.Status != status) || suspended[ls.UserID] {
+					continue
+				}
 
-			livestreamModels = append(livestreamModels, &ls)
+				livestreamModels = append(livestreamModels, &ls)
+			}
 		}
 	} else {
 		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
+		limit := -1
 		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
+			l, err := strconv.Atoi(c.QueryParam("limit"))
 			if err != nil {
 				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
 			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
+			limit = l
 		}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
+		models, err := livestreamRegistryCache.list(ctx, status, limit, suspended)
+		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 		}
+		for i := range models {
+			livestreamModels = append(livestreamModels, &models[i])
+		}
 	}
 
 	livestreams := make([]Livestream, len(livestreamModels))
@@ -235,7 +390,26 @@ func searchLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	if c.QueryParam("facets") != "true" {
+		return c.JSON(http.StatusOK, livestreams)
+	}
+
+	// タグの絞り込み UI 用に、検索結果のタグごとの件数も返す
+	if matchedIDs == nil {
+		matchedIDs = make([]int64, len(livestreamModels))
+		for i := range livestreamModels {
+			matchedIDs[i] = livestreamModels[i].ID
+		}
+	}
+	facets, err := livestreamTagIndex.facets(ctx, matchedIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag facets: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &SearchLivestreamsResponse{
+		Livestreams: livestreams,
+		Facets:      facets,
+	})
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
@@ -289,17 +463,16 @@ func getUserLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "user not found")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
-		}
+	userID, ok, err := usernameIndex.userIDByName(ctx, username)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
 	}
 
 	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 	livestreams := make([]Livestream, len(livestreamModels))
@@ -336,25 +509,17 @@ func enterLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
 		CreatedAt:    time.Now().Unix(),
 	}
 
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+	if err := viewerHistory.enter(ctx, viewer); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
+	metrics.enterViewer(int64(livestreamID))
+	tagStats.recordViewer(int64(livestreamID))
 
 	return c.NoContent(http.StatusOK)
 }
@@ -376,19 +541,18 @@ func exitLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	enteredAt, err := viewerHistory.exit(ctx, userID, int64(livestreamID))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
 	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	if enteredAt > 0 {
+		if err := recordWatchSession(ctx, userID, int64(livestreamID), time.Now().Unix()-enteredAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to record watch time: "+err.Error())
+		}
+		// 視聴履歴を消したときだけ引く (入室していないユーザの退室で減らさない)
+		tagStats.recordViewerExit(int64(livestreamID))
 	}
+	metrics.exitViewer(int64(livestreamID))
 
 	return c.NoContent(http.StatusOK)
 }
@@ -411,14 +575,13 @@ func getLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	livestreamModel := LivestreamModel{}
-	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
-	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
-	}
+	livestreamModel, ok, err := livestreamRegistryCache.get(ctx, int64(livestreamID))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
 
 	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
 	if err != nil {
@@ -464,18 +627,24 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
 	}
 
-	var reportModels []*LivecommentReportModel
-	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
+	query := "SELECT * FROM livecomment_reports WHERE livestream_id = ?"
+	args := []interface{}{livestreamID}
+	if status := c.QueryParam("status"); status != "" {
+		if !isValidLivecommentReportStatus(status) {
+			return echo.NewHTTPError(http.StatusBadRequest, "status must be one of open, reviewed, dismissed, actioned")
+		}
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+
+	var reportModels []LivecommentReportModel
+	if err := tx.SelectContext(ctx, &reportModels, query, args...); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
 	}
 
-	reports := make([]LivecommentReport, len(reportModels))
-	for i := range reportModels {
-		report, err := fillLivecommentReportResponse(ctx, tx, *reportModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
-		}
-		reports[i] = report
+	reports, err := fillLivecommentReportResponses(ctx, tx, reportModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -486,6 +655,8 @@ func getLivecommentReportsHandler(c echo.Context) error {
 }
 
 func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (Livestream, error) {
+	defer traceFill(ctx, "fillLivestreamResponse")()
+
 	ownerModel := UserModel{}
 	if err := tx.GetContext(ctx, &ownerModel, "SELECT * FROM users WHERE id = ?", livestreamModel.UserID); err != nil {
 		return Livestream{}, err
@@ -511,6 +682,7 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		ThumbnailUrl: livestreamModel.ThumbnailUrl,
 		StartAt:      livestreamModel.StartAt,
 		EndAt:        livestreamModel.EndAt,
+		Status:       livestreamModel.Status,
 	}
 	return livestream, nil
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// livestreamRegistry は配信の行をすべてメモリに持ち、配信の取得・検索の絞り込み・fill を DB を引かずに行うためのものです。
+// 書き込みは今まで通り DB に行い、成功したらここにも反映する (DB が正)。
+// initialize で全件読み込み、配信予約・状態の変更のたびに更新する。
+// 他のサーバで予約された配信は、見つからなかったときや一覧を返すときに DB から追いかけて読み込む。
+// 他のサーバでの状態の変更は hub の中継 (hub_fanout.go) で受け取る
+type livestreamRegistry struct {
+	mu     sync.RWMutex
+	loaded bool
+
+	byID map[int64]LivestreamModel
+	// 配信 ID (昇順)
+	ids []int64
+	// DB にもなかった配信 ID と、覚えておく期限 (存在しない配信を何度も引かれても DB に行かない)
+	missing map[int64]time.Time
+}
+
+var livestreamRegistryCache = &livestreamRegistry{}
+
+// reset は initialize 時に呼び、次のアクセスで読み込み直させます。
+func (r *livestreamRegistry) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loaded = false
+	r.byID = nil
+	r.ids = nil
+	r.missing = nil
+}
+
+func (r *livestreamRegistry) ensureLoaded(ctx context.Context) error {
+	r.mu.RLock()
+	loaded := r.loaded
+	r.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams ORDER BY id"); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.loaded {
+		return nil
+	}
+	r.byID = make(map[int64]LivestreamModel, len(livestreamModels))
+	r.ids = make([]int64, 0, len(livestreamModels))
+	r.missing = map[int64]time.Time{}
+	for _, m := range livestreamModels {
+		r.byID[m.ID] = m
+		r.ids = append(r.ids, m.ID)
+	}
+	r.loaded = true
+	return nil
+}
+
+// put は配信を追加・更新します。まだ読み込んでいなければ何もしません (読み込み時に DB から拾われる)。
+func (r *livestreamRegistry) put(m LivestreamModel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.loaded {
+		return
+	}
+	r.putLocked(m)
+}
+
+func (r *livestreamRegistry) putLocked(m LivestreamModel) {
+	delete(r.missing, m.ID)
+	if _, ok := r.byID[m.ID]; !ok {
+		// 昇順を保って挿入する (新しい配信ならほぼ末尾)
+		i := sort.Search(len(r.ids), func(i int) bool { return r.ids[i] >= m.ID })
+		r.ids = append(r.ids, 0)
+		copy(r.ids[i+1:], r.ids[i:])
+		r.ids[i] = m.ID
+	}
+	r.byID[m.ID] = m
+}
+
+// setStatus は配信の状態を更新します。持っていない配信なら何もしません。
+func (r *livestreamRegistry) setStatus(livestreamID int64, status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.byID[livestreamID]; ok {
+		m.Status = status
+		r.byID[livestreamID] = m
+	}
+}
+
+// setThumbnailUrl は配信のサムネイルの URL を更新します。持っていない配信なら何もしません。
+func (r *livestreamRegistry) setThumbnailUrl(livestreamID int64, thumbnailUrl string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.byID[livestreamID]; ok {
+		m.ThumbnailUrl = thumbnailUrl
+		r.byID[livestreamID] = m
+	}
+}
+
+// get は配信を返します。持っていなければ DB から読み込み、DB にもなければ false を返します。
+func (r *livestreamRegistry) get(ctx context.Context, livestreamID int64) (LivestreamModel, bool, error) {
+	if err := r.ensureLoaded(ctx); err != nil {
+		return LivestreamModel{}, false, err
+	}
+	r.mu.RLock()
+	m, ok := r.byID[livestreamID]
+	missing := r.missingLocked(livestreamID)
+	r.mu.RUnlock()
+	if ok {
+		return m, true, nil
+	}
+	if missing {
+		return LivestreamModel{}, false, nil
+	}
+
+	if err := dbConn.GetContext(ctx, &m, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			r.markMissing([]int64{livestreamID})
+			return LivestreamModel{}, false, nil
+		}
+		return LivestreamModel{}, false, err
+	}
+	r.put(m)
+	return m, true, nil
+}
+
+// getMany は ids の配信を ID をキーにして返します。DB にもない配信は含まれません。
+func (r *livestreamRegistry) getMany(ctx context.Context, ids []int64) (map[int64]LivestreamModel, error) {
+	if err := r.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	found := make(map[int64]LivestreamModel, len(ids))
+	var missing []int64
+	r.mu.RLock()
+	for _, id := range ids {
+		if m, ok := r.byID[id]; ok {
+			found[id] = m
+		} else if !r.missingLocked(id) {
+			missing = append(missing, id)
+		}
+	}
+	r.mu.RUnlock()
+	if len(missing) == 0 {
+		return found, nil
+	}
+
+	query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", missing)
+	if err != nil {
+		return nil, err
+	}
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+		return nil, err
+	}
+	for _, m := range livestreamModels {
+		found[m.ID] = m
+		r.put(m)
+	}
+	var notFound []int64
+	for _, id := range missing {
+		if _, ok := found[id]; !ok {
+			notFound = append(notFound, id)
+		}
+	}
+	r.markMissing(notFound)
+	return found, nil
+}
+
+func (r *livestreamRegistry) missingLocked(livestreamID int64) bool {
+	expiresAt, ok := r.missing[livestreamID]
+	return ok && time.Now().Before(expiresAt)
+}
+
+// markMissing は DB にもなかった配信 ID を設定の negative_cache_ttl の間覚えておきます。
+// 他のサーバで予約された配信もこの時間が経てば見つかる
+func (r *livestreamRegistry) markMissing(ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.loaded {
+		return
+	}
+	now := time.Now()
+	if len(r.missing) >= negativeCachePruneSize {
+		for id, expiresAt := range r.missing {
+			if now.After(expiresAt) {
+				delete(r.missing, id)
+			}
+		}
+	}
+	for _, id := range ids {
+		r.missing[id] = now.Add(currentConfig().NegativeCacheTTL.duration())
+	}
+}
+
+// catchUp は他のサーバで予約された配信 (持っている最大の ID より後ろ) を DB から読み込みます。
+func (r *livestreamRegistry) catchUp(ctx context.Context) error {
+	if err := r.ensureLoaded(ctx); err != nil {
+		return err
+	}
+	r.mu.RLock()
+	var maxID int64
+	if len(r.ids) > 0 {
+		maxID = r.ids[len(r.ids)-1]
+	}
+	r.mu.RUnlock()
+
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE id > ? ORDER BY id", maxID); err != nil {
+		return err
+	}
+	if len(livestreamModels) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.loaded {
+		return nil
+	}
+	for _, m := range livestreamModels {
+		r.putLocked(m)
+	}
+	return nil
+}
+
+// list は配信を新しい順に返します。status が空でなければその状態の配信だけ、limit が負なら全件返します。
+// excludedUsers のユーザの配信は limit に数えずに除きます。
+func (r *livestreamRegistry) list(ctx context.Context, status string, limit int, excludedUsers map[int64]bool) ([]LivestreamModel, error) {
+	if err := r.catchUp(ctx); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	livestreamModels := []LivestreamModel{}
+	for i := len(r.ids) - 1; i >= 0; i-- {
+		if limit >= 0 && len(livestreamModels) >= limit {
+			break
+		}
+		m := r.byID[r.ids[i]]
+		if (status != "" && m.Status != status) || excludedUsers[m.UserID] {
+			continue
+		}
+		livestreamModels = append(livestreamModels, m)
+	}
+	return livestreamModels, nil
+}
+
+// filter は ids のうち status の配信 (status が空ならすべて) で、excludedUsers のユーザのものでない配信の ID を、ids の順に返します。
+func (r *livestreamRegistry) filter(ctx context.Context, ids []int64, status string, excludedUsers map[int64]bool) ([]int64, error) {
+	livestreamModels, err := r.getMany(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if m, ok := livestreamModels[id]; ok && (status == "" || m.Status == status) && !excludedUsers[m.UserID] {
+			filtered = append(filtered, id)
+		}
+	}
+	return filtered, nil
+}
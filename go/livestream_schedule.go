@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 配信予定表
+// 指定した日に開始する配信を、開始時刻の時間帯ごとにまとめて返す。
+// 日と時間帯は tz (IANA の名前) のタイムゾーンで区切る。省略すると設定のタイムゾーン (config.go の time_zone)
+// 配信者はまとめて取得し (fill_batch.go)、タグは索引 (tag_index.go) から引く
+type LivestreamSchedule struct {
+	Date     string         `json:"date"`
+	TimeZone string         `json:"time_zone"`
+	Hours    []ScheduleHour `json:"hours"`
+}
+
+type ScheduleHour struct {
+	// 0 - 23
+	Hour        int          `json:"hour"`
+	StartAt     int64        `json:"start_at"`
+	Livestreams []Livestream `json:"livestreams"`
+}
+
+// 配信予定表API
+// GET /api/livestream/schedule?date=YYYY-MM-DD&tz=
+func getLivestreamScheduleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	loc := currentConfig().timeLocation()
+	if tz := c.QueryParam("tz"); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "tz query parameter must be a time zone name such as Asia/Tokyo")
+		}
+		loc = l
+	}
+	day, err := time.ParseInLocation(time.DateOnly, c.QueryParam("date"), loc)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "date query parameter must be YYYY-MM-DD")
+	}
+	dayStart := day.Unix()
+	dayEnd := day.AddDate(0, 0, 1).Unix()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE start_at >= ? AND start_at < ? ORDER BY start_at, id", dayStart, dayEnd); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	// 停止中のユーザの配信は予定表に出さない
+	suspended, err := userSuspensions.set(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user suspensions: "+err.Error())
+	}
+	if len(suspended) > 0 {
+		visible := livestreamModels[:0]
+		for _, m := range livestreamModels {
+			if !suspended[m.UserID] {
+				visible = append(visible, m)
+			}
+		}
+		livestreamModels = visible
+	}
+
+	userIDs := make([]int64, len(livestreamModels))
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i, m := range livestreamModels {
+		userIDs[i] = m.UserID
+		livestreamIDs[i] = m.ID
+	}
+	owners, err := fillUsersByID(ctx, tx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+	tags, err := livestreamTagIndex.tagsOfMany(ctx, livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	schedule := LivestreamSchedule{
+		Date:     day.Format(time.DateOnly),
+		TimeZone: loc.String(),
+		Hours:    make([]ScheduleHour, 24),
+	}
+	for hour := range schedule.Hours {
+		schedule.Hours[hour] = ScheduleHour{
+			Hour:        hour,
+			StartAt:     time.Date(day.Year(), day.Month(), day.Day(), hour, 0, 0, 0, loc).Unix(),
+			Livestreams: []Livestream{},
+		}
+	}
+	for _, m := range livestreamModels {
+		hour := time.Unix(m.StartAt, 0).In(loc).Hour()
+		schedule.Hours[hour].Livestreams = append(schedule.Hours[hour].Livestreams, Livestream{
+			ID:           m.ID,
+			Owner:        owners[m.UserID],
+			Title:        m.Title,
+			Tags:         tags[m.ID],
+			Description:  m.Description,
+			PlaylistUrl:  m.PlaylistUrl,
+			ThumbnailUrl: m.ThumbnailUrl,
+			StartAt:      m.StartAt,
+			EndAt:        m.EndAt,
+			Status:       m.Status,
+		})
+	}
+
+	return c.JSON(http.StatusOK, schedule)
+}
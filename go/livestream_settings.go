@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const hubMessageLivestreamSettings = "livestream_settings"
+
+// 配信ごとの設定
+type LivestreamSettings struct {
+	LivestreamID int64 `json:"livestream_id" db:"livestream_id"`
+	// true ならライブコメントは絵文字のみ (リアクションは制限しない)
+	EmojiOnlyChat bool `json:"emoji_only_chat" db:"emoji_only_chat"`
+	// 投げ銭の下限・上限。0 ならサービス全体の設定 (設定の tip_min / tip_max) に従う
+	MinTip int64 `json:"min_tip" db:"min_tip"`
+	MaxTip int64 `json:"max_tip" db:"max_tip"`
+	// 1ユーザがこの配信に投げられる投げ銭の合計の上限。0 なら無制限
+	TipCapPerUser int64 `json:"tip_cap_per_user" db:"tip_cap_per_user"`
+	// スパムスコアがこの値以上のライブコメントを保留する。0 なら保留しない
+	SpamHoldThreshold float64 `json:"spam_hold_threshold" db:"spam_hold_threshold"`
+}
+
+type PutLivestreamSettingsRequest struct {
+	EmojiOnlyChat     bool    `json:"emoji_only_chat"`
+	MinTip            int64   `json:"min_tip"`
+	MaxTip            int64   `json:"max_tip"`
+	TipCapPerUser     int64   `json:"tip_cap_per_user"`
+	SpamHoldThreshold float64 `json:"spam_hold_threshold"`
+}
+
+type cachedLivestreamSettings struct {
+	settings  LivestreamSettings
+	expiresAt time.Time
+}
+
+// livestreamSettingsCache は livestreamID ごとの設定のキャッシュです。更新時に消します。
+var livestreamSettingsCache sync.Map
+
+func resetLivestreamSettingsCache() {
+	livestreamSettingsCache.Range(func(key, _ interface{}) bool {
+		livestreamSettingsCache.Delete(key)
+		return true
+	})
+}
+
+// getLivestreamSettings は配信の設定を返します。未設定ならデフォルト値を返します。
+func getLivestreamSettings(ctx context.Context, livestreamID int64) (LivestreamSettings, error) {
+	if v, ok := livestreamSettingsCache.Load(livestreamID); ok {
+		if cached := v.(cachedLivestreamSettings); time.Now().Before(cached.expiresAt) {
+			return cached.settings, nil
+		}
+	}
+
+	settings := LivestreamSettings{LivestreamID: livestreamID}
+	if err := dbConn.GetContext(ctx, &settings, "SELECT livestream_id, emoji_only_chat, min_tip, max_tip, tip_cap_per_user, spam_hold_threshold FROM livestream_settings WHERE livestream_id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return LivestreamSettings{}, err
+	}
+	livestreamSettingsCache.Store(livestreamID, cachedLivestreamSettings{settings: settings, expiresAt: time.Now().Add(currentConfig().LivestreamSettingsTTL.duration())})
+	return settings, nil
+}
+
+// 配信設定取得API
+// GET /api/livestream/:livestream_id/settings
+func getLivestreamSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	if _, ok, err := livestreamRegistryCache.get(ctx, int64(livestreamID)); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	} else if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+	}
+
+	settings, err := getLivestreamSettings(ctx, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream settings: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+// 配信設定更新API (配信者のみ)
+// PUT /api/livestream/:livestream_id/settings
+func putLivestreamSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PutLivestreamSettingsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.MinTip < 0 || req.MaxTip < 0 || req.TipCapPerUser < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tip limits must be non-negative")
+	}
+	if req.MinTip > 0 && req.MaxTip > 0 && req.MinTip > req.MaxTip {
+		return echo.NewHTTPError(http.StatusBadRequest, "min_tip must not exceed max_tip")
+	}
+	if tipMax := currentConfig().TipMax; req.MaxTip > tipMax {
+		return echo.NewHTTPError(http.StatusBadRequest, "max_tip must not exceed "+strconv.FormatInt(tipMax, 10))
+	}
+	if req.SpamHoldThreshold < 0 || req.SpamHoldThreshold > 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "spam_hold_threshold must be between 0 and 1")
+	}
+
+	var settings LivestreamSettings
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			}
+		}
+		if livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't change settings of other streamer's livestream")
+		}
+
+		settings = LivestreamSettings{
+			LivestreamID:      int64(livestreamID),
+			EmojiOnlyChat:     req.EmojiOnlyChat,
+			MinTip:            req.MinTip,
+			MaxTip:            req.MaxTip,
+			TipCapPerUser:     req.TipCapPerUser,
+			SpamHoldThreshold: req.SpamHoldThreshold,
+		}
+		query := `
+		INSERT INTO livestream_settings (livestream_id, emoji_only_chat, min_tip, max_tip, tip_cap_per_user, spam_hold_threshold)
+		VALUES (:livestream_id, :emoji_only_chat, :min_tip, :max_tip, :tip_cap_per_user, :spam_hold_threshold)
+		ON DUPLICATE KEY UPDATE
+			emoji_only_chat = VALUES(emoji_only_chat),
+			min_tip = VALUES(min_tip),
+			max_tip = VALUES(max_tip),
+			tip_cap_per_user = VALUES(tip_cap_per_user),
+			spam_hold_threshold = VALUES(spam_hold_threshold)
+		`
+		if _, err := tx.NamedExecContext(ctx, query, settings); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream settings: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	livestreamSettingsCache.Delete(settings.LivestreamID)
+	hub.publish(settings.LivestreamID, HubMessage{
+		Type: hubMessageLivestreamSettings,
+		Data: settings,
+	})
+
+	return c.JSON(http.StatusOK, settings)
+}
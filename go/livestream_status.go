@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信の状態
+// 予約時は reserved で、配信者が開始・終了を明示的に操作する (start_at / end_at は予定として残す)
+const (
+	livestreamStatusReserved = "reserved"
+	livestreamStatusLive     = "live"
+	livestreamStatusEnded    = "ended"
+
+	hubMessageLivestreamStatus = "livestream_status"
+)
+
+func isValidLivestreamStatus(status string) bool {
+	switch status {
+	case livestreamStatusReserved, livestreamStatusLive, livestreamStatusEnded:
+		return true
+	}
+	return false
+}
+
+// 配信開始API
+// POST /api/livestream/:livestream_id/live
+func startLivestreamHandler(c echo.Context) error {
+	return updateLivestreamStatus(c, livestreamStatusLive, livestreamStatusReserved)
+}
+
+// 配信終了API
+// 予定の終了時刻より前でも終了できる
+// POST /api/livestream/:livestream_id/end
+func endLivestreamHandler(c echo.Context) error {
+	return updateLivestreamStatus(c, livestreamStatusEnded, livestreamStatusReserved, livestreamStatusLive)
+}
+
+// updateLivestreamStatus は配信者本人の配信を from のいずれかの状態から to に遷移させます。
+func updateLivestreamStatus(c echo.Context, to string, from ...string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var livestream Livestream
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			}
+		}
+		if livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't change other streamer's livestream status")
+		}
+
+		if livestreamModel.Status != to {
+			allowed := false
+			for _, status := range from {
+				if livestreamModel.Status == status {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return echo.NewHTTPError(http.StatusConflict, "livestream is already "+livestreamModel.Status)
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET status = ? WHERE id = ?", to, livestreamModel.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream status: "+err.Error())
+			}
+			livestreamModel.Status = to
+		}
+
+		var err error
+		livestream, err = fillLivestreamResponse(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	livestreamRegistryCache.setStatus(livestream.ID, livestream.Status)
+	hub.publish(livestream.ID, HubMessage{
+		Type: hubMessageLivestreamStatus,
+		Data: livestream,
+	})
+
+	return c.JSON(http.StatusOK, livestream)
+}
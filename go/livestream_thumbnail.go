@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信のサムネイル
+// 配信者がアップロードした画像を、アイコンと同じく sha256 をキーにしてオブジェクトストレージ (icon_storage.go) に置く。
+// アップロードすると配信の thumbnail_url をこのアプリの URL に差し替えるので、配信を返す API や検索結果にもそのまま出る。
+// URL には画像のハッシュを付けて、画像が変わったら URL も変わるようにする。GET は ETag (画像のハッシュ) で 304 を返す
+const (
+	thumbnailObjectPrefix = "thumbnails/"
+	maxThumbnailSize      = 5 << 20
+
+	// 配信のサムネイルが変わった (Data は変更後の Livestream)
+	hubMessageLivestreamThumbnail = "livestream_thumbnail"
+)
+
+type PostLivestreamThumbnailRequest struct {
+	Image []byte `json:"image"`
+}
+
+type LivestreamThumbnail struct {
+	LivestreamID int64  `json:"livestream_id"`
+	ThumbnailUrl string `json:"thumbnail_url"`
+	Hash         string `json:"hash"`
+}
+
+type livestreamThumbnailModel struct {
+	ContentType string `db:"content_type"`
+	Hash        string `db:"hash"`
+}
+
+func thumbnailObjectKey(hash string) string {
+	return thumbnailObjectPrefix + hash
+}
+
+func thumbnailURL(livestreamID int64, hash string) string {
+	return fmt.Sprintf("/api/livestream/%d/thumbnail?h=%s", livestreamID, hash[:16])
+}
+
+// サムネイル取得API
+// GET /api/livestream/:livestream_id/thumbnail
+func getLivestreamThumbnailHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var thumbnail livestreamThumbnailModel
+	if err := dbConn.GetContext(ctx, &thumbnail, "SELECT content_type, hash FROM livestream_thumbnails WHERE livestream_id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "thumbnail not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get thumbnail: "+err.Error())
+	}
+
+	etag := `"` + thumbnail.Hash + `"`
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	if iconStorage != nil {
+		key := thumbnailObjectKey(thumbnail.Hash)
+		if iconStorage.presign {
+			u, err := iconStorage.presignedObjectURL(ctx, key)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to presign thumbnail url: "+err.Error())
+			}
+			return c.Redirect(http.StatusFound, u.String())
+		}
+		obj, err := iconStorage.openObject(ctx, key)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get thumbnail object: "+err.Error())
+		}
+		defer obj.Close()
+		return c.Stream(http.StatusOK, thumbnail.ContentType, obj)
+	}
+
+	var image []byte
+	if err := dbConn.GetContext(ctx, &image, "SELECT image FROM livestream_thumbnails WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get thumbnail: "+err.Error())
+	}
+	return c.Blob(http.StatusOK, thumbnail.ContentType, image)
+}
+
+// etagMatches は If-None-Match に etag が含まれるか (* を含む) を返します。
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// サムネイルアップロードAPI (配信者のみ)
+// POST /api/livestream/:livestream_id/thumbnail
+func postLivestreamThumbnailHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	if err := verifyLivestreamOwner(ctx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	// アイコンと同じく、受信は先に済ませて base64 のデコードとハッシュ計算だけをワーカーで行う
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read the request body")
+	}
+	var (
+		req       *PostLivestreamThumbnailRequest
+		hash      string
+		decodeErr error
+	)
+	if err := imagePool.do(ctx, func() {
+		if decodeErr = json.Unmarshal(body, &req); decodeErr != nil || req == nil {
+			return
+		}
+		hash = fmt.Sprintf("%x", sha256.Sum256(req.Image))
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "failed to wait for image worker: "+err.Error())
+	}
+	if decodeErr != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if len(req.Image) == 0 || len(req.Image) > maxThumbnailSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "image must be 1 to "+strconv.Itoa(maxThumbnailSize)+" bytes")
+	}
+	contentType := http.DetectContentType(req.Image)
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return echo.NewHTTPError(http.StatusBadRequest, "image must be jpeg or png")
+	}
+
+	// オブジェクトストレージを使うときは画像はそちらにだけ置き、DB には content_type と hash だけ持つ
+	image := req.Image
+	if iconStorage != nil {
+		if err := iconStorage.putObject(ctx, thumbnailObjectKey(hash), contentType, req.Image); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to upload thumbnail: "+err.Error())
+		}
+		image = []byte{}
+	}
+
+	url := thumbnailURL(int64(livestreamID), hash)
+	var livestream Livestream
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		query := "INSERT INTO livestream_thumbnails (livestream_id, image, content_type, hash, updated_at) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE image = VALUES(image), content_type = VALUES(content_type), hash = VALUES(hash), updated_at = VALUES(updated_at)"
+		if _, err := tx.ExecContext(ctx, query, livestreamID, image, contentType, hash, time.Now().Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert thumbnail: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET thumbnail_url = ? WHERE id = ?", url, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+		}
+
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		var err error
+		livestream, err = fillLivestreamResponse(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	livestreamRegistryCache.setThumbnailUrl(livestream.ID, livestream.ThumbnailUrl)
+	resetHomeCache()
+	hub.publish(livestream.ID, HubMessage{
+		Type: hubMessageLivestreamThumbnail,
+		Data: livestream,
+	})
+
+	return c.JSON(http.StatusOK, LivestreamThumbnail{LivestreamID: livestream.ID, ThumbnailUrl: url, Hash: hash})
+}
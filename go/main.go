@@ -5,19 +5,20 @@ package main
 
 import (
 	"cloud.google.com/go/profiler"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/felixge/fgprof"
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/gorilla/sessions"
@@ -45,9 +46,20 @@ func init() {
 
 type InitializeResponse struct {
 	Language string `json:"language"`
+	// ISUCON13_PEERS を設定したときだけ返す
+	Peers []PeerInitResult `json:"peers,omitempty"`
 }
 
 func connectDB(logger echo.Logger) (*sqlx.DB, error) {
+	confs, err := dbConfigs()
+	if err != nil {
+		return nil, err
+	}
+	return openDB(confs)
+}
+
+// dbConfigs は環境変数から接続先の一覧を作ります。
+func dbConfigs() ([]*mysql.Config, error) {
 	const (
 		networkTypeEnvKey = "ISUCON13_MYSQL_DIALCONFIG_NET"
 		addrEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
@@ -56,6 +68,8 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
 		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
 		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+		// カンマ区切りで複数指定すると先頭から順にフェイルオーバーする
+		dsnListEnvKey = "ISUCON13_MYSQL_DSN"
 	)
 
 	conf := mysql.NewConfig()
@@ -97,10 +111,29 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		conf.ParseTime = parseTime
 	}
 
-	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	confs := []*mysql.Config{conf}
+	if v, ok := os.LookupEnv(dsnListEnvKey); ok {
+		list, err := parseDSNList(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s': %+v", dsnListEnvKey, err)
+		}
+		confs = list
+	}
+	return confs, nil
+}
+
+func openDB(confs []*mysql.Config) (*sqlx.DB, error) {
+	if currentConfig().MySQLStmtCache {
+		// 埋め込んでしまうと Prepare したステートメントが使われない
+		for _, conf := range confs {
+			conf.InterpolateParams = false
+		}
+	}
+	connector, err := newFailoverConnector(confs)
 	if err != nil {
 		return nil, err
 	}
+	db := sqlx.NewDb(sql.OpenDB(&instrumentedConnector{Connector: connector}), "mysql")
 	db.SetMaxOpenConns(100)
 	db.SetMaxIdleConns(100)
 
@@ -112,25 +145,66 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 }
 
 func initializeHandler(c echo.Context) error {
+	// まだ書き込んでいない入室が作り直したテーブルに入らないように捨てる
+	discardViewerHistoryBuffer()
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		c.Logger().Warnf("init.sh failed with err=%s", string(out))
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
-	resetSubdomains()
-	rrCache = sync.Map{}
+	if err := truncateSplitTables(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize split tables: "+err.Error())
+	}
+
+	if err := rebuildCounters(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to rebuild viewer history: "+err.Error())
+	}
+
+	if iconStorage != nil {
+		if err := iconStorage.uploadAll(c.Request().Context()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to upload icons: "+err.Error())
+		}
+	}
+
+	rebuildDNSState()
+	resetCaches()
+	if err := livestreamRegistryCache.ensureLoaded(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load livestreams: "+err.Error())
+	}
+
+	// 他のサーバも温まってから応答する (失敗しても initialize 自体は成功させる)
+	peers := initializePeers(c.Request().Context())
+
+	if profiles.enabled() {
+		if err := profiles.start(profiles.duration); err != nil {
+			c.Logger().Warnf("failed to start profile capture: %v", err)
+		}
+	}
 
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
+		Peers:    peers,
 	})
 }
 
 func main() {
+	if runCLI(os.Args[1:]) {
+		return
+	}
+	runServer()
+}
+
+func runServer() {
 	http.DefaultServeMux.Handle("/debug/fgprof", fgprof.Handler())
+	http.DefaultServeMux.HandleFunc("/debug/stats", debugStatsHandler)
+	http.DefaultServeMux.HandleFunc("/debug/score_estimate", scoreEstimateHandler)
+	http.DefaultServeMux.HandleFunc("/metrics", metricsHandler)
 	go func() {
 		log.Println(http.ListenAndServe(":6060", nil))
 	}()
+	// SIGHUP で設定を読み直す
+	go watchConfigReload()
 	// DNSサーバ起動
 	go func() {
 		err := runDNS()
@@ -150,42 +224,107 @@ func main() {
 	e := echo.New()
 	e.Debug = true
 	e.Logger.SetLevel(echolog.DEBUG)
-	e.Use(middleware.Logger())
+	e.Use(benchPhaseMiddleware)
+	e.Use(accessLogMiddleware())
+	e.Use(corsMiddleware())
+	e.Use(securityHeadersMiddleware())
 	cookieStore := sessions.NewCookieStore(secret)
 	cookieStore.Options.Domain = "*.t.isucon.pw"
 	e.Use(session.Middleware(cookieStore))
+	e.Use(sessionRefreshMiddleware)
+	e.Use(apiTokenMiddleware)
+	e.Use(csrfMiddleware())
+	e.Use(metricsMiddleware)
+	e.Use(debugStatsMiddleware)
+	e.Use(requestTraceMiddleware())
+	e.Use(readOnlyMiddleware)
+	e.Use(suspendedUserMiddleware)
+	e.Use(queryHintsMiddleware)
+	e.Use(routeHintMiddleware)
+	e.Use(routePolicyMiddleware)
 	// e.Use(middleware.Recover())
 
 	// 初期化
 	e.POST("/api/initialize", initializeHandler)
+	e.POST("/internal/warm/caches", postInternalWarmCachesHandler)
+	e.POST("/internal/rebuild/counters", postInternalRebuildCountersHandler)
+	e.POST("/internal/rebuild/dns", postInternalRebuildDNSHandler)
+	e.POST("/internal/ingest/auth", postIngestAuthHandler)
 
 	// top
 	e.GET("/api/tag", getTagHandler)
+	e.GET("/api/tag/popular", getPopularTagsHandler)
+	e.GET("/api/tag/:tag_id/statistics", getTagStatisticsHandler)
+	e.GET("/api/home", getHomeHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
+	e.GET("/api/v2/user/:username/theme", getStreamerThemeV2Handler)
+	e.GET("/api/v2/theme/presets", getThemePresetsHandler)
 
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	e.POST("/api/livestream/reservation/bulk", bulkReserveLivestreamHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	e.GET("/api/livestream/schedule", getLivestreamScheduleHandler)
+	e.GET("/api/livestream/recommended", getRecommendedLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	e.GET("/api/livestream/:livestream_id/playlist", getLivestreamPlaylistHandler)
+	e.GET("/api/livestream/:livestream_id/thumbnail", getLivestreamThumbnailHandler)
+	e.POST("/api/livestream/:livestream_id/thumbnail", postLivestreamThumbnailHandler)
+	e.POST("/api/livestream/:livestream_id/live", startLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/end", endLivestreamHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
+	e.GET("/api/livestream/:livestream_id/settings", getLivestreamSettingsHandler)
+	e.PUT("/api/livestream/:livestream_id/settings", putLivestreamSettingsHandler)
+	e.GET("/api/livestream/:livestream_id/bans", getLivestreamBansHandler)
+	e.GET("/api/livestream/:livestream_id/bans/logs", getLivestreamBanLogsHandler)
+	e.PUT("/api/livestream/:livestream_id/bans/:username", putLivestreamBanHandler)
+	e.DELETE("/api/livestream/:livestream_id/bans/:username", deleteLivestreamBanHandler)
+	e.POST("/api/livestream/:livestream_id/stream_key/rotate", rotateStreamKeyHandler)
+	e.POST("/api/livestream/:livestream_id/polls", postPollHandler)
+	e.GET("/api/livestream/:livestream_id/polls", getPollsHandler)
+	e.POST("/api/livestream/:livestream_id/polls/:poll_id/vote", postPollVoteHandler)
+	e.POST("/api/livestream/:livestream_id/polls/:poll_id/close", closePollHandler)
+	e.POST("/api/livestream/:livestream_id/questions", postQuestionHandler)
+	e.GET("/api/livestream/:livestream_id/questions", getQuestionsHandler)
+	e.POST("/api/livestream/:livestream_id/questions/:question_id/upvote", upvoteQuestionHandler)
+	e.POST("/api/livestream/:livestream_id/questions/:question_id/answer", answerQuestionHandler)
+	e.GET("/api/tip_tiers", getTipTiersHandler)
+	e.POST("/api/livestream/:livestream_id/clips", postClipHandler)
+	e.GET("/api/livestream/:livestream_id/clips", getLivestreamClipsHandler)
+	e.GET("/api/clips/ranking", getClipRankingHandler)
+	e.GET("/api/ranking/livestreams", getLivestreamLeaderboardHandler)
+	e.GET("/api/ranking/users", getUserLeaderboardHandler)
+	e.GET("/api/clips/:clip_id", getClipHandler)
+	e.POST("/api/clips/:clip_id/reactions", postClipReactionHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment/replay", getLivecommentReplayHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment/search", searchLivecommentsHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment/deleted", getDeletedLivecommentsHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment/held", getHeldLivecommentsHandler)
+	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/approve", approveLivecommentHandler)
+	e.DELETE("/api/livestream/:livestream_id/livecomment/:livecomment_id", deleteLivecommentHandler)
+	e.PATCH("/api/livestream/:livestream_id/livecomment/:livecomment_id", patchLivecommentHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment/:livecomment_id/edits", getLivecommentEditsHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
+	e.PUT("/api/livestream/:livestream_id/report/:report_id", putLivecommentReportStatusHandler)
 	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
 	// ライブコメント報告
 	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
 	// 配信者によるモデレーション (NGワード登録)
 	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
+	e.POST("/api/livestream/:livestream_id/moderate/import", importNGWordsHandler)
+	e.GET("/api/livestream/:livestream_id/moderation/summary", getModerationSummaryHandler)
 
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
@@ -196,21 +335,75 @@ func main() {
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
+	e.POST("/api/logout", logoutHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.PATCH("/api/user/me", patchMeHandler)
+	e.PATCH("/api/user/me/theme", patchMeThemeHandler)
+	e.POST("/api/user/me/tokens", postAPITokenHandler)
+	e.GET("/api/user/me/tokens", getAPITokensHandler)
+	e.DELETE("/api/user/me/tokens/:token_id", deleteAPITokenHandler)
+	e.GET("/api/user/me/chat_preferences", getChatPreferencesHandler)
+	e.PUT("/api/user/me/chat_preferences", putChatPreferencesHandler)
+	e.GET("/api/user/me/blocks", getUserBlocksHandler)
+	e.POST("/api/user/me/blocks/:username", postUserBlockHandler)
+	e.DELETE("/api/user/me/blocks/:username", deleteUserBlockHandler)
+	e.GET("/api/user/me/privacy", getPrivacySettingsHandler)
+	e.PUT("/api/user/me/privacy", putPrivacySettingsHandler)
+	e.GET("/api/user/me/tips/export", getTipsExportHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
 	e.POST("/api/icon", postIconHandler)
+	e.GET("/api/icons/hashes", getIconHashesHandler)
 
 	// stats
 	// ライブ配信統計情報
-	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	e.GET("/api/livestream/:livestream_id/statistics", shadowRead("livestream_statistics", getLivestreamStatisticsHandler, getLivestreamStatisticsHandlerFast))
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
 
+	// 管理者向け
+	e.GET("/api/admin/dashboard/ws", getAdminDashboardWSHandler)
+	e.POST("/api/admin/announcements", postAnnouncementHandler)
+	e.GET("/api/admin/readonly", getReadOnlyModeHandler)
+	e.PUT("/api/admin/readonly", putReadOnlyModeHandler)
+	e.POST("/api/admin/profile/start", postProfileStartHandler)
+	e.POST("/api/admin/profile/stop", postProfileStopHandler)
+	e.GET("/api/admin/consistency", getConsistencyReportHandler)
+	e.POST("/api/admin/recalculate_scores", postRecalculateScoresHandler)
+	e.GET("/api/admin/recalculate_scores", getRecalculateScoresHandler)
+	e.POST("/api/admin/tasks/:name", postOpsTaskHandler)
+	e.POST("/api/admin/users/:username/sessions/revoke", revokeUserSessionsHandler)
+	e.GET("/api/admin/users/:username/suspension", getUserSuspensionHandler)
+	e.PUT("/api/admin/users/:username/suspension", putUserSuspensionHandler)
+	e.DELETE("/api/admin/users/:username/suspension", deleteUserSuspensionHandler)
+	e.GET("/api/admin/tags", getAdminTagsHandler)
+	e.POST("/api/admin/tags", postAdminTagHandler)
+	e.PATCH("/api/admin/tags/:tag_id", patchAdminTagHandler)
+	e.POST("/api/admin/tags/:tag_id/merge", mergeAdminTagHandler)
+	e.GET("/api/admin/route_ring", getRouteRingHandler)
+	e.GET("/api/admin/config", getConfigHandler)
+	e.POST("/api/admin/config/reload", postConfigReloadHandler)
+	e.GET("/api/admin/dns/zone", getDNSZoneHandler)
+	e.PUT("/api/admin/dns/zone", putDNSZoneHandler)
+
+	// お知らせ
+	e.GET("/api/announcements", getAnnouncementsHandler)
+
+	// WebSocket / SSE によるイベント購読
+	e.GET("/api/ws", getStreamWSHandler)
+	e.GET("/api/sse", getStreamSSEHandler)
+
+	// フロントエンドの行動ログ
+	e.POST("/api/analytics/events", postAnalyticsEventsHandler)
+
+	// フロントエンドの静的ファイル
+	registerStaticRoutes(e)
+
 	e.HTTPErrorHandler = errorResponseHandler
+	e.JSONSerializer = boundedJSONSerializer{}
 
 	// DB接続
 	conn, err := connectDB(e.Logger)
@@ -221,22 +414,77 @@ func main() {
 	defer conn.Close()
 	dbConn = conn
 
+	if migrateOnStartupEnabled() {
+		if err := migrateUp(); err != nil {
+			e.Logger.Errorf("failed to migrate: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := connectSplitDBs(); err != nil {
+		e.Logger.Errorf("failed to connect split db: %v", err)
+		os.Exit(1)
+	}
+	defer closeSplitDBs()
+	if err := migrateSplitDBs(context.Background(), migrateOnStartupEnabled()); err != nil {
+		e.Logger.Errorf("failed to migrate split db: %v", err)
+		os.Exit(1)
+	}
+
+	if err := setupIconStorage(); err != nil {
+		e.Logger.Errorf("failed to setup icon storage: %v", err)
+		os.Exit(1)
+	}
+
+	if err := setupViewerHistoryStore(); err != nil {
+		e.Logger.Errorf("failed to setup viewer history store: %v", err)
+		os.Exit(1)
+	}
+	if err := setupSessionIndex(); err != nil {
+		e.Logger.Errorf("failed to setup session index: %v", err)
+		os.Exit(1)
+	}
+	if err := setupHubFanout(); err != nil {
+		e.Logger.Errorf("failed to setup hub fanout: %v", err)
+		os.Exit(1)
+	}
+
+	hub.listen(tagStats.observe)
+
+	go runAnalyticsAppender()
+	go runRecommendationRefresher()
+	go runLivecommentCounterFlusher()
+	go runConsistencyChecker()
+	go runDNSOutboxDispatcher()
+
 	// HTTPサーバ起動
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
+	tlsConfig, err := setupTLSConfig()
+	if err != nil {
+		e.Logger.Errorf("failed to setup TLS: %v", err)
+		os.Exit(1)
+	}
+	shutdown := shutdownOnSignal(e)
+	if err := startHTTPServer(e, listenAddr, tlsConfig); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		e.Logger.Errorf("failed to start HTTP server: %v", err)
 		os.Exit(1)
 	}
+	<-shutdown
+	// 溜めている視聴履歴を書き込んでから終了する
+	closeViewerHistory()
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// 理由を機械的に判別できるエラーだけ (user_validation.go の errCode*)
+	Code string `json:"code,omitempty"`
 }
 
 func errorResponseHandler(err error, c echo.Context) {
 	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
 	if he, ok := err.(*echo.HTTPError); ok {
-		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
+		code, _ := c.Get(errorCodeContextKey).(string)
+		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error(), Code: code}); e != nil {
 			c.Logger().Errorf("%+v", e)
 		}
 		return
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+const defaultReadOnlyRetryAfter = 30
+
+// 読み取り専用モード中でも受け付ける書き込み系エンドポイント
+var readOnlyExemptPaths = []string{
+	"/api/initialize",
+	"/api/login",
+	"/api/admin/",
+	"/internal/",
+}
+
+var (
+	readOnlyMode       atomic.Bool
+	readOnlyRetryAfter atomic.Int64
+)
+
+func init() {
+	readOnlyRetryAfter.Store(defaultReadOnlyRetryAfter)
+	if v, ok := os.LookupEnv("ISUCON13_READ_ONLY"); ok {
+		if enabled, err := strconv.ParseBool(v); err == nil {
+			readOnlyMode.Store(enabled)
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_READ_ONLY_RETRY_AFTER"); ok {
+		if sec, err := strconv.ParseInt(v, 10, 64); err == nil && sec > 0 {
+			readOnlyRetryAfter.Store(sec)
+		}
+	}
+}
+
+type ReadOnlyModeRequest struct {
+	Enabled    bool  `json:"enabled"`
+	RetryAfter int64 `json:"retry_after"`
+}
+
+type ReadOnlyModeResponse struct {
+	Enabled    bool  `json:"enabled"`
+	RetryAfter int64 `json:"retry_after"`
+}
+
+// readOnlyMiddleware は読み取り専用モード中の書き込みリクエストを 503 で弾きます。
+func readOnlyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !readOnlyMode.Load() || !isWriteRequest(c.Request()) {
+			return next(c)
+		}
+		path := c.Request().URL.Path
+		for _, exempt := range readOnlyExemptPaths {
+			if strings.HasPrefix(path, exempt) {
+				return next(c)
+			}
+		}
+		c.Response().Header().Set("Retry-After", strconv.FormatInt(readOnlyRetryAfter.Load(), 10))
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "service is in read-only mode")
+	}
+}
+
+func isWriteRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	default:
+		return true
+	}
+}
+
+// 読み取り専用モード取得API
+// GET /api/admin/readonly
+func getReadOnlyModeHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &ReadOnlyModeResponse{
+		Enabled:    readOnlyMode.Load(),
+		RetryAfter: readOnlyRetryAfter.Load(),
+	})
+}
+
+// 読み取り専用モード切り替えAPI
+// PUT /api/admin/readonly
+func putReadOnlyModeHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	var req *ReadOnlyModeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.RetryAfter < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "retry_after must not be negative")
+	}
+
+	if req.RetryAfter > 0 {
+		readOnlyRetryAfter.Store(req.RetryAfter)
+	}
+	readOnlyMode.Store(req.Enabled)
+	c.Logger().Infof("read-only mode changed: enabled=%v", req.Enabled)
+
+	return c.JSON(http.StatusOK, &ReadOnlyModeResponse{
+		Enabled:    readOnlyMode.Load(),
+		RetryAfter: readOnlyRetryAfter.Load(),
+	})
+}
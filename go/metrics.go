@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 直近何秒分のリクエスト数・チップを保持するか
+	metricsWindowSeconds = 60
+	metricsTopStreams    = 10
+)
+
+// metricsBucket は1秒分の集計です。
+type metricsBucket struct {
+	unix     int64
+	requests map[string]int64
+	tips     int64
+}
+
+// liveMetrics はベンチマーク中の挙動を観察するためにプロセス内で集計するメトリクスです。
+type liveMetrics struct {
+	mu            sync.Mutex
+	buckets       [metricsWindowSeconds]metricsBucket
+	activeViewers map[int64]int64
+	streamScores  map[int64]int64
+}
+
+var metrics = newLiveMetrics()
+
+func newLiveMetrics() *liveMetrics {
+	return &liveMetrics{
+		activeViewers: map[int64]int64{},
+		streamScores:  map[int64]int64{},
+	}
+}
+
+func (m *liveMetrics) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buckets = [metricsWindowSeconds]metricsBucket{}
+	m.activeViewers = map[int64]int64{}
+	m.streamScores = map[int64]int64{}
+}
+
+// bucket は現在時刻のバケットを返します。呼び出し側でロックを取ること。
+func (m *liveMetrics) bucket(now int64) *metricsBucket {
+	b := &m.buckets[now%metricsWindowSeconds]
+	if b.unix != now {
+		b.unix = now
+		b.requests = map[string]int64{}
+		b.tips = 0
+	}
+	return b
+}
+
+func (m *liveMetrics) recordRequest(route string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bucket(time.Now().Unix()).requests[route]++
+}
+
+func (m *liveMetrics) recordTip(livestreamID, tip int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bucket(time.Now().Unix()).tips += tip
+	m.streamScores[livestreamID] += tip
+}
+
+// streamScoresSnapshot は initialize から数えた配信ごとのスコアの写しを返します。
+func (m *liveMetrics) streamScoresSnapshot() map[int64]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	scores := make(map[int64]int64, len(m.streamScores))
+	for id, score := range m.streamScores {
+		scores[id] = score
+	}
+	return scores
+}
+
+func (m *liveMetrics) recordReaction(livestreamID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.streamScores[livestreamID]++
+}
+
+func (m *liveMetrics) enterViewer(livestreamID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeViewers[livestreamID]++
+}
+
+func (m *liveMetrics) exitViewer(livestreamID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.activeViewers[livestreamID] <= 1 {
+		delete(m.activeViewers, livestreamID)
+		return
+	}
+	m.activeViewers[livestreamID]--
+}
+
+type StreamScore struct {
+	LivestreamID int64 `json:"livestream_id"`
+	Score        int64 `json:"score"`
+}
+
+type MetricsSnapshot struct {
+	Timestamp int64 `json:"timestamp"`
+	// 今のベンチマークのフェーズ (initialize からの経過時間で決めたもの)
+	Phase            string           `json:"phase"`
+	RequestsPerSec   map[string]int64 `json:"requests_per_sec"`
+	ActiveViewers    int64            `json:"active_viewers"`
+	TipsPerMin       int64            `json:"tips_per_min"`
+	TopStreams       []StreamScore    `json:"top_streams"`
+	AnalyticsBacklog int              `json:"analytics_backlog"`
+	ImageWorkers     WorkerPoolStats  `json:"image_workers"`
+	// 同時実行数を絞っているルートの状況 (route_policy.go)
+	RoutePools map[string]WorkerPoolStats `json:"route_pools"`
+}
+
+// snapshot は直前の1秒間のリクエスト数と、直近1分間のチップ合計などを返します。
+func (m *liveMetrics) snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+	snap := MetricsSnapshot{
+		Timestamp:      now,
+		Phase:          benchPhaseAt(time.Unix(now, 0)),
+		RequestsPerSec: map[string]int64{},
+	}
+
+	last := &m.buckets[(now-1)%metricsWindowSeconds]
+	if last.unix == now-1 {
+		for route, cnt := range last.requests {
+			snap.RequestsPerSec[route] = cnt
+		}
+	}
+	for i := range m.buckets {
+		if b := &m.buckets[i]; now-b.unix < metricsWindowSeconds {
+			snap.TipsPerMin += b.tips
+		}
+	}
+	for _, cnt := range m.activeViewers {
+		snap.ActiveViewers += cnt
+	}
+
+	top := make([]StreamScore, 0, len(m.streamScores))
+	for id, score := range m.streamScores {
+		top = append(top, StreamScore{LivestreamID: id, Score: score})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Score == top[j].Score {
+			return top[i].LivestreamID < top[j].LivestreamID
+		}
+		return top[i].Score > top[j].Score
+	})
+	if len(top) > metricsTopStreams {
+		top = top[:metricsTopStreams]
+	}
+	snap.TopStreams = top
+	snap.AnalyticsBacklog = len(analyticsEvents)
+	snap.ImageWorkers = imagePool.stats()
+	snap.RoutePools = routePoolStats()
+
+	return snap
+}
+
+// metricsMiddleware はルートごとのリクエスト数を集計します。
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		metrics.recordRequest(c.Request().Method + " " + c.Path())
+		return err
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/golang-migrate/migrate/v4"
+	migratemysql "github.com/golang-migrate/migrate/v4/database/mysql"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// スキーマ変更は migrations/ に連番で置き、バイナリに埋め込みます。
+// 10_schema.sql は初期状態のまま残し、インデックスなどの追加はすべてここで管理します。
+// 別ホストに切り出したテーブル (db_resolver.go) には流れないので、その分は splitTableChanges に同じ変更を書きます。
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// newMigrate はマイグレーション専用の接続を開きます。
+// 1ファイルに複数の ALTER TABLE を書けるように multiStatements を有効にするので、アプリの接続とは分けます。
+func newMigrate() (*migrate.Migrate, error) {
+	confs, err := dbConfigs()
+	if err != nil {
+		return nil, err
+	}
+	for i, conf := range confs {
+		conf = conf.Clone()
+		conf.MultiStatements = true
+		confs[i] = conf
+	}
+	connector, err := newFailoverConnector(confs)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+
+	driver, err := migratemysql.WithInstance(db, &migratemysql.Config{})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	source, err := iofs.New(migrationFiles, "migrations")
+	if err != nil {
+		driver.Close()
+		return nil, err
+	}
+	return migrate.NewWithInstance("iofs", source, "mysql", driver)
+}
+
+// migrateUp は未適用のマイグレーションをすべて適用します。
+// GET_LOCK で排他するので、複数台が同時に起動しても適用されるのは1回だけです。
+func migrateUp() error {
+	m, err := newMigrate()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	version, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return err
+	}
+	log.Printf("schema version: %d (dirty=%v)", version, dirty)
+	return nil
+}
+
+// migrateOnStartupEnabled は ISUCON13_MIGRATE_ON_STARTUP が false でなければ true を返します。
+func migrateOnStartupEnabled() bool {
+	v, ok := os.LookupEnv("ISUCON13_MIGRATE_ON_STARTUP")
+	if !ok {
+		return true
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid ISUCON13_MIGRATE_ON_STARTUP: %q", v)
+		return true
+	}
+	return b
+}
+
+// runMigrateCommand はマイグレーションを操作します。
+// isupipe migrate [up|down N|version|force V]
+func runMigrateCommand(args []string) error {
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	if action == "up" {
+		if err := migrateUp(); err != nil {
+			return err
+		}
+		// 切り出し先の DB は golang-migrate の管理外なので、同じ変更を別に流す
+		if err := connectSplitDBs(); err != nil {
+			return err
+		}
+		defer closeSplitDBs()
+		return migrateSplitDBs(context.Background(), true)
+	}
+
+	m, err := newMigrate()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	switch action {
+	case "down":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: migrate down N")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid step: %q", args[1])
+		}
+		if err := m.Steps(-n); err != nil {
+			return err
+		}
+	case "force":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: migrate force V")
+		}
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version: %q", args[1])
+		}
+		if err := m.Force(v); err != nil {
+			return err
+		}
+	case "version":
+	default:
+		return fmt.Errorf("unknown migrate action %q", action)
+	}
+
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		fmt.Println("no migration applied")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("version %d (dirty=%v)\n", version, dirty)
+	return nil
+}
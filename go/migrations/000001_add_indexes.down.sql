@@ -0,0 +1,9 @@
+ALTER TABLE `icons` DROP INDEX `icons_user_id`;
+ALTER TABLE `themes` DROP INDEX `themes_user_id`;
+ALTER TABLE `livestreams` DROP INDEX `livestreams_user_id`;
+ALTER TABLE `livestream_tags` DROP INDEX `livestream_tags_livestream_id`, DROP INDEX `livestream_tags_tag_id_livestream_id`;
+ALTER TABLE `livestream_viewers_history` DROP INDEX `livestream_viewers_history_user_id_livestream_id`;
+ALTER TABLE `livecomments` DROP INDEX `livecomments_livestream_id_created_at`;
+ALTER TABLE `livecomment_reports` DROP INDEX `livecomment_reports_livestream_id`;
+ALTER TABLE `ng_words` DROP INDEX `ng_words_user_id_livestream_id_created_at`;
+ALTER TABLE `reactions` DROP INDEX `reactions_livestream_id_created_at`;
@@ -0,0 +1,10 @@
+-- これまで手で貼っていたインデックス
+ALTER TABLE `icons` ADD INDEX `icons_user_id` (`user_id`);
+ALTER TABLE `themes` ADD INDEX `themes_user_id` (`user_id`);
+ALTER TABLE `livestreams` ADD INDEX `livestreams_user_id` (`user_id`);
+ALTER TABLE `livestream_tags` ADD INDEX `livestream_tags_livestream_id` (`livestream_id`), ADD INDEX `livestream_tags_tag_id_livestream_id` (`tag_id`, `livestream_id`);
+ALTER TABLE `livestream_viewers_history` ADD INDEX `livestream_viewers_history_user_id_livestream_id` (`user_id`, `livestream_id`);
+ALTER TABLE `livecomments` ADD INDEX `livecomments_livestream_id_created_at` (`livestream_id`, `created_at`);
+ALTER TABLE `livecomment_reports` ADD INDEX `livecomment_reports_livestream_id` (`livestream_id`);
+ALTER TABLE `ng_words` ADD INDEX `ng_words_user_id_livestream_id_created_at` (`user_id`, `livestream_id`, `created_at`);
+ALTER TABLE `reactions` ADD INDEX `reactions_livestream_id_created_at` (`livestream_id`, `created_at`);
@@ -0,0 +1,4 @@
+ALTER TABLE `livecomments`
+  DROP COLUMN `deleted_at`,
+  DROP COLUMN `deleted_by`,
+  DROP COLUMN `delete_reason`;
@@ -0,0 +1,5 @@
+-- 削除したライブコメントは残しておき、後からスパムの分析ができるようにする
+ALTER TABLE `livecomments`
+  ADD COLUMN `deleted_at` BIGINT NULL DEFAULT NULL,
+  ADD COLUMN `deleted_by` BIGINT NULL DEFAULT NULL,
+  ADD COLUMN `delete_reason` VARCHAR(255) NULL DEFAULT NULL;
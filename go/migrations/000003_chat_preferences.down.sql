@@ -0,0 +1,2 @@
+DROP TABLE `chat_hidden_users`;
+DROP TABLE `chat_preferences`;
@@ -0,0 +1,16 @@
+-- 視聴者ごとのライブコメント表示設定
+CREATE TABLE `chat_preferences` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `min_tip` BIGINT NOT NULL DEFAULT 0,
+  `emoji_only` BOOLEAN NOT NULL DEFAULT FALSE,
+  UNIQUE `uniq_chat_preferences_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 視聴者が非表示にしたユーザ
+CREATE TABLE `chat_hidden_users` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `hidden_user_id` BIGINT NOT NULL,
+  UNIQUE `uniq_chat_hidden_users` (`user_id`, `hidden_user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
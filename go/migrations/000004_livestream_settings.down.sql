@@ -0,0 +1 @@
+DROP TABLE `livestream_settings`;
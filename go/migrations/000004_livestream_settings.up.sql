@@ -0,0 +1,7 @@
+-- 配信ごとの設定
+CREATE TABLE `livestream_settings` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `emoji_only_chat` BOOLEAN NOT NULL DEFAULT FALSE,
+  UNIQUE `uniq_livestream_settings_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,2 @@
+DROP TABLE `clip_reactions`;
+DROP TABLE `clips`;
@@ -0,0 +1,21 @@
+-- ライブ配信の切り抜き
+CREATE TABLE `clips` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `title` VARCHAR(255) NOT NULL,
+  `start_offset_seconds` BIGINT NOT NULL,
+  `end_offset_seconds` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `clips_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- クリップに対するリアクション (クリップのスコアになる)
+CREATE TABLE `clip_reactions` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `clip_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `emoji_name` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `clip_reactions_clip_id` (`clip_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,29 @@
+-- 配信中の投票
+CREATE TABLE `polls` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `question` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `closed_at` BIGINT NULL DEFAULT NULL,
+  INDEX `polls_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 投票の選択肢。votes は poll_votes の件数のカウンタキャッシュ
+CREATE TABLE `poll_options` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `poll_id` BIGINT NOT NULL,
+  `label` VARCHAR(255) NOT NULL,
+  `votes` BIGINT NOT NULL DEFAULT 0,
+  INDEX `poll_options_poll_id` (`poll_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 1ユーザ1票
+CREATE TABLE `poll_votes` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `poll_id` BIGINT NOT NULL,
+  `option_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_poll_votes_poll_id_user_id` (`poll_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
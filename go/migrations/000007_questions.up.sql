@@ -0,0 +1,20 @@
+-- 配信への質問 (Q&A)。votes は question_votes の件数のカウンタキャッシュ
+CREATE TABLE `questions` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `body` VARCHAR(255) NOT NULL,
+  `votes` BIGINT NOT NULL DEFAULT 0,
+  `answered_at` BIGINT NULL DEFAULT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `questions_livestream_id_votes` (`livestream_id`, `votes`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 1ユーザ1票
+CREATE TABLE `question_votes` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `question_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_question_votes_question_id_user_id` (`question_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
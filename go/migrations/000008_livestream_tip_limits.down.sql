@@ -0,0 +1,4 @@
+ALTER TABLE `livestream_settings`
+  DROP COLUMN `min_tip`,
+  DROP COLUMN `max_tip`,
+  DROP COLUMN `tip_cap_per_user`;
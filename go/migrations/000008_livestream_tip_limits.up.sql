@@ -0,0 +1,4 @@
+ALTER TABLE `livestream_settings`
+  ADD COLUMN `min_tip` BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN `max_tip` BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN `tip_cap_per_user` BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+DROP INDEX livecomment_reports_livestream_id_status ON livecomment_reports;
+ALTER TABLE `livecomment_reports`
+  DROP COLUMN `status`,
+  DROP COLUMN `reviewed_by`,
+  DROP COLUMN `reviewed_at`;
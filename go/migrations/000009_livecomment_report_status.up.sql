@@ -0,0 +1,5 @@
+ALTER TABLE `livecomment_reports`
+  ADD COLUMN `status` VARCHAR(16) NOT NULL DEFAULT 'open',
+  ADD COLUMN `reviewed_by` BIGINT NULL,
+  ADD COLUMN `reviewed_at` BIGINT NULL;
+CREATE INDEX livecomment_reports_livestream_id_status ON livecomment_reports(`livestream_id`, `status`);
@@ -0,0 +1,5 @@
+ALTER TABLE `livestream_settings`
+  DROP COLUMN `spam_hold_threshold`;
+ALTER TABLE `livecomments`
+  DROP COLUMN `spam_score`,
+  DROP COLUMN `held_at`;
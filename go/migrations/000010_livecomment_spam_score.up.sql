@@ -0,0 +1,5 @@
+ALTER TABLE `livecomments`
+  ADD COLUMN `spam_score` DOUBLE NOT NULL DEFAULT 0,
+  ADD COLUMN `held_at` BIGINT NULL;
+ALTER TABLE `livestream_settings`
+  ADD COLUMN `spam_hold_threshold` DOUBLE NOT NULL DEFAULT 0;
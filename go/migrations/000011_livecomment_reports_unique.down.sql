@@ -0,0 +1 @@
+DROP INDEX livecomment_reports_user_id_livecomment_id ON livecomment_reports;
@@ -0,0 +1,5 @@
+-- 同じユーザによる同じコメントへの重複した通報は最初の1件だけ残す
+DELETE r1 FROM livecomment_reports r1
+INNER JOIN livecomment_reports r2
+  ON r1.user_id = r2.user_id AND r1.livecomment_id = r2.livecomment_id AND r1.id > r2.id;
+CREATE UNIQUE INDEX livecomment_reports_user_id_livecomment_id ON livecomment_reports(`user_id`, `livecomment_id`);
@@ -0,0 +1,3 @@
+ALTER TABLE `themes`
+  DROP COLUMN `accent_color`,
+  DROP COLUMN `layout_preset`;
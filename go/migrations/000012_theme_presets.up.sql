@@ -0,0 +1,3 @@
+ALTER TABLE `themes`
+  ADD COLUMN `accent_color` VARCHAR(7) NOT NULL DEFAULT '#e65100',
+  ADD COLUMN `layout_preset` VARCHAR(32) NOT NULL DEFAULT 'standard';
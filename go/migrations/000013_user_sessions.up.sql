@@ -0,0 +1,10 @@
+-- ログイン中のセッション (ログアウト・強制失効したものは消す)
+CREATE TABLE `user_sessions` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `session_id` VARCHAR(36) NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  UNIQUE `uniq_user_sessions_session_id` (`session_id`),
+  INDEX `user_sessions_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
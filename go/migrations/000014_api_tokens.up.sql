@@ -0,0 +1,12 @@
+-- ボットや配信オーバーレイ向けのアクセストークン (平文は保存しない)
+CREATE TABLE `api_tokens` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `scope` VARCHAR(16) NOT NULL,
+  `token_hash` CHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `last_used_at` BIGINT NULL,
+  UNIQUE `uniq_api_tokens_token_hash` (`token_hash`),
+  INDEX `api_tokens_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
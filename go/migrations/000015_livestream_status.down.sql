@@ -0,0 +1,3 @@
+ALTER TABLE `livestreams`
+  DROP INDEX `livestreams_status_idx`,
+  DROP COLUMN `status`;
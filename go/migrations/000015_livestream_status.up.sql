@@ -0,0 +1,6 @@
+ALTER TABLE `livestreams`
+  ADD COLUMN `status` VARCHAR(16) NOT NULL DEFAULT 'reserved',
+  ADD INDEX `livestreams_status_idx` (`status`);
+
+-- 既存の配信は終了時刻を過ぎていれば終了扱いにする
+UPDATE `livestreams` SET `status` = 'ended' WHERE `end_at` <= UNIX_TIMESTAMP();
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `user_watch_stats`;
+DROP TABLE IF EXISTS `livestream_watch_stats`;
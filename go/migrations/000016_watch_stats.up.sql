@@ -0,0 +1,11 @@
+-- 入室から退室までの視聴時間の累計 (退室のたびに加算する)
+CREATE TABLE `livestream_watch_stats` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `total_seconds` BIGINT NOT NULL DEFAULT 0,
+  `sessions` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+CREATE TABLE `user_watch_stats` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `total_seconds` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `dns_registration_outbox`;
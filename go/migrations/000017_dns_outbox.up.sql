@@ -0,0 +1,9 @@
+-- ユーザ登録と同じトランザクションで書き込む、DNS に登録するサブドメインの記録
+-- 各サーバは処理済みの id を覚えておき、新しい行 (と直近の行) を自分の DNS に反映する
+CREATE TABLE `dns_registration_outbox` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `subdomain` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `dns_registration_outbox_created_at` (`created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,6 @@
+-- 管理者による利用停止。行があるユーザは書き込みができず、配信は検索・トレンド・ランキングに出ない
+CREATE TABLE `user_suspensions` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `reason` TEXT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
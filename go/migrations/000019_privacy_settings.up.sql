@@ -0,0 +1,5 @@
+-- ユーザごとの公開範囲の設定。行がなければすべて公開
+CREATE TABLE `privacy_settings` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `statistics_visibility` VARCHAR(16) NOT NULL DEFAULT 'public'
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
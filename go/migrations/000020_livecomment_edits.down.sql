@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS `livecomment_edits`;
+ALTER TABLE `livecomments`
+  DROP COLUMN `edited_at`;
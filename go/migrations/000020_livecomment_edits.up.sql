@@ -0,0 +1,10 @@
+-- 投稿者による編集。livecomments には編集後の本文と最後に編集した時刻を持ち、編集前の本文は livecomment_edits に残す
+ALTER TABLE `livecomments`
+  ADD COLUMN `edited_at` BIGINT NULL;
+CREATE TABLE `livecomment_edits` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livecomment_id` BIGINT NOT NULL,
+  `comment` VARCHAR(255) NOT NULL,
+  `edited_at` BIGINT NOT NULL,
+  INDEX livecomment_edits_livecomment_id (`livecomment_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,8 @@
+-- ユーザがブロックしたユーザ。ブロックしたユーザのライブコメントとリアクションは一覧にも配信にも出さない
+CREATE TABLE `user_blocks` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `blocked_user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_user_blocks` (`user_id`, `blocked_user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `livestream_ban_logs`;
+DROP TABLE IF EXISTS `livestream_bans`;
@@ -0,0 +1,19 @@
+-- 配信者が配信ごとにライブコメント・リアクションを禁止したユーザ
+CREATE TABLE `livestream_bans` (
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `reason` VARCHAR(255) NOT NULL DEFAULT '',
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+-- 禁止・解除の記録 (解除しても残す)
+CREATE TABLE `livestream_ban_logs` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `actor_id` BIGINT NOT NULL,
+  `action` VARCHAR(16) NOT NULL,
+  `reason` VARCHAR(255) NOT NULL DEFAULT '',
+  `created_at` BIGINT NOT NULL,
+  INDEX livestream_ban_logs_livestream_id (`livestream_id`, `id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
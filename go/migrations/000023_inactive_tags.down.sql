@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `inactive_tags`;
@@ -0,0 +1,5 @@
+-- 管理者が無効にしたタグ。新しい配信には付けられず、タグ一覧に出ない (付いている配信からは外さない)
+CREATE TABLE `inactive_tags` (
+  `tag_id` BIGINT NOT NULL PRIMARY KEY,
+  `deactivated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
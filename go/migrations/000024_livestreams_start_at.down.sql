@@ -0,0 +1 @@
+ALTER TABLE `livestreams` DROP INDEX `livestreams_start_at`;
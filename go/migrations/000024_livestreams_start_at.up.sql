@@ -0,0 +1 @@
+ALTER TABLE `livestreams` ADD INDEX `livestreams_start_at` (`start_at`);
@@ -0,0 +1,7 @@
+-- 配信ごとの配信キー (RTMP の取り込みサーバが配信者の認証に使う)。平文は発行時に持ち主に返すだけで、ハッシュだけを持つ
+CREATE TABLE `stream_keys` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `key_hash` VARCHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_stream_keys_key_hash` (`key_hash`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
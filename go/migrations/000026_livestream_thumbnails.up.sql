@@ -0,0 +1,8 @@
+-- 配信者がアップロードした配信のサムネイル (オブジェクトストレージを使うときは image は空で、画像はストレージにだけ置く)
+CREATE TABLE `livestream_thumbnails` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `image` LONGBLOB NOT NULL,
+  `content_type` VARCHAR(32) NOT NULL,
+  `hash` VARCHAR(64) NOT NULL,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
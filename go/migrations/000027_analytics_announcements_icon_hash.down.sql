@@ -0,0 +1,3 @@
+ALTER TABLE `icons` DROP COLUMN `hash`;
+DROP TABLE IF EXISTS `announcements`;
+DROP TABLE IF EXISTS `analytics_events`;
@@ -0,0 +1,20 @@
+-- 10_schema.sql は初期状態のままにするので、当初そちらに書いていた変更をここで行う
+-- フロントエンドから送信される行動ログ (スコア計算には使わない)
+CREATE TABLE IF NOT EXISTS `analytics_events` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `event_type` VARCHAR(64) NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `path` VARCHAR(255) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `occurred_at` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+-- 運営からのお知らせ
+CREATE TABLE IF NOT EXISTS `announcements` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `message` TEXT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+-- imageのsha256 (hex)。オブジェクトストレージのキーにもなる
+ALTER TABLE `icons` ADD COLUMN `hash` VARCHAR(64) NOT NULL DEFAULT '';
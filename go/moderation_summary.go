@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 通報の多いユーザの上位何件を返すか
+const moderationTopReportedUsersLimit = 10
+
+type NGWordHit struct {
+	WordID int64  `json:"word_id" db:"word_id"`
+	Word   string `json:"word" db:"word"`
+	// このワードにより削除されたライブコメントの数
+	Hits int64 `json:"hits" db:"hits"`
+}
+
+type ReportedUser struct {
+	User    User  `json:"user"`
+	Reports int64 `json:"reports"`
+}
+
+type ReportResolutionStats struct {
+	Total int64 `json:"total"`
+	// 通報されたライブコメントがまだ表示されている
+	Open int64 `json:"open"`
+	// 通報されたライブコメントが削除済み
+	Resolved int64 `json:"resolved"`
+	// 通報から削除までの平均秒数 (Resolved が 0 なら 0)
+	AvgResolutionSeconds float64 `json:"avg_resolution_seconds"`
+	// 配信者による対応状況ごとの件数
+	ByStatus map[string]int64 `json:"by_status"`
+}
+
+type ModerationSummary struct {
+	LivestreamID     int64                 `json:"livestream_id"`
+	NGWordHits       []NGWordHit           `json:"ng_word_hits"`
+	TopReportedUsers []ReportedUser        `json:"top_reported_users"`
+	ReportResolution ReportResolutionStats `json:"report_resolution"`
+	GeneratedAt      int64                 `json:"generated_at"`
+}
+
+type cachedModerationSummary struct {
+	summary   ModerationSummary
+	expiresAt time.Time
+}
+
+// moderationSummaries は livestreamID ごとの集計結果のキャッシュです。
+var moderationSummaries sync.Map
+
+func resetModerationSummaries() {
+	moderationSummaries.Range(func(key, _ interface{}) bool {
+		moderationSummaries.Delete(key)
+		return true
+	})
+}
+
+// モデレーション集計API (配信者、または管理者トークンを持つモデレーターのみ)
+// GET /api/livestream/:livestream_id/moderation/summary
+func getModerationSummaryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var livestreamModel LivestreamModel
+	if err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+
+	if c.Request().Header.Get(adminTokenHeader) != "" {
+		if err := verifyAdmin(c); err != nil {
+			return err
+		}
+	} else {
+		if err := verifyUserSession(c); err != nil {
+			return err
+		}
+
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		userID := sess.Values[defaultUserIDKey].(int64)
+
+		if livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't get moderation summary of other streamer's livestream")
+		}
+	}
+
+	if v, ok := moderationSummaries.Load(livestreamModel.ID); ok {
+		if cached := v.(cachedModerationSummary); time.Now().Before(cached.expiresAt) {
+			return c.JSON(http.StatusOK, cached.summary)
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	summary, err := buildModerationSummary(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build moderation summary: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	moderationSummaries.Store(livestreamModel.ID, cachedModerationSummary{summary: summary, expiresAt: time.Now().Add(currentConfig().ModerationSummaryTTL.duration())})
+
+	return c.JSON(http.StatusOK, summary)
+}
+
+func buildModerationSummary(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (ModerationSummary, error) {
+	summary := ModerationSummary{
+		LivestreamID: livestreamID,
+		GeneratedAt:  time.Now().Unix(),
+	}
+
+	// NGワードで論理削除されたコメントを、moderateHandler と同じ部分一致でワードごとに数える
+	hits := []NGWordHit{}
+	query := `
+	SELECT w.id AS word_id, w.word, COUNT(lc.id) AS hits
+	FROM ng_words w
+	LEFT JOIN livecomments lc
+		ON lc.livestream_id = w.livestream_id
+		AND lc.delete_reason = ?
+		AND lc.comment LIKE CONCAT('%', w.word, '%')
+	WHERE w.livestream_id = ?
+	GROUP BY w.id, w.word
+	ORDER BY hits DESC, w.id ASC
+	`
+	if err := tx.SelectContext(ctx, &hits, query, livecommentDeleteReasonNGWord, livestreamID); err != nil {
+		return ModerationSummary{}, err
+	}
+	summary.NGWordHits = hits
+
+	var reported []struct {
+		UserID  int64 `db:"user_id"`
+		Reports int64 `db:"reports"`
+	}
+	query = `
+	SELECT lc.user_id, COUNT(*) AS reports
+	FROM livecomment_reports r
+	INNER JOIN livecomments lc ON lc.id = r.livecomment_id
+	WHERE r.livestream_id = ?
+	GROUP BY lc.user_id
+	ORDER BY reports DESC, lc.user_id ASC
+	LIMIT ?
+	`
+	if err := tx.SelectContext(ctx, &reported, query, livestreamID, moderationTopReportedUsersLimit); err != nil {
+		return ModerationSummary{}, err
+	}
+	summary.TopReportedUsers = make([]ReportedUser, len(reported))
+	for i := range reported {
+		userModel := UserModel{}
+		if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", reported[i].UserID); err != nil {
+			return ModerationSummary{}, err
+		}
+		user, err := fillUserResponse(ctx, tx, userModel)
+		if err != nil {
+			return ModerationSummary{}, err
+		}
+		summary.TopReportedUsers[i] = ReportedUser{User: user, Reports: reported[i].Reports}
+	}
+
+	query = `
+	SELECT
+		COUNT(*) AS total,
+		IFNULL(SUM(lc.deleted_at IS NULL), 0) AS open,
+		IFNULL(SUM(lc.deleted_at IS NOT NULL), 0) AS resolved,
+		IFNULL(AVG(IF(lc.deleted_at IS NOT NULL, GREATEST(lc.deleted_at - r.created_at, 0), NULL)), 0) AS avg_resolution_seconds
+	FROM livecomment_reports r
+	INNER JOIN livecomments lc ON lc.id = r.livecomment_id
+	WHERE r.livestream_id = ?
+	`
+	var resolution struct {
+		Total                int64   `db:"total"`
+		Open                 int64   `db:"open"`
+		Resolved             int64   `db:"resolved"`
+		AvgResolutionSeconds float64 `db:"avg_resolution_seconds"`
+	}
+	if err := tx.GetContext(ctx, &resolution, query, livestreamID); err != nil {
+		return ModerationSummary{}, err
+	}
+	summary.ReportResolution = ReportResolutionStats{
+		Total:                resolution.Total,
+		Open:                 resolution.Open,
+		Resolved:             resolution.Resolved,
+		AvgResolutionSeconds: resolution.AvgResolutionSeconds,
+		ByStatus: map[string]int64{
+			livecommentReportStatusOpen:      0,
+			livecommentReportStatusReviewed:  0,
+			livecommentReportStatusDismissed: 0,
+			livecommentReportStatusActioned:  0,
+		},
+	}
+
+	var byStatus []struct {
+		Status string `db:"status"`
+		Count  int64  `db:"cnt"`
+	}
+	if err := tx.SelectContext(ctx, &byStatus, "SELECT status, COUNT(*) AS cnt FROM livecomment_reports WHERE livestream_id = ? GROUP BY status", livestreamID); err != nil {
+		return ModerationSummary{}, err
+	}
+	for _, row := range byStatus {
+		summary.ReportResolution.ByStatus[row.Status] = row.Count
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 一覧APIを Accept: application/x-ndjson で呼ぶと、スライスにすべて読み込まずに
+// カーソルから ndjsonChunkSize 行ずつ読んで組み立て、1 行 1 要素の JSON で書き出す。
+// 組み立て (fill) はトランザクションの接続で行うので、カーソルは別の接続で開くこと
+// (MySQL は読み終わっていない結果がある接続で次のクエリを実行できない)
+const (
+	mimeApplicationNDJSON = "application/x-ndjson"
+	ndjsonChunkSize       = 100
+)
+
+// wantsNDJSON はクライアントが NDJSON での応答を求めているかを返します。
+func wantsNDJSON(c echo.Context) bool {
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), mimeApplicationNDJSON)
+}
+
+// streamNDJSON は rows を ndjsonChunkSize 行ずつ M に読み、fill で組み立てたものを 1 行ずつ書き出します。
+// ヘッダを送った後は状態コードを変えられないので、途中で失敗したらログに残して打ち切る
+func streamNDJSON[M any, R any](c echo.Context, rows *sqlx.Rows, fill func(models []M) ([]R, error)) error {
+	defer rows.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, mimeApplicationNDJSON)
+	res.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(res)
+
+	flush := func(models []M) bool {
+		if len(models) == 0 {
+			return true
+		}
+		items, err := fill(models)
+		if err != nil {
+			log.Printf("failed to stream %s: %v", c.Path(), err)
+			return false
+		}
+		for i := range items {
+			if err := enc.Encode(items[i]); err != nil {
+				// クライアントが切断した
+				return false
+			}
+		}
+		res.Flush()
+		return true
+	}
+
+	chunk := make([]M, 0, ndjsonChunkSize)
+	for rows.Next() {
+		var m M
+		if err := rows.StructScan(&m); err != nil {
+			log.Printf("failed to stream %s: %v", c.Path(), err)
+			return nil
+		}
+		chunk = append(chunk, m)
+		if len(chunk) == ndjsonChunkSize {
+			if !flush(chunk) {
+				return nil
+			}
+			chunk = chunk[:0]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to stream %s: %v", c.Path(), err)
+		return nil
+	}
+	flush(chunk)
+	return nil
+}
@@ -2,17 +2,82 @@ package main
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
+// 内訳の集計単位 (?group_by=)
+const (
+	paymentGroupByLivestream = "livestream"
+	paymentGroupByUser       = "user"
+	paymentGroupByDay        = "day"
+)
+
+// 日ごとの内訳は日本時間 (UTC+9) で区切る
+const paymentDayOffset = 9 * 60 * 60
+
 type PaymentResult struct {
 	TotalTip int64 `json:"total_tip"`
 }
 
+// group_by を指定したときのレスポンス
+type PaymentBreakdownResult struct {
+	TotalTip  int64                   `json:"total_tip"`
+	GroupBy   string                  `json:"group_by"`
+	Breakdown []PaymentBreakdownEntry `json:"breakdown"`
+}
+
+// PaymentBreakdownEntry は集計単位ごとの投げ銭の合計です。集計単位に応じたキーだけを返します。
+type PaymentBreakdownEntry struct {
+	LivestreamID int64  `json:"livestream_id,omitempty" db:"livestream_id"`
+	Title        string `json:"title,omitempty" db:"title"`
+	// 配信者のユーザ名 (group_by=livestream|user)
+	Username string `json:"username,omitempty" db:"username"`
+	// YYYY-MM-DD (group_by=day)
+	Date     string `json:"date,omitempty" db:"-"`
+	Day      int64  `json:"-" db:"day"`
+	TotalTip int64  `json:"total_tip" db:"total_tip"`
+	TipCount int64  `json:"tip_count" db:"tip_count"`
+}
+
+var paymentBreakdownQueries = map[string]string{
+	paymentGroupByLivestream: `
+	SELECT l.id AS livestream_id, l.title, u.name AS username, SUM(c.tip) AS total_tip, COUNT(*) AS tip_count
+	FROM livecomments c
+	INNER JOIN livestreams l ON l.id = c.livestream_id
+	INNER JOIN users u ON u.id = l.user_id
+	WHERE c.deleted_at IS NULL AND c.tip > 0
+	GROUP BY l.id, l.title, u.name
+	ORDER BY total_tip DESC, l.id ASC`,
+	paymentGroupByUser: `
+	SELECT u.name AS username, SUM(c.tip) AS total_tip, COUNT(*) AS tip_count
+	FROM livecomments c
+	INNER JOIN livestreams l ON l.id = c.livestream_id
+	INNER JOIN users u ON u.id = l.user_id
+	WHERE c.deleted_at IS NULL AND c.tip > 0
+	GROUP BY u.id, u.name
+	ORDER BY total_tip DESC, u.name ASC`,
+	paymentGroupByDay: `
+	SELECT FLOOR((c.created_at + ?) / 86400) AS day, SUM(c.tip) AS total_tip, COUNT(*) AS tip_count
+	FROM livecomments c
+	WHERE c.deleted_at IS NULL AND c.tip > 0
+	GROUP BY day
+	ORDER BY day ASC`,
+}
+
+// 支払い結果API
+// GET /api/payment?group_by=livestream|user|day
+// group_by を指定すると、合計に加えて配信ごと・配信者ごと・日ごとの内訳を返す
 func GetPaymentResult(c echo.Context) error {
 	ctx := c.Request().Context()
 
+	groupBy := c.QueryParam("group_by")
+	breakdownQuery, ok := paymentBreakdownQueries[groupBy]
+	if groupBy != "" && !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "group_by query parameter must be livestream, user or day")
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -20,15 +85,38 @@ func GetPaymentResult(c echo.Context) error {
 	defer tx.Rollback()
 
 	var totalTip int64
-	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
+	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments WHERE deleted_at IS NULL"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
 	}
 
+	breakdown := []PaymentBreakdownEntry{}
+	if groupBy != "" {
+		var args []interface{}
+		if groupBy == paymentGroupByDay {
+			args = append(args, paymentDayOffset)
+		}
+		if err := tx.SelectContext(ctx, &breakdown, breakdownQuery, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get payment breakdown: "+err.Error())
+		}
+		if groupBy == paymentGroupByDay {
+			for i := range breakdown {
+				breakdown[i].Date = time.Unix(breakdown[i].Day*86400, 0).UTC().Format(time.DateOnly)
+			}
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, &PaymentResult{
-		TotalTip: totalTip,
+	if groupBy == "" {
+		return c.JSON(http.StatusOK, &PaymentResult{
+			TotalTip: totalTip,
+		})
+	}
+	return c.JSON(http.StatusOK, &PaymentBreakdownResult{
+		TotalTip:  totalTip,
+		GroupBy:   groupBy,
+		Breakdown: breakdown,
 	})
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// initialize を受けたサーバから他のサーバ (ISUCON13_PEERS にカンマ区切りで http://host:port を並べる) の
+// 内部APIを叩き、キャッシュなどを温めてからベンチマーカーに応答する
+func peerInternalPaths() []string {
+	paths := []string{"/internal/rebuild/dns"}
+	// Redis の視聴履歴は全サーバで共有していてこのサーバで作り直し済み (並行して作り直すと件数が重複する)
+	// プロセス内に持つユニーク視聴者数のスケッチだけはサーバごとに作り直す
+	if viewerHistoryOnMySQL() {
+		paths = append(paths, "/internal/rebuild/counters")
+	}
+	return append(paths, "/internal/warm/caches")
+}
+
+func peerServers() []string {
+	var peers []string
+	for _, p := range strings.Split(os.Getenv("ISUCON13_PEERS"), ",") {
+		if p = strings.TrimRight(strings.TrimSpace(p), "/"); p != "" {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+type PeerInitResult struct {
+	Peer      string  `json:"peer"`
+	Ready     bool    `json:"ready"`
+	ElapsedMS float64 `json:"elapsed_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// initializePeers は全サーバを並行して初期化し、結果を ISUCON13_PEERS の順に返します。
+// 1 台が失敗しても他のサーバの初期化は続けます。
+func initializePeers(ctx context.Context) []PeerInitResult {
+	peers := peerServers()
+	if len(peers) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, currentConfig().PeerInitTimeout.duration())
+	defer cancel()
+
+	results := make([]PeerInitResult, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			start := time.Now()
+			err := initializePeer(ctx, peer)
+			results[i] = PeerInitResult{
+				Peer:      peer,
+				Ready:     err == nil,
+				ElapsedMS: durationMS(time.Since(start)),
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+				log.Printf("failed to initialize peer %s: %v", peer, err)
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+	return results
+}
+
+func initializePeer(ctx context.Context, peer string) error {
+	for _, path := range peerInternalPaths() {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+path, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(adminTokenHeader, adminToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned %d: %s", path, res.StatusCode, body)
+		}
+	}
+	return nil
+}
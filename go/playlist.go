@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 再生情報と視聴トークン
+// 配信の再生 URL と一緒に、メディアのエッジサーバが視聴者を確かめるための視聴トークンを発行する。
+// 視聴トークンは <ペイロードの JSON の base64url>.<その HMAC-SHA256 の base64url> で、
+// エッジサーバは ISUCON13_VIEWER_TOKEN_SECRET を共有するだけで、セッションを引かずに署名と期限を確かめられる
+var viewerTokenSecret = []byte("isucon13_viewer_token_defaultsecret")
+
+func init() {
+	if secretKey, ok := os.LookupEnv("ISUCON13_VIEWER_TOKEN_SECRET"); ok {
+		viewerTokenSecret = []byte(secretKey)
+	}
+}
+
+type viewerTokenPayload struct {
+	LivestreamID int64 `json:"lid"`
+	UserID       int64 `json:"uid"`
+	ExpiresAt    int64 `json:"exp"`
+}
+
+type LivestreamPlaylist struct {
+	LivestreamID int64  `json:"livestream_id"`
+	PlaylistUrl  string `json:"playlist_url"`
+	Status       string `json:"status"`
+	// 再生 URL へのリクエストに付ける視聴トークンとその期限 (unix 秒)
+	ViewerToken          string `json:"viewer_token"`
+	ViewerTokenExpiresAt int64  `json:"viewer_token_expires_at"`
+}
+
+func signViewerToken(payload viewerTokenPayload) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, viewerTokenSecret)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(b) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// 再生情報API
+// GET /api/livestream/:livestream_id/playlist
+func getLivestreamPlaylistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, ok, err := livestreamRegistryCache.get(ctx, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+	}
+
+	expiresAt := time.Now().Add(currentConfig().ViewerTokenTTL.duration()).Unix()
+	token, err := signViewerToken(viewerTokenPayload{LivestreamID: livestreamModel.ID, UserID: userID, ExpiresAt: expiresAt})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to sign viewer token: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, LivestreamPlaylist{
+		LivestreamID:         livestreamModel.ID,
+		PlaylistUrl:          livestreamModel.PlaylistUrl,
+		Status:               livestreamModel.Status,
+		ViewerToken:          token,
+		ViewerTokenExpiresAt: expiresAt,
+	})
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	hubMessagePollResult = "poll_result"
+
+	pollMinOptions = 2
+	pollMaxOptions = 10
+)
+
+type PostPollRequest struct {
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+}
+
+type PostPollVoteRequest struct {
+	OptionID int64 `json:"option_id"`
+}
+
+type PollModel struct {
+	ID           int64         `db:"id"`
+	LivestreamID int64         `db:"livestream_id"`
+	UserID       int64         `db:"user_id"`
+	Question     string        `db:"question"`
+	CreatedAt    int64         `db:"created_at"`
+	ClosedAt     sql.NullInt64 `db:"closed_at"`
+}
+
+// PollOptionModel の votes は poll_votes の件数のカウンタキャッシュで、投票と同じトランザクションで更新する
+type PollOptionModel struct {
+	ID     int64  `db:"id"`
+	PollID int64  `db:"poll_id"`
+	Label  string `db:"label"`
+	Votes  int64  `db:"votes"`
+}
+
+type PollOption struct {
+	ID    int64  `json:"id"`
+	Label string `json:"label"`
+	Votes int64  `json:"votes"`
+}
+
+type Poll struct {
+	ID           int64        `json:"id"`
+	LivestreamID int64        `json:"livestream_id"`
+	Question     string       `json:"question"`
+	Options      []PollOption `json:"options"`
+	TotalVotes   int64        `json:"total_votes"`
+	Closed       bool         `json:"closed"`
+	CreatedAt    int64        `json:"created_at"`
+}
+
+// 投票作成API (配信者のみ)
+// POST /api/livestream/:livestream_id/polls
+func postPollHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostPollRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Question == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "question is required")
+	}
+	if len(req.Options) < pollMinOptions || len(req.Options) > pollMaxOptions {
+		return echo.NewHTTPError(http.StatusBadRequest, "options must have between "+strconv.Itoa(pollMinOptions)+" and "+strconv.Itoa(pollMaxOptions)+" items")
+	}
+
+	var poll Poll
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			}
+		}
+		if livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't create polls on other streamer's livestream")
+		}
+
+		pollModel := PollModel{
+			LivestreamID: livestreamModel.ID,
+			UserID:       userID,
+			Question:     req.Question,
+			CreatedAt:    time.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO polls (livestream_id, user_id, question, created_at) VALUES (:livestream_id, :user_id, :question, :created_at)", pollModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert poll: "+err.Error())
+		}
+		pollID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted poll id: "+err.Error())
+		}
+		pollModel.ID = pollID
+
+		for _, label := range req.Options {
+			if label == "" {
+				return echo.NewHTTPError(http.StatusBadRequest, "option label must not be empty")
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO poll_options (poll_id, label) VALUES (?, ?)", pollID, label); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert poll option: "+err.Error())
+			}
+		}
+
+		poll, err = fillPollResponse(ctx, tx, pollModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill poll: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	hub.publish(poll.LivestreamID, HubMessage{
+		Type: hubMessagePollResult,
+		Data: poll,
+	})
+
+	return c.JSON(http.StatusCreated, poll)
+}
+
+// 投票一覧API
+// GET /api/livestream/:livestream_id/polls
+func getPollsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var pollModels []PollModel
+	if err := tx.SelectContext(ctx, &pollModels, "SELECT * FROM polls WHERE livestream_id = ? ORDER BY created_at DESC, id DESC", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get polls: "+err.Error())
+	}
+
+	polls := make([]Poll, len(pollModels))
+	for i := range pollModels {
+		poll, err := fillPollResponse(ctx, tx, pollModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill poll: "+err.Error())
+		}
+		polls[i] = poll
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, polls)
+}
+
+// 投票API (1ユーザ1票)
+// POST /api/livestream/:livestream_id/polls/:poll_id/vote
+func postPollVoteHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	pollID, err := strconv.ParseInt(c.Param("poll_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "poll_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostPollVoteRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	var poll Poll
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		pollModel, err := getPollForLivestream(ctx, tx, pollID, int64(livestreamID))
+		if err != nil {
+			return err
+		}
+		if pollModel.ClosedAt.Valid {
+			return echo.NewHTTPError(http.StatusConflict, "poll is already closed")
+		}
+
+		var optionExists bool
+		if err := tx.GetContext(ctx, &optionExists, "SELECT EXISTS(SELECT 1 FROM poll_options WHERE id = ? AND poll_id = ?)", req.OptionID, pollID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get poll option: "+err.Error())
+		}
+		if !optionExists {
+			return echo.NewHTTPError(http.StatusBadRequest, "option_id does not belong to the poll")
+		}
+
+		// (poll_id, user_id) のユニーク制約で二重投票を弾く
+		rs, err := tx.ExecContext(ctx, "INSERT IGNORE INTO poll_votes (poll_id, option_id, user_id, created_at) VALUES (?, ?, ?, ?)", pollID, req.OptionID, userID, time.Now().Unix())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert poll vote: "+err.Error())
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusConflict, "already voted")
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE poll_options SET votes = votes + 1 WHERE id = ?", req.OptionID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update poll option votes: "+err.Error())
+		}
+
+		poll, err = fillPollResponse(ctx, tx, pollModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill poll: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	hub.publish(poll.LivestreamID, HubMessage{
+		Type: hubMessagePollResult,
+		Data: poll,
+	})
+
+	return c.JSON(http.StatusCreated, poll)
+}
+
+// 投票締め切りAPI (配信者のみ)
+// POST /api/livestream/:livestream_id/polls/:poll_id/close
+func closePollHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	pollID, err := strconv.ParseInt(c.Param("poll_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "poll_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var poll Poll
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		pollModel, err := getPollForLivestream(ctx, tx, pollID, int64(livestreamID))
+		if err != nil {
+			return err
+		}
+		if pollModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't close other streamer's poll")
+		}
+		if !pollModel.ClosedAt.Valid {
+			now := time.Now().Unix()
+			if _, err := tx.ExecContext(ctx, "UPDATE polls SET closed_at = ? WHERE id = ?", now, pollID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to close poll: "+err.Error())
+			}
+			pollModel.ClosedAt = sql.NullInt64{Int64: now, Valid: true}
+		}
+
+		poll, err = fillPollResponse(ctx, tx, pollModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill poll: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	hub.publish(poll.LivestreamID, HubMessage{
+		Type: hubMessagePollResult,
+		Data: poll,
+	})
+
+	return c.JSON(http.StatusOK, poll)
+}
+
+// getPollForLivestream は配信に属する投票を返します。見つからなければ echo.HTTPError を返します。
+func getPollForLivestream(ctx context.Context, tx *sqlx.Tx, pollID, livestreamID int64) (PollModel, error) {
+	var pollModel PollModel
+	if err := tx.GetContext(ctx, &pollModel, "SELECT * FROM polls WHERE id = ? AND livestream_id = ?", pollID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PollModel{}, echo.NewHTTPError(http.StatusNotFound, "poll not found")
+		}
+		return PollModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get poll: "+err.Error())
+	}
+	return pollModel, nil
+}
+
+func fillPollResponse(ctx context.Context, tx *sqlx.Tx, pollModel PollModel) (Poll, error) {
+	var optionModels []PollOptionModel
+	if err := tx.SelectContext(ctx, &optionModels, "SELECT * FROM poll_options WHERE poll_id = ? ORDER BY id", pollModel.ID); err != nil {
+		return Poll{}, err
+	}
+
+	options := make([]PollOption, len(optionModels))
+	var totalVotes int64
+	for i, optionModel := range optionModels {
+		options[i] = PollOption{
+			ID:    optionModel.ID,
+			Label: optionModel.Label,
+			Votes: optionModel.Votes,
+		}
+		totalVotes += optionModel.Votes
+	}
+
+	return Poll{
+		ID:           pollModel.ID,
+		LivestreamID: pollModel.LivestreamID,
+		Question:     pollModel.Question,
+		Options:      options,
+		TotalVotes:   totalVotes,
+		Closed:       pollModel.ClosedAt.Valid,
+		CreatedAt:    pollModel.CreatedAt,
+	}, nil
+}
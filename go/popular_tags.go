@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 人気のタグ
+// 配信ごとの直近 1 時間のスコア (リアクション数と投げ銭の合計) を 1 分ごとのバケットで数えておき、
+// 問い合わせのたびにタグの索引 (tag_index.go) でタグごとに集計する。livestream_tags は読まない
+// 他のサーバで受けたリアクション・投げ銭は数えない (メトリクスと同じ)
+const (
+	popularTagsDefaultSize = 10
+	popularTagsMaxSize     = 100
+)
+
+var livestreamActivity = newSlidingCounter(time.Minute, 60)
+
+// 人気のタグAPI
+// GET /api/tag/popular?limit=
+func getPopularTagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := popularTagsDefaultSize
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 || l > popularTagsMaxSize {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(popularTagsMaxSize))
+		}
+		limit = l
+	}
+
+	tags, err := livestreamTagIndex.popular(ctx, livestreamActivity.totals())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get popular tags: "+err.Error())
+	}
+	if len(tags) > limit {
+		tags = tags[:limit]
+	}
+	return c.JSON(http.StatusOK, tags)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ユーザごとの公開範囲の設定
+// statistics_visibility を private にすると、ユーザ統計API は本人と管理者にしか返さない。
+// ランキングは全ユーザの集計値だけを出すので、設定によらずこれまで通り含める
+const (
+	statisticsVisibilityPublic  = "public"
+	statisticsVisibilityPrivate = "private"
+)
+
+type PrivacySettings struct {
+	StatisticsVisibility string `json:"statistics_visibility"`
+}
+
+type PrivacySettingsModel struct {
+	UserID               int64  `db:"user_id"`
+	StatisticsVisibility string `db:"statistics_visibility"`
+}
+
+type cachedPrivacySettings struct {
+	settings  PrivacySettings
+	expiresAt time.Time
+}
+
+// privacySettingsCache は userID ごとの設定のキャッシュです。設定の更新時に消します。
+var privacySettingsCache sync.Map
+
+func resetPrivacySettingsCache() {
+	privacySettingsCache.Range(func(key, _ interface{}) bool {
+		privacySettingsCache.Delete(key)
+		return true
+	})
+}
+
+func defaultPrivacySettings() PrivacySettings {
+	return PrivacySettings{StatisticsVisibility: statisticsVisibilityPublic}
+}
+
+// getPrivacySettings はユーザの公開範囲の設定を返します。設定がなければすべて公開です。
+func getPrivacySettings(ctx context.Context, userID int64) (PrivacySettings, error) {
+	if v, ok := privacySettingsCache.Load(userID); ok {
+		if cached := v.(cachedPrivacySettings); time.Now().Before(cached.expiresAt) {
+			return cached.settings, nil
+		}
+	}
+
+	settings := defaultPrivacySettings()
+	var model PrivacySettingsModel
+	if err := dbConn.GetContext(ctx, &model, "SELECT * FROM privacy_settings WHERE user_id = ?", userID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return PrivacySettings{}, err
+		}
+	} else {
+		settings.StatisticsVisibility = model.StatisticsVisibility
+	}
+
+	privacySettingsCache.Store(userID, cachedPrivacySettings{settings: settings, expiresAt: time.Now().Add(currentConfig().PrivacySettingsTTL.duration())})
+	return settings, nil
+}
+
+// verifyStatisticsVisible はログイン中のユーザ (か管理者) が userID のユーザ統計を見てよいかを確かめます。
+// verifyUserSession で検証した後に呼ぶこと
+func verifyStatisticsVisible(c echo.Context, userID int64) error {
+	settings, err := getPrivacySettings(c.Request().Context(), userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get privacy settings: "+err.Error())
+	}
+	if settings.StatisticsVisibility != statisticsVisibilityPrivate {
+		return nil
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	if sess.Values[defaultUserIDKey].(int64) == userID {
+		return nil
+	}
+	if verifyAdmin(c) == nil {
+		return nil
+	}
+	return echo.NewHTTPError(http.StatusForbidden, "the user's statistics are private")
+}
+
+// 公開範囲の設定取得API
+// GET /api/user/me/privacy
+func getPrivacySettingsHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	settings, err := getPrivacySettings(c.Request().Context(), userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get privacy settings: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, settings)
+}
+
+// 公開範囲の設定更新API
+// PUT /api/user/me/privacy
+func putPrivacySettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req PrivacySettings
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.StatisticsVisibility != statisticsVisibilityPublic && req.StatisticsVisibility != statisticsVisibilityPrivate {
+		return echo.NewHTTPError(http.StatusBadRequest, "statistics_visibility must be public or private")
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO privacy_settings (user_id, statistics_visibility) VALUES (?, ?) ON DUPLICATE KEY UPDATE statistics_visibility = VALUES(statistics_visibility)", userID, req.StatisticsVisibility); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update privacy settings: "+err.Error())
+	}
+	privacySettingsCache.Delete(userID)
+
+	return c.JSON(http.StatusOK, req)
+}
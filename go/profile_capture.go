@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultProfileCaptureInterval = 10 * time.Second
+	// ベンチマークは60秒なので少し余裕を持たせる
+	defaultProfileCaptureDuration = 75 * time.Second
+)
+
+// profileCapturer はベンチマーク中に CPU / heap / goroutine プロファイルを定期的に取得します。
+// ISUCON13_PPROF_CAPTURE_DIR が設定されていれば /api/initialize のたびに自動で開始します。
+type profileCapturer struct {
+	mu       sync.Mutex
+	dir      string
+	interval time.Duration
+	duration time.Duration
+	// pyroscopeURL が設定されていれば CPU プロファイルを送信します
+	pyroscopeURL string
+	cancel       context.CancelFunc
+	generation   int
+	// CPU プロファイルは同時に1つしか取れないので run を直列化する
+	runMu sync.Mutex
+}
+
+var profiles = newProfileCapturer()
+
+func newProfileCapturer() *profileCapturer {
+	p := &profileCapturer{
+		dir:          os.Getenv("ISUCON13_PPROF_CAPTURE_DIR"),
+		interval:     defaultProfileCaptureInterval,
+		duration:     defaultProfileCaptureDuration,
+		pyroscopeURL: os.Getenv("ISUCON13_PYROSCOPE_URL"),
+	}
+	if v, ok := os.LookupEnv("ISUCON13_PPROF_CAPTURE_INTERVAL"); ok {
+		if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+			p.interval = time.Duration(sec) * time.Second
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_PPROF_CAPTURE_DURATION"); ok {
+		if sec, err := strconv.Atoi(v); err == nil && sec > 0 {
+			p.duration = time.Duration(sec) * time.Second
+		}
+	}
+	return p
+}
+
+func (p *profileCapturer) enabled() bool {
+	return p.dir != "" || p.pyroscopeURL != ""
+}
+
+func (p *profileCapturer) running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cancel != nil
+}
+
+// start は duration の間プロファイルを取り続けます。実行中の場合は取り直します。
+func (p *profileCapturer) start(duration time.Duration) error {
+	if !p.enabled() {
+		return fmt.Errorf("profile capture is not configured")
+	}
+	if p.dir != "" {
+		if err := os.MkdirAll(p.dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	if p.cancel != nil {
+		p.cancel()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	p.cancel = cancel
+	p.generation++
+	generation := p.generation
+	p.mu.Unlock()
+
+	go p.run(ctx, generation)
+	return nil
+}
+
+func (p *profileCapturer) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+}
+
+func (p *profileCapturer) run(ctx context.Context, generation int) {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	if ctx.Err() != nil {
+		// 待っている間に取り直しや停止がされた
+		return
+	}
+
+	runID := time.Now().Format("20060102-150405")
+	log.Printf("profile capture started: run=%s interval=%s", runID, p.interval)
+	defer log.Printf("profile capture finished: run=%s", runID)
+
+	for seq := 0; ; seq++ {
+		from := time.Now()
+		var cpu bytes.Buffer
+		if err := pprof.StartCPUProfile(&cpu); err != nil {
+			// fgprof やプロファイラの CPU プロファイルと衝突した場合
+			log.Printf("failed to start cpu profile: %v", err)
+			p.stop()
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(p.interval):
+		}
+		pprof.StopCPUProfile()
+
+		prefix := fmt.Sprintf("%s-%03d", runID, seq)
+		p.save(prefix+"-cpu.pb.gz", cpu.Bytes())
+		p.push(cpu.Bytes(), from, time.Now())
+		for _, name := range []string{"heap", "goroutine"} {
+			var buf bytes.Buffer
+			if err := pprof.Lookup(name).WriteTo(&buf, 0); err != nil {
+				log.Printf("failed to write %s profile: %v", name, err)
+				continue
+			}
+			p.save(prefix+"-"+name+".pb.gz", buf.Bytes())
+		}
+
+		if ctx.Err() != nil {
+			p.mu.Lock()
+			if p.generation == generation {
+				p.cancel = nil
+			}
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (p *profileCapturer) save(name string, data []byte) {
+	if p.dir == "" {
+		return
+	}
+	if err := os.WriteFile(filepath.Join(p.dir, name), data, 0o644); err != nil {
+		log.Printf("failed to save profile %s: %v", name, err)
+	}
+}
+
+func (p *profileCapturer) push(data []byte, from, until time.Time) {
+	if p.pyroscopeURL == "" {
+		return
+	}
+	q := url.Values{}
+	q.Set("name", "isupipe.cpu")
+	q.Set("from", strconv.FormatInt(from.Unix(), 10))
+	q.Set("until", strconv.FormatInt(until.Unix(), 10))
+	q.Set("format", "pprof")
+	res, err := http.Post(p.pyroscopeURL+"/ingest?"+q.Encode(), "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		log.Printf("failed to push profile to pyroscope: %v", err)
+		return
+	}
+	res.Body.Close()
+}
+
+type ProfileCaptureRequest struct {
+	DurationSeconds int `json:"duration_seconds"`
+}
+
+type ProfileCaptureResponse struct {
+	Running bool `json:"running"`
+}
+
+// プロファイル取得開始API
+// POST /api/admin/profile/start
+func postProfileStartHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	duration := profiles.duration
+	var req ProfileCaptureRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err == nil && req.DurationSeconds > 0 {
+		duration = time.Duration(req.DurationSeconds) * time.Second
+	}
+
+	if err := profiles.start(duration); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to start profile capture: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, &ProfileCaptureResponse{Running: true})
+}
+
+// プロファイル取得停止API
+// POST /api/admin/profile/stop
+func postProfileStopHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	profiles.stop()
+	return c.JSON(http.StatusOK, &ProfileCaptureResponse{Running: profiles.running()})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ハンドラごとのクエリの実行時間・ロック待ちの上限
+// 重い集計クエリがロックを握り続けて、ライブコメント投稿などの書き込みを止めないようにする。
+// 設定の query_hints か、ISUCON13_QUERY_HINTS に「メソッド ルート=名前:値,...」をセミコロン区切りで並べる
+//
+//	ISUCON13_QUERY_HINTS="GET /api/user/:username/statistics=max_execution_time:2000,innodb_lock_wait_timeout:1"
+//
+// max_execution_time はミリ秒で SELECT にだけ効く。innodb_lock_wait_timeout は秒。
+// どちらもセッション変数ではなくオプティマイザヒントでクエリごとに付けるので、接続を使い回しても後に残らない
+type queryHints struct {
+	MaxExecutionTimeMS    int64 `json:"max_execution_time"`
+	LockWaitTimeoutSecond int64 `json:"innodb_lock_wait_timeout"`
+}
+
+type queryHintsKey struct{}
+
+// parseRouteQueryHints は ISUCON13_QUERY_HINTS の値を読みます。読めないエントリは無視します。
+func parseRouteQueryHints(v string) map[string]queryHints {
+	hints := map[string]queryHints{}
+	for _, entry := range strings.Split(v, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, params, ok := strings.Cut(entry, "=")
+		if !ok {
+			log.Printf("invalid ISUCON13_QUERY_HINTS entry: %q", entry)
+			continue
+		}
+		h, err := parseQueryHints(params)
+		if err != nil {
+			log.Printf("invalid ISUCON13_QUERY_HINTS entry: %q: %v", entry, err)
+			continue
+		}
+		hints[route] = h
+	}
+	return hints
+}
+
+// normalizeRouteQueryHints はルートの空白を詰め、上限のないエントリを除きます。
+func normalizeRouteQueryHints(hints map[string]queryHints) map[string]queryHints {
+	normalized := make(map[string]queryHints, len(hints))
+	for route, h := range hints {
+		h.MaxExecutionTimeMS = max(h.MaxExecutionTimeMS, 0)
+		h.LockWaitTimeoutSecond = max(h.LockWaitTimeoutSecond, 0)
+		if h.MaxExecutionTimeMS == 0 && h.LockWaitTimeoutSecond == 0 {
+			continue
+		}
+		normalized[strings.Join(strings.Fields(route), " ")] = h
+	}
+	return normalized
+}
+
+func parseQueryHints(v string) (queryHints, error) {
+	var h queryHints
+	for _, param := range strings.Split(v, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), ":")
+		if !ok {
+			return h, fmt.Errorf("missing value for %q", param)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return h, fmt.Errorf("%s must be a positive integer", name)
+		}
+		switch name {
+		case "max_execution_time":
+			h.MaxExecutionTimeMS = n
+		case "innodb_lock_wait_timeout":
+			h.LockWaitTimeoutSecond = n
+		default:
+			return h, fmt.Errorf("unknown hint %q", name)
+		}
+	}
+	return h, nil
+}
+
+func withQueryHints(ctx context.Context, h queryHints) context.Context {
+	return context.WithValue(ctx, queryHintsKey{}, h)
+}
+
+// queryHintsMiddleware はルートに設定した上限をリクエストのコンテキストに載せます。
+func queryHintsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if h, ok := currentConfig().QueryHints[c.Request().Method+" "+c.Path()]; ok {
+			req := c.Request()
+			c.SetRequest(req.WithContext(withQueryHints(req.Context(), h)))
+		}
+		return next(c)
+	}
+}
+
+// applyQueryHints はコンテキストに上限があれば、クエリの先頭のキーワードの直後にオプティマイザヒントを差し込みます。
+// SELECT / INSERT / UPDATE / DELETE / REPLACE 以外 (SET や BEGIN など) はそのまま返します。
+func applyQueryHints(ctx context.Context, query string) string {
+	h, ok := ctx.Value(queryHintsKey{}).(queryHints)
+	if !ok {
+		return query
+	}
+
+	trimmed := strings.TrimLeft(query, " \t\r\n")
+	keyword := trimmed
+	if i := strings.IndexAny(trimmed, " \t\r\n"); i >= 0 {
+		keyword = trimmed[:i]
+	}
+	keyword = strings.ToUpper(keyword)
+
+	var hints []string
+	switch keyword {
+	case "SELECT":
+		if h.MaxExecutionTimeMS > 0 {
+			hints = append(hints, fmt.Sprintf("MAX_EXECUTION_TIME(%d)", h.MaxExecutionTimeMS))
+		}
+	case "INSERT", "UPDATE", "DELETE", "REPLACE":
+	default:
+		return query
+	}
+	if h.LockWaitTimeoutSecond > 0 {
+		hints = append(hints, fmt.Sprintf("SET_VAR(innodb_lock_wait_timeout=%d)", h.LockWaitTimeoutSecond))
+	}
+	if len(hints) == 0 {
+		return query
+	}
+	return trimmed[:len(keyword)] + " /*+ " + strings.Join(hints, " ") + " */" + trimmed[len(keyword):]
+}
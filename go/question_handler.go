@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const hubMessageQuestion = "question"
+
+type PostQuestionRequest struct {
+	Body string `json:"body"`
+}
+
+// QuestionModel の votes は question_votes の件数のカウンタキャッシュ
+type QuestionModel struct {
+	ID           int64         `db:"id"`
+	LivestreamID int64         `db:"livestream_id"`
+	UserID       int64         `db:"user_id"`
+	Body         string        `db:"body"`
+	Votes        int64         `db:"votes"`
+	AnsweredAt   sql.NullInt64 `db:"answered_at"`
+	CreatedAt    int64         `db:"created_at"`
+}
+
+type Question struct {
+	ID           int64  `json:"id"`
+	LivestreamID int64  `json:"livestream_id"`
+	User         User   `json:"user"`
+	Body         string `json:"body"`
+	Votes        int64  `json:"votes"`
+	Answered     bool   `json:"answered"`
+	AnsweredAt   *int64 `json:"answered_at"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// 質問投稿API
+// POST /api/livestream/:livestream_id/questions
+func postQuestionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostQuestionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Body == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "body is required")
+	}
+
+	var question Question
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		if !exists {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+
+		questionModel := QuestionModel{
+			LivestreamID: int64(livestreamID),
+			UserID:       userID,
+			Body:         req.Body,
+			CreatedAt:    time.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO questions (livestream_id, user_id, body, created_at) VALUES (:livestream_id, :user_id, :body, :created_at)", questionModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert question: "+err.Error())
+		}
+		questionID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted question id: "+err.Error())
+		}
+		questionModel.ID = questionID
+
+		question, err = fillQuestionResponse(ctx, tx, questionModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill question: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	hub.publish(question.LivestreamID, HubMessage{
+		Type: hubMessageQuestion,
+		Data: question,
+	})
+
+	return c.JSON(http.StatusCreated, question)
+}
+
+// 質問一覧API (投票数の多い順)
+// GET /api/livestream/:livestream_id/questions?answered=
+func getQuestionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	query := "SELECT * FROM questions WHERE livestream_id = ?"
+	if v := c.QueryParam("answered"); v != "" {
+		answered, err := strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "answered query parameter must be boolean")
+		}
+		if answered {
+			query += " AND answered_at IS NOT NULL"
+		} else {
+			query += " AND answered_at IS NULL"
+		}
+	}
+	query += " ORDER BY votes DESC, created_at ASC, id ASC"
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var questionModels []QuestionModel
+	if err := tx.SelectContext(ctx, &questionModels, query, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get questions: "+err.Error())
+	}
+
+	questions := make([]Question, len(questionModels))
+	for i := range questionModels {
+		question, err := fillQuestionResponse(ctx, tx, questionModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill question: "+err.Error())
+		}
+		questions[i] = question
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, questions)
+}
+
+// 質問への投票API (1ユーザ1票)
+// POST /api/livestream/:livestream_id/questions/:question_id/upvote
+func upvoteQuestionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	questionID, err := strconv.ParseInt(c.Param("question_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "question_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var question Question
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		questionModel, err := getQuestionForLivestream(ctx, tx, questionID, int64(livestreamID))
+		if err != nil {
+			return err
+		}
+		if questionModel.AnsweredAt.Valid {
+			return echo.NewHTTPError(http.StatusConflict, "question is already answered")
+		}
+
+		// (question_id, user_id) のユニーク制約で二重投票を弾く
+		rs, err := tx.ExecContext(ctx, "INSERT IGNORE INTO question_votes (question_id, user_id, created_at) VALUES (?, ?, ?)", questionID, userID, time.Now().Unix())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert question vote: "+err.Error())
+		}
+		if n, err := rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+		} else if n == 0 {
+			return echo.NewHTTPError(http.StatusConflict, "already upvoted")
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE questions SET votes = votes + 1 WHERE id = ?", questionID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update question votes: "+err.Error())
+		}
+		questionModel.Votes++
+
+		question, err = fillQuestionResponse(ctx, tx, questionModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill question: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	hub.publish(question.LivestreamID, HubMessage{
+		Type: hubMessageQuestion,
+		Data: question,
+	})
+
+	return c.JSON(http.StatusOK, question)
+}
+
+// 質問を回答済みにするAPI (配信者のみ)
+// POST /api/livestream/:livestream_id/questions/:question_id/answer
+func answerQuestionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	questionID, err := strconv.ParseInt(c.Param("question_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "question_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var question Question
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			}
+		}
+		if livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't answer questions on other streamer's livestream")
+		}
+
+		questionModel, err := getQuestionForLivestream(ctx, tx, questionID, livestreamModel.ID)
+		if err != nil {
+			return err
+		}
+		if !questionModel.AnsweredAt.Valid {
+			now := time.Now().Unix()
+			if _, err := tx.ExecContext(ctx, "UPDATE questions SET answered_at = ? WHERE id = ?", now, questionID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to mark question answered: "+err.Error())
+			}
+			questionModel.AnsweredAt = sql.NullInt64{Int64: now, Valid: true}
+		}
+
+		question, err = fillQuestionResponse(ctx, tx, questionModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill question: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	hub.publish(question.LivestreamID, HubMessage{
+		Type: hubMessageQuestion,
+		Data: question,
+	})
+
+	return c.JSON(http.StatusOK, question)
+}
+
+// getQuestionForLivestream は配信に属する質問を返します。見つからなければ echo.HTTPError を返します。
+func getQuestionForLivestream(ctx context.Context, tx *sqlx.Tx, questionID, livestreamID int64) (QuestionModel, error) {
+	var questionModel QuestionModel
+	if err := tx.GetContext(ctx, &questionModel, "SELECT * FROM questions WHERE id = ? AND livestream_id = ?", questionID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return QuestionModel{}, echo.NewHTTPError(http.StatusNotFound, "question not found")
+		}
+		return QuestionModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get question: "+err.Error())
+	}
+	return questionModel, nil
+}
+
+func fillQuestionResponse(ctx context.Context, tx *sqlx.Tx, questionModel QuestionModel) (Question, error) {
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", questionModel.UserID); err != nil {
+		return Question{}, err
+	}
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return Question{}, err
+	}
+
+	question := Question{
+		ID:           questionModel.ID,
+		LivestreamID: questionModel.LivestreamID,
+		User:         user,
+		Body:         questionModel.Body,
+		Votes:        questionModel.Votes,
+		Answered:     questionModel.AnsweredAt.Valid,
+		CreatedAt:    questionModel.CreatedAt,
+	}
+	if questionModel.AnsweredAt.Valid {
+		question.AnsweredAt = &questionModel.AnsweredAt.Int64
+	}
+	return question, nil
+}
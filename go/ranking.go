@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ランキングで値が同じときにどちらを上位にするか (設定の ranking_tie_break、ISUCON13_RANKING_TIE_BREAK)
+// 統計APIの rank もこの規則に従う
+const (
+	// 既存の挙動: 配信は ID が大きい方、ユーザは名前が辞書順で後ろの方が上位
+	rankingTieBreakLegacy = "legacy"
+	// 配信・ユーザとも ID が小さい方 (先に作られた方) が上位
+	rankingTieBreakLowerID = "lower_id"
+	// 配信・ユーザとも ID が大きい方 (後に作られた方) が上位
+	rankingTieBreakHigherID = "higher_id"
+)
+
+func normalizeRankingTieBreak(v string) string {
+	switch v {
+	case rankingTieBreakLegacy, rankingTieBreakLowerID, rankingTieBreakHigherID:
+		return v
+	}
+	return rankingTieBreakLegacy
+}
+
+// livestreamRanksAbove は値が同じ配信 a, b のうち a を上位にするなら true を返します。
+func livestreamRanksAbove(a, b int64) bool {
+	if currentConfig().RankingTieBreak == rankingTieBreakLowerID {
+		return a < b
+	}
+	return a > b
+}
+
+// userRanksAbove は値が同じユーザ a, b のうち a を上位にするなら true を返します。
+func userRanksAbove(aID int64, aName string, bID int64, bName string) bool {
+	switch currentConfig().RankingTieBreak {
+	case rankingTieBreakLowerID:
+		return aID < bID
+	case rankingTieBreakHigherID:
+		return aID > bID
+	}
+	return aName > bName
+}
+
+// リーダーボードの並び順 (?order=)
+const (
+	rankingOrderScore     = "score"
+	rankingOrderViewers   = "viewers"
+	rankingOrderReactions = "reactions"
+
+	rankingDefaultSize = 20
+	rankingMaxSize     = 100
+)
+
+type rankingValues struct {
+	// リアクション数 + チップ合計 (統計APIの rank と同じ)
+	Score          int64 `json:"score" db:"score"`
+	ViewersCount   int64 `json:"viewers_count" db:"-"`
+	TotalReactions int64 `json:"total_reactions" db:"reactions"`
+}
+
+func (v rankingValues) get(order string) int64 {
+	switch order {
+	case rankingOrderViewers:
+		return v.ViewersCount
+	case rankingOrderReactions:
+		return v.TotalReactions
+	}
+	return v.Score
+}
+
+type LivestreamLeaderboardEntry struct {
+	Rank         int64  `json:"rank"`
+	LivestreamID int64  `json:"livestream_id" db:"id"`
+	UserID       int64  `json:"-" db:"user_id"`
+	Title        string `json:"title" db:"title"`
+	rankingValues
+}
+
+type UserLeaderboardEntry struct {
+	Rank     int64  `json:"rank"`
+	UserID   int64  `json:"-" db:"id"`
+	Username string `json:"username" db:"name"`
+	rankingValues
+}
+
+func parseRankingQuery(c echo.Context) (string, int, error) {
+	order := c.QueryParam("order")
+	if order == "" {
+		order = rankingOrderScore
+	}
+	if order != rankingOrderScore && order != rankingOrderViewers && order != rankingOrderReactions {
+		return "", 0, echo.NewHTTPError(http.StatusBadRequest, "order query parameter must be score, viewers or reactions")
+	}
+	limit := rankingDefaultSize
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 || l > rankingMaxSize {
+			return "", 0, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(rankingMaxSize))
+		}
+		limit = l
+	}
+	return order, limit, nil
+}
+
+func livestreamLeaderboard(ctx context.Context, order string) ([]LivestreamLeaderboardEntry, error) {
+	var entries []LivestreamLeaderboardEntry
+	query := `
+	SELECT l.id, l.user_id, l.title, IFNULL(r.cnt, 0) AS reactions, IFNULL(r.cnt, 0) + IFNULL(c.tips, 0) AS score
+	FROM livestreams l
+	LEFT JOIN (SELECT livestream_id, COUNT(*) AS cnt FROM reactions GROUP BY livestream_id) r ON r.livestream_id = l.id
+	LEFT JOIN (SELECT livestream_id, SUM(tip) AS tips FROM livecomments WHERE deleted_at IS NULL GROUP BY livestream_id) c ON c.livestream_id = l.id
+	`
+	if err := readDB().SelectContext(ctx, &entries, query); err != nil {
+		return nil, err
+	}
+	// 停止中のユーザの配信はランキングに含めない
+	suspended, err := userSuspensions.set(ctx)
+	if err != nil {
+		return nil, err
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if !suspended[e.UserID] {
+			kept = append(kept, e)
+		}
+	}
+	entries = kept
+
+	viewers, err := viewerHistory.countAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].ViewersCount = viewers[entries[i].LivestreamID]
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		vi, vj := entries[i].get(order), entries[j].get(order)
+		if vi == vj {
+			return livestreamRanksAbove(entries[i].LivestreamID, entries[j].LivestreamID)
+		}
+		return vi > vj
+	})
+	for i := range entries {
+		entries[i].Rank = int64(i + 1)
+	}
+	return entries, nil
+}
+
+func userLeaderboard(ctx context.Context, order string) ([]UserLeaderboardEntry, error) {
+	var entries []UserLeaderboardEntry
+	query := `
+	SELECT u.id, u.name, IFNULL(SUM(r.cnt), 0) AS reactions, IFNULL(SUM(r.cnt), 0) + IFNULL(SUM(c.tips), 0) AS score
+	FROM users u
+	LEFT JOIN livestreams l ON l.user_id = u.id
+	LEFT JOIN (SELECT livestream_id, COUNT(*) AS cnt FROM reactions GROUP BY livestream_id) r ON r.livestream_id = l.id
+	LEFT JOIN (SELECT livestream_id, SUM(tip) AS tips FROM livecomments WHERE deleted_at IS NULL GROUP BY livestream_id) c ON c.livestream_id = l.id
+	GROUP BY u.id, u.name
+	`
+	if err := readDB().SelectContext(ctx, &entries, query); err != nil {
+		return nil, err
+	}
+
+	// 停止中のユーザはランキングに含めない
+	suspended, err := userSuspensions.set(ctx)
+	if err != nil {
+		return nil, err
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if !suspended[e.UserID] {
+			kept = append(kept, e)
+		}
+	}
+	entries = kept
+
+	viewers, err := viewerHistory.countAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var livestreams []LivestreamModel
+	if err := readDB().SelectContext(ctx, &livestreams, "SELECT id, user_id FROM livestreams"); err != nil {
+		return nil, err
+	}
+	viewersByUser := map[int64]int64{}
+	for _, ls := range livestreams {
+		viewersByUser[ls.UserID] += viewers[ls.ID]
+	}
+	for i := range entries {
+		entries[i].ViewersCount = viewersByUser[entries[i].UserID]
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		vi, vj := entries[i].get(order), entries[j].get(order)
+		if vi == vj {
+			return userRanksAbove(entries[i].UserID, entries[i].Username, entries[j].UserID, entries[j].Username)
+		}
+		return vi > vj
+	})
+	for i := range entries {
+		entries[i].Rank = int64(i + 1)
+	}
+	return entries, nil
+}
+
+// 配信ランキングAPI
+// GET /api/ranking/livestreams?order=score|viewers|reactions&limit=
+func getLivestreamLeaderboardHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	order, limit, err := parseRankingQuery(c)
+	if err != nil {
+		return err
+	}
+
+	entries, err := livestreamLeaderboard(c.Request().Context(), order)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream ranking: "+err.Error())
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+// ユーザランキングAPI
+// GET /api/ranking/users?order=score|viewers|reactions&limit=
+func getUserLeaderboardHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	order, limit, err := parseRankingQuery(c)
+	if err != nil {
+		return err
+	}
+
+	entries, err := userLeaderboard(c.Request().Context(), order)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user ranking: "+err.Error())
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return c.JSON(http.StatusOK, entries)
+}
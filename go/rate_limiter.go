@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// rateLimiter はキーごとに固定窓で回数を数える簡易なレートリミッタです。
+// サーバごとに数えるので、複数台構成では上限は台数倍になります。
+type rateLimiter struct {
+	// 設定の読み直し (config.go) で変わる
+	limit  atomic.Int64
+	window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int64
+}
+
+// 古い窓を掃除し始めるキーの数
+const rateLimiterSweepThreshold = 10000
+
+// limit が 0 以下なら制限しない
+func newRateLimiter(limit int64, window time.Duration) *rateLimiter {
+	l := &rateLimiter{
+		window:  window,
+		windows: make(map[string]*rateWindow),
+	}
+	l.limit.Store(limit)
+	return l
+}
+
+// setLimit は上限を変えます。数えている回数はそのまま使います。
+func (l *rateLimiter) setLimit(limit int64) {
+	l.limit.Store(limit)
+}
+
+// allow は key の回数を 1 増やし、上限内なら true を返します。
+// 上限を超えた場合は次の窓までの時間を返します。
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	limit := l.limit.Load()
+	if limit <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.windows) >= rateLimiterSweepThreshold {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	if w.count >= limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
+
+func (l *rateLimiter) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.windows = make(map[string]*rateWindow)
+}
+
+// tooManyRequests は Retry-After を付けて 429 を返します。
+func tooManyRequests(c echo.Context, retryAfter time.Duration, message string) error {
+	seconds := int64(retryAfter.Seconds())
+	if retryAfter > time.Duration(seconds)*time.Second {
+		seconds++
+	}
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	return echo.NewHTTPError(http.StatusTooManyRequests, message)
+}
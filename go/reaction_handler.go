@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -52,28 +53,77 @@ func getReactionsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
+	filter, err := sessionChatFilter(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get chat preferences: "+err.Error())
+	}
+
+	query := "SELECT * FROM reactions WHERE livestream_id = ?"
+	args := []interface{}{livestreamID}
+	// ブロックしたユーザのリアクションは返さない (user_block.go)
+	if filter != nil {
+		for blockedUserID := range filter.blockedUserIDs {
+			query += " AND user_id != ?"
+			args = append(args, blockedUserID)
+		}
+	}
+	// ?before=<reaction_id> ならそれより前のリアクション (履歴) を返す
+	before := c.QueryParam("before")
+	if before != "" {
+		beforeID, err := strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	query += " ORDER BY created_at DESC"
+	limit := -1
 	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
 		}
 		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
 
-	reactionModels := []ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
+	// 最新のリアクションはメモリに持っている分から返す (recent_ring.go)
+	if before == "" && limit >= -1 && !wantsNDJSON(c) {
+		reactionModels, ok, err := reactionRings.latest(ctx, int64(livestreamID), limit, func(m *ReactionModel) bool {
+			return filter.reactionVisible(m.UserID)
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+		}
+		if ok {
+			return respondReactions(c, tx, reactionModels)
+		}
 	}
 
-	reactions := make([]Reaction, len(reactionModels))
-	for i := range reactionModels {
-		reaction, err := fillReactionResponse(ctx, tx, reactionModels[i])
+	if wantsNDJSON(c) {
+		rows, err := dbConn.QueryxContext(ctx, query, args...)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+			return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 		}
+		return streamNDJSON(c, rows, func(models []ReactionModel) ([]Reaction, error) {
+			return fillReactionResponses(ctx, tx, models)
+		})
+	}
+
+	reactionModels := []ReactionModel{}
+	if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
+	}
+
+	return respondReactions(c, tx, reactionModels)
+}
 
-		reactions[i] = reaction
+func respondReactions(c echo.Context, tx *sqlx.Tx, reactionModels []ReactionModel) error {
+	ctx := c.Request().Context()
+
+	reactions, err := fillReactionResponses(ctx, tx, reactionModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -100,48 +150,61 @@ func postReactionHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
+	if err := verifyNotBanned(ctx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
 	var req *PostReactionRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
-	reactionModel := ReactionModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		EmojiName:    req.EmojiName,
-		CreatedAt:    time.Now().Unix(),
-	}
+	var (
+		reactionModel ReactionModel
+		reaction      Reaction
+	)
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		reactionModel = ReactionModel{
+			UserID:       int64(userID),
+			LivestreamID: int64(livestreamID),
+			EmojiName:    req.EmojiName,
+			CreatedAt:    time.Now().Unix(),
+		}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
-	}
+		result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+		}
 
-	reactionID, err := result.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
-	}
-	reactionModel.ID = reactionID
+		reactionID, err := result.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+		}
+		reactionModel.ID = reactionID
 
-	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
-	}
+		reaction, err = fillReactionResponse(ctx, tx, reactionModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+		}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
+	reactionRings.add(reactionModel.LivestreamID, reactionModel)
+	metrics.recordReaction(reactionModel.LivestreamID)
+	livestreamActivity.add(reactionModel.LivestreamID, 1)
+	hub.publish(reactionModel.LivestreamID, HubMessage{
+		Type: hubMessageReaction,
+		Data: reaction,
+	})
 
 	return c.JSON(http.StatusCreated, reaction)
 }
 
 func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
+	defer traceFill(ctx, "fillReactionResponse")()
+
 	userModel := UserModel{}
 	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", reactionModel.UserID); err != nil {
 		return Reaction{}, err
@@ -151,22 +214,55 @@ func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel Reacti
 		return Reaction{}, err
 	}
 
-	livestreamModel := LivestreamModel{}
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", reactionModel.LivestreamID); err != nil {
+	livestreamModel, ok, err := livestreamRegistryCache.get(ctx, reactionModel.LivestreamID)
+	if err != nil {
 		return Reaction{}, err
 	}
+	if !ok {
+		return Reaction{}, sql.ErrNoRows
+	}
 	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
 	if err != nil {
 		return Reaction{}, err
 	}
 
-	reaction := Reaction{
+	return newReaction(reactionModel, user, livestream), nil
+}
+
+func newReaction(reactionModel ReactionModel, user User, livestream Livestream) Reaction {
+	return Reaction{
 		ID:         reactionModel.ID,
 		EmojiName:  reactionModel.EmojiName,
 		User:       user,
 		Livestream: livestream,
 		CreatedAt:  reactionModel.CreatedAt,
 	}
+}
+
+// fillReactionResponses は fillReactionResponse の一覧版です。
+// リアクションしたユーザと配信を重複を除いてまとめて取得してから組み立てるので、件数によらずクエリ数は一定です。
+func fillReactionResponses(ctx context.Context, tx *sqlx.Tx, reactionModels []ReactionModel) ([]Reaction, error) {
+	defer traceFill(ctx, "fillReactionResponses")()
+
+	userIDs := make([]int64, len(reactionModels))
+	livestreamIDs := make([]int64, len(reactionModels))
+	for i := range reactionModels {
+		userIDs[i] = reactionModels[i].UserID
+		livestreamIDs[i] = reactionModels[i].LivestreamID
+	}
+	users, err := fillUsersByID(ctx, tx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	livestreams, err := fillLivestreamsByID(ctx, tx, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
 
-	return reaction, nil
+	reactions := make([]Reaction, len(reactionModels))
+	for i := range reactionModels {
+		m := reactionModels[i]
+		reactions[i] = newReaction(m, users[m.UserID], livestreams[m.LivestreamID])
+	}
+	return reactions, nil
 }
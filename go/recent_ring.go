@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ライブコメント・リアクションの一覧APIはほとんどが最新のものを取りに来るので、配信ごとに最新の N 件をメモリに持ち、
+// 遡らない取得 (?before なし) はここから返す。遡る取得は DB から読む。
+// 最初に参照されたときに DB から読み込み、以降は投稿されたものを足していく。
+// 削除は件数が読めない (NGワードによる一括削除など) ので、その配信の分を捨てて次の参照で読み直す。
+// 他のサーバでの投稿は hub の中継 (hub_fanout.go) で届くが、削除は届かないので TTL ごとに読み直す
+type recentRing[M any] struct {
+	mu sync.Mutex
+	// 古い順
+	entries []M
+	// 配信の分をすべて持っているか (N 件に満たない)
+	complete bool
+	loaded   bool
+	loadedAt time.Time
+}
+
+type recentRingCache[M any] struct {
+	mu    sync.Mutex
+	rings map[int64]*recentRing[M]
+
+	id func(m *M) int64
+	// load は配信の最新の n 件を新しい順に読み込みます
+	load func(ctx context.Context, livestreamID int64, n int) ([]M, error)
+	// 持つ件数 (0 なら持たない) と読み直す間隔 (設定から読む)
+	size func() int
+	ttl  func() time.Duration
+}
+
+func newRecentRingCache[M any](id func(m *M) int64, load func(ctx context.Context, livestreamID int64, n int) ([]M, error), size func() int, ttl func() time.Duration) *recentRingCache[M] {
+	return &recentRingCache[M]{
+		rings: map[int64]*recentRing[M]{},
+		id:    id,
+		load:  load,
+		size:  size,
+		ttl:   ttl,
+	}
+}
+
+var livecommentRings = newRecentRingCache(
+	func(m *LivecommentModel) int64 { return m.ID },
+	func(ctx context.Context, livestreamID int64, n int) ([]LivecommentModel, error) {
+		var entries []LivecommentModel
+		err := dbConn.SelectContext(ctx, &entries, "SELECT * FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL AND held_at IS NULL ORDER BY id DESC LIMIT ?", livestreamID, n)
+		return entries, err
+	},
+	func() int { return currentConfig().LivecommentRingSize },
+	func() time.Duration { return currentConfig().LivecommentRingTTL.duration() },
+)
+
+var reactionRings = newRecentRingCache(
+	func(m *ReactionModel) int64 { return m.ID },
+	func(ctx context.Context, livestreamID int64, n int) ([]ReactionModel, error) {
+		var entries []ReactionModel
+		err := dbConn.SelectContext(ctx, &entries, "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY id DESC LIMIT ?", livestreamID, n)
+		return entries, err
+	},
+	func() int { return currentConfig().ReactionRingSize },
+	func() time.Duration { return currentConfig().ReactionRingTTL.duration() },
+)
+
+// addLivecommentToRing は投稿・承認されたライブコメントを足します。削除・保留されているものは足しません。
+func addLivecommentToRing(m LivecommentModel) {
+	if m.DeletedAt.Valid || m.HeldAt.Valid {
+		return
+	}
+	livecommentRings.add(m.LivestreamID, m)
+}
+
+// reset は initialize 時に呼び、すべて捨てます。
+func (rc *recentRingCache[M]) reset() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.rings = map[int64]*recentRing[M]{}
+}
+
+// invalidate は削除があったときに呼び、配信の分を捨てます。
+func (rc *recentRingCache[M]) invalidate(livestreamID int64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.rings, livestreamID)
+}
+
+// add は投稿されたものを足します。まだ読み込んでいない配信なら何もしません (読み込むときに DB から読む)。
+func (rc *recentRingCache[M]) add(livestreamID int64, m M) {
+	rc.mu.Lock()
+	ring, ok := rc.rings[livestreamID]
+	rc.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// 読み込み中なら読み込みが終わるのを待つ (読み込んだ結果に含まれていれば重複させない)
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	if !ring.loaded {
+		return
+	}
+	id := rc.id(&m)
+	i := sort.Search(len(ring.entries), func(i int) bool { return rc.id(&ring.entries[i]) >= id })
+	if i < len(ring.entries) && rc.id(&ring.entries[i]) == id {
+		return
+	}
+	var zero M
+	ring.entries = append(ring.entries, zero)
+	copy(ring.entries[i+1:], ring.entries[i:])
+	ring.entries[i] = m
+	if size := rc.size(); len(ring.entries) > size {
+		ring.entries = append(ring.entries[:0], ring.entries[len(ring.entries)-size:]...)
+		ring.complete = false
+	}
+}
+
+// update は編集されたものを差し替えます。持っていなければ何もしません。
+func (rc *recentRingCache[M]) update(livestreamID int64, m M) {
+	rc.mu.Lock()
+	ring, ok := rc.rings[livestreamID]
+	rc.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	id := rc.id(&m)
+	i := sort.Search(len(ring.entries), func(i int) bool { return rc.id(&ring.entries[i]) >= id })
+	if i < len(ring.entries) && rc.id(&ring.entries[i]) == id {
+		ring.entries[i] = m
+	}
+}
+
+func (rc *recentRingCache[M]) ring(livestreamID int64) *recentRing[M] {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	ring, ok := rc.rings[livestreamID]
+	if !ok {
+		ring = &recentRing[M]{}
+		rc.rings[livestreamID] = ring
+	}
+	return ring
+}
+
+// latest は新しい順に、keep を満たすものを limit 件 (負ならすべて) 返します。keep が nil ならすべて満たします。
+// 持っている分では足りなければ false を返します (DB から読むこと)。
+func (rc *recentRingCache[M]) latest(ctx context.Context, livestreamID int64, limit int, keep func(m *M) bool) ([]M, bool, error) {
+	size := rc.size()
+	if size <= 0 || limit > size {
+		return nil, false, nil
+	}
+
+	ring := rc.ring(livestreamID)
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	if !ring.loaded || time.Since(ring.loadedAt) > rc.ttl() {
+		entries, err := rc.load(ctx, livestreamID, size+1)
+		if err != nil {
+			return nil, false, err
+		}
+		ring.complete = len(entries) <= size
+		entries = entries[:min(len(entries), size)]
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+		ring.entries = entries
+		ring.loaded = true
+		ring.loadedAt = time.Now()
+	}
+
+	res := make([]M, 0, max(limit, 0))
+	for i := len(ring.entries) - 1; i >= 0; i-- {
+		if limit >= 0 && len(res) >= limit {
+			return res, true, nil
+		}
+		if keep == nil || keep(&ring.entries[i]) {
+			res = append(res, ring.entries[i])
+		}
+	}
+	// 持っている分を使い切った。古いものが残っていればそこにも該当するものがあるかもしれない
+	if !ring.complete && (limit < 0 || len(res) < limit) {
+		return nil, false, nil
+	}
+	return res, true, nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	recommendationRefreshInterval = 30 * time.Second
+	// この期間アクセスのなかったユーザのキャッシュは破棄する
+	recommendationIdleTTL      = 10 * time.Minute
+	recommendationDefaultLimit = 10
+	recommendationMaxLimit     = 50
+
+	// スコアの重み付け
+	recommendationStreamerWeight = 3.0
+	recommendationTagWeight      = 1.0
+	recommendationTrendingWeight = 1.0
+)
+
+type trendingLivestream struct {
+	LivestreamID int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	Score        int64  `db:"score"`
+	Status       string `db:"status"`
+}
+
+// trendingSnapshot は全ユーザ共通の集計結果です。
+type trendingSnapshot struct {
+	livestreams []trendingLivestream
+	maxScore    int64
+	tagsByID    map[int64][]int64
+	scoreByID   map[int64]int64
+	// 集計を始めた時刻 (これ以降の変更は含まれていないかもしれない)
+	loadedAt time.Time
+}
+
+type recommendationEntry struct {
+	livestreamIDs []int64
+	lastAccessAt  time.Time
+}
+
+// recommendationCache はユーザごとのおすすめ配信一覧を保持し、定期的に再計算します。
+type recommendationCache struct {
+	mu       sync.RWMutex
+	trending *trendingSnapshot
+	entries  map[int64]*recommendationEntry
+}
+
+var recommendations = &recommendationCache{
+	entries: map[int64]*recommendationEntry{},
+}
+
+// reset は initialize 時にキャッシュを破棄します。
+func (rc *recommendationCache) reset() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.trending = nil
+	rc.entries = map[int64]*recommendationEntry{}
+}
+
+func (rc *recommendationCache) get(ctx context.Context, userID int64) ([]int64, error) {
+	rc.mu.Lock()
+	if entry, ok := rc.entries[userID]; ok {
+		entry.lastAccessAt = time.Now()
+		ids := entry.livestreamIDs
+		rc.mu.Unlock()
+		return ids, nil
+	}
+	trending := rc.trending
+	rc.mu.Unlock()
+
+	if trending == nil {
+		t, err := loadTrendingSnapshot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		trending = t
+	}
+
+	ids, err := computeRecommendation(ctx, trending, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.trending == nil {
+		rc.trending = trending
+	}
+	rc.entries[userID] = &recommendationEntry{
+		livestreamIDs: ids,
+		lastAccessAt:  time.Now(),
+	}
+	return ids, nil
+}
+
+// trendingSnapshot は直近に集計したトレンドを返します。まだなければ集計します。
+func (rc *recommendationCache) trendingSnapshot(ctx context.Context) (*trendingSnapshot, error) {
+	rc.mu.RLock()
+	trending := rc.trending
+	rc.mu.RUnlock()
+	if trending != nil {
+		return trending, nil
+	}
+
+	trending, err := loadTrendingSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.trending == nil {
+		rc.trending = trending
+	}
+	return rc.trending, nil
+}
+
+// refresh はトレンドを再集計し、最近アクセスのあったユーザのおすすめを再計算します。
+func (rc *recommendationCache) refresh(ctx context.Context) error {
+	trending, err := loadTrendingSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	rc.trending = trending
+	var userIDs []int64
+	for userID, entry := range rc.entries {
+		if time.Since(entry.lastAccessAt) > recommendationIdleTTL {
+			delete(rc.entries, userID)
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rc.mu.Unlock()
+
+	for _, userID := range userIDs {
+		ids, err := computeRecommendation(ctx, trending, userID)
+		if err != nil {
+			return err
+		}
+		rc.mu.Lock()
+		if entry, ok := rc.entries[userID]; ok {
+			entry.livestreamIDs = ids
+		}
+		rc.mu.Unlock()
+	}
+	return nil
+}
+
+func runRecommendationRefresher() {
+	ticker := time.NewTicker(recommendationRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := recommendations.refresh(context.Background()); err != nil {
+			log.Printf("failed to refresh recommendations: %v", err)
+		}
+	}
+}
+
+func loadTrendingSnapshot(ctx context.Context) (*trendingSnapshot, error) {
+	loadedAt := time.Now()
+	var livestreams []trendingLivestream
+	query := `
+	SELECT l.id, l.user_id, l.status, IFNULL(r.cnt, 0) + IFNULL(c.tips, 0) AS score
+	FROM livestreams l
+	LEFT JOIN (SELECT livestream_id, COUNT(*) AS cnt FROM reactions GROUP BY livestream_id) r ON r.livestream_id = l.id
+	LEFT JOIN (SELECT livestream_id, SUM(tip) AS tips FROM livecomments WHERE deleted_at IS NULL GROUP BY livestream_id) c ON c.livestream_id = l.id
+	`
+	if err := dbConn.SelectContext(ctx, &livestreams, query); err != nil {
+		return nil, err
+	}
+
+	var livestreamTags []*LivestreamTagModel
+	if err := dbConn.SelectContext(ctx, &livestreamTags, "SELECT * FROM livestream_tags"); err != nil {
+		return nil, err
+	}
+
+	snapshot := &trendingSnapshot{
+		livestreams: livestreams,
+		tagsByID:    map[int64][]int64{},
+		scoreByID:   make(map[int64]int64, len(livestreams)),
+		loadedAt:    loadedAt,
+	}
+	for _, ls := range livestreams {
+		snapshot.scoreByID[ls.LivestreamID] = ls.Score
+		if ls.Score > snapshot.maxScore {
+			snapshot.maxScore = ls.Score
+		}
+	}
+	for _, lt := range livestreamTags {
+		snapshot.tagsByID[lt.LivestreamID] = append(snapshot.tagsByID[lt.LivestreamID], lt.TagID)
+	}
+	return snapshot, nil
+}
+
+// computeRecommendation は視聴履歴から好みの配信者・タグを求め、トレンドと混ぜてスコアの高い順に並べます。
+// フォロー機能はないため、過去に視聴した配信の配信者をフォロー相当として扱います。
+func computeRecommendation(ctx context.Context, trending *trendingSnapshot, userID int64) ([]int64, error) {
+	watchedIDs, err := viewerHistory.watchedLivestreamIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerByID := make(map[int64]int64, len(trending.livestreams))
+	for _, ls := range trending.livestreams {
+		ownerByID[ls.LivestreamID] = ls.UserID
+	}
+
+	watched := make(map[int64]struct{}, len(watchedIDs))
+	streamers := map[int64]struct{}{}
+	tagWeights := map[int64]float64{}
+	for _, id := range watchedIDs {
+		watched[id] = struct{}{}
+		if owner, ok := ownerByID[id]; ok {
+			streamers[owner] = struct{}{}
+		}
+		for _, tagID := range trending.tagsByID[id] {
+			tagWeights[tagID]++
+		}
+	}
+
+	type scored struct {
+		id    int64
+		score float64
+	}
+	candidates := make([]scored, 0, len(trending.livestreams))
+	for _, ls := range trending.livestreams {
+		if ls.UserID == userID {
+			continue
+		}
+		if _, ok := watched[ls.LivestreamID]; ok {
+			continue
+		}
+
+		var score float64
+		if _, ok := streamers[ls.UserID]; ok {
+			score += recommendationStreamerWeight
+		}
+		if len(watchedIDs) > 0 {
+			var tagScore float64
+			for _, tagID := range trending.tagsByID[ls.LivestreamID] {
+				tagScore += tagWeights[tagID]
+			}
+			score += recommendationTagWeight * tagScore / float64(len(watchedIDs))
+		}
+		if trending.maxScore > 0 {
+			score += recommendationTrendingWeight * float64(ls.Score) / float64(trending.maxScore)
+		}
+		candidates = append(candidates, scored{id: ls.LivestreamID, score: score})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score == candidates[j].score {
+			return candidates[i].id > candidates[j].id
+		}
+		return candidates[i].score > candidates[j].score
+	})
+
+	n := len(candidates)
+	if n > recommendationMaxLimit {
+		n = recommendationMaxLimit
+	}
+	ids := make([]int64, n)
+	for i := 0; i < n; i++ {
+		ids[i] = candidates[i].id
+	}
+	return ids, nil
+}
+
+// おすすめ配信一覧API
+// GET /api/livestream/recommended
+func getRecommendedLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit := recommendationDefaultLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		limit = l
+	}
+
+	ids, err := recommendations.get(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get recommendations: "+err.Error())
+	}
+	// 停止中のユーザの配信はおすすめに出さない (キャッシュには残っているので、limit で切る前に除く)
+	suspended, err := userSuspensions.set(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user suspensions: "+err.Error())
+	}
+	if len(suspended) > 0 && len(ids) > 0 {
+		ids, err = livestreamRegistryCache.filter(ctx, ids, "", suspended)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to filter livestreams: "+err.Error())
+		}
+	}
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	if len(ids) == 0 {
+		return c.JSON(http.StatusOK, []Livestream{})
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	modelByID, err := livestreamRegistryCache.getMany(ctx, ids)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	// キャッシュの並び順を維持する
+	livestreams := make([]Livestream, 0, len(ids))
+	for _, id := range ids {
+		m, ok := modelByID[id]
+		if !ok {
+			continue
+		}
+		livestream, err := fillLivestreamResponse(ctx, tx, m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams = append(livestreams, livestream)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
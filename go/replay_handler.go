@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	replayDefaultWindowSeconds = 60
+	replayMaxWindowSeconds     = 600
+)
+
+type ReplayLivecomment struct {
+	// 配信開始からの経過秒数
+	OffsetSeconds int64       `json:"offset_seconds"`
+	Livecomment   Livecomment `json:"livecomment"`
+}
+
+type ReplayReaction struct {
+	OffsetSeconds int64    `json:"offset_seconds"`
+	Reaction      Reaction `json:"reaction"`
+}
+
+type LivecommentReplay struct {
+	LivestreamID  int64 `json:"livestream_id"`
+	StartAt       int64 `json:"start_at"`
+	OffsetSeconds int64 `json:"offset_seconds"`
+	WindowSeconds int64 `json:"window_seconds"`
+	// 次の窓の offset_seconds。配信の終了を過ぎていれば null
+	NextOffsetSeconds *int64              `json:"next_offset_seconds"`
+	Livecomments      []ReplayLivecomment `json:"livecomments"`
+	Reactions         []ReplayReaction    `json:"reactions"`
+}
+
+// チャットリプレイAPI
+// GET /api/livestream/:livestream_id/livecomment/replay?offset_seconds=&window_seconds=
+// 配信開始から offset_seconds 秒後から window_seconds 秒間のライブコメントとリアクションを時刻順に返す
+func getLivecommentReplayHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var offset int64
+	if v := c.QueryParam("offset_seconds"); v != "" {
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "offset_seconds query parameter must be non-negative integer")
+		}
+	}
+	var window int64 = replayDefaultWindowSeconds
+	if v := c.QueryParam("window_seconds"); v != "" {
+		window, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || window <= 0 || window > replayMaxWindowSeconds {
+			return echo.NewHTTPError(http.StatusBadRequest, "window_seconds query parameter must be between 1 and "+strconv.Itoa(replayMaxWindowSeconds))
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+
+	from := livestreamModel.StartAt + offset
+	to := from + window
+
+	var livecommentModels []LivecommentModel
+	if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL AND held_at IS NULL AND created_at >= ? AND created_at < ? ORDER BY created_at, id", livestreamID, from, to); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+	filledLivecomments, err := fillLivecommentResponses(ctx, tx, livecommentModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+	}
+	livecomments := make([]ReplayLivecomment, len(livecommentModels))
+	for i := range livecommentModels {
+		livecomments[i] = ReplayLivecomment{
+			OffsetSeconds: livecommentModels[i].CreatedAt - livestreamModel.StartAt,
+			Livecomment:   filledLivecomments[i],
+		}
+	}
+
+	var reactionModels []ReactionModel
+	if err := tx.SelectContext(ctx, &reactionModels, "SELECT * FROM reactions WHERE livestream_id = ? AND created_at >= ? AND created_at < ? ORDER BY created_at, id", livestreamID, from, to); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+	filledReactions, err := fillReactionResponses(ctx, tx, reactionModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+	}
+	reactions := make([]ReplayReaction, len(reactionModels))
+	for i := range reactionModels {
+		reactions[i] = ReplayReaction{
+			OffsetSeconds: reactionModels[i].CreatedAt - livestreamModel.StartAt,
+			Reaction:      filledReactions[i],
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	replay := LivecommentReplay{
+		LivestreamID:  livestreamModel.ID,
+		StartAt:       livestreamModel.StartAt,
+		OffsetSeconds: offset,
+		WindowSeconds: window,
+		Livecomments:  livecomments,
+		Reactions:     reactions,
+	}
+	if to < livestreamModel.EndAt {
+		next := offset + window
+		replay.NextOffsetSeconds = &next
+	}
+
+	return c.JSON(http.StatusOK, replay)
+}
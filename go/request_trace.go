@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 詳細ログ (発行したクエリの一覧や fill* の所要時間) をすべてのリクエストで出すとそれ自体がボトルネックになるので、
+// 設定の verbose_log_sample_percent % のリクエストと verbose_log_slow_ms 以上かかったリクエストだけ出す
+// どちらも 0 (未指定) なら記録自体をしない
+type requestTraceConfig struct {
+	samplePercent float64
+	slow          time.Duration
+}
+
+func (cfg requestTraceConfig) enabled() bool {
+	return cfg.samplePercent > 0 || cfg.slow > 0
+}
+
+// 1 リクエストで記録するクエリの上限。N+1 のリクエストでログが膨れないようにする
+const requestTraceMaxQueries = 200
+
+type requestTraceKey struct{}
+
+type tracedQuery struct {
+	Query     string  `json:"query"`
+	ElapsedMS float64 `json:"elapsed_ms"`
+}
+
+type fillTiming struct {
+	Count   int64   `json:"count"`
+	TotalMS float64 `json:"total_ms"`
+}
+
+// requestTrace は 1 リクエストの間に発行したクエリと fill* の所要時間を記録します。
+type requestTrace struct {
+	mu             sync.Mutex
+	queries        []tracedQuery
+	droppedQueries int64
+	fills          map[string]*fillTiming
+}
+
+func (t *requestTrace) addQuery(query string, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queries) >= requestTraceMaxQueries {
+		t.droppedQueries++
+		return
+	}
+	t.queries = append(t.queries, tracedQuery{Query: query, ElapsedMS: durationMS(elapsed)})
+}
+
+func (t *requestTrace) addFill(name string, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.fills[name]
+	if !ok {
+		f = &fillTiming{}
+		t.fills[name] = f
+	}
+	f.Count++
+	f.TotalMS += durationMS(elapsed)
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// traceFill は fill* の所要時間を記録する関数を返します。
+// defer traceFill(ctx, "fillUserResponse")() のように使います。
+func traceFill(ctx context.Context, name string) func() {
+	trace, ok := ctx.Value(requestTraceKey{}).(*requestTrace)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		trace.addFill(name, time.Since(start))
+	}
+}
+
+type requestTraceLog struct {
+	Time           string                 `json:"time"`
+	Method         string                 `json:"method"`
+	Route          string                 `json:"route"`
+	Phase          string                 `json:"phase"`
+	URI            string                 `json:"uri"`
+	Status         int                    `json:"status"`
+	ElapsedMS      float64                `json:"elapsed_ms"`
+	Reason         string                 `json:"reason"`
+	Queries        []tracedQuery          `json:"queries"`
+	DroppedQueries int64                  `json:"dropped_queries,omitempty"`
+	Fills          map[string]*fillTiming `json:"fills"`
+}
+
+func loadRequestTraceConfig() requestTraceConfig {
+	conf := currentConfig()
+	return requestTraceConfig{
+		samplePercent: float64(conf.VerboseLogSamplePercent),
+		slow:          time.Duration(conf.VerboseLogSlowMS) * time.Millisecond,
+	}
+}
+
+// requestTraceMiddleware はサンプリングされたリクエストと遅いリクエストの詳細ログを出力します。
+// ログは標準エラー出力に 1 リクエスト 1 行の JSON で書きます。
+// 設定は読み直しで変わるので、リクエストごとに見る。
+func requestTraceMiddleware() echo.MiddlewareFunc {
+	logger := log.New(os.Stderr, "", 0)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cfg := loadRequestTraceConfig()
+			if !cfg.enabled() {
+				return next(c)
+			}
+			// サンプリング対象かどうかは先に決めておく。遅いリクエストは終わるまでわからないので、どちらにしても記録はする
+			sampled := cfg.samplePercent > 0 && rand.Float64()*100 < cfg.samplePercent
+			if !sampled && cfg.slow <= 0 {
+				return next(c)
+			}
+
+			trace := &requestTrace{fills: make(map[string]*fillTiming)}
+			req := c.Request()
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestTraceKey{}, trace)))
+
+			start := time.Now()
+			err := next(c)
+			elapsed := time.Since(start)
+
+			var reason string
+			switch {
+			case cfg.slow > 0 && elapsed >= cfg.slow:
+				reason = "slow"
+			case sampled:
+				reason = "sampled"
+			default:
+				return err
+			}
+
+			status := c.Response().Status
+			if httpErr, ok := err.(*echo.HTTPError); ok {
+				status = httpErr.Code
+			}
+
+			trace.mu.Lock()
+			entry := requestTraceLog{
+				Time:           start.Format(time.RFC3339),
+				Method:         req.Method,
+				Route:          c.Path(),
+				Phase:          benchPhase(c),
+				URI:            req.RequestURI,
+				Status:         status,
+				ElapsedMS:      durationMS(elapsed),
+				Reason:         reason,
+				Queries:        trace.queries,
+				DroppedQueries: trace.droppedQueries,
+				Fills:          trace.fills,
+			}
+			b, jsonErr := json.Marshal(entry)
+			trace.mu.Unlock()
+			if jsonErr != nil {
+				log.Printf("request trace: failed to marshal: %v", jsonErr)
+				return err
+			}
+			logger.Println(string(b))
+
+			return err
+		}
+	}
+}
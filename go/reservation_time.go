@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 配信予約の時刻
+// start_at / end_at は unix 秒のほか、オフセット付きの RFC3339 ("2023-11-25T10:00:00+09:00") でも受け付ける。
+// 予約できる期間 (2023/11/25 10:00 からの 1 年間) は設定のタイムゾーン (config.go の time_zone) で決める
+type reservationTime int64
+
+func (t *reservationTime) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*t = reservationTime(v)
+	case string:
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return fmt.Errorf("invalid time %q: must be unix seconds or RFC3339 with offset", v)
+		}
+		*t = reservationTime(parsed.Unix())
+	default:
+		return fmt.Errorf("invalid time: %s", b)
+	}
+	return nil
+}
+
+// reservationTerm は予約できる期間を設定のタイムゾーンで返します。
+func reservationTerm() (time.Time, time.Time) {
+	loc := currentConfig().timeLocation()
+	return time.Date(2023, 11, 25, 10, 0, 0, 0, loc), time.Date(2024, 11, 25, 10, 0, 0, 0, loc)
+}
+
+// validateReservationTime は予約の時刻が正しく、予約できる期間にかかっていることを確かめます。
+func validateReservationTime(startAt, endAt int64) error {
+	if startAt >= endAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+	}
+
+	termStartAt, termEndAt := reservationTerm()
+	loc := termStartAt.Location()
+	if startAt >= termEndAt.Unix() || endAt <= termStartAt.Unix() {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(
+			"bad reservation time range: %s - %s is out of the reservation period %s - %s",
+			time.Unix(startAt, 0).In(loc).Format(time.RFC3339),
+			time.Unix(endAt, 0).In(loc).Format(time.RFC3339),
+			termStartAt.Format(time.RFC3339),
+			termEndAt.Format(time.RFC3339),
+		))
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"hash/crc32"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 配信ごとのルーティングのヒント
+// ISUCON13_ROUTE_NODES にサーバ名 (リバースプロキシの upstream 名など) をカンマ区切りで並べると、
+// 配信IDを含むリクエストに X-Route-Hint ヘッダでその配信を担当するサーバを返す。
+// プロキシがこのヘッダ (または同じハッシュ) で振り分ければ、配信ごとのキャッシュや hub が 1 台に集まる
+const (
+	routeHintHeader = "X-Route-Hint"
+	// 1 台あたりのリング上の点の数。多いほど配信が均等に散らばる
+	routeRingReplicas = 64
+)
+
+type routeRingPoint struct {
+	Hash uint32 `json:"hash"`
+	Node string `json:"node"`
+}
+
+type routeRing struct {
+	nodes  []string
+	points []routeRingPoint
+}
+
+var livestreamRouteRing = newRouteRing(routeNodes())
+
+func routeNodes() []string {
+	var nodes []string
+	for _, n := range strings.Split(os.Getenv("ISUCON13_ROUTE_NODES"), ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func newRouteRing(nodes []string) *routeRing {
+	r := &routeRing{nodes: nodes}
+	for _, node := range nodes {
+		for i := 0; i < routeRingReplicas; i++ {
+			r.points = append(r.points, routeRingPoint{
+				Hash: crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i))),
+				Node: node,
+			})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].Hash < r.points[j].Hash
+	})
+	return r
+}
+
+// routeHash はプロキシ側で同じ計算ができるよう、配信IDの10進文字列の CRC32 (IEEE) を使います。
+func routeHash(livestreamID int64) uint32 {
+	return crc32.ChecksumIEEE([]byte(strconv.FormatInt(livestreamID, 10)))
+}
+
+// nodeFor は配信を担当するサーバを返します。ノードがなければ空文字列を返します。
+func (r *routeRing) nodeFor(livestreamID int64) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := routeHash(livestreamID)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].Hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].Node
+}
+
+// routeHintMiddleware はパスに配信IDを含むリクエストに X-Route-Hint を付けます。
+func routeHintMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if len(livestreamRouteRing.points) > 0 {
+			if id, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64); err == nil {
+				c.Response().Header().Set(routeHintHeader, livestreamRouteRing.nodeFor(id))
+			}
+		}
+		return next(c)
+	}
+}
+
+type RouteRingResponse struct {
+	Nodes    []string         `json:"nodes"`
+	Replicas int              `json:"replicas"`
+	Hash     string           `json:"hash"`
+	Points   []routeRingPoint `json:"points"`
+	// ?livestream_id= を指定したときの担当サーバ
+	Node string `json:"node,omitempty"`
+}
+
+// ルーティング用ハッシュリング取得API
+// GET /api/admin/route_ring?livestream_id=
+func getRouteRingHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	res := RouteRingResponse{
+		Nodes:    livestreamRouteRing.nodes,
+		Replicas: routeRingReplicas,
+		Hash:     "crc32-ieee",
+		Points:   livestreamRouteRing.points,
+	}
+	if res.Nodes == nil {
+		res.Nodes = []string{}
+		res.Points = []routeRingPoint{}
+	}
+	if v := c.QueryParam("livestream_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "livestream_id query parameter must be integer")
+		}
+		res.Node = livestreamRouteRing.nodeFor(id)
+	}
+	return c.JSON(http.StatusOK, res)
+}
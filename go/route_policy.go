@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ルートごとの処理方針 (タイムアウト・同時実行数・キャッシュの TTL・優先度)
+// ハンドラごとにばらばらに調整せず、設定の route_policies にまとめて書く。上から順に最初に一致したものを使う
+//
+//	"route_policies": [
+//	  {"route": "GET /api/user/:username/statistics", "timeout": "3s", "max_concurrency": 4, "priority": "low"},
+//	  {"route": "GET /api/livestream/:livestream_id/*", "cache_ttl": "1s"},
+//	  {"route": "* /api/*", "timeout": "10s"}
+//	]
+//
+// route はメソッド (* ならすべて) と echo のルートで、ルートは path.Match のパターンとして比べる (* は / をまたがない)。
+// 同時実行数が埋まっているとき、priority が low のルートはすぐに 503 を返し、それ以外は timeout まで空きを待つ。
+// cache_ttl は GET の 200 に Cache-Control: private, max-age を付ける (ハンドラが自分で付けた場合はそのまま)
+type RoutePolicy struct {
+	Route          string         `json:"route"`
+	Timeout        configDuration `json:"timeout,omitempty"`
+	MaxConcurrency int            `json:"max_concurrency,omitempty"`
+	CacheTTL       configDuration `json:"cache_ttl,omitempty"`
+	Priority       string         `json:"priority,omitempty"`
+
+	method  string
+	pattern string
+}
+
+const (
+	routePriorityNormal = "normal"
+	routePriorityLow    = "low"
+)
+
+// compile は route をメソッドとパターンに分けます。
+func (p *RoutePolicy) compile() error {
+	method, pattern, ok := strings.Cut(strings.TrimSpace(p.Route), " ")
+	pattern = strings.TrimSpace(pattern)
+	if !ok || pattern == "" {
+		return fmt.Errorf("route must be \"METHOD PATTERN\"")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	switch p.Priority {
+	case "":
+		p.Priority = routePriorityNormal
+	case routePriorityNormal, routePriorityLow:
+	default:
+		return fmt.Errorf("unknown priority %q", p.Priority)
+	}
+	p.method = strings.ToUpper(method)
+	p.pattern = pattern
+	return nil
+}
+
+func (p *RoutePolicy) matches(method, route string) bool {
+	if p.method != "*" && p.method != method {
+		return false
+	}
+	ok, _ := path.Match(p.pattern, route)
+	return ok
+}
+
+// normalizeRoutePolicies は読めない方針を捨てます。
+func normalizeRoutePolicies(policies []RoutePolicy) []RoutePolicy {
+	valid := make([]RoutePolicy, 0, len(policies))
+	for _, p := range policies {
+		if err := p.compile(); err != nil {
+			log.Printf("invalid route policy %q: %v", p.Route, err)
+			continue
+		}
+		valid = append(valid, p)
+	}
+	return valid
+}
+
+func routePolicyFor(method, route string) (RoutePolicy, bool) {
+	for _, p := range currentConfig().RoutePolicies {
+		if p.matches(method, route) {
+			return p, true
+		}
+	}
+	return RoutePolicy{}, false
+}
+
+// 方針ごとの同時実行数の枠。設定を読み直しても実行中の処理の数は引き継ぐので、route をキーにして使い回す
+var (
+	routePoolsMu sync.Mutex
+	routePools   = map[string]*workerPool{}
+)
+
+func routePoolFor(p RoutePolicy) *workerPool {
+	routePoolsMu.Lock()
+	defer routePoolsMu.Unlock()
+	pool, ok := routePools[p.Route]
+	if !ok {
+		pool = newWorkerPool(p.MaxConcurrency)
+		routePools[p.Route] = pool
+	} else {
+		pool.resize(p.MaxConcurrency)
+	}
+	return pool
+}
+
+func routePoolStats() map[string]WorkerPoolStats {
+	routePoolsMu.Lock()
+	defer routePoolsMu.Unlock()
+	stats := make(map[string]WorkerPoolStats, len(routePools))
+	for route, pool := range routePools {
+		stats[route] = pool.stats()
+	}
+	return stats
+}
+
+// routePolicyMiddleware はルートに一致した方針を適用します。
+// 設定は読み直しで変わるので、リクエストごとに見る。
+func routePolicyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		p, ok := routePolicyFor(c.Request().Method, c.Path())
+		if !ok {
+			return next(c)
+		}
+
+		if ttl := p.CacheTTL.duration(); ttl > 0 && c.Request().Method == http.MethodGet {
+			res := c.Response()
+			res.Before(func() {
+				if res.Status == http.StatusOK && res.Header().Get("Cache-Control") == "" {
+					res.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(ttl.Seconds())))
+				}
+			})
+		}
+
+		ctx := c.Request().Context()
+		if timeout := p.Timeout.duration(); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+		}
+
+		var err error
+		run := func() { err = next(c) }
+		if p.MaxConcurrency > 0 {
+			pool := routePoolFor(p)
+			if p.Priority == routePriorityLow {
+				if !pool.tryDo(run) {
+					return echo.NewHTTPError(http.StatusServiceUnavailable, "too many requests for this route")
+				}
+			} else if waitErr := pool.do(ctx, run); waitErr != nil {
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "failed to wait for a slot: "+waitErr.Error())
+			}
+		} else {
+			run()
+		}
+
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "request timed out: "+err.Error())
+		}
+		return err
+	}
+}
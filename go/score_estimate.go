@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ベンチマークの結果を待たずにスコアの推移を見るための概算
+// ISUCON13 のスコアは負荷走行中に投稿できたライブコメントの投げ銭 (tip) の合計なので、
+// initialize からの tip の合計をそのまま概算のスコアとし、成功・失敗したリクエストの数を種類ごとに並べる。
+// ベンチマーカー側のタイムアウトや整合性チェックの失敗は見えないので、実際のスコアより高めに出る
+const scoreEstimateBucketSeconds = 10
+
+// スコアに関わるリクエストの種類。これ以外のルートは other にまとめる
+var scoreEstimateKinds = map[string]string{
+	"POST /api/register":                                                     "register",
+	"POST /api/login":                                                        "login",
+	"POST /api/livestream/reservation":                                       "reservation",
+	"POST /api/livestream/:livestream_id/enter":                              "enter",
+	"DELETE /api/livestream/:livestream_id/exit":                             "exit",
+	"POST /api/livestream/:livestream_id/livecomment":                        "livecomment",
+	"GET /api/livestream/:livestream_id/livecomment":                         "livecomment_list",
+	"POST /api/livestream/:livestream_id/reaction":                           "reaction",
+	"GET /api/livestream/:livestream_id/reaction":                            "reaction_list",
+	"POST /api/livestream/:livestream_id/livecomment/:livecomment_id/report": "report",
+	"POST /api/livestream/:livestream_id/moderate":                           "moderate",
+	"GET /api/livestream/search":                                             "search",
+	"GET /api/user/:username/statistics":                                     "user_statistics",
+	"GET /api/livestream/:livestream_id/statistics":                          "livestream_statistics",
+	"GET /api/user/:username/icon":                                           "icon",
+	"POST /api/icon":                                                         "icon_upload",
+}
+
+type scoreEstimateCounts struct {
+	success      int64
+	clientErrors int64
+	serverErrors int64
+}
+
+type scoreEstimator struct {
+	mu      sync.Mutex
+	since   time.Time
+	tips    int64
+	tipped  int64
+	buckets []int64
+	kinds   map[string]*scoreEstimateCounts
+}
+
+var scoreEstimate = newScoreEstimator()
+
+func newScoreEstimator() *scoreEstimator {
+	return &scoreEstimator{
+		since: time.Now(),
+		kinds: map[string]*scoreEstimateCounts{},
+	}
+}
+
+// reset は initialize 時に呼び、集計をやり直します。
+func (s *scoreEstimator) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since = time.Now()
+	s.tips = 0
+	s.tipped = 0
+	s.buckets = nil
+	s.kinds = map[string]*scoreEstimateCounts{}
+}
+
+func (s *scoreEstimator) recordRequest(route string, status int) {
+	kind, ok := scoreEstimateKinds[route]
+	if !ok {
+		kind = "other"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cnt, ok := s.kinds[kind]
+	if !ok {
+		cnt = &scoreEstimateCounts{}
+		s.kinds[kind] = cnt
+	}
+	switch {
+	case status >= 500:
+		cnt.serverErrors++
+	case status >= 400:
+		cnt.clientErrors++
+	default:
+		cnt.success++
+	}
+}
+
+// recordTips は n 件の投げ銭 (合計 total) を数えます。
+func (s *scoreEstimator) recordTips(total, n int64) {
+	if n <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tips += total
+	s.tipped += n
+	i := int(time.Since(s.since) / (scoreEstimateBucketSeconds * time.Second))
+	for len(s.buckets) <= i {
+		s.buckets = append(s.buckets, 0)
+	}
+	s.buckets[i] += total
+}
+
+type ScoreEstimateRequests struct {
+	Success      int64 `json:"success"`
+	ClientErrors int64 `json:"client_errors"`
+	ServerErrors int64 `json:"server_errors"`
+}
+
+type ScoreEstimatePoint struct {
+	// initialize からの経過秒数と、その時点までの概算スコア
+	ElapsedSeconds int64 `json:"elapsed_seconds"`
+	Score          int64 `json:"score"`
+}
+
+type ScoreEstimateResponse struct {
+	Since          int64 `json:"since"`
+	ElapsedSeconds int64 `json:"elapsed_seconds"`
+	Score          int64 `json:"score"`
+	// 投げ銭付きで投稿できたライブコメントの数
+	TippedLivecomments int64                            `json:"tipped_livecomments"`
+	ServerErrors       int64                            `json:"server_errors"`
+	Requests           map[string]ScoreEstimateRequests `json:"requests"`
+	Timeline           []ScoreEstimatePoint             `json:"timeline"`
+}
+
+func (s *scoreEstimator) snapshot() ScoreEstimateResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := ScoreEstimateResponse{
+		Since:              s.since.Unix(),
+		ElapsedSeconds:     int64(time.Since(s.since).Seconds()),
+		Score:              s.tips,
+		TippedLivecomments: s.tipped,
+		Requests:           make(map[string]ScoreEstimateRequests, len(s.kinds)),
+		Timeline:           make([]ScoreEstimatePoint, 0, len(s.buckets)),
+	}
+	for kind, cnt := range s.kinds {
+		res.Requests[kind] = ScoreEstimateRequests{
+			Success:      cnt.success,
+			ClientErrors: cnt.clientErrors,
+			ServerErrors: cnt.serverErrors,
+		}
+		res.ServerErrors += cnt.serverErrors
+	}
+	var acc int64
+	for i, tips := range s.buckets {
+		acc += tips
+		res.Timeline = append(res.Timeline, ScoreEstimatePoint{
+			ElapsedSeconds: int64((i + 1) * scoreEstimateBucketSeconds),
+			Score:          acc,
+		})
+	}
+	return res
+}
+
+// scoreEstimateHandler は pprof と同じポートで、initialize からの概算スコアを返します。
+// GET /debug/score_estimate
+func scoreEstimateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(scoreEstimate.snapshot())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 非正規化したスコア・カウンタの作り直し
+// 整合性チェックでずれが見つかったときに、/api/initialize を叩かずに生テーブルから作り直す
+// (視聴時間の累計は退室時に履歴を消しているので作り直せない)
+type scoreRecalcStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+var scoreRecalcSteps = []scoreRecalcStep{
+	{name: "viewer_history", run: func(ctx context.Context) error {
+		return viewerHistory.rebuild(ctx)
+	}},
+	{name: "poll_votes", run: func(ctx context.Context) error {
+		_, err := dbConn.ExecContext(ctx, "UPDATE poll_options o SET votes = (SELECT COUNT(*) FROM poll_votes v WHERE v.option_id = o.id)")
+		return err
+	}},
+	{name: "question_votes", run: func(ctx context.Context) error {
+		_, err := dbConn.ExecContext(ctx, "UPDATE questions q SET votes = (SELECT COUNT(*) FROM question_votes v WHERE v.question_id = q.id)")
+		return err
+	}},
+	{name: "trending", run: func(ctx context.Context) error {
+		return recommendations.refresh(ctx)
+	}},
+	{name: "tag_index", run: func(ctx context.Context) error {
+		livestreamTagIndex.reset()
+		return livestreamTagIndex.ensureLoaded(ctx)
+	}},
+	{name: "caches", run: func(ctx context.Context) error {
+		resetHomeCache()
+		resetModerationSummaries()
+		// 作り直した視聴履歴から数え直させる
+		tagStats.reset()
+		return nil
+	}},
+}
+
+const (
+	scoreRecalcStatusPending = "pending"
+	scoreRecalcStatusRunning = "running"
+	scoreRecalcStatusDone    = "done"
+	scoreRecalcStatusFailed  = "failed"
+)
+
+type ScoreRecalcStepProgress struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	ElapsedMS float64 `json:"elapsed_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type ScoreRecalcProgress struct {
+	Running    bool                      `json:"running"`
+	StartedAt  int64                     `json:"started_at,omitempty"`
+	FinishedAt int64                     `json:"finished_at,omitempty"`
+	Steps      []ScoreRecalcStepProgress `json:"steps"`
+}
+
+// scoreRecalculator は作り直しを 1 つずつバックグラウンドで実行し、進捗を保持します。
+type scoreRecalculator struct {
+	mu       sync.Mutex
+	progress ScoreRecalcProgress
+}
+
+var scoreRecalc = &scoreRecalculator{}
+
+func (r *scoreRecalculator) snapshot() ScoreRecalcProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.progress
+	p.Steps = append([]ScoreRecalcStepProgress{}, r.progress.Steps...)
+	return p
+}
+
+// start は実行中でなければ作り直しを始めて true を返します。
+func (r *scoreRecalculator) start() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.progress.Running {
+		return false
+	}
+	steps := make([]ScoreRecalcStepProgress, len(scoreRecalcSteps))
+	for i, step := range scoreRecalcSteps {
+		steps[i] = ScoreRecalcStepProgress{Name: step.name, Status: scoreRecalcStatusPending}
+	}
+	r.progress = ScoreRecalcProgress{
+		Running:   true,
+		StartedAt: time.Now().Unix(),
+		Steps:     steps,
+	}
+	go func() {
+		if err := r.run(context.Background()); err != nil {
+			log.Printf("failed to recalculate scores: %v", err)
+		}
+	}()
+	return true
+}
+
+// run はすべてのステップを順に実行します。途中で失敗したら残りは実行しません。
+func (r *scoreRecalculator) run(ctx context.Context) error {
+	defer func() {
+		r.mu.Lock()
+		r.progress.Running = false
+		r.progress.FinishedAt = time.Now().Unix()
+		r.mu.Unlock()
+	}()
+
+	for i, step := range scoreRecalcSteps {
+		r.setStep(i, scoreRecalcStatusRunning, 0, nil)
+		start := time.Now()
+		err := step.run(ctx)
+		if err != nil {
+			r.setStep(i, scoreRecalcStatusFailed, time.Since(start), err)
+			return err
+		}
+		r.setStep(i, scoreRecalcStatusDone, time.Since(start), nil)
+	}
+	return nil
+}
+
+func (r *scoreRecalculator) setStep(i int, status string, elapsed time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i >= len(r.progress.Steps) {
+		return
+	}
+	step := &r.progress.Steps[i]
+	step.Status = status
+	step.ElapsedMS = durationMS(elapsed)
+	if err != nil {
+		step.Error = err.Error()
+	}
+}
+
+// スコア再計算API
+// バックグラウンドで実行し、進捗は GET で確認する
+// POST /api/admin/recalculate_scores
+func postRecalculateScoresHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	if !scoreRecalc.start() {
+		return echo.NewHTTPError(http.StatusConflict, "score recalculation is already running")
+	}
+	return c.JSON(http.StatusAccepted, scoreRecalc.snapshot())
+}
+
+// スコア再計算の進捗取得API
+// GET /api/admin/recalculate_scores
+func getRecalculateScoresHandler(c echo.Context) error {
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, scoreRecalc.snapshot())
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// corsMiddleware は別ホストのフロントエンドや配信オーバーレイから API を直接呼べるようにします。
+// 許可するオリジンは ISUCON13_CORS_ALLOWED_ORIGINS (カンマ区切り) で、未設定なら ISUCON13_FRONTEND_ORIGIN を使います。
+// どちらも空なら CORS ヘッダは付けません (nginx で同一オリジンにしている構成)。
+func corsMiddleware() echo.MiddlewareFunc {
+	origins := frontendOrigins()
+	if v, ok := os.LookupEnv("ISUCON13_CORS_ALLOWED_ORIGINS"); ok {
+		origins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, origin)
+			}
+		}
+	}
+	if len(origins) == 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: origins,
+		AllowMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+		AllowHeaders: []string{
+			echo.HeaderContentType,
+			echo.HeaderAuthorization,
+			csrfHeaderName,
+			adminTokenHeader,
+		},
+		ExposeHeaders:    []string{"Retry-After"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	})
+}
+
+// securityHeadersMiddleware は一般的なセキュリティヘッダを付けます。
+// HSTS は TLS を Go で終端しているときだけ意味があるので ISUCON13_HSTS_MAX_AGE で明示的に有効にします。
+func securityHeadersMiddleware() echo.MiddlewareFunc {
+	return middleware.SecureWithConfig(middleware.SecureConfig{
+		XSSProtection:         "0",
+		ContentTypeNosniff:    "nosniff",
+		XFrameOptions:         "SAMEORIGIN",
+		HSTSMaxAge:            int(envInt64("ISUCON13_HSTS_MAX_AGE", 0)),
+		ContentSecurityPolicy: os.Getenv("ISUCON13_CONTENT_SECURITY_POLICY"),
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// seedBatchSize 件ずつ生成して bulkInsert で書き込む
+const seedBatchSize = bulkInsertBatchSize
+
+// 投げ銭の額面 (フロントエンドで選べる金額に寄せる)
+var seedTipAmounts = []int64{100, 500, 1000, 5000, 10000, 20000, 50000}
+
+var seedEmojis = []string{"innocent", "tada", "heart", "+1", "joy", "fire", "clap", "eyes", "100", "sob"}
+
+type seedOptions struct {
+	users        int
+	livestreams  int
+	livecomments int
+	reactions    int
+	// tipRate はライブコメントのうち投げ銭付きの割合
+	tipRate  float64
+	password string
+	seed     int64
+}
+
+// runSeedCommand は負荷試験用のデータを生成して投入します。
+// isupipe seed -users 10000 -livestreams 20000 -livecomments 500000 -reactions 1000000
+func runSeedCommand(args []string) error {
+	opts := seedOptions{}
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	fs.IntVar(&opts.users, "users", 1000, "追加するユーザ数")
+	fs.IntVar(&opts.livestreams, "livestreams", 2000, "追加する配信数")
+	fs.IntVar(&opts.livecomments, "livecomments", 50000, "追加するライブコメント数")
+	fs.IntVar(&opts.reactions, "reactions", 100000, "追加するリアクション数")
+	fs.Float64Var(&opts.tipRate, "tip-rate", 0.1, "投げ銭付きライブコメントの割合")
+	fs.StringVar(&opts.password, "password", "test", "生成するユーザのパスワード")
+	fs.Int64Var(&opts.seed, "seed", time.Now().UnixNano(), "乱数のシード")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	conn, err := connectDB(nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect db: %w", err)
+	}
+	defer conn.Close()
+	dbConn = conn
+
+	return seedData(context.Background(), opts)
+}
+
+func seedData(ctx context.Context, opts seedOptions) error {
+	rnd := rand.New(rand.NewSource(opts.seed))
+
+	// bcrypt は遅いので全員同じハッシュを使う
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(opts.password), bcryptDefaultCost)
+	if err != nil {
+		return err
+	}
+
+	var baseUserID int64
+	if err := dbConn.GetContext(ctx, &baseUserID, "SELECT IFNULL(MAX(id), 0) FROM users"); err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("seed%d", opts.seed%100000)
+
+	users := make([]UserModel, 0, seedBatchSize)
+	themes := make([]ThemeModel, 0, seedBatchSize)
+	for i := 0; i < opts.users; i++ {
+		users = append(users, UserModel{
+			ID:             baseUserID + int64(i) + 1,
+			Name:           fmt.Sprintf("%s-%d", prefix, i),
+			DisplayName:    fmt.Sprintf("Seed User %d", i),
+			Description:    "generated by isupipe seed",
+			HashedPassword: string(hashedPassword),
+		})
+		themes = append(themes, ThemeModel{UserID: baseUserID + int64(i) + 1, DarkMode: rnd.Intn(2) == 0})
+		if len(users) == seedBatchSize || i == opts.users-1 {
+			if err := bulkInsert(ctx, dbConn, "INSERT INTO users (id, name, display_name, description, password) VALUES (:id, :name, :display_name, :description, :password)", users); err != nil {
+				return fmt.Errorf("failed to insert users: %w", err)
+			}
+			if err := bulkInsert(ctx, dbConn, "INSERT INTO themes (user_id, dark_mode) VALUES (:user_id, :dark_mode)", themes); err != nil {
+				return fmt.Errorf("failed to insert themes: %w", err)
+			}
+			users, themes = users[:0], themes[:0]
+		}
+	}
+	fmt.Printf("inserted %d users\n", opts.users)
+
+	var userIDs []int64
+	if err := dbConn.SelectContext(ctx, &userIDs, "SELECT id FROM users"); err != nil {
+		return err
+	}
+	if len(userIDs) == 0 {
+		return fmt.Errorf("no users to attach livestreams")
+	}
+
+	var baseLivestreamID int64
+	if err := dbConn.GetContext(ctx, &baseLivestreamID, "SELECT IFNULL(MAX(id), 0) FROM livestreams"); err != nil {
+		return err
+	}
+	var tagIDs []int64
+	if err := dbConn.SelectContext(ctx, &tagIDs, "SELECT id FROM tags"); err != nil {
+		return err
+	}
+
+	// 予約可能期間 (reserveLivestreamHandler と同じ) の中に1時間単位で置く
+	termStartAt := time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC).Unix()
+	termHours := int64(365 * 24)
+
+	livestreams := make([]LivestreamModel, 0, seedBatchSize)
+	livestreamTags := make([]LivestreamTagModel, 0, seedBatchSize)
+	for i := 0; i < opts.livestreams; i++ {
+		id := baseLivestreamID + int64(i) + 1
+		startAt := termStartAt + rnd.Int63n(termHours-2)*3600
+		livestreams = append(livestreams, LivestreamModel{
+			ID:           id,
+			UserID:       userIDs[rnd.Intn(len(userIDs))],
+			Title:        fmt.Sprintf("Seed Livestream %d", i),
+			Description:  "generated by isupipe seed",
+			PlaylistUrl:  "https://media.xiii.isucon.dev/api/4/playlist.m3u8",
+			ThumbnailUrl: "https://media.xiii.isucon.dev/isucon12_final.webp",
+			StartAt:      startAt,
+			EndAt:        startAt + (1+rnd.Int63n(2))*3600,
+		})
+		if len(tagIDs) > 0 {
+			for n := rnd.Intn(4); n > 0; n-- {
+				livestreamTags = append(livestreamTags, LivestreamTagModel{LivestreamID: id, TagID: tagIDs[rnd.Intn(len(tagIDs))]})
+			}
+		}
+		if len(livestreams) == seedBatchSize || i == opts.livestreams-1 {
+			if err := bulkInsert(ctx, dbConn, "INSERT INTO livestreams (id, user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (:id, :user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreams); err != nil {
+				return fmt.Errorf("failed to insert livestreams: %w", err)
+			}
+			if len(livestreamTags) > 0 {
+				if err := bulkInsert(ctx, dbConn, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", livestreamTags); err != nil {
+					return fmt.Errorf("failed to insert livestream tags: %w", err)
+				}
+			}
+			livestreams, livestreamTags = livestreams[:0], livestreamTags[:0]
+		}
+	}
+	fmt.Printf("inserted %d livestreams\n", opts.livestreams)
+
+	var livestreamIDs []int64
+	if err := dbConn.SelectContext(ctx, &livestreamIDs, "SELECT id FROM livestreams"); err != nil {
+		return err
+	}
+	if len(livestreamIDs) == 0 {
+		return fmt.Errorf("no livestreams to attach livecomments")
+	}
+
+	now := time.Now().Unix()
+	livecomments := make([]LivecommentModel, 0, seedBatchSize)
+	for i := 0; i < opts.livecomments; i++ {
+		livecomments = append(livecomments, LivecommentModel{
+			UserID:       userIDs[rnd.Intn(len(userIDs))],
+			LivestreamID: pickPopular(rnd, livestreamIDs),
+			Comment:      fmt.Sprintf("seed comment %d", i),
+			Tip:          seedTip(rnd, opts.tipRate),
+			CreatedAt:    now,
+		})
+		if len(livecomments) == seedBatchSize || i == opts.livecomments-1 {
+			if err := bulkInsert(ctx, dbConn, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecomments); err != nil {
+				return fmt.Errorf("failed to insert livecomments: %w", err)
+			}
+			livecomments = livecomments[:0]
+		}
+	}
+	fmt.Printf("inserted %d livecomments\n", opts.livecomments)
+
+	reactions := make([]ReactionModel, 0, seedBatchSize)
+	for i := 0; i < opts.reactions; i++ {
+		reactions = append(reactions, ReactionModel{
+			UserID:       userIDs[rnd.Intn(len(userIDs))],
+			LivestreamID: pickPopular(rnd, livestreamIDs),
+			EmojiName:    seedEmojis[rnd.Intn(len(seedEmojis))],
+			CreatedAt:    now,
+		})
+		if len(reactions) == seedBatchSize || i == opts.reactions-1 {
+			if err := bulkInsert(ctx, dbConn, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactions); err != nil {
+				return fmt.Errorf("failed to insert reactions: %w", err)
+			}
+			reactions = reactions[:0]
+		}
+	}
+	fmt.Printf("inserted %d reactions\n", opts.reactions)
+
+	return nil
+}
+
+// seedTip は投げ銭の額を返します。大半は0で、額面が大きいほど出にくい。
+func seedTip(rnd *rand.Rand, tipRate float64) int64 {
+	if rnd.Float64() >= tipRate {
+		return 0
+	}
+	// 指数分布で小さい額面に寄せる
+	idx := int(rnd.ExpFloat64() * 1.2)
+	if idx >= len(seedTipAmounts) {
+		idx = len(seedTipAmounts) - 1
+	}
+	return seedTipAmounts[idx]
+}
+
+// pickPopular は一部の配信にコメントやリアクションが集中するように選びます (おおよそべき分布)。
+func pickPopular(rnd *rand.Rand, ids []int64) int64 {
+	idx := int(math.Pow(rnd.Float64(), 3) * float64(len(ids)))
+	if idx >= len(ids) {
+		idx = len(ids) - 1
+	}
+	return ids[idx]
+}
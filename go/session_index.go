@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// sessionIndex はユーザごとの有効なセッションを管理します。
+// セッション本体は Cookie に入っているので、サーバ側ではログアウトや強制失効を反映するためだけに使います。
+type sessionIndex interface {
+	add(ctx context.Context, userID int64, sessionID string, expiresAt int64) error
+	isActive(ctx context.Context, userID int64, sessionID string) (bool, error)
+	// touch はセッションの有効期限を延ばします
+	touch(ctx context.Context, userID int64, sessionID string, expiresAt int64) error
+	revoke(ctx context.Context, sessionID string) error
+	// revokeAll はユーザのすべてのセッションを失効させ、失効させた件数を返します
+	revokeAll(ctx context.Context, userID int64) (int64, error)
+}
+
+var userSessions sessionIndex = &mysqlSessionIndex{}
+
+// setupSessionIndex は ISUCON13_SESSION_INDEX_BACKEND=redis のとき Redis を使うようにします。
+func setupSessionIndex() error {
+	if os.Getenv("ISUCON13_SESSION_INDEX_BACKEND") != "redis" {
+		return nil
+	}
+	addr := "127.0.0.1:6379"
+	if v, ok := os.LookupEnv("ISUCON13_REDIS_ADDR"); ok {
+		addr = v
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return fmt.Errorf("failed to connect redis: %w", err)
+	}
+	userSessions = &redisSessionIndex{client: client}
+	log.Printf("session index backend: redis (%s)", addr)
+	return nil
+}
+
+type cachedActiveSession struct {
+	active    bool
+	expiresAt time.Time
+}
+
+// activeSessions は sessionID ごとの isActive の結果のキャッシュです。
+var activeSessions sync.Map
+
+func resetActiveSessions() {
+	activeSessions.Range(func(key, _ interface{}) bool {
+		activeSessions.Delete(key)
+		return true
+	})
+}
+
+func isActiveSession(ctx context.Context, userID int64, sessionID string) (bool, error) {
+	if v, ok := activeSessions.Load(sessionID); ok {
+		if cached := v.(cachedActiveSession); time.Now().Before(cached.expiresAt) {
+			return cached.active, nil
+		}
+	}
+	active, err := userSessions.isActive(ctx, userID, sessionID)
+	if err != nil {
+		return false, err
+	}
+	activeSessions.Store(sessionID, cachedActiveSession{active: active, expiresAt: time.Now().Add(currentConfig().ActiveSessionTTL.duration())})
+	return active, nil
+}
+
+type mysqlSessionIndex struct{}
+
+func (s *mysqlSessionIndex) add(ctx context.Context, userID int64, sessionID string, expiresAt int64) error {
+	_, err := dbConn.ExecContext(ctx, "INSERT INTO user_sessions (session_id, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)", sessionID, userID, time.Now().Unix(), expiresAt)
+	return err
+}
+
+func (s *mysqlSessionIndex) isActive(ctx context.Context, userID int64, sessionID string) (bool, error) {
+	var active bool
+	err := dbConn.GetContext(ctx, &active, "SELECT EXISTS(SELECT 1 FROM user_sessions WHERE session_id = ? AND user_id = ? AND expires_at >= ?)", sessionID, userID, time.Now().Unix())
+	return active, err
+}
+
+func (s *mysqlSessionIndex) touch(ctx context.Context, userID int64, sessionID string, expiresAt int64) error {
+	_, err := dbConn.ExecContext(ctx, "UPDATE user_sessions SET expires_at = ? WHERE session_id = ? AND user_id = ?", expiresAt, sessionID, userID)
+	return err
+}
+
+func (s *mysqlSessionIndex) revoke(ctx context.Context, sessionID string) error {
+	_, err := dbConn.ExecContext(ctx, "DELETE FROM user_sessions WHERE session_id = ?", sessionID)
+	return err
+}
+
+func (s *mysqlSessionIndex) revokeAll(ctx context.Context, userID int64) (int64, error) {
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM user_sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	return rs.RowsAffected()
+}
+
+// redisSessionIndex はセッションごとのキー (値は userID、期限付き) と、ユーザごとのセッションIDのセットを持ちます。
+type redisSessionIndex struct {
+	client *redis.Client
+}
+
+const redisSessionKeyPrefix = "isupipe:session:"
+
+func redisSessionKey(sessionID string) string {
+	return redisSessionKeyPrefix + sessionID
+}
+
+func redisUserSessionsKey(userID int64) string {
+	return redisSessionKeyPrefix + "user:" + strconv.FormatInt(userID, 10)
+}
+
+func (s *redisSessionIndex) add(ctx context.Context, userID int64, sessionID string, expiresAt int64) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisSessionKey(sessionID), userID, 0)
+		pipe.ExpireAt(ctx, redisSessionKey(sessionID), time.Unix(expiresAt, 0))
+		pipe.SAdd(ctx, redisUserSessionsKey(userID), sessionID)
+		return nil
+	})
+	return err
+}
+
+func (s *redisSessionIndex) isActive(ctx context.Context, userID int64, sessionID string) (bool, error) {
+	v, err := s.client.Get(ctx, redisSessionKey(sessionID)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return v == userID, nil
+}
+
+func (s *redisSessionIndex) touch(ctx context.Context, userID int64, sessionID string, expiresAt int64) error {
+	return s.client.ExpireAt(ctx, redisSessionKey(sessionID), time.Unix(expiresAt, 0)).Err()
+}
+
+func (s *redisSessionIndex) revoke(ctx context.Context, sessionID string) error {
+	key := redisSessionKey(sessionID)
+	userID, err := s.client.Get(ctx, key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.SRem(ctx, redisUserSessionsKey(userID), sessionID)
+		return nil
+	})
+	return err
+}
+
+func (s *redisSessionIndex) revokeAll(ctx context.Context, userID int64) (int64, error) {
+	sessionIDs, err := s.client.SMembers(ctx, redisUserSessionsKey(userID)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(sessionIDs) == 0 {
+		return 0, nil
+	}
+	keys := make([]string, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		keys[i] = redisSessionKey(sessionID)
+	}
+	// 期限切れで消えたセッションもセットには残っているので、実際に消せたキーの数を返す
+	var deleted *redis.IntCmd
+	if _, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, keys...)
+		pipe.Del(ctx, redisUserSessionsKey(userID))
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return deleted.Val(), nil
+}
+
+// ログアウトAPI
+// ?everywhere=true なら他の端末のセッションもすべて失効させる
+// POST /api/logout
+func logoutHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	if c.QueryParam("everywhere") == "true" {
+		if _, err := userSessions.revokeAll(ctx, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke sessions: "+err.Error())
+		}
+	} else {
+		if err := userSessions.revoke(ctx, sessionID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke session: "+err.Error())
+		}
+	}
+	activeSessions.Delete(sessionID)
+
+	sess.Options = &sessions.Options{
+		Domain: "t.isucon.pw",
+		MaxAge: -1,
+		Path:   "/",
+	}
+	sess.Values = map[interface{}]interface{}{}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// セッション強制失効API (管理者のみ)
+// アカウント停止時などに、ユーザのすべてのセッションを失効させる
+// POST /api/admin/users/:username/sessions/revoke
+func revokeUserSessionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	userID, ok, err := usernameIndex.userIDByName(ctx, c.Param("username"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+
+	revoked, err := userSessions.revokeAll(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke sessions: "+err.Error())
+	}
+	// このサーバのキャッシュは即座に消す (他のサーバは設定の active_session_ttl 以内に反映される)
+	resetActiveSessions()
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"revoked": revoked,
+	})
+}
+
+func sessionCookieOptions() *sessions.Options {
+	return &sessions.Options{
+		Domain: "t.isucon.pw",
+		MaxAge: int(60000),
+		Path:   "/",
+	}
+}
+
+// sessionRefreshMiddleware はセッションの期限をスライドさせます。
+// 残りの有効期間が設定の session_refresh_threshold を下回ったセッションを session_ttl まで延ばす (0 なら延ばさず固定の期限にする)。
+// 毎回 Set-Cookie しないよう、実際に延ばしたときだけ Cookie を書き戻します。
+func sessionRefreshMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if currentConfig().SessionRefreshThreshold > 0 {
+			if err := refreshSession(c); err != nil {
+				c.Logger().Warnf("failed to refresh session: %v", err)
+			}
+		}
+		return next(c)
+	}
+}
+
+func refreshSession(c echo.Context) error {
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return nil
+	}
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
+	if !ok {
+		return nil
+	}
+	expires, ok := sess.Values[defaultSessionExpiresKey].(int64)
+	if !ok {
+		return nil
+	}
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	now := time.Now()
+	// 期限切れのものは延ばさない (ログインし直してもらう)
+	if now.Unix() > expires || time.Unix(expires, 0).Sub(now) >= currentConfig().SessionRefreshThreshold.duration() {
+		return nil
+	}
+
+	ctx := c.Request().Context()
+	active, err := isActiveSession(ctx, userID, sessionID)
+	if err != nil || !active {
+		return err
+	}
+
+	newExpires := now.Add(currentConfig().SessionTTL.duration()).Unix()
+	if err := userSessions.touch(ctx, userID, sessionID, newExpires); err != nil {
+		return err
+	}
+	sess.Options = sessionCookieOptions()
+	sess.Values[defaultSessionExpiresKey] = newExpires
+	return sess.Save(c.Request(), c.Response())
+}
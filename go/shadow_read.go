@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// echo-contrib/session がセッションストアを保存しているキー
+const echoSessionStoreKey = "_session_store"
+
+// normalizeShadowReadTargets は新旧両方の実装を実行して比較するハンドラ名の前後の空白を除き、空のものを捨てます。
+// 設定の shadow_read (ISUCON13_SHADOW_READ にカンマ区切り) で指定し、"*" ならすべてを対象にします。
+func normalizeShadowReadTargets(names []string) []string {
+	targets := make([]string, 0, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			targets = append(targets, name)
+		}
+	}
+	return targets
+}
+
+func shadowReadEnabled(name string) bool {
+	for _, target := range currentConfig().ShadowRead {
+		if target == "*" || target == name {
+			return true
+		}
+	}
+	return false
+}
+
+// shadowRead は書き換えたハンドラ newHandler を oldHandler と並べて実行し、レスポンスが食い違えばログに出します。
+// クライアントには常に oldHandler のレスポンスを返します。対象外のときは oldHandler だけを実行します。
+// 対象かどうかはリクエストごとに設定を見るので、設定を読み直せば再起動せずに切り替えられます。
+func shadowRead(name string, oldHandler, newHandler echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !shadowReadEnabled(name) {
+			return oldHandler(c)
+		}
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		c.Request().Body.Close()
+
+		oldRec, oldErr := runCaptured(c, oldHandler, body)
+		newRec, newErr := runCaptured(c, newHandler, body)
+
+		oldStatus, oldBody := capturedResult(oldRec, oldErr)
+		newStatus, newBody := capturedResult(newRec, newErr)
+		if oldStatus != newStatus || !equalJSONBody(oldBody, newBody) {
+			log.Printf("shadow read mismatch: handler=%s uri=%s old=(%d %s) new=(%d %s)",
+				name, c.Request().RequestURI, oldStatus, truncateForLog(oldBody), newStatus, truncateForLog(newBody))
+		}
+
+		if oldErr != nil {
+			return oldErr
+		}
+		for k, vs := range oldRec.Header() {
+			for _, v := range vs {
+				c.Response().Header().Add(k, v)
+			}
+		}
+		c.Response().WriteHeader(oldRec.Code)
+		_, err = c.Response().Write(oldRec.Body.Bytes())
+		return err
+	}
+}
+
+// runCaptured はリクエストを複製してハンドラを実行し、レスポンスを記録します。
+func runCaptured(c echo.Context, h echo.HandlerFunc, body []byte) (*httptest.ResponseRecorder, error) {
+	req := c.Request().Clone(c.Request().Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	rec := httptest.NewRecorder()
+	nc := c.Echo().NewContext(req, rec)
+	nc.SetPath(c.Path())
+	nc.SetParamNames(c.ParamNames()...)
+	nc.SetParamValues(c.ParamValues()...)
+	nc.Set(echoSessionStoreKey, c.Get(echoSessionStoreKey))
+	nc.SetLogger(c.Logger())
+
+	err := h(nc)
+	return rec, err
+}
+
+func capturedResult(rec *httptest.ResponseRecorder, err error) (int, []byte) {
+	if err != nil {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code, []byte(err.Error())
+		}
+		return 500, []byte(err.Error())
+	}
+	return rec.Code, rec.Body.Bytes()
+}
+
+// equalJSONBody はキーの順序や空白の違いを無視して比較します。
+func equalJSONBody(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func truncateForLog(b []byte) string {
+	const max = 512
+	if len(b) > max {
+		return string(b[:max]) + "..."
+	}
+	return string(b)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// slidingCounter はキーごとの直近 (バケットの幅 × バケット数) の合計を数えます。
+// メトリクス (metrics.go) と同じく、時刻で決まるバケットをリングで使い回し、古くなったバケットは次に使うときに捨てる
+type slidingCounter struct {
+	mu          sync.Mutex
+	bucketWidth int64
+	buckets     []slidingBucket
+}
+
+type slidingBucket struct {
+	// バケットの開始時刻 (unix 秒をバケットの幅で割ったもの)
+	slot   int64
+	counts map[int64]int64
+}
+
+func newSlidingCounter(bucketWidth time.Duration, buckets int) *slidingCounter {
+	return &slidingCounter{
+		bucketWidth: max(int64(bucketWidth/time.Second), 1),
+		buckets:     make([]slidingBucket, buckets),
+	}
+}
+
+func (sc *slidingCounter) reset() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	clear(sc.buckets)
+}
+
+// add はキーに n を足します。n が 0 でも直近に現れたキーとして数えます。
+func (sc *slidingCounter) add(key, n int64) {
+	slot := time.Now().Unix() / sc.bucketWidth
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	b := &sc.buckets[slot%int64(len(sc.buckets))]
+	if b.slot != slot || b.counts == nil {
+		b.slot = slot
+		b.counts = map[int64]int64{}
+	}
+	b.counts[key] += n
+}
+
+// totals は直近に現れたキーごとの合計を返します。
+func (sc *slidingCounter) totals() map[int64]int64 {
+	slot := time.Now().Unix() / sc.bucketWidth
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	totals := map[int64]int64{}
+	for i := range sc.buckets {
+		b := &sc.buckets[i]
+		if b.counts == nil || slot-b.slot >= int64(len(sc.buckets)) {
+			continue
+		}
+		for key, n := range b.counts {
+			totals[key] += n
+		}
+	}
+	return totals
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// スパムスコアの各要素の重み (合計 1)
+const (
+	spamWeightRepetition  = 0.3
+	spamWeightURLDensity  = 0.2
+	spamWeightNGProximity = 0.3
+	spamWeightPostingRate = 0.2
+)
+
+const (
+	// 同じ内容の投稿をこの期間内で数える
+	spamRepetitionWindow = 60 // 秒
+	// この件数の繰り返しでスコア満点
+	spamRepetitionSaturation = 3
+	// 投稿頻度をこの期間内で数える
+	spamPostingRateWindow = 10 // 秒
+	// この件数の投稿でスコア満点
+	spamPostingRateSaturation = 5
+)
+
+var spamURLPattern = regexp.MustCompile(`(?i)(https?://|www\.)\S+`)
+
+// spamScore はライブコメントのスパムらしさを 0 から 1 で返します。
+// NGワードを含むコメントは投稿時に弾かれるので、ここでは空白や記号で崩して NGワードを避けたものを拾います。
+func spamScore(ctx context.Context, tx *sqlx.Tx, userID, livestreamID int64, comment string, ngwords []*NGWord, now int64) (float64, error) {
+	var repeated int64
+	if err := tx.GetContext(ctx, &repeated, "SELECT COUNT(*) FROM livecomments WHERE livestream_id = ? AND user_id = ? AND comment = ? AND created_at >= ?", livestreamID, userID, comment, now-spamRepetitionWindow); err != nil {
+		return 0, err
+	}
+
+	var recent int64
+	if err := tx.GetContext(ctx, &recent, "SELECT COUNT(*) FROM livecomments WHERE livestream_id = ? AND user_id = ? AND created_at >= ?", livestreamID, userID, now-spamPostingRateWindow); err != nil {
+		return 0, err
+	}
+
+	score := spamWeightRepetition*saturate(repeated, spamRepetitionSaturation) +
+		spamWeightURLDensity*urlDensity(comment) +
+		spamWeightNGProximity*ngProximity(comment, ngwords) +
+		spamWeightPostingRate*saturate(recent, spamPostingRateSaturation)
+	return score, nil
+}
+
+func saturate(n, max int64) float64 {
+	if n >= max {
+		return 1
+	}
+	return float64(n) / float64(max)
+}
+
+// urlDensity はコメントのうち URL が占める文字の割合です。
+func urlDensity(comment string) float64 {
+	total := utf8.RuneCountInString(comment)
+	if total == 0 {
+		return 0
+	}
+	var urlRunes int
+	for _, m := range spamURLPattern.FindAllString(comment, -1) {
+		urlRunes += utf8.RuneCountInString(m)
+	}
+	return float64(urlRunes) / float64(total)
+}
+
+// ngProximity は空白・記号を除いて小文字にしたコメントが NGワードを含めば 1 を返します。
+func ngProximity(comment string, ngwords []*NGWord) float64 {
+	normalized := normalizeForSpam(comment)
+	for _, ngword := range ngwords {
+		word := normalizeForSpam(ngword.Word)
+		if word != "" && strings.Contains(normalized, word) {
+			return 1
+		}
+	}
+	return 0
+}
+
+func normalizeForSpam(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+// 保留中ライブコメント一覧API (配信者のみ)
+// GET /api/livestream/:livestream_id/livecomment/held
+func getHeldLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get held livecomments of other streamer's livestream")
+	}
+
+	var livecommentModels []LivecommentModel
+	if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND held_at IS NOT NULL AND deleted_at IS NULL ORDER BY spam_score DESC, id", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get held livecomments: "+err.Error())
+	}
+
+	livecomments, err := fillLivecommentResponses(ctx, tx, livecommentModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livecomments)
+}
+
+// 保留中ライブコメント承認API (配信者のみ)
+// 却下する場合は削除APIを使う
+// POST /api/livestream/:livestream_id/livecomment/:livecomment_id/approve
+func approveLivecommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var (
+		livecommentModel LivecommentModel
+		livecomment      Livecomment
+	)
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			}
+		}
+		if livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't approve livecomments of other streamer's livestream")
+		}
+
+		if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ? AND held_at IS NOT NULL AND deleted_at IS NULL FOR UPDATE", livecommentID, livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "held livecomment not found")
+			} else {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE livecomments SET held_at = NULL WHERE id = ?", livecommentModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to approve livecomment: "+err.Error())
+		}
+		livecommentModel.HeldAt = sql.NullInt64{}
+
+		var err error
+		livecomment, err = fillLivecommentResponse(ctx, tx, livecommentModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	addLivecommentToRing(livecommentModel)
+	hub.publish(livecommentModel.LivestreamID, HubMessage{
+		Type: hubMessageLivecomment,
+		Data: livecomment,
+	})
+
+	return c.JSON(http.StatusOK, livecomment)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// nginx を置かずにアプリケーションサーバで直接受ける構成向けに、フロントエンドのビルド成果物を配信します。
+// ISUCON13_PUBLIC_DIR (デフォルト ../public) が存在するときだけ有効です。
+//
+//	/assets/*  ファイル名にハッシュが入っているので、1年キャッシュさせる (immutable)
+//	その他     public 配下にあればそのファイル、なければ index.html (SPA のルーティング用、毎回再検証させる)
+const (
+	immutableCacheControl  = "public, max-age=31536000, immutable"
+	revalidateCacheControl = "no-cache"
+)
+
+func publicDir() string {
+	if v, ok := os.LookupEnv("ISUCON13_PUBLIC_DIR"); ok {
+		return v
+	}
+	return "../public"
+}
+
+func registerStaticRoutes(e *echo.Echo) {
+	dir := publicDir()
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return
+	}
+
+	e.GET("/assets/*", func(c echo.Context) error {
+		return serveStaticFile(c, dir, "assets/"+c.Param("*"), immutableCacheControl)
+	})
+	e.GET("/*", func(c echo.Context) error {
+		name := c.Param("*")
+		if strings.HasPrefix(name, "api/") {
+			return echo.ErrNotFound
+		}
+		if name != "" {
+			if err := serveStaticFile(c, dir, name, revalidateCacheControl); err != echo.ErrNotFound {
+				return err
+			}
+		}
+		return serveStaticFile(c, dir, "index.html", revalidateCacheControl)
+	})
+}
+
+// serveStaticFile は dir 配下の name を ETag 付きで返します。If-None-Match / If-Modified-Since には 304 を返します。
+func serveStaticFile(c echo.Context, dir, name, cacheControl string) error {
+	// ".." でルートの外に出られないようにする
+	path := filepath.Join(dir, filepath.FromSlash(filepath.Clean("/"+name)))
+	f, err := os.Open(path)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return echo.ErrNotFound
+	}
+
+	header := c.Response().Header()
+	header.Set("Cache-Control", cacheControl)
+	header.Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(c.Response(), c.Request(), info.Name(), info.ModTime(), f)
+	return nil
+}
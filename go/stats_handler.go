@@ -11,11 +11,17 @@ import (
 )
 
 type LivestreamStatistics struct {
-	Rank           int64 `json:"rank"`
-	ViewersCount   int64 `json:"viewers_count"`
-	TotalReactions int64 `json:"total_reactions"`
-	TotalReports   int64 `json:"total_reports"`
-	MaxTip         int64 `json:"max_tip"`
+	Rank           int64            `json:"rank"`
+	ViewersCount   int64            `json:"viewers_count"`
+	TotalReactions int64            `json:"total_reactions"`
+	TotalReports   int64            `json:"total_reports"`
+	MaxTip         int64            `json:"max_tip"`
+	TipTiers       []TipTierSummary `json:"tip_tiers"`
+	// initialize 以降に入室したユーザ数の概算 (誤差 2% 程度)
+	ApproxUniqueViewers int64 `json:"approx_unique_viewers"`
+	// 退室済みの視聴の合計・1回あたりの平均 (秒)
+	TotalWatchSeconds   int64   `json:"total_watch_seconds"`
+	AverageWatchSeconds float64 `json:"average_watch_seconds"`
 }
 
 type LivestreamRankingEntry struct {
@@ -28,7 +34,7 @@ func (r LivestreamRanking) Len() int      { return len(r) }
 func (r LivestreamRanking) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
 func (r LivestreamRanking) Less(i, j int) bool {
 	if r[i].Score == r[j].Score {
-		return r[i].LivestreamID < r[j].LivestreamID
+		return livestreamRanksAbove(r[j].LivestreamID, r[i].LivestreamID)
 	} else {
 		return r[i].Score < r[j].Score
 	}
@@ -41,9 +47,12 @@ type UserStatistics struct {
 	TotalLivecomments int64  `json:"total_livecomments"`
 	TotalTip          int64  `json:"total_tip"`
 	FavoriteEmoji     string `json:"favorite_emoji"`
+	// このユーザが視聴者として配信を見ていた時間の合計 (秒)
+	TotalWatchSeconds int64 `json:"total_watch_seconds"`
 }
 
 type UserRankingEntry struct {
+	UserID   int64
 	Username string
 	Score    int64
 }
@@ -53,7 +62,7 @@ func (r UserRanking) Len() int      { return len(r) }
 func (r UserRanking) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
 func (r UserRanking) Less(i, j int) bool {
 	if r[i].Score == r[j].Score {
-		return r[i].Username < r[j].Username
+		return userRanksAbove(r[j].UserID, r[j].Username, r[i].UserID, r[i].Username)
 	} else {
 		return r[i].Score < r[j].Score
 	}
@@ -71,24 +80,23 @@ func getUserStatisticsHandler(c echo.Context) error {
 	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
 	// また、現在の合計視聴者数もだす
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	// 参照だけなのでトランザクションは張らない
+	db := readDB()
+
+	userID, ok, err := usernameIndex.userIDByName(ctx, username)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
-	defer tx.Rollback()
-
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
-		}
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
+	}
+	if err := verifyStatisticsVisible(c, userID); err != nil {
+		return err
 	}
 
 	// ランク算出
 	var users []*UserModel
-	if err := tx.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
+	if err := db.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
 	}
 
@@ -100,7 +108,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 		INNER JOIN livestreams l ON l.user_id = u.id
 		INNER JOIN reactions r ON r.livestream_id = l.id
 		WHERE u.id = ?`
-		if err := tx.GetContext(ctx, &reactions, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		if err := db.GetContext(ctx, &reactions, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
 		}
 
@@ -108,14 +116,15 @@ func getUserStatisticsHandler(c echo.Context) error {
 		query = `
 		SELECT IFNULL(SUM(l2.tip), 0) FROM users u
 		INNER JOIN livestreams l ON l.user_id = u.id	
-		INNER JOIN livecomments l2 ON l2.livestream_id = l.id
+		INNER JOIN livecomments l2 ON l2.livestream_id = l.id AND l2.deleted_at IS NULL
 		WHERE u.id = ?`
-		if err := tx.GetContext(ctx, &tips, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		if err := db.GetContext(ctx, &tips, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
 		}
 
 		score := reactions + tips
 		ranking = append(ranking, UserRankingEntry{
+			UserID:   user.ID,
 			Username: user.Name,
 			Score:    score,
 		})
@@ -138,7 +147,7 @@ func getUserStatisticsHandler(c echo.Context) error {
     INNER JOIN reactions r ON r.livestream_id = l.id
     WHERE u.name = ?
 	`
-	if err := tx.GetContext(ctx, &totalReactions, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := db.GetContext(ctx, &totalReactions, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
 
@@ -146,13 +155,13 @@ func getUserStatisticsHandler(c echo.Context) error {
 	var totalLivecomments int64
 	var totalTip int64
 	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := db.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	for _, livestream := range livestreams {
 		var livecomments []*LivecommentModel
-		if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		if err := db.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 		}
 
@@ -165,8 +174,8 @@ func getUserStatisticsHandler(c echo.Context) error {
 	// 合計視聴者数
 	var viewersCount int64
 	for _, livestream := range livestreams {
-		var cnt int64
-		if err := tx.GetContext(ctx, &cnt, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		cnt, err := viewerHistory.countByLivestream(ctx, livestream.ID)
+		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
 		}
 		viewersCount += cnt
@@ -184,10 +193,16 @@ func getUserStatisticsHandler(c echo.Context) error {
 	ORDER BY COUNT(*) DESC, emoji_name DESC
 	LIMIT 1
 	`
-	if err := tx.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := db.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
 	}
 
+	// 視聴時間
+	totalWatchSeconds, err := userWatchSeconds(ctx, db, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch time: "+err.Error())
+	}
+
 	stats := UserStatistics{
 		Rank:              rank,
 		ViewersCount:      viewersCount,
@@ -195,6 +210,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 		TotalLivecomments: totalLivecomments,
 		TotalTip:          totalTip,
 		FavoriteEmoji:     favoriteEmoji,
+		TotalWatchSeconds: totalWatchSeconds,
 	}
 	return c.JSON(http.StatusOK, stats)
 }
@@ -212,23 +228,17 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 	livestreamID := int64(id)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	// 参照だけなのでトランザクションは張らない
+	db := readDB()
 
-	var livestream LivestreamModel
-	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
-		}
+	if _, ok, err := livestreamRegistryCache.get(ctx, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	} else if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
 	}
 
 	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := db.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
@@ -236,12 +246,12 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	var ranking LivestreamRanking
 	for _, livestream := range livestreams {
 		var reactions int64
-		if err := tx.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		if err := db.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
 		}
 
 		var totalTips int64
-		if err := tx.GetContext(ctx, &totalTips, "SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l.id = l2.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		if err := db.GetContext(ctx, &totalTips, "SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l.id = l2.livestream_id AND l2.deleted_at IS NULL WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
 		}
 
@@ -263,31 +273,44 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 
 	// 視聴者数算出
-	var viewersCount int64
-	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(*) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	// 配信の存在は確認済みなので、別DBやRedisに切り出されていても引けるよう履歴単体で数える
+	viewersCount, err := viewerHistory.countByLivestream(ctx, livestreamID)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
 	}
+	approxUniqueViewers, err := viewerHistory.approxUniqueViewers(ctx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count unique viewers: "+err.Error())
+	}
 
 	// 最大チップ額
 	var maxTip int64
-	if err := tx.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := db.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id AND l2.deleted_at IS NULL WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
 	}
 
 	// リアクション数
 	var totalReactions int64
-	if err := tx.GetContext(ctx, &totalReactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := db.GetContext(ctx, &totalReactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
 
 	// スパム報告数
 	var totalReports int64
-	if err := tx.GetContext(ctx, &totalReports, `SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := db.GetContext(ctx, &totalReports, `SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`+reportStatusCondition(c), livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	// 投げ銭の段階ごとの集計
+	tipTierSummary, err := livestreamTipTierSummary(ctx, db, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to summarize tip tiers: "+err.Error())
+	}
+
+	// 視聴時間
+	totalWatchSeconds, averageWatchSeconds, err := livestreamWatchStats(ctx, db, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch time: "+err.Error())
 	}
 
 	return c.JSON(http.StatusOK, LivestreamStatistics{
@@ -296,5 +319,105 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		MaxTip:         maxTip,
 		TotalReactions: totalReactions,
 		TotalReports:   totalReports,
+		TipTiers:       tipTierSummary,
+
+		ApproxUniqueViewers: approxUniqueViewers,
+		TotalWatchSeconds:   totalWatchSeconds,
+		AverageWatchSeconds: averageWatchSeconds,
+	})
+}
+
+// getLivestreamStatisticsHandlerFast は getLivestreamStatisticsHandler のランク算出を集約クエリ1本にしたものです。
+// ISUCON13_SHADOW_READ=livestream_statistics で旧実装と突き合わせてから切り替えること。
+func getLivestreamStatisticsHandlerFast(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livestreamID := int64(id)
+
+	db := readDB()
+
+	if _, ok, err := livestreamRegistryCache.get(ctx, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	} else if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
+	}
+
+	// ランク算出
+	// 旧実装のソートを後ろから数えるのと同じく、自分より上位の配信数 + 1 とする
+	scores, err := rawLivestreamScores(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count scores: "+err.Error())
+	}
+	myScore := scores[livestreamID]
+	var rank int64 = 1
+	for otherID, score := range scores {
+		if score > myScore || (score == myScore && livestreamRanksAbove(otherID, livestreamID)) {
+			rank++
+		}
+	}
+
+	// 視聴者数算出
+	viewersCount, err := viewerHistory.countByLivestream(ctx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+	}
+	approxUniqueViewers, err := viewerHistory.approxUniqueViewers(ctx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count unique viewers: "+err.Error())
+	}
+
+	var stats struct {
+		MaxTip         int64 `db:"max_tip"`
+		TotalReactions int64 `db:"total_reactions"`
+		TotalReports   int64 `db:"total_reports"`
+	}
+	query := `
+	SELECT
+		(SELECT IFNULL(MAX(tip), 0) FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL) AS max_tip,
+		(SELECT COUNT(*) FROM reactions WHERE livestream_id = ?) AS total_reactions,
+		(SELECT COUNT(*) FROM livecomment_reports r WHERE livestream_id = ?` + reportStatusCondition(c) + `) AS total_reports
+	`
+	if err := db.GetContext(ctx, &stats, query, livestreamID, livestreamID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream statistics: "+err.Error())
+	}
+
+	tipTierSummary, err := livestreamTipTierSummary(ctx, db, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to summarize tip tiers: "+err.Error())
+	}
+
+	totalWatchSeconds, averageWatchSeconds, err := livestreamWatchStats(ctx, db, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch time: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, LivestreamStatistics{
+		Rank:           rank,
+		ViewersCount:   viewersCount,
+		MaxTip:         stats.MaxTip,
+		TotalReactions: stats.TotalReactions,
+		TotalReports:   stats.TotalReports,
+		TipTiers:       tipTierSummary,
+
+		ApproxUniqueViewers: approxUniqueViewers,
+		TotalWatchSeconds:   totalWatchSeconds,
+		AverageWatchSeconds: averageWatchSeconds,
 	})
 }
+
+// reportStatusCondition は ?open_reports_only=true のとき、未対応の通報だけを数える条件を返します。
+// 通報テーブルは r という別名で参照されている必要があります。
+func reportStatusCondition(c echo.Context) string {
+	if c.QueryParam("open_reports_only") != "true" {
+		return ""
+	}
+	return " AND r.status = '" + livecommentReportStatusOpen + "'"
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// 設定の mysql_stmt_cache (ISUCON13_MYSQL_STMT_CACHE=true) のとき、頻出クエリは接続ごとに一度だけ Prepare して使い回す
+// (MySQL の Com_prepare が減る)。起動時に有効なら interpolateParams は使わない。
+// 無効 (デフォルト) のときは従来どおり interpolateParams でクライアント側で埋め込む。
+// 読み直しで切り替えると、使い回すかどうかはすぐに変わるが interpolateParams は起動時のまま
+
+// hotStatements は使い回す対象のクエリです。接続ごとにこの数までしか Prepare しない
+var hotStatements = map[string]struct{}{
+	"SELECT * FROM users WHERE id = ?":                                                            {},
+	"SELECT * FROM users WHERE name = ?":                                                          {},
+	"SELECT * FROM livestreams WHERE id = ?":                                                      {},
+	"SELECT * FROM themes WHERE user_id = ?":                                                      {},
+	"SELECT hash FROM icons WHERE user_id = ?":                                                    {},
+	"SELECT * FROM tags WHERE id IN (SELECT tag_id FROM livestream_tags WHERE livestream_id = ?)": {},
+	// postLivecommentHandler の NamedExec を展開したもの
+	"INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at, spam_score, held_at) VALUES (?, ?, ?, ?, ?, ?, ?)": {},
+}
+
+// cachedStmt は query が使い回す対象なら、この接続で準備済みのステートメントを返します。
+// 対象外なら nil を返します。
+// database/sql は 1 つの接続を同時に使わないので、ロックは不要です。
+func (ic *instrumentedConn) cachedStmt(ctx context.Context, query string, args []driver.NamedValue) (driver.Stmt, error) {
+	if !currentConfig().MySQLStmtCache || len(args) == 0 {
+		return nil, nil
+	}
+	if _, ok := hotStatements[query]; !ok {
+		return nil, nil
+	}
+	if stmt, ok := ic.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := ic.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if ic.stmts == nil {
+		ic.stmts = make(map[string]driver.Stmt, len(hotStatements))
+	}
+	ic.stmts[query] = stmt
+	return stmt, nil
+}
+
+// dropStmt は接続が切れたなどで使えなくなったステートメントを捨てます。
+func (ic *instrumentedConn) dropStmt(query string) {
+	if stmt, ok := ic.stmts[query]; ok {
+		stmt.Close()
+		delete(ic.stmts, query)
+	}
+}
+
+func (ic *instrumentedConn) closeStmts() {
+	for query := range ic.stmts {
+		ic.dropStmt(query)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信キー
+// 配信の予約時に配信ごとに発行し、予約APIのレスポンスで持ち主にだけ返す (DB にはハッシュだけを持つ)。
+// 取り込みサーバ (nginx-rtmp の on_publish など) は POST /internal/ingest/auth で配信キーを確かめる。
+// 平文は後から取り出せないので、なくしたときや漏れたときは持ち主が作り直す
+const streamKeyPrefix = "live_"
+
+type StreamKey struct {
+	LivestreamID int64  `json:"livestream_id"`
+	StreamKey    string `json:"stream_key"`
+}
+
+type IngestAuthResponse struct {
+	LivestreamID int64 `json:"livestream_id"`
+	UserID       int64 `json:"user_id"`
+}
+
+func hashStreamKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueStreamKey は配信キーを発行し (あれば作り直し)、平文を返します。
+func issueStreamKey(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := streamKeyPrefix + hex.EncodeToString(b)
+
+	query := "INSERT INTO stream_keys (livestream_id, key_hash, created_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE key_hash = VALUES(key_hash), created_at = VALUES(created_at)"
+	if _, err := tx.ExecContext(ctx, query, livestreamID, hashStreamKey(key), time.Now().Unix()); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// 配信キー再発行API (配信者のみ)
+// POST /api/livestream/:livestream_id/stream_key/rotate
+// 今までの配信キーは使えなくなる
+func rotateStreamKeyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	if err := verifyLivestreamOwner(ctx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	var key string
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		key, err = issueStreamKey(ctx, tx, int64(livestreamID))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to issue stream key: "+err.Error())
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, StreamKey{LivestreamID: int64(livestreamID), StreamKey: key})
+}
+
+// 配信キー認証API (取り込みサーバ向け)
+// POST /internal/ingest/auth?token=<管理者トークン>
+// nginx-rtmp の on_publish と同じく、フォームの name に配信キーを入れて呼ぶ。
+// 2xx なら配信を受け付け、それ以外なら切断する想定
+func postIngestAuthHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	key := c.FormValue("name")
+	if key == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must be the stream key")
+	}
+
+	var livestreamID int64
+	if err := dbConn.GetContext(ctx, &livestreamID, "SELECT livestream_id FROM stream_keys WHERE key_hash = ?", hashStreamKey(key)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusForbidden, "invalid stream key")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get stream key: "+err.Error())
+	}
+
+	livestreamModel, ok, err := livestreamRegistryCache.get(ctx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "invalid stream key")
+	}
+	if livestreamModel.Status == livestreamStatusEnded {
+		return echo.NewHTTPError(http.StatusForbidden, "livestream has already ended")
+	}
+
+	return c.JSON(http.StatusOK, IngestAuthResponse{LivestreamID: livestreamID, UserID: livestreamModel.UserID})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// タグの管理 (管理者のみ)
+// タグは initialize で投入したものに加えて、管理者が作成・名前の変更・統合・無効化できる。
+// 変更はタグの索引 (tag_index.go) とトップページのキャッシュに反映する
+const maxTagNameLength = 255
+
+type AdminTag struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	// タグが付いた配信の数
+	LivestreamCount int `json:"livestream_count"`
+}
+
+type PostAdminTagRequest struct {
+	Name string `json:"name"`
+}
+
+type PatchAdminTagRequest struct {
+	// 指定した項目だけ変える
+	Name   *string `json:"name"`
+	Active *bool   `json:"active"`
+}
+
+type MergeAdminTagRequest struct {
+	IntoTagID int64 `json:"into_tag_id"`
+}
+
+type MergeAdminTagResponse struct {
+	Tag AdminTag `json:"tag"`
+	// into に付け替えた配信の数 (もともと両方付いていた配信は含まない)
+	Relinked int64 `json:"relinked"`
+}
+
+func validateTagName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "name must not be empty")
+	}
+	if len([]rune(name)) > maxTagNameLength {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "name must be at most "+strconv.Itoa(maxTagNameLength)+" characters")
+	}
+	return name, nil
+}
+
+func loadAdminTag(ctx context.Context, tx *sqlx.Tx, tagID int64) (AdminTag, error) {
+	var tagModel TagModel
+	if err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ?", tagID); err != nil {
+		return AdminTag{}, err
+	}
+	var inactive int
+	if err := tx.GetContext(ctx, &inactive, "SELECT COUNT(*) FROM inactive_tags WHERE tag_id = ?", tagID); err != nil {
+		return AdminTag{}, err
+	}
+	count, err := livestreamTagIndex.livestreamCount(ctx, tagID)
+	if err != nil {
+		return AdminTag{}, err
+	}
+	return AdminTag{ID: tagModel.ID, Name: tagModel.Name, Active: inactive == 0, LivestreamCount: count}, nil
+}
+
+// タグ一覧API (管理者向け、無効にしたタグを含む)
+// GET /api/admin/tags
+func getAdminTagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	var tagModels []*TagModel
+	if err := dbConn.SelectContext(ctx, &tagModels, "SELECT * FROM tags ORDER BY id"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	var inactiveTagIDs []int64
+	if err := dbConn.SelectContext(ctx, &inactiveTagIDs, "SELECT tag_id FROM inactive_tags"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get inactive tags: "+err.Error())
+	}
+	inactive := make(map[int64]struct{}, len(inactiveTagIDs))
+	for _, id := range inactiveTagIDs {
+		inactive[id] = struct{}{}
+	}
+
+	tags := make([]AdminTag, len(tagModels))
+	for i, t := range tagModels {
+		count, err := livestreamTagIndex.livestreamCount(ctx, t.ID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestreams: "+err.Error())
+		}
+		_, isInactive := inactive[t.ID]
+		tags[i] = AdminTag{ID: t.ID, Name: t.Name, Active: !isInactive, LivestreamCount: count}
+	}
+	return c.JSON(http.StatusOK, tags)
+}
+
+// タグ作成API
+// POST /api/admin/tags
+func postAdminTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	var req PostAdminTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	name, err := validateTagName(req.Name)
+	if err != nil {
+		return err
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?)", name)
+	if err != nil {
+		if isDuplicateEntryError(err) {
+			return echo.NewHTTPError(http.StatusConflict, "tag already exists")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+	}
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag id: "+err.Error())
+	}
+	livestreamTagIndex.setTag(tagID, name)
+
+	return c.JSON(http.StatusCreated, AdminTag{ID: tagID, Name: name, Active: true})
+}
+
+// タグ更新API (名前の変更・無効化・再有効化)
+// PATCH /api/admin/tags/:tag_id
+func patchAdminTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req PatchAdminTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	var name string
+	if req.Name != nil {
+		if name, err = validateTagName(*req.Name); err != nil {
+			return err
+		}
+	}
+
+	var tag AdminTag
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var tagModel TagModel
+		if err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ? FOR UPDATE", tagID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusNotFound, "tag not found")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+		}
+
+		if req.Name != nil && name != tagModel.Name {
+			if _, err := tx.ExecContext(ctx, "UPDATE tags SET name = ? WHERE id = ?", name, tagID); err != nil {
+				if isDuplicateEntryError(err) {
+					return echo.NewHTTPError(http.StatusConflict, "tag already exists")
+				}
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to rename tag: "+err.Error())
+			}
+		}
+		if req.Active != nil {
+			var err error
+			if *req.Active {
+				_, err = tx.ExecContext(ctx, "DELETE FROM inactive_tags WHERE tag_id = ?", tagID)
+			} else {
+				_, err = tx.ExecContext(ctx, "INSERT IGNORE INTO inactive_tags (tag_id, deactivated_at) VALUES (?, ?)", tagID, time.Now().Unix())
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+			}
+		}
+
+		var err error
+		tag, err = loadAdminTag(ctx, tx, tagID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	livestreamTagIndex.setTag(tag.ID, tag.Name)
+	livestreamTagIndex.setActive(tag.ID, tag.Active)
+	resetHomeCache()
+
+	return c.JSON(http.StatusOK, tag)
+}
+
+// タグ統合API
+// POST /api/admin/tags/:tag_id/merge
+// :tag_id のタグが付いた配信を into_tag_id のタグに付け替え、:tag_id のタグを消す
+func mergeAdminTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	fromTagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	var req MergeAdminTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.IntoTagID == fromTagID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't merge a tag into itself")
+	}
+
+	var res MergeAdminTagResponse
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		query, params, err := sqlx.In("SELECT id FROM tags WHERE id IN (?) FOR UPDATE", []int64{fromTagID, req.IntoTagID})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var found []int64
+		if err := tx.SelectContext(ctx, &found, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+		}
+		if len(found) != 2 {
+			return echo.NewHTTPError(http.StatusNotFound, "tag not found")
+		}
+
+		// 両方のタグが付いている配信は from の方を外すだけにする
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE tag_id = ? AND livestream_id IN (SELECT livestream_id FROM (SELECT livestream_id FROM livestream_tags WHERE tag_id = ?) AS t)", fromTagID, req.IntoTagID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+		}
+		rs, err := tx.ExecContext(ctx, "UPDATE livestream_tags SET tag_id = ? WHERE tag_id = ?", req.IntoTagID, fromTagID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to relink livestream tags: "+err.Error())
+		}
+		if res.Relinked, err = rs.RowsAffected(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM inactive_tags WHERE tag_id = ?", fromTagID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete inactive tag: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", fromTagID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	livestreamTagIndex.merge(fromTagID, req.IntoTagID)
+	tagStats.reset()
+	resetHomeCache()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+	if res.Tag, err = loadAdminTag(ctx, tx, req.IntoTagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
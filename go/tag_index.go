@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// tagIndex はタグと配信の対応をメモリに持ち、タグ検索やタグごとの件数集計を DB を引かずに行うためのものです。
+// 初回アクセス時に全件読み込み、以降は配信予約と管理者によるタグの変更 (tag_admin.go) のたびに更新します。
+type tagIndex struct {
+	mu     sync.RWMutex
+	loaded bool
+
+	tagNames map[int64]string
+	tagIDs   map[string][]int64
+	// タグごとの配信 ID (降順)
+	livestreamIDs map[int64][]int64
+	tagsOf        map[int64][]int64
+	// 無効にされたタグ
+	inactive map[int64]struct{}
+}
+
+var livestreamTagIndex = &tagIndex{}
+
+// reset は initialize 時に呼び、次のアクセスで読み込み直させます。
+func (ti *tagIndex) reset() {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.loaded = false
+	ti.tagNames = nil
+	ti.tagIDs = nil
+	ti.livestreamIDs = nil
+	ti.tagsOf = nil
+	ti.inactive = nil
+}
+
+func (ti *tagIndex) ensureLoaded(ctx context.Context) error {
+	ti.mu.RLock()
+	loaded := ti.loaded
+	ti.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	var tagModels []*TagModel
+	if err := dbConn.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+		return err
+	}
+	var livestreamTags []*LivestreamTagModel
+	if err := dbConn.SelectContext(ctx, &livestreamTags, "SELECT * FROM livestream_tags"); err != nil {
+		return err
+	}
+	var inactiveTagIDs []int64
+	if err := dbConn.SelectContext(ctx, &inactiveTagIDs, "SELECT tag_id FROM inactive_tags"); err != nil {
+		return err
+	}
+
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.loaded {
+		return nil
+	}
+	ti.tagNames = make(map[int64]string, len(tagModels))
+	ti.tagIDs = make(map[string][]int64, len(tagModels))
+	for _, t := range tagModels {
+		ti.tagNames[t.ID] = t.Name
+		ti.tagIDs[t.Name] = append(ti.tagIDs[t.Name], t.ID)
+	}
+	ti.livestreamIDs = map[int64][]int64{}
+	ti.tagsOf = map[int64][]int64{}
+	for _, lt := range livestreamTags {
+		ti.livestreamIDs[lt.TagID] = append(ti.livestreamIDs[lt.TagID], lt.LivestreamID)
+		ti.tagsOf[lt.LivestreamID] = append(ti.tagsOf[lt.LivestreamID], lt.TagID)
+	}
+	for tagID := range ti.livestreamIDs {
+		ids := ti.livestreamIDs[tagID]
+		sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	}
+	ti.inactive = make(map[int64]struct{}, len(inactiveTagIDs))
+	for _, tagID := range inactiveTagIDs {
+		ti.inactive[tagID] = struct{}{}
+	}
+	ti.loaded = true
+	return nil
+}
+
+// add は新しく予約された配信のタグを追加します。まだ読み込んでいなければ何もしません (読み込み時に DB から拾われる)。
+func (ti *tagIndex) add(livestreamID int64, tagIDs []int64) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if !ti.loaded {
+		return
+	}
+	for _, tagID := range tagIDs {
+		ti.link(livestreamID, tagID)
+	}
+}
+
+func (ti *tagIndex) link(livestreamID, tagID int64) {
+	// 降順を保って挿入する (新しい配信ならほぼ先頭)
+	ids := ti.livestreamIDs[tagID]
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] <= livestreamID })
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = livestreamID
+	ti.livestreamIDs[tagID] = ids
+	ti.tagsOf[livestreamID] = append(ti.tagsOf[livestreamID], tagID)
+}
+
+// setTag は作成・名前の変更されたタグを反映します。まだ読み込んでいなければ何もしません。
+func (ti *tagIndex) setTag(tagID int64, name string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if !ti.loaded {
+		return
+	}
+	if old, ok := ti.tagNames[tagID]; ok {
+		ti.tagIDs[old] = removeInt64(ti.tagIDs[old], tagID)
+		if len(ti.tagIDs[old]) == 0 {
+			delete(ti.tagIDs, old)
+		}
+	}
+	ti.tagNames[tagID] = name
+	ti.tagIDs[name] = append(ti.tagIDs[name], tagID)
+}
+
+// setActive はタグの有効・無効を反映します。まだ読み込んでいなければ何もしません。
+func (ti *tagIndex) setActive(tagID int64, active bool) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if !ti.loaded {
+		return
+	}
+	if active {
+		delete(ti.inactive, tagID)
+	} else {
+		ti.inactive[tagID] = struct{}{}
+	}
+}
+
+// merge は from のタグが付いた配信を into に付け替え、from を消します。まだ読み込んでいなければ何もしません。
+func (ti *tagIndex) merge(fromTagID, intoTagID int64) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if !ti.loaded {
+		return
+	}
+	for _, livestreamID := range ti.livestreamIDs[fromTagID] {
+		ti.tagsOf[livestreamID] = removeInt64(ti.tagsOf[livestreamID], fromTagID)
+		if !slices.Contains(ti.tagsOf[livestreamID], intoTagID) {
+			ti.link(livestreamID, intoTagID)
+		}
+	}
+	delete(ti.livestreamIDs, fromTagID)
+	if name, ok := ti.tagNames[fromTagID]; ok {
+		ti.tagIDs[name] = removeInt64(ti.tagIDs[name], fromTagID)
+		if len(ti.tagIDs[name]) == 0 {
+			delete(ti.tagIDs, name)
+		}
+		delete(ti.tagNames, fromTagID)
+	}
+	delete(ti.inactive, fromTagID)
+}
+
+// inactiveTagIDs は tagIDs のうち無効にされたタグの ID を返します。
+func (ti *tagIndex) inactiveTagIDs(ctx context.Context, tagIDs []int64) ([]int64, error) {
+	if err := ti.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	var inactive []int64
+	for _, tagID := range tagIDs {
+		if _, ok := ti.inactive[tagID]; ok {
+			inactive = append(inactive, tagID)
+		}
+	}
+	return inactive, nil
+}
+
+// livestreamCount はタグが付いた配信の数を返します。
+func (ti *tagIndex) livestreamCount(ctx context.Context, tagID int64) (int, error) {
+	if err := ti.ensureLoaded(ctx); err != nil {
+		return 0, err
+	}
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	return len(ti.livestreamIDs[tagID]), nil
+}
+
+// tagName はタグの名前を返します。
+func (ti *tagIndex) tagName(ctx context.Context, tagID int64) (string, bool, error) {
+	if err := ti.ensureLoaded(ctx); err != nil {
+		return "", false, err
+	}
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	name, ok := ti.tagNames[tagID]
+	return name, ok, nil
+}
+
+// loadedTagsOf は配信に付いたタグの ID を返します。まだ読み込んでいなければ読み込まずに nil を返します。
+func (ti *tagIndex) loadedTagsOf(livestreamID int64) []int64 {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	if !ti.loaded {
+		return nil
+	}
+	return slices.Clone(ti.tagsOf[livestreamID])
+}
+
+// forEachLivestream はタグが付いた配信ごとに fn を呼びます。fn の中で索引を変更しないこと。
+func (ti *tagIndex) forEachLivestream(ctx context.Context, fn func(livestreamID int64, tagIDs []int64)) error {
+	if err := ti.ensureLoaded(ctx); err != nil {
+		return err
+	}
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	for livestreamID, tagIDs := range ti.tagsOf {
+		fn(livestreamID, tagIDs)
+	}
+	return nil
+}
+
+// tagsOfMany は配信ごとに付いたタグを ID の昇順で返します。タグのない配信は空のスライスです。
+func (ti *tagIndex) tagsOfMany(ctx context.Context, livestreamIDs []int64) (map[int64][]Tag, error) {
+	if err := ti.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	tags := make(map[int64][]Tag, len(livestreamIDs))
+	for _, livestreamID := range livestreamIDs {
+		tagIDs := slices.Clone(ti.tagsOf[livestreamID])
+		slices.Sort(tagIDs)
+		ls := make([]Tag, 0, len(tagIDs))
+		for _, tagID := range tagIDs {
+			ls = append(ls, Tag{ID: tagID, Name: ti.tagNames[tagID]})
+		}
+		tags[livestreamID] = ls
+	}
+	return tags, nil
+}
+
+func removeInt64(s []int64, v int64) []int64 {
+	if i := slices.Index(s, v); i >= 0 {
+		return slices.Delete(s, i, i+1)
+	}
+	return s
+}
+
+// tagIDsByName はタグ名に対応するタグ ID を返します。
+func (ti *tagIndex) tagIDsByName(ctx context.Context, name string) ([]int64, error) {
+	if err := ti.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	return ti.tagIDs[name], nil
+}
+
+// search は tagNames のいずれか (and なら全て) のタグが付いた配信の ID を返します。順序は不定です。
+func (ti *tagIndex) search(ctx context.Context, tagNames []string, and bool) ([]int64, error) {
+	if err := ti.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	var result map[int64]struct{}
+	for i, name := range tagNames {
+		// 同名のタグが複数あってもひとつのタグとして扱う。無効にされたタグでは検索できない
+		matched := map[int64]struct{}{}
+		for _, tagID := range ti.tagIDs[name] {
+			if _, ok := ti.inactive[tagID]; ok {
+				continue
+			}
+			for _, id := range ti.livestreamIDs[tagID] {
+				matched[id] = struct{}{}
+			}
+		}
+
+		switch {
+		case i == 0:
+			result = matched
+		case and:
+			for id := range result {
+				if _, ok := matched[id]; !ok {
+					delete(result, id)
+				}
+			}
+		default:
+			for id := range matched {
+				result[id] = struct{}{}
+			}
+		}
+		if and && len(result) == 0 {
+			break
+		}
+	}
+
+	ids := make([]int64, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// TagFacet はタグごとの検索結果の件数です。
+type TagFacet struct {
+	Tag
+	Count int64 `json:"count"`
+}
+
+// facets は livestreamIDs に含まれる配信の (無効にされていない) タグごとの件数を、件数の多い順に返します。
+func (ti *tagIndex) facets(ctx context.Context, livestreamIDs []int64) ([]TagFacet, error) {
+	if err := ti.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	counts := map[int64]int64{}
+	for _, id := range livestreamIDs {
+		for _, tagID := range ti.tagsOf[id] {
+			if _, ok := ti.inactive[tagID]; ok {
+				continue
+			}
+			counts[tagID]++
+		}
+	}
+	facets := make([]TagFacet, 0, len(counts))
+	for tagID, count := range counts {
+		facets = append(facets, TagFacet{
+			Tag:   Tag{ID: tagID, Name: ti.tagNames[tagID]},
+			Count: count,
+		})
+	}
+	sort.Slice(facets, func(i, j int) bool {
+		if facets[i].Count == facets[j].Count {
+			return facets[i].ID < facets[j].ID
+		}
+		return facets[i].Count > facets[j].Count
+	})
+	return facets, nil
+}
+
+// PopularTag は直近の配信数とスコアによるタグの人気です。
+type PopularTag struct {
+	Tag
+	// 直近に予約された、またはリアクション・投げ銭があった配信の数
+	LivestreamCount int64 `json:"livestream_count"`
+	// 直近のリアクション数と投げ銭の合計
+	Score int64 `json:"score"`
+}
+
+// popular は配信ごとの直近のスコアをタグごとに集計し、配信数・スコアの多い順に返します。無効にされたタグは除きます。
+func (ti *tagIndex) popular(ctx context.Context, scores map[int64]int64) ([]PopularTag, error) {
+	if err := ti.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	byTag := map[int64]*PopularTag{}
+	for livestreamID, score := range scores {
+		for _, tagID := range ti.tagsOf[livestreamID] {
+			if _, ok := ti.inactive[tagID]; ok {
+				continue
+			}
+			p, ok := byTag[tagID]
+			if !ok {
+				p = &PopularTag{Tag: Tag{ID: tagID, Name: ti.tagNames[tagID]}}
+				byTag[tagID] = p
+			}
+			p.LivestreamCount++
+			p.Score += score
+		}
+	}
+	tags := make([]PopularTag, 0, len(byTag))
+	for _, p := range byTag {
+		tags = append(tags, *p)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].LivestreamCount != tags[j].LivestreamCount {
+			return tags[i].LivestreamCount > tags[j].LivestreamCount
+		}
+		if tags[i].Score != tags[j].Score {
+			return tags[i].Score > tags[j].Score
+		}
+		return tags[i].ID < tags[j].ID
+	})
+	return tags, nil
+}
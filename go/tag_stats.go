@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// タグごとの統計
+// タグごとの視聴者数・投げ銭の合計と配信者ごとの投げ銭の合計をメモリに持つ。
+// 最初の参照と設定の tag_stats_ttl ごとに DB から作り直し、その間は hub で配信するライブコメント
+// (他のサーバから中継されたものを含む) と、このサーバでの入室・退室で増減させる。
+// 配信数はタグの索引 (tag_index.go) から数える
+const tagStatsTopStreamers = 10
+
+type tagAccumulator struct {
+	viewers int64
+	tips    int64
+	// 配信者ごとの投げ銭の合計
+	tipsByStreamer map[int64]int64
+}
+
+type tagStatsStore struct {
+	mu       sync.Mutex
+	loaded   bool
+	loadedAt time.Time
+	tags     map[int64]*tagAccumulator
+}
+
+var tagStats = &tagStatsStore{}
+
+type TagTopStreamer struct {
+	User      User  `json:"user"`
+	TotalTips int64 `json:"total_tips"`
+}
+
+type TagStatistics struct {
+	Tag              Tag              `json:"tag"`
+	TotalLivestreams int64            `json:"total_livestreams"`
+	TotalViewers     int64            `json:"total_viewers"`
+	TotalTips        int64            `json:"total_tips"`
+	TopStreamers     []TagTopStreamer `json:"top_streamers"`
+}
+
+// reset は initialize 時とタグの統合時に呼び、次の参照で作り直させます。
+func (s *tagStatsStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded = false
+	s.tags = nil
+}
+
+// accumulator は呼び出し側でロックを取ること。
+func (s *tagStatsStore) accumulator(tagID int64) *tagAccumulator {
+	acc, ok := s.tags[tagID]
+	if !ok {
+		acc = &tagAccumulator{tipsByStreamer: map[int64]int64{}}
+		s.tags[tagID] = acc
+	}
+	return acc
+}
+
+func (s *tagStatsStore) ensureLoaded(ctx context.Context) error {
+	s.mu.Lock()
+	fresh := s.loaded && time.Since(s.loadedAt) <= currentConfig().TagStatsTTL.duration()
+	s.mu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	var livestreams []struct {
+		ID     int64 `db:"id"`
+		UserID int64 `db:"user_id"`
+		Tips   int64 `db:"tips"`
+	}
+	query := `
+	SELECT l.id, l.user_id, IFNULL(SUM(c.tip), 0) AS tips
+	FROM livestreams l
+	LEFT JOIN livecomments c ON c.livestream_id = l.id AND c.deleted_at IS NULL AND c.held_at IS NULL
+	GROUP BY l.id, l.user_id`
+	if err := readDB().SelectContext(ctx, &livestreams, query); err != nil {
+		return err
+	}
+	viewers, err := viewerHistory.countAll(ctx)
+	if err != nil {
+		return err
+	}
+	type livestreamTotals struct {
+		userID int64
+		tips   int64
+	}
+	totals := make(map[int64]livestreamTotals, len(livestreams))
+	for _, l := range livestreams {
+		totals[l.ID] = livestreamTotals{userID: l.UserID, tips: l.Tips}
+	}
+
+	tags := map[int64]*tagAccumulator{}
+	if err := livestreamTagIndex.forEachLivestream(ctx, func(livestreamID int64, tagIDs []int64) {
+		t := totals[livestreamID]
+		for _, tagID := range tagIDs {
+			acc, ok := tags[tagID]
+			if !ok {
+				acc = &tagAccumulator{tipsByStreamer: map[int64]int64{}}
+				tags[tagID] = acc
+			}
+			acc.viewers += viewers[livestreamID]
+			acc.tips += t.tips
+			if t.tips > 0 {
+				acc.tipsByStreamer[t.userID] += t.tips
+			}
+		}
+	}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags = tags
+	s.loaded = true
+	s.loadedAt = time.Now()
+	return nil
+}
+
+// observe は hub で配信するメッセージを受け取り、投げ銭を足します。
+func (s *tagStatsStore) observe(msg HubMessage) {
+	if msg.Type != hubMessageLivecomment {
+		return
+	}
+	livecomment, ok := msg.Data.(Livecomment)
+	if !ok || livecomment.Tip <= 0 || livecomment.Held {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded {
+		return
+	}
+	for _, tag := range livecomment.Livestream.Tags {
+		acc := s.accumulator(tag.ID)
+		acc.tips += livecomment.Tip
+		acc.tipsByStreamer[livecomment.Livestream.Owner.ID] += livecomment.Tip
+	}
+}
+
+// recordViewer はこのサーバでの入室を足します。
+func (s *tagStatsStore) recordViewer(livestreamID int64) {
+	tagIDs := livestreamTagIndex.loadedTagsOf(livestreamID)
+	if len(tagIDs) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded {
+		return
+	}
+	for _, tagID := range tagIDs {
+		s.accumulator(tagID).viewers++
+	}
+}
+
+// recordViewerExit はこのサーバでの退室を引きます。
+func (s *tagStatsStore) recordViewerExit(livestreamID int64) {
+	tagIDs := livestreamTagIndex.loadedTagsOf(livestreamID)
+	if len(tagIDs) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded {
+		return
+	}
+	for _, tagID := range tagIDs {
+		if acc := s.accumulator(tagID); acc.viewers > 0 {
+			acc.viewers--
+		}
+	}
+}
+
+type tagTotals struct {
+	viewers int64
+	tips    int64
+}
+
+// snapshot は読み込み済みなら、タグごとの視聴者数・投げ銭の合計を返します (整合性チェック用)。
+func (s *tagStatsStore) snapshot() (map[int64]tagTotals, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded {
+		return nil, false
+	}
+	totals := make(map[int64]tagTotals, len(s.tags))
+	for tagID, acc := range s.tags {
+		totals[tagID] = tagTotals{viewers: acc.viewers, tips: acc.tips}
+	}
+	return totals, true
+}
+
+// get はタグの視聴者数・投げ銭の合計と、投げ銭の多い配信者 (ID と合計) を返します。
+func (s *tagStatsStore) get(ctx context.Context, tagID int64) (int64, int64, []idCount, error) {
+	if err := s.ensureLoaded(ctx); err != nil {
+		return 0, 0, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acc, ok := s.tags[tagID]
+	if !ok {
+		return 0, 0, nil, nil
+	}
+	top := make([]idCount, 0, len(acc.tipsByStreamer))
+	for userID, tips := range acc.tipsByStreamer {
+		top = append(top, idCount{id: userID, count: tips})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].count == top[j].count {
+			return top[i].id < top[j].id
+		}
+		return top[i].count > top[j].count
+	})
+	if len(top) > tagStatsTopStreamers {
+		top = top[:tagStatsTopStreamers]
+	}
+	return acc.viewers, acc.tips, top, nil
+}
+
+type idCount struct {
+	id    int64
+	count int64
+}
+
+// タグ統計API
+// GET /api/tag/:tag_id/statistics
+func getTagStatisticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	name, ok, err := livestreamTagIndex.tagName(ctx, tagID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "tag not found")
+	}
+	livestreams, err := livestreamTagIndex.livestreamCount(ctx, tagID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestreams: "+err.Error())
+	}
+	viewers, tips, top, err := tagStats.get(ctx, tagID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag statistics: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userIDs := make([]int64, len(top))
+	for i := range top {
+		userIDs[i] = top[i].id
+	}
+	users, err := fillUsersByID(ctx, tx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	stats := TagStatistics{
+		Tag:              Tag{ID: tagID, Name: name},
+		TotalLivestreams: int64(livestreams),
+		TotalViewers:     viewers,
+		TotalTips:        tips,
+		TopStreamers:     make([]TagTopStreamer, len(top)),
+	}
+	for i := range top {
+		stats.TopStreamers[i] = TagTopStreamer{User: users[top[i].id], TotalTips: top[i].count}
+	}
+	return c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ThemeV2 は /api/v2 で返すテーマです。/api の Theme は互換性のため dark_mode のみのままにしています。
+type ThemeV2 struct {
+	ID           int64  `json:"id"`
+	DarkMode     bool   `json:"dark_mode"`
+	AccentColor  string `json:"accent_color"`
+	LayoutPreset string `json:"layout_preset"`
+}
+
+// 省略したフィールドは変更しない
+type PatchThemeRequest struct {
+	DarkMode     *bool   `json:"dark_mode"`
+	AccentColor  *string `json:"accent_color"`
+	LayoutPreset *string `json:"layout_preset"`
+}
+
+type ThemePreset struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// 配信ページのレイアウトのプリセット (先頭がデフォルト)
+var themePresets = []ThemePreset{
+	{Name: "standard", Description: "配信画面の横にコメント欄"},
+	{Name: "theater", Description: "配信画面を大きく、コメント欄を下に"},
+	{Name: "compact", Description: "コメント欄を重ねて表示"},
+}
+
+var accentColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func isValidLayoutPreset(name string) bool {
+	for _, preset := range themePresets {
+		if preset.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func themeV2FromModel(themeModel ThemeModel) ThemeV2 {
+	return ThemeV2{
+		ID:           themeModel.ID,
+		DarkMode:     themeModel.DarkMode,
+		AccentColor:  themeModel.AccentColor,
+		LayoutPreset: themeModel.LayoutPreset,
+	}
+}
+
+// 配信者のテーマ取得API (v2)
+// GET /api/v2/user/:username/theme
+func getStreamerThemeV2Handler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	username := c.Param("username")
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userID, ok, err := usernameIndex.userIDByName(ctx, username)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+	}
+
+	themeModel := ThemeModel{}
+	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user theme: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, themeV2FromModel(themeModel))
+}
+
+// テーマのレイアウトプリセット一覧API
+// GET /api/v2/theme/presets
+func getThemePresetsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, themePresets)
+}
+
+// 自分のテーマ更新API
+// PATCH /api/user/me/theme
+func patchMeThemeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PatchThemeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.AccentColor != nil && !accentColorPattern.MatchString(*req.AccentColor) {
+		return echo.NewHTTPError(http.StatusBadRequest, "accent_color must be in #rrggbb format")
+	}
+	if req.LayoutPreset != nil && !isValidLayoutPreset(*req.LayoutPreset) {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown layout_preset")
+	}
+
+	var themeModel ThemeModel
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ? FOR UPDATE", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user theme: "+err.Error())
+		}
+
+		if req.DarkMode != nil {
+			themeModel.DarkMode = *req.DarkMode
+		}
+		if req.AccentColor != nil {
+			themeModel.AccentColor = strings.ToLower(*req.AccentColor)
+		}
+		if req.LayoutPreset != nil {
+			themeModel.LayoutPreset = *req.LayoutPreset
+		}
+		if _, err := tx.NamedExecContext(ctx, "UPDATE themes SET dark_mode = :dark_mode, accent_color = :accent_color, layout_preset = :layout_preset WHERE id = :id", &themeModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user theme: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, themeV2FromModel(themeModel))
+}
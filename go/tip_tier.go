@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// TipTier は投げ銭の額に応じたスーパーチャットの段階です。
+type TipTier struct {
+	Name   string `json:"name"`
+	Color  string `json:"color"`
+	MinTip int64  `json:"min_tip"`
+}
+
+type TipTierSummary struct {
+	TipTier
+	Count int64 `json:"count"`
+	Total int64 `json:"total"`
+}
+
+// デフォルトの段階 (MinTip の昇順)
+var defaultTipTiers = []TipTier{
+	{Name: "blue", Color: "#1565c0", MinTip: 1},
+	{Name: "cyan", Color: "#00b8d4", MinTip: 500},
+	{Name: "green", Color: "#00bfa5", MinTip: 1000},
+	{Name: "yellow", Color: "#ffb300", MinTip: 5000},
+	{Name: "orange", Color: "#e65100", MinTip: 10000},
+	{Name: "magenta", Color: "#c2185b", MinTip: 20000},
+	{Name: "red", Color: "#d00000", MinTip: 50000},
+}
+
+// tipTiers は ISUCON13_TIP_TIERS で上書きできます。
+// 書式: "name:color:min_tip" をカンマ区切りで並べる (例: "blue:#1565c0:1,red:#d00000:10000")
+var tipTiers = func() []TipTier {
+	v, ok := os.LookupEnv("ISUCON13_TIP_TIERS")
+	if !ok {
+		return defaultTipTiers
+	}
+	tiers, err := parseTipTiers(v)
+	if err != nil {
+		log.Printf("invalid ISUCON13_TIP_TIERS, using defaults: %v", err)
+		return defaultTipTiers
+	}
+	return tiers
+}()
+
+func parseTipTiers(s string) ([]TipTier, error) {
+	var tiers []TipTier
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("tier %q must be name:color:min_tip", item)
+		}
+		minTip, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || minTip <= 0 {
+			return nil, fmt.Errorf("min_tip of tier %q must be positive integer", item)
+		}
+		tiers = append(tiers, TipTier{Name: parts[0], Color: parts[1], MinTip: minTip})
+	}
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("no tiers")
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinTip < tiers[j].MinTip })
+	return tiers, nil
+}
+
+// tipTierFor は投げ銭の額に対応する段階を返します。どの段階にも届かなければ nil を返します。
+func tipTierFor(tip int64) *TipTier {
+	var tier *TipTier
+	for i := range tipTiers {
+		if tip < tipTiers[i].MinTip {
+			break
+		}
+		tier = &tipTiers[i]
+	}
+	return tier
+}
+
+// livestreamTipTierSummary は配信の投げ銭を段階ごとに集計します。すべての段階を MinTip の昇順で返します。
+func livestreamTipTierSummary(ctx context.Context, q sqlx.QueryerContext, livestreamID int64) ([]TipTierSummary, error) {
+	var rows []struct {
+		Tip   int64 `db:"tip"`
+		Count int64 `db:"cnt"`
+	}
+	if err := sqlx.SelectContext(ctx, q, &rows, "SELECT tip, COUNT(*) AS cnt FROM livecomments WHERE livestream_id = ? AND tip > 0 AND deleted_at IS NULL GROUP BY tip", livestreamID); err != nil {
+		return nil, err
+	}
+
+	summary := make([]TipTierSummary, len(tipTiers))
+	for i, tier := range tipTiers {
+		summary[i].TipTier = tier
+	}
+	for _, row := range rows {
+		for i := len(tipTiers) - 1; i >= 0; i-- {
+			if row.Tip >= tipTiers[i].MinTip {
+				summary[i].Count += row.Count
+				summary[i].Total += row.Tip * row.Count
+				break
+			}
+		}
+	}
+	return summary, nil
+}
+
+// 投げ銭の段階一覧API
+// GET /api/tip_tiers
+func getTipTiersHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, tipTiers)
+}
+
+func envInt64(key string, def int64) int64 {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("invalid %s: %q", key, v)
+		return def
+	}
+	return n
+}
+
+// validateTip は投げ銭の額を配信の設定とサービス全体の設定で検証します。
+// 不正な場合は理由がわかるメッセージの 400 を返します。
+func validateTip(ctx context.Context, tx *sqlx.Tx, settings LivestreamSettings, userID int64, tip int64) error {
+	if tip < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tip must not be negative")
+	}
+	if tip == 0 {
+		return nil
+	}
+
+	// サービス全体の下限・上限は設定の tip_min / tip_max (ISUCON13_TIP_MIN / ISUCON13_TIP_MAX)
+	conf := currentConfig()
+	minTip, maxTip := conf.TipMin, conf.TipMax
+	if settings.MinTip > minTip {
+		minTip = settings.MinTip
+	}
+	if settings.MaxTip > 0 && settings.MaxTip < maxTip {
+		maxTip = settings.MaxTip
+	}
+	if tip < minTip {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tip is below the minimum (%d)", minTip))
+	}
+	if tip > maxTip {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tip exceeds the maximum (%d)", maxTip))
+	}
+
+	if settings.TipCapPerUser > 0 {
+		var total int64
+		if err := tx.GetContext(ctx, &total, "SELECT IFNULL(SUM(tip), 0) FROM livecomments WHERE livestream_id = ? AND user_id = ? AND deleted_at IS NULL", settings.LivestreamID, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum tips: "+err.Error())
+		}
+		if total+tip > settings.TipCapPerUser {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tip exceeds the per-user cap for this livestream (%d remaining)", settings.TipCapPerUser-total))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 受け取った投げ銭の CSV は件数が多くなりうるので、カーソルで 1 行ずつ読みながら書き出す
+// (tipsExportFlushRows 行ごとにクライアントへ送る)
+const tipsExportFlushRows = 1000
+
+var tipsExportHeader = []string{"timestamp", "tipper", "livestream_id", "livestream_title", "amount"}
+
+// 投げ銭エクスポートAPI
+// GET /api/user/me/tips/export
+// 自分の配信に付いた投げ銭 (削除されたライブコメントを除く) を古い順に CSV で返す
+func getTipsExportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	query := `
+	SELECT c.created_at, u.name, l.id, l.title, c.tip
+	FROM livecomments c
+	INNER JOIN livestreams l ON l.id = c.livestream_id
+	INNER JOIN users u ON u.id = c.user_id
+	WHERE l.user_id = ? AND c.tip > 0 AND c.deleted_at IS NULL
+	ORDER BY c.id`
+	rows, err := readDB().QueryxContext(ctx, query, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tips: "+err.Error())
+	}
+	defer rows.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="tips.csv"`)
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	if err := w.Write(tipsExportHeader); err != nil {
+		return nil
+	}
+	// ヘッダを送った後は状態コードを変えられないので、途中で失敗したらログに残して打ち切る
+	n := 0
+	for rows.Next() {
+		var (
+			createdAt    int64
+			tipper       string
+			livestreamID int64
+			title        string
+			tip          int64
+		)
+		if err := rows.Scan(&createdAt, &tipper, &livestreamID, &title, &tip); err != nil {
+			log.Printf("failed to export tips of user %d: %v", userID, err)
+			return nil
+		}
+		record := []string{
+			time.Unix(createdAt, 0).Format(time.RFC3339),
+			tipper,
+			strconv.FormatInt(livestreamID, 10),
+			title,
+			strconv.FormatInt(tip, 10),
+		}
+		if err := w.Write(record); err != nil {
+			// クライアントが切断した
+			return nil
+		}
+		if n++; n%tipsExportFlushRows == 0 {
+			w.Flush()
+			res.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("failed to export tips of user %d: %v", userID, err)
+		return nil
+	}
+	w.Flush()
+	return nil
+}
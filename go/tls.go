@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// nginx を置かずに Go で TLS を終端する構成向けです。
+// ISUCON13_TLS_CERT_FILE と ISUCON13_TLS_KEY_FILE を両方設定すると HTTPS で待ち受けます。
+// SIGHUP を受けると証明書を読み直し、以降の TLS ハンドシェイクから新しい証明書を使います (既存の接続は切りません)。
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// watchSIGHUP は SIGHUP のたびに証明書を読み直します。読み直しに失敗したら古い証明書を使い続けます。
+func (r *certReloader) watchSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := r.reload(); err != nil {
+			log.Printf("keep using the current certificate: %v", err)
+			continue
+		}
+		log.Printf("reloaded certificate from %s", r.certFile)
+	}
+}
+
+// setupTLSConfig は TLS が設定されていなければ nil を返します。
+func setupTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("ISUCON13_TLS_CERT_FILE"), os.Getenv("ISUCON13_TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both ISUCON13_TLS_CERT_FILE and ISUCON13_TLS_KEY_FILE must be set")
+	}
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.watchSIGHUP()
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ユーザのブロック
+// ブロックしたユーザのライブコメントとリアクションは、ブロックしたユーザの一覧APIと WebSocket / SSE の配信に出さない。
+// 判定は表示設定と同じく視聴者ごとの chatFilter (chat_preferences.go) で行う
+type UserBlocks struct {
+	// ブロックしているユーザ (ユーザ名)
+	BlockedUsers []string `json:"blocked_users"`
+}
+
+// ブロック一覧API
+// GET /api/user/me/blocks
+func getUserBlocksHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	blocks, err := loadUserBlocks(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get blocked users: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, blocks)
+}
+
+// ブロックAPI
+// POST /api/user/me/blocks/:username
+func postUserBlockHandler(c echo.Context) error {
+	return changeUserBlock(c, true)
+}
+
+// ブロック解除API
+// DELETE /api/user/me/blocks/:username
+func deleteUserBlockHandler(c echo.Context) error {
+	return changeUserBlock(c, false)
+}
+
+func changeUserBlock(c echo.Context, block bool) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	blockedUserID, ok, err := usernameIndex.userIDByName(ctx, c.Param("username"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+	}
+	if blockedUserID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't block yourself")
+	}
+
+	var blocks UserBlocks
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		if block {
+			if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO user_blocks (user_id, blocked_user_id, created_at) VALUES (?, ?, ?)", userID, blockedUserID, time.Now().Unix()); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user block: "+err.Error())
+			}
+		} else {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM user_blocks WHERE user_id = ? AND blocked_user_id = ?", userID, blockedUserID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user block: "+err.Error())
+			}
+		}
+
+		var err error
+		blocks, err = loadUserBlocks(ctx, tx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get blocked users: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	chatFilters.Delete(userID)
+
+	return c.JSON(http.StatusOK, blocks)
+}
+
+func loadUserBlocks(ctx context.Context, tx *sqlx.Tx, userID int64) (UserBlocks, error) {
+	blockedUsers := []string{}
+	query := "SELECT u.name FROM user_blocks b INNER JOIN users u ON u.id = b.blocked_user_id WHERE b.user_id = ? ORDER BY u.name"
+	if err := tx.SelectContext(ctx, &blockedUsers, query, userID); err != nil {
+		return UserBlocks{}, err
+	}
+	return UserBlocks{BlockedUsers: blockedUsers}, nil
+}
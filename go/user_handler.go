@@ -7,12 +7,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -52,9 +53,11 @@ type Theme struct {
 }
 
 type ThemeModel struct {
-	ID       int64 `db:"id"`
-	UserID   int64 `db:"user_id"`
-	DarkMode bool  `db:"dark_mode"`
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	DarkMode     bool   `db:"dark_mode"`
+	AccentColor  string `db:"accent_color"`
+	LayoutPreset string `db:"layout_preset"`
 }
 
 type PostUserRequest struct {
@@ -70,6 +73,17 @@ type PostUserRequestTheme struct {
 	DarkMode bool `json:"dark_mode"`
 }
 
+// 省略したフィールドは変更しない
+type PatchUserMeRequest struct {
+	DisplayName *string `json:"display_name"`
+	Description *string `json:"description"`
+}
+
+const (
+	maxDisplayNameLength = 64
+	maxDescriptionLength = 2000
+)
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	// Password is non-hashed password.
@@ -84,6 +98,13 @@ type PostIconResponse struct {
 	ID int64 `json:"id"`
 }
 
+type IconHashesResponse struct {
+	// username -> icon hash
+	Hashes map[string]string `json:"hashes"`
+}
+
+const maxIconHashUsernames = 100
+
 func getIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -95,16 +116,20 @@ func getIconHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
-		}
+	userID, ok, err := usernameIndex.userIDByName(ctx, username)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+	}
+
+	if iconStorage != nil {
+		return serveIconFromStorage(c, userID)
+	}
 
 	var image []byte
-	if err := tx.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", user.ID); err != nil {
+	if err := dbFor(tableIcons).GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", userID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.File(fallbackImage)
 		} else {
@@ -115,6 +140,34 @@ func getIconHandler(c echo.Context) error {
 	return c.Blob(http.StatusOK, "image/jpeg", image)
 }
 
+// serveIconFromStorage はオブジェクトストレージに置いたアイコンを、署名付きURLへのリダイレクトか中継で返します。
+func serveIconFromStorage(c echo.Context, userID int64) error {
+	ctx := c.Request().Context()
+
+	var hash string
+	if err := dbFor(tableIcons).GetContext(ctx, &hash, "SELECT hash FROM icons WHERE user_id = ?", userID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon hash: "+err.Error())
+		}
+		hash = fallbackIconHash()
+	}
+
+	if iconStorage.presign {
+		u, err := iconStorage.presignedURL(ctx, hash)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to presign icon url: "+err.Error())
+		}
+		return c.Redirect(http.StatusFound, u.String())
+	}
+
+	obj, err := iconStorage.open(ctx, hash)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon object: "+err.Error())
+	}
+	defer obj.Close()
+	return c.Stream(http.StatusOK, "image/jpeg", obj)
+}
+
 func postIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -128,12 +181,35 @@ func postIconHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var req *PostIconRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+	// 受信は先に済ませて、base64 のデコードとハッシュ計算だけをワーカーで行う
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read the request body")
+	}
+	var (
+		req       *PostIconRequest
+		iconHash  string
+		decodeErr error
+	)
+	if err := imagePool.do(ctx, func() {
+		if decodeErr = json.Unmarshal(body, &req); decodeErr != nil || req == nil {
+			return
+		}
+		iconHash = fmt.Sprintf("%x", sha256.Sum256(req.Image))
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "failed to wait for image worker: "+err.Error())
+	}
+	if decodeErr != nil || req == nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	rs, err := dbConn.ExecContext(ctx, "INSERT INTO icons (user_id, image) VALUES (?, ?) ON DUPLICATE KEY UPDATE image=VALUES(image)", userID, req.Image)
+	if iconStorage != nil {
+		if err := iconStorage.put(ctx, iconHash, req.Image); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to upload user icon: "+err.Error())
+		}
+	}
+
+	rs, err := dbFor(tableIcons).ExecContext(ctx, "INSERT INTO icons (user_id, image, hash) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE image=VALUES(image), hash=VALUES(hash)", userID, req.Image, iconHash)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new user icon: "+err.Error())
 	}
@@ -148,6 +224,71 @@ func postIconHandler(c echo.Context) error {
 	})
 }
 
+// アイコンハッシュ一括取得API
+// GET /api/icons/hashes?usernames=a,b,c
+func getIconHashesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var usernames []string
+	for _, name := range strings.Split(c.QueryParam("usernames"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			usernames = append(usernames, name)
+		}
+	}
+	if len(usernames) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "usernames query parameter is required")
+	}
+	if len(usernames) > maxIconHashUsernames {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("usernames must be at most %d", maxIconHashUsernames))
+	}
+
+	res := IconHashesResponse{Hashes: make(map[string]string, len(usernames))}
+
+	idByName, err := usernameIndex.userIDsByNames(ctx, usernames)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	if len(idByName) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	userIDs := make([]int64, 0, len(idByName))
+	nameByID := make(map[int64]string, len(idByName))
+	for name, id := range idByName {
+		userIDs = append(userIDs, id)
+		nameByID[id] = name
+		res.Hashes[name] = fallbackIconHash()
+	}
+
+	var icons []struct {
+		UserID int64  `db:"user_id"`
+		Hash   string `db:"hash"`
+	}
+	query, params, err := sqlx.In("SELECT user_id, hash FROM icons WHERE user_id IN (?) ORDER BY id", userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	if err := dbFor(tableIcons).SelectContext(ctx, &icons, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icons: "+err.Error())
+	}
+	// fillUserResponse と同じく、最初に登録された行を採用する
+	seen := make(map[int64]struct{}, len(icons))
+	for _, icon := range icons {
+		if _, ok := seen[icon.UserID]; ok {
+			continue
+		}
+		seen[icon.UserID] = struct{}{}
+		res.Hashes[nameByID[icon.UserID]] = icon.Hash
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
 func getMeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -188,6 +329,72 @@ func getMeHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+// プロフィール更新API
+// PATCH /api/user/me
+func patchMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PatchUserMeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.DisplayName != nil {
+		displayName := strings.TrimSpace(*req.DisplayName)
+		if code, message := validateDisplayName(displayName); code != "" {
+			return httpErrorWithCode(c, http.StatusBadRequest, code, message)
+		}
+		req.DisplayName = &displayName
+	}
+	if req.Description != nil && utf8.RuneCountInString(*req.Description) > maxDescriptionLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("description must be at most %d characters", maxDescriptionLength))
+	}
+
+	var user User
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		userModel := UserModel{}
+		err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+
+		if req.DisplayName != nil {
+			userModel.DisplayName = *req.DisplayName
+		}
+		if req.Description != nil {
+			userModel.Description = *req.Description
+		}
+		if _, err := tx.NamedExecContext(ctx, "UPDATE users SET display_name = :display_name, description = :description WHERE id = :id", &userModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user: "+err.Error())
+		}
+
+		user, err = fillUserResponse(ctx, tx, userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	// ユーザ情報を埋め込んだ集計のキャッシュは作り直させる
+	resetModerationSummaries()
+
+	return c.JSON(http.StatusOK, user)
+}
+
 // ユーザ登録API
 // POST /api/register
 func registerHandler(c echo.Context) error {
@@ -199,8 +406,21 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	if req.Name == "pipe" {
-		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
+	if code, message := validateUsername(req.Name); code != "" {
+		return httpErrorWithCode(c, http.StatusBadRequest, code, message)
+	}
+	if code, message := validateDisplayName(strings.TrimSpace(req.DisplayName)); code != "" {
+		return httpErrorWithCode(c, http.StatusBadRequest, code, message)
+	}
+
+	// 登録は 検証 → (重複の事前チェック) → パスワードのハッシュ → DB への書き込み (1 トランザクション) → コミット後の反映 の順に行う。
+	// DB の状態 (ユーザ・テーマ・DNS 登録の記録) はすべて同じトランザクションで書き、
+	// DNS とプロセス内のキャッシュにはコミットしてから反映する (ロールバックしたユーザが残らないように)
+	// 既に使われている名前は bcrypt の前に弾く (最終的な判定は users.name の UNIQUE 制約)
+	if _, exists, err := usernameIndex.userIDByName(ctx, req.Name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to check username: "+err.Error())
+	} else if exists {
+		return httpErrorWithCode(c, http.StatusConflict, errCodeUsernameTaken, "the username is already taken")
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
@@ -208,49 +428,58 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	subdomain := req.Name + "." + dnsZoneName
+	var user User
+	if err := runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		userModel := UserModel{
+			Name:           req.Name,
+			DisplayName:    req.DisplayName,
+			Description:    req.Description,
+			HashedPassword: string(hashedPassword),
+		}
 
-	userModel := UserModel{
-		Name:           req.Name,
-		DisplayName:    req.DisplayName,
-		Description:    req.Description,
-		HashedPassword: string(hashedPassword),
-	}
+		result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
+		if err != nil {
+			if isDuplicateEntryError(err) {
+				return httpErrorWithCode(c, http.StatusConflict, errCodeUsernameTaken, "the username is already taken")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
+		}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
-	}
+		userID, err := result.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user id: "+err.Error())
+		}
 
-	userID, err := result.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user id: "+err.Error())
-	}
+		userModel.ID = userID
 
-	userModel.ID = userID
+		themeModel := ThemeModel{
+			UserID:   userID,
+			DarkMode: req.Theme.DarkMode,
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
+		}
 
-	themeModel := ThemeModel{
-		UserID:   userID,
-		DarkMode: req.Theme.DarkMode,
-	}
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
-	}
+		// DNS登録 (コミット後に dns_outbox.go が反映する)
+		if err := enqueueDNSRegistration(ctx, tx, userID, subdomain); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue dns registration: "+err.Error())
+		}
 
-	// DNS登録
-	addSubdomain(req.Name + ".t.isucon.pw.")
+		user, err = fillUserResponse(ctx, tx, userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
 
-	user, err := fillUserResponse(ctx, tx, userModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	usernameIndex.add(user.ID, user.Name)
+	// 自分のサーバの DNS にはすぐに載せる。失敗しても記録は残っているので、定期的な反映で載る
+	if _, err := dnsOutbox.drain(ctx); err != nil {
+		c.Logger().Warnf("failed to apply dns registration for %s: %v", subdomain, err)
 	}
 
 	return c.JSON(http.StatusCreated, user)
@@ -295,7 +524,7 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	sessionEndAt := time.Now().Add(currentConfig().SessionTTL.duration())
 
 	sessionID := uuid.NewString()
 
@@ -304,16 +533,15 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
 	}
 
-	sess.Options = &sessions.Options{
-		Domain: "t.isucon.pw",
-		MaxAge: int(60000),
-		Path:   "/",
-	}
+	sess.Options = sessionCookieOptions()
 	sess.Values[defaultSessionIDKey] = sessionID
 	sess.Values[defaultUserIDKey] = userModel.ID
 	sess.Values[defaultUsernameKey] = userModel.Name
 	sess.Values[defaultSessionExpiresKey] = sessionEndAt.Unix()
 
+	if err := userSessions.add(ctx, userModel.ID, sessionID, sessionEndAt.Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to register session: "+err.Error())
+	}
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
 	}
@@ -338,8 +566,17 @@ func getUserHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// 存在しないユーザ名なら DB を引かずに返す
+	userID, ok, err := usernameIndex.userIDByName(ctx, username)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+	}
+
 	userModel := UserModel{}
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 		}
@@ -369,7 +606,7 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session")
 	}
 
-	_, ok = sess.Values[defaultUserIDKey].(int64)
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
 	if !ok {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
 	}
@@ -379,26 +616,43 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
 	}
 
+	// アクセストークンはミドルウェアで検証済み
+	if isAPITokenRequest(c) {
+		return nil
+	}
+
+	// ログアウトや強制失効されたセッションを弾く
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+	active, err := isActiveSession(c.Request().Context(), userID, sessionID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to check session: "+err.Error())
+	}
+	if !active {
+		return echo.NewHTTPError(http.StatusUnauthorized, "session has been revoked")
+	}
+
 	return nil
 }
 
 func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
+	defer traceFill(ctx, "fillUserResponse")()
+
 	themeModel := ThemeModel{}
 	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
 		return User{}, err
 	}
 
-	var image []byte
-	if err := tx.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", userModel.ID); err != nil {
+	// 画像本体は引かずに、保存時に計算したハッシュを使う
+	var iconHash string
+	if err := dbFor(tableIcons).GetContext(ctx, &iconHash, "SELECT hash FROM icons WHERE user_id = ?", userModel.ID); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			return User{}, err
 		}
-		image, err = os.ReadFile(fallbackImage)
-		if err != nil {
-			return User{}, err
+		iconHash = fallbackIconHash()
+		if iconHash == "" {
+			return User{}, fmt.Errorf("failed to read fallback image")
 		}
 	}
-	iconHash := sha256.Sum256(image)
 
 	user := User{
 		ID:          userModel.ID,
@@ -409,7 +663,7 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 			ID:       themeModel.ID,
 			DarkMode: themeModel.DarkMode,
 		},
-		IconHash: fmt.Sprintf("%x", iconHash),
+		IconHash: iconHash,
 	}
 
 	return user, nil
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 管理者によるユーザの利用停止
+//   - 停止中のユーザの書き込みリクエストは 403 で弾く (ログアウトはできる)
+//   - 停止中のユーザの配信は検索・トレンドに出さず、ランキングにも含めない
+//
+// 停止中のユーザの一覧はユーザのキャッシュとしてプロセス内に持ち、設定の user_suspension_cache_ttl ごとに読み直す
+// (他のサーバで停止・解除したものもこの時間が経てば反映される)
+
+// 停止中でも受け付ける書き込み系エンドポイント
+var suspensionExemptPaths = []string{
+	"/api/initialize",
+	"/api/login",
+	"/api/logout",
+	"/api/admin/",
+	"/internal/",
+}
+
+const errCodeUserSuspended = "user_suspended"
+
+type UserSuspensionModel struct {
+	UserID    int64  `db:"user_id"`
+	Reason    string `db:"reason"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type PutUserSuspensionRequest struct {
+	Reason string `json:"reason"`
+}
+
+type UserSuspensionResponse struct {
+	Username  string `json:"username"`
+	Suspended bool   `json:"suspended"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+}
+
+type userSuspensionCache struct {
+	mu        sync.Mutex
+	suspended map[int64]bool
+	loadedAt  time.Time
+}
+
+var userSuspensions = &userSuspensionCache{}
+
+// reset は initialize 時や停止・解除したときに呼び、次の参照で読み直させます。
+func (s *userSuspensionCache) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.suspended = nil
+}
+
+// set は停止中のユーザの集合を返します。呼び出し側で変更しないこと。
+func (s *userSuspensionCache) set(ctx context.Context) (map[int64]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.suspended != nil && time.Since(s.loadedAt) < currentConfig().UserSuspensionCacheTTL.duration() {
+		return s.suspended, nil
+	}
+
+	var userIDs []int64
+	if err := dbConn.SelectContext(ctx, &userIDs, "SELECT user_id FROM user_suspensions"); err != nil {
+		return nil, err
+	}
+	suspended := make(map[int64]bool, len(userIDs))
+	for _, id := range userIDs {
+		suspended[id] = true
+	}
+	s.suspended = suspended
+	s.loadedAt = time.Now()
+	return suspended, nil
+}
+
+func (s *userSuspensionCache) isSuspended(ctx context.Context, userID int64) (bool, error) {
+	suspended, err := s.set(ctx)
+	if err != nil {
+		return false, err
+	}
+	return suspended[userID], nil
+}
+
+// suspendedUserMiddleware は停止中のユーザの書き込みリクエストを 403 で弾きます。
+func suspendedUserMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !isWriteRequest(c.Request()) {
+			return next(c)
+		}
+		path := c.Request().URL.Path
+		for _, exempt := range suspensionExemptPaths {
+			if strings.HasPrefix(path, exempt) {
+				return next(c)
+			}
+		}
+
+		sess, err := session.Get(defaultSessionIDKey, c)
+		if err != nil {
+			return next(c)
+		}
+		userID, ok := sess.Values[defaultUserIDKey].(int64)
+		if !ok {
+			return next(c)
+		}
+		suspended, err := userSuspensions.isSuspended(c.Request().Context(), userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to check user suspension: "+err.Error())
+		}
+		if suspended {
+			return httpErrorWithCode(c, http.StatusForbidden, errCodeUserSuspended, "the user is suspended")
+		}
+		return next(c)
+	}
+}
+
+func resolveSuspensionTarget(c echo.Context) (int64, error) {
+	userID, ok, err := usernameIndex.userIDByName(c.Request().Context(), c.Param("username"))
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if !ok {
+		return 0, echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	return userID, nil
+}
+
+// 利用停止の状態を変えたら、停止中のユーザを除いて組み立てたキャッシュを捨てる
+func onUserSuspensionChanged() {
+	userSuspensions.reset()
+	resetHomeCache()
+}
+
+// 利用停止取得API
+// GET /api/admin/users/:username/suspension
+func getUserSuspensionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+	userID, err := resolveSuspensionTarget(c)
+	if err != nil {
+		return err
+	}
+
+	var suspensions []UserSuspensionModel
+	if err := dbConn.SelectContext(ctx, &suspensions, "SELECT * FROM user_suspensions WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user suspension: "+err.Error())
+	}
+	res := UserSuspensionResponse{Username: c.Param("username")}
+	if len(suspensions) > 0 {
+		res.Suspended = true
+		res.Reason = suspensions[0].Reason
+		res.CreatedAt = suspensions[0].CreatedAt
+	}
+	return c.JSON(http.StatusOK, &res)
+}
+
+// 利用停止API
+// PUT /api/admin/users/:username/suspension
+func putUserSuspensionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+	userID, err := resolveSuspensionTarget(c)
+	if err != nil {
+		return err
+	}
+
+	var req PutUserSuspensionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	suspension := UserSuspensionModel{
+		UserID:    userID,
+		Reason:    req.Reason,
+		CreatedAt: time.Now().Unix(),
+	}
+	if _, err := dbConn.NamedExecContext(ctx, "INSERT INTO user_suspensions (user_id, reason, created_at) VALUES (:user_id, :reason, :created_at) ON DUPLICATE KEY UPDATE reason = VALUES(reason)", suspension); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user suspension: "+err.Error())
+	}
+	// 停止したユーザのログイン中のセッションも失効させる (revokeUserSessionsHandler と同じ)
+	if _, err := userSessions.revokeAll(ctx, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke sessions: "+err.Error())
+	}
+	resetActiveSessions()
+	onUserSuspensionChanged()
+
+	return c.JSON(http.StatusOK, &UserSuspensionResponse{
+		Username:  c.Param("username"),
+		Suspended: true,
+		Reason:    suspension.Reason,
+		CreatedAt: suspension.CreatedAt,
+	})
+}
+
+// 利用停止解除API
+// DELETE /api/admin/users/:username/suspension
+func deleteUserSuspensionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+	userID, err := resolveSuspensionTarget(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "DELETE FROM user_suspensions WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user suspension: "+err.Error())
+	}
+	onUserSuspensionChanged()
+
+	return c.JSON(http.StatusOK, &UserSuspensionResponse{Username: c.Param("username")})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ユーザ名は <name>.t.isucon.pw のサブドメインとして DNS に登録するので、DNS のラベルとして使える名前だけを受け付ける
+// (英小文字・数字・ハイフン、先頭と末尾はハイフン以外)。DNS の問い合わせとは大文字小文字を区別して比べているので大文字は使えない。
+// 不正な名前は登録時に弾き、エラーレスポンスの code で理由がわかるようにする
+// 表示名の制限は PATCH /api/user/me と同じ (maxDisplayNameLength)
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+)
+
+// ゾーンで使っている名前 (ネームサーバや配信サイトなど) はユーザ名にできない
+var reservedUsernames = map[string]bool{
+	"pipe":       true,
+	"www":        true,
+	"www1":       true,
+	"www2":       true,
+	"www3":       true,
+	"www4":       true,
+	"www5":       true,
+	"ns1":        true,
+	"ns2":        true,
+	"mail":       true,
+	"hostmaster": true,
+}
+
+// エラーレスポンスの code
+const (
+	errCodeUsernameLength     = "username_length"
+	errCodeUsernameCharset    = "username_charset"
+	errCodeUsernameHyphen     = "username_hyphen"
+	errCodeUsernameReserved   = "username_reserved"
+	errCodeUsernameTaken      = "username_taken"
+	errCodeDisplayNameBlank   = "display_name_blank"
+	errCodeDisplayNameLength  = "display_name_length"
+	errCodeDisplayNameControl = "display_name_control_character"
+)
+
+// validateUsername は不正なユーザ名なら code とメッセージを返します。問題なければ code は空です。
+func validateUsername(name string) (code, message string) {
+	if len(name) < minUsernameLength || len(name) > maxUsernameLength {
+		return errCodeUsernameLength, fmt.Sprintf("the username must be between %d and %d characters", minUsernameLength, maxUsernameLength)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return errCodeUsernameCharset, "the username may contain only lowercase letters, digits and hyphens"
+		}
+	}
+	if strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") {
+		return errCodeUsernameHyphen, "the username must not start or end with a hyphen"
+	}
+	if reservedUsernames[name] {
+		return errCodeUsernameReserved, "the username '" + name + "' is reserved"
+	}
+	return "", ""
+}
+
+// validateDisplayName は不正な表示名なら code とメッセージを返します。問題なければ code は空です。
+// 前後の空白は呼び出し側で取り除いておくこと
+func validateDisplayName(displayName string) (code, message string) {
+	if displayName == "" {
+		return errCodeDisplayNameBlank, "display_name must not be empty"
+	}
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		return errCodeDisplayNameLength, fmt.Sprintf("display_name must be at most %d characters", maxDisplayNameLength)
+	}
+	if strings.IndexFunc(displayName, unicode.IsControl) >= 0 {
+		return errCodeDisplayNameControl, "display_name must not contain control characters"
+	}
+	return "", ""
+}
+
+// errorCodeContextKey はエラーレスポンスに載せる code を echo.Context に記録するキーです。
+const errorCodeContextKey = "error_code"
+
+// httpErrorWithCode は code 付きのエラーレスポンスを返すための HTTPError を返します (errorResponseHandler が code を載せる)。
+func httpErrorWithCode(c echo.Context, status int, code, message string) error {
+	c.Set(errorCodeContextKey, code)
+	return echo.NewHTTPError(status, message)
+}
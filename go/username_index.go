@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ユーザ名から ID を引くだけのために users を読んでいるハンドラ (統計・テーマ・アイコンなど) が多いので、
+// ユーザ名と ID の対応をプロセス内に持つ。ユーザ名は変更できないので、一度引けたものはそのまま使える。
+// 存在しないユーザ名もしばらく (設定の negative_cache_ttl) 覚えておく (他のサーバで登録されたユーザもこの時間が経てば見つかる)
+
+// 存在しないものを覚えている件数がこれを超えたら、期限切れのものを捨てる
+const negativeCachePruneSize = 4096
+
+type usernameResolver struct {
+	mu       sync.RWMutex
+	idByName map[string]int64
+	nameByID map[int64]string
+	// 存在しなかったユーザ名と、覚えておく期限
+	unknown map[string]time.Time
+}
+
+var usernameIndex = newUsernameResolver()
+
+func newUsernameResolver() *usernameResolver {
+	return &usernameResolver{
+		idByName: map[string]int64{},
+		nameByID: map[int64]string{},
+		unknown:  map[string]time.Time{},
+	}
+}
+
+// reset は initialize 時に呼び、すべて忘れます。
+func (r *usernameResolver) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idByName = map[string]int64{}
+	r.nameByID = map[int64]string{}
+	r.unknown = map[string]time.Time{}
+}
+
+// add は登録されたユーザを覚えます。存在しないと覚えていたユーザ名なら忘れます。
+func (r *usernameResolver) add(userID int64, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idByName[name] = userID
+	r.nameByID[userID] = name
+	delete(r.unknown, name)
+}
+
+func (r *usernameResolver) lookupName(name string) (userID int64, known, missing bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if id, ok := r.idByName[name]; ok {
+		return id, true, false
+	}
+	if expiresAt, ok := r.unknown[name]; ok && time.Now().Before(expiresAt) {
+		return 0, false, true
+	}
+	return 0, false, false
+}
+
+// userIDByName はユーザ名に対応するユーザ ID を返します。存在しなければ false を返します。
+func (r *usernameResolver) userIDByName(ctx context.Context, name string) (int64, bool, error) {
+	if id, known, missing := r.lookupName(name); known || missing {
+		return id, known, nil
+	}
+
+	var userID int64
+	if err := dbConn.GetContext(ctx, &userID, "SELECT id FROM users WHERE name = ?", name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			r.markUnknown([]string{name})
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	r.add(userID, name)
+	return userID, true, nil
+}
+
+// usernameByID はユーザ ID に対応するユーザ名を返します。存在しなければ false を返します。
+func (r *usernameResolver) usernameByID(ctx context.Context, userID int64) (string, bool, error) {
+	r.mu.RLock()
+	name, ok := r.nameByID[userID]
+	r.mu.RUnlock()
+	if ok {
+		return name, true, nil
+	}
+
+	if err := dbConn.GetContext(ctx, &name, "SELECT name FROM users WHERE id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	r.add(userID, name)
+	return name, true, nil
+}
+
+// userIDsByNames は userIDByName の一覧版で、見つかったユーザだけをユーザ名をキーにして返します。
+// 知らないユーザ名はまとめて IN 句で引きます。
+func (r *usernameResolver) userIDsByNames(ctx context.Context, names []string) (map[string]int64, error) {
+	ids := make(map[string]int64, len(names))
+	var unresolved []string
+	for _, name := range names {
+		id, known, missing := r.lookupName(name)
+		switch {
+		case known:
+			ids[name] = id
+		case !missing:
+			unresolved = append(unresolved, name)
+		}
+	}
+	if len(unresolved) == 0 {
+		return ids, nil
+	}
+
+	query, params, err := sqlx.In("SELECT id, name FROM users WHERE name IN (?)", unresolved)
+	if err != nil {
+		return nil, err
+	}
+	var users []UserModel
+	if err := dbConn.SelectContext(ctx, &users, query, params...); err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		ids[u.Name] = u.ID
+		r.add(u.ID, u.Name)
+	}
+
+	var unknown []string
+	for _, name := range unresolved {
+		if _, ok := ids[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	r.markUnknown(unknown)
+	return ids, nil
+}
+
+// markUnknown は存在しなかったユーザ名を設定の negative_cache_ttl の間覚えておきます。
+func (r *usernameResolver) markUnknown(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if len(r.unknown) >= negativeCachePruneSize {
+		for name, expiresAt := range r.unknown {
+			if now.After(expiresAt) {
+				delete(r.unknown, name)
+			}
+		}
+	}
+	for _, name := range names {
+		r.unknown[name] = now.Add(currentConfig().NegativeCacheTTL.duration())
+	}
+}
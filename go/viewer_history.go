@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// viewerHistoryStore は視聴履歴の保存先を抽象化します。
+// 視聴履歴は書き込みが多い割に件数の集計にしか使わないので、Redis に逃がせるようにしています。
+type viewerHistoryStore interface {
+	enter(ctx context.Context, viewer LivestreamViewerModel) error
+	// exit は退室させ、入室時刻 (複数回入室していれば最初のもの) を返します。入室していなければ 0 を返します
+	exit(ctx context.Context, userID, livestreamID int64) (int64, error)
+	countByLivestream(ctx context.Context, livestreamID int64) (int64, error)
+	// countAll は全配信の件数を返します (0 件の配信は含まれません)
+	countAll(ctx context.Context) (map[int64]int64, error)
+	watchedLivestreamIDs(ctx context.Context, userID int64) ([]int64, error)
+	// approxUniqueViewers は initialize 以降に入室したユーザ数の概算を返します (HyperLogLog)
+	approxUniqueViewers(ctx context.Context, livestreamID int64) (int64, error)
+	// rebuild は initialize 後に MySQL の内容から作り直します
+	rebuild(ctx context.Context) error
+}
+
+var viewerHistory viewerHistoryStore = &mysqlViewerHistoryStore{uniqueViewers: newUniqueViewerSketches()}
+
+// setupViewerHistoryStore は ISUCON13_VIEWER_HISTORY_BACKEND=redis のとき Redis を使うようにします。
+// MySQL のままなら、設定で入室の書き込みをまとめられるようにします (viewer_history_buffer.go)。
+func setupViewerHistoryStore() error {
+	if os.Getenv("ISUCON13_VIEWER_HISTORY_BACKEND") != "redis" {
+		viewerHistory = newBufferedViewerHistoryStore(viewerHistory.(*mysqlViewerHistoryStore))
+		if conf := currentConfig(); conf.ViewerHistoryWriteBehind {
+			log.Printf("viewer history backend: mysql (write-behind, batch size %d)", conf.ViewerHistoryBatchSize)
+		}
+		return nil
+	}
+	addr := "127.0.0.1:6379"
+	if v, ok := os.LookupEnv("ISUCON13_REDIS_ADDR"); ok {
+		addr = v
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return fmt.Errorf("failed to connect redis: %w", err)
+	}
+	viewerHistory = &redisViewerHistoryStore{client: client}
+	log.Printf("viewer history backend: redis (%s)", addr)
+	return nil
+}
+
+// mysqlViewerHistoryStore はユニーク視聴者数のスケッチだけをプロセス内に持ちます (サーバごとの概算になる)。
+type mysqlViewerHistoryStore struct {
+	uniqueViewers *uniqueViewerSketches
+}
+
+func (s *mysqlViewerHistoryStore) enter(ctx context.Context, viewer LivestreamViewerModel) error {
+	if _, err := dbFor(tableLivestreamViewersHistory).NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+		return err
+	}
+	s.uniqueViewers.add(viewer.LivestreamID, viewer.UserID)
+	return nil
+}
+
+func (s *mysqlViewerHistoryStore) exit(ctx context.Context, userID, livestreamID int64) (int64, error) {
+	db := dbFor(tableLivestreamViewersHistory)
+	var enteredAt int64
+	if err := db.GetContext(ctx, &enteredAt, "SELECT IFNULL(MIN(created_at), 0) FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
+		return 0, err
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
+		return 0, err
+	}
+	return enteredAt, nil
+}
+
+func (s *mysqlViewerHistoryStore) countByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	var cnt int64
+	err := dbFor(tableLivestreamViewersHistory).GetContext(ctx, &cnt, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestreamID)
+	return cnt, err
+}
+
+func (s *mysqlViewerHistoryStore) countAll(ctx context.Context) (map[int64]int64, error) {
+	var rows []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"cnt"`
+	}
+	if err := dbFor(tableLivestreamViewersHistory).SelectContext(ctx, &rows, "SELECT livestream_id, COUNT(*) AS cnt FROM livestream_viewers_history GROUP BY livestream_id"); err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		counts[row.LivestreamID] = row.Count
+	}
+	return counts, nil
+}
+
+func (s *mysqlViewerHistoryStore) watchedLivestreamIDs(ctx context.Context, userID int64) ([]int64, error) {
+	var ids []int64
+	err := dbFor(tableLivestreamViewersHistory).SelectContext(ctx, &ids, "SELECT DISTINCT livestream_id FROM livestream_viewers_history WHERE user_id = ?", userID)
+	return ids, err
+}
+
+func (s *mysqlViewerHistoryStore) approxUniqueViewers(ctx context.Context, livestreamID int64) (int64, error) {
+	return s.uniqueViewers.count(livestreamID), nil
+}
+
+func (s *mysqlViewerHistoryStore) rebuild(ctx context.Context) error {
+	var viewers []LivestreamViewerModel
+	if err := dbFor(tableLivestreamViewersHistory).SelectContext(ctx, &viewers, "SELECT DISTINCT user_id, livestream_id FROM livestream_viewers_history"); err != nil {
+		return err
+	}
+	s.uniqueViewers.reset()
+	for _, v := range viewers {
+		s.uniqueViewers.add(v.LivestreamID, v.UserID)
+	}
+	return nil
+}
+
+// redisViewerHistoryStore は配信ごとに「ユーザ → 入室回数」「ユーザ → 最初の入室時刻」のハッシュと合計件数のカウンタ、
+// ユーザごとに視聴した配信のセットを持ちます。
+// MySQL では同じユーザが複数回入室すると複数行になるため、件数はそれに合わせて数えます。
+type redisViewerHistoryStore struct {
+	client *redis.Client
+}
+
+const redisViewerHistoryKeyPrefix = "isupipe:viewers:"
+
+func redisViewersKey(livestreamID int64) string {
+	return redisViewerHistoryKeyPrefix + "livestream:" + strconv.FormatInt(livestreamID, 10)
+}
+
+func redisViewersCountKey(livestreamID int64) string {
+	return redisViewerHistoryKeyPrefix + "count:" + strconv.FormatInt(livestreamID, 10)
+}
+
+func redisViewersEnteredAtKey(livestreamID int64) string {
+	return redisViewerHistoryKeyPrefix + "entered:" + strconv.FormatInt(livestreamID, 10)
+}
+
+func redisWatchedKey(userID int64) string {
+	return redisViewerHistoryKeyPrefix + "user:" + strconv.FormatInt(userID, 10)
+}
+
+// 退室は「入室回数を消してその分だけカウンタを減らし、入室時刻を取り出す」を原子的に行う
+var redisViewerExitScript = redis.NewScript(`
+local n = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+if n > 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	redis.call('DECRBY', KEYS[2], n)
+end
+redis.call('SREM', KEYS[3], ARGV[2])
+local enteredAt = tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or '0')
+redis.call('HDEL', KEYS[4], ARGV[1])
+return enteredAt
+`)
+
+func (s *redisViewerHistoryStore) enter(ctx context.Context, viewer LivestreamViewerModel) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, redisViewersKey(viewer.LivestreamID), strconv.FormatInt(viewer.UserID, 10), 1)
+		pipe.Incr(ctx, redisViewersCountKey(viewer.LivestreamID))
+		pipe.SAdd(ctx, redisWatchedKey(viewer.UserID), viewer.LivestreamID)
+		pipe.HSetNX(ctx, redisViewersEnteredAtKey(viewer.LivestreamID), strconv.FormatInt(viewer.UserID, 10), viewer.CreatedAt)
+		pipe.PFAdd(ctx, redisUniqueViewersKey(viewer.LivestreamID), viewer.UserID)
+		return nil
+	})
+	return err
+}
+
+func (s *redisViewerHistoryStore) exit(ctx context.Context, userID, livestreamID int64) (int64, error) {
+	keys := []string{redisViewersKey(livestreamID), redisViewersCountKey(livestreamID), redisWatchedKey(userID), redisViewersEnteredAtKey(livestreamID)}
+	return redisViewerExitScript.Run(ctx, s.client, keys, userID, livestreamID).Int64()
+}
+
+func (s *redisViewerHistoryStore) countByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	cnt, err := s.client.Get(ctx, redisViewersCountKey(livestreamID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return cnt, err
+}
+
+func (s *redisViewerHistoryStore) countAll(ctx context.Context) (map[int64]int64, error) {
+	prefix := redisViewerHistoryKeyPrefix + "count:"
+	iter := s.client.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]int64, len(keys))
+	if len(keys) == 0 {
+		return counts, nil
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		v, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		livestreamID, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		cnt, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if cnt > 0 {
+			counts[livestreamID] = cnt
+		}
+	}
+	return counts, nil
+}
+
+func (s *redisViewerHistoryStore) watchedLivestreamIDs(ctx context.Context, userID int64) ([]int64, error) {
+	members, err := s.client.SMembers(ctx, redisWatchedKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(members))
+	for _, m := range members {
+		id, err := strconv.ParseInt(m, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *redisViewerHistoryStore) approxUniqueViewers(ctx context.Context, livestreamID int64) (int64, error) {
+	return s.client.PFCount(ctx, redisUniqueViewersKey(livestreamID)).Result()
+}
+
+type viewerHistoryCount struct {
+	UserID       int64 `db:"user_id"`
+	LivestreamID int64 `db:"livestream_id"`
+	Count        int64 `db:"cnt"`
+	EnteredAt    int64 `db:"entered_at"`
+}
+
+func (s *redisViewerHistoryStore) rebuild(ctx context.Context) error {
+	iter := s.client.Scan(ctx, 0, redisViewerHistoryKeyPrefix+"*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		if err := s.client.Unlink(ctx, keys...).Err(); err != nil {
+			return err
+		}
+	}
+
+	var counts []viewerHistoryCount
+	query := "SELECT user_id, livestream_id, COUNT(*) AS cnt, MIN(created_at) AS entered_at FROM livestream_viewers_history GROUP BY user_id, livestream_id"
+	if err := dbFor(tableLivestreamViewersHistory).SelectContext(ctx, &counts, query); err != nil {
+		return err
+	}
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, c := range counts {
+			pipe.HSet(ctx, redisViewersKey(c.LivestreamID), strconv.FormatInt(c.UserID, 10), c.Count)
+			pipe.IncrBy(ctx, redisViewersCountKey(c.LivestreamID), c.Count)
+			pipe.SAdd(ctx, redisWatchedKey(c.UserID), c.LivestreamID)
+			pipe.HSet(ctx, redisViewersEnteredAtKey(c.LivestreamID), strconv.FormatInt(c.UserID, 10), c.EnteredAt)
+			pipe.PFAdd(ctx, redisUniqueViewersKey(c.LivestreamID), c.UserID)
+		}
+		return nil
+	})
+	return err
+}
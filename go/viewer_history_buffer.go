@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// 視聴履歴の書き込みをまとめる (設定の viewer_history_write_behind、ISUCON13_VIEWER_HISTORY_WRITE_BEHIND=true、MySQL のときだけ)
+// 入室は即座に永続化しなくてよいので、溜めておいて一定間隔か一定件数 (設定の viewer_history_batch_size) ごとに複数行の INSERT で書き込む。
+// 件数などの参照はまだ書き込んでいない分も足して返すので、書き込みを待たずに値が合う
+// MySQL のときは常にこのストアを使い、無効なら入室をその場で書き込む (設定を読み直せば切り替えられる)
+const viewerHistoryFlushInterval = 100 * time.Millisecond
+
+type bufferedViewerHistoryStore struct {
+	*mysqlViewerHistoryStore
+
+	// flushing は書き込み中に参照させないためのロックです。
+	// 書き込み中の行は「溜めている分」からも「テーブル」からも見えない (あるいは両方から見える) ので、
+	// 参照 (RLock) と書き込み (Lock) を排他にする
+	flushing sync.RWMutex
+
+	mu      sync.Mutex
+	pending []LivestreamViewerModel
+	full    chan struct{}
+	closed  chan struct{}
+	done    chan struct{}
+}
+
+func newBufferedViewerHistoryStore(base *mysqlViewerHistoryStore) *bufferedViewerHistoryStore {
+	s := &bufferedViewerHistoryStore{
+		mysqlViewerHistoryStore: base,
+		full:                    make(chan struct{}, 1),
+		closed:                  make(chan struct{}),
+		done:                    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *bufferedViewerHistoryStore) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(viewerHistoryFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.full:
+		case <-s.closed:
+			if err := s.flush(context.Background()); err != nil {
+				log.Printf("failed to flush viewer history: %v", err)
+			}
+			return
+		}
+		if err := s.flush(context.Background()); err != nil {
+			log.Printf("failed to flush viewer history: %v", err)
+		}
+	}
+}
+
+// flush は溜めている入室をまとめて書き込みます。
+// 書き込みに失敗した分は捨てずに戻し、次の書き込みでやり直します。
+func (s *bufferedViewerHistoryStore) flush(ctx context.Context) error {
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	batchSize := currentConfig().ViewerHistoryBatchSize
+	for len(batch) > 0 {
+		n := min(len(batch), batchSize)
+		if _, err := dbFor(tableLivestreamViewersHistory).NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES (:user_id, :livestream_id, :created_at)", batch[:n]); err != nil {
+			s.mu.Lock()
+			s.pending = append(batch, s.pending...)
+			s.mu.Unlock()
+			return err
+		}
+		batch = batch[n:]
+	}
+	return nil
+}
+
+// close は溜めている分を書き込んでから止めます。サーバの終了時に呼びます。
+func (s *bufferedViewerHistoryStore) close() {
+	close(s.closed)
+	<-s.done
+}
+
+// discard は溜めている分を捨てます。initialize でテーブルを作り直すときに呼びます。
+func (s *bufferedViewerHistoryStore) discard() {
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = nil
+}
+
+func (s *bufferedViewerHistoryStore) enter(ctx context.Context, viewer LivestreamViewerModel) error {
+	if !currentConfig().ViewerHistoryWriteBehind {
+		return s.mysqlViewerHistoryStore.enter(ctx, viewer)
+	}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, viewer)
+	n := len(s.pending)
+	s.mu.Unlock()
+
+	if n >= currentConfig().ViewerHistoryBatchSize {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+	s.uniqueViewers.add(viewer.LivestreamID, viewer.UserID)
+	return nil
+}
+
+func (s *bufferedViewerHistoryStore) exit(ctx context.Context, userID, livestreamID int64) (int64, error) {
+	s.flushing.RLock()
+	defer s.flushing.RUnlock()
+
+	// まだ書き込んでいない入室はここで取り消す
+	var pendingEnteredAt int64
+	s.mu.Lock()
+	kept := s.pending[:0]
+	for _, v := range s.pending {
+		if v.UserID == userID && v.LivestreamID == livestreamID {
+			if pendingEnteredAt == 0 || v.CreatedAt < pendingEnteredAt {
+				pendingEnteredAt = v.CreatedAt
+			}
+			continue
+		}
+		kept = append(kept, v)
+	}
+	s.pending = kept
+	s.mu.Unlock()
+
+	enteredAt, err := s.mysqlViewerHistoryStore.exit(ctx, userID, livestreamID)
+	if err != nil {
+		return 0, err
+	}
+	if enteredAt == 0 || (pendingEnteredAt != 0 && pendingEnteredAt < enteredAt) {
+		enteredAt = pendingEnteredAt
+	}
+	return enteredAt, nil
+}
+
+func (s *bufferedViewerHistoryStore) countByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	s.flushing.RLock()
+	defer s.flushing.RUnlock()
+
+	cnt, err := s.mysqlViewerHistoryStore.countByLivestream(ctx, livestreamID)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	for _, v := range s.pending {
+		if v.LivestreamID == livestreamID {
+			cnt++
+		}
+	}
+	s.mu.Unlock()
+	return cnt, nil
+}
+
+func (s *bufferedViewerHistoryStore) countAll(ctx context.Context) (map[int64]int64, error) {
+	s.flushing.RLock()
+	defer s.flushing.RUnlock()
+
+	counts, err := s.mysqlViewerHistoryStore.countAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	for _, v := range s.pending {
+		counts[v.LivestreamID]++
+	}
+	s.mu.Unlock()
+	return counts, nil
+}
+
+func (s *bufferedViewerHistoryStore) watchedLivestreamIDs(ctx context.Context, userID int64) ([]int64, error) {
+	s.flushing.RLock()
+	defer s.flushing.RUnlock()
+
+	ids, err := s.mysqlViewerHistoryStore.watchedLivestreamIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		seen[id] = struct{}{}
+	}
+	s.mu.Lock()
+	for _, v := range s.pending {
+		if _, ok := seen[v.LivestreamID]; v.UserID == userID && !ok {
+			seen[v.LivestreamID] = struct{}{}
+			ids = append(ids, v.LivestreamID)
+		}
+	}
+	s.mu.Unlock()
+	return ids, nil
+}
+
+// rebuild はテーブルから作り直すので、先に溜めている分を書き込みます。
+func (s *bufferedViewerHistoryStore) rebuild(ctx context.Context) error {
+	if err := s.flush(ctx); err != nil {
+		return err
+	}
+	return s.mysqlViewerHistoryStore.rebuild(ctx)
+}
+
+// viewerHistoryOnMySQL は視聴履歴を MySQL のテーブルに置いているかを返します。
+func viewerHistoryOnMySQL() bool {
+	switch viewerHistory.(type) {
+	case *mysqlViewerHistoryStore, *bufferedViewerHistoryStore:
+		return true
+	}
+	return false
+}
+
+// discardViewerHistoryBuffer は initialize でテーブルを作り直す前に、溜めている入室を捨てます。
+func discardViewerHistoryBuffer() {
+	if s, ok := viewerHistory.(*bufferedViewerHistoryStore); ok {
+		s.discard()
+	}
+}
+
+// closeViewerHistory はサーバの終了時に溜めている入室を書き込みます。
+func closeViewerHistory() {
+	if s, ok := viewerHistory.(*bufferedViewerHistoryStore); ok {
+		s.close()
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 視聴時間の集計
+// 入室から退室までを 1 回の視聴として、退室のたびに配信ごと・視聴者ごとの累計に加算する
+// (履歴を舐めずに統計を返すため。退室していない視聴は含まれない)
+
+type LivestreamWatchStatsModel struct {
+	LivestreamID int64 `db:"livestream_id"`
+	TotalSeconds int64 `db:"total_seconds"`
+	Sessions     int64 `db:"sessions"`
+}
+
+// recordWatchSession は 1 回分の視聴時間を累計に加算します。
+func recordWatchSession(ctx context.Context, userID, livestreamID, seconds int64) error {
+	if seconds < 0 {
+		seconds = 0
+	}
+	return runInTx(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_watch_stats (livestream_id, total_seconds, sessions) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE total_seconds = total_seconds + VALUES(total_seconds), sessions = sessions + 1", livestreamID, seconds); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO user_watch_stats (user_id, total_seconds) VALUES (?, ?) ON DUPLICATE KEY UPDATE total_seconds = total_seconds + VALUES(total_seconds)", userID, seconds); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// livestreamWatchStats は配信の視聴時間の合計と 1 回あたりの平均 (秒) を返します。
+func livestreamWatchStats(ctx context.Context, db sqlx.QueryerContext, livestreamID int64) (total int64, average float64, err error) {
+	var stats LivestreamWatchStatsModel
+	if err := sqlx.GetContext(ctx, db, &stats, "SELECT IFNULL(SUM(total_seconds), 0) AS total_seconds, IFNULL(SUM(sessions), 0) AS sessions FROM livestream_watch_stats WHERE livestream_id = ?", livestreamID); err != nil {
+		return 0, 0, err
+	}
+	if stats.Sessions > 0 {
+		average = float64(stats.TotalSeconds) / float64(stats.Sessions)
+	}
+	return stats.TotalSeconds, average, nil
+}
+
+// userWatchSeconds はユーザが視聴者として配信を見ていた時間の合計 (秒) を返します。
+func userWatchSeconds(ctx context.Context, db sqlx.QueryerContext, userID int64) (int64, error) {
+	var total int64
+	err := sqlx.GetContext(ctx, db, &total, "SELECT IFNULL(SUM(total_seconds), 0) FROM user_watch_stats WHERE user_id = ?", userID)
+	return total, err
+}
@@ -10,6 +10,32 @@ TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
+TRUNCATE TABLE analytics_events;
+TRUNCATE TABLE announcements;
+TRUNCATE TABLE chat_preferences;
+TRUNCATE TABLE chat_hidden_users;
+TRUNCATE TABLE livestream_settings;
+TRUNCATE TABLE clips;
+TRUNCATE TABLE clip_reactions;
+TRUNCATE TABLE polls;
+TRUNCATE TABLE poll_options;
+TRUNCATE TABLE poll_votes;
+TRUNCATE TABLE questions;
+TRUNCATE TABLE question_votes;
+TRUNCATE TABLE user_sessions;
+TRUNCATE TABLE api_tokens;
+TRUNCATE TABLE livestream_watch_stats;
+TRUNCATE TABLE user_watch_stats;
+TRUNCATE TABLE dns_registration_outbox;
+TRUNCATE TABLE user_suspensions;
+TRUNCATE TABLE privacy_settings;
+TRUNCATE TABLE livecomment_edits;
+TRUNCATE TABLE user_blocks;
+TRUNCATE TABLE livestream_bans;
+TRUNCATE TABLE livestream_ban_logs;
+TRUNCATE TABLE inactive_tags;
+TRUNCATE TABLE stream_keys;
+TRUNCATE TABLE livestream_thumbnails;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
@@ -22,4 +48,22 @@ ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
-ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
+ALTER TABLE `users` auto_increment = 1;
+ALTER TABLE `analytics_events` auto_increment = 1;
+ALTER TABLE `announcements` auto_increment = 1;
+ALTER TABLE `chat_preferences` auto_increment = 1;
+ALTER TABLE `chat_hidden_users` auto_increment = 1;
+ALTER TABLE `livestream_settings` auto_increment = 1;
+ALTER TABLE `clips` auto_increment = 1;
+ALTER TABLE `clip_reactions` auto_increment = 1;
+ALTER TABLE `polls` auto_increment = 1;
+ALTER TABLE `poll_options` auto_increment = 1;
+ALTER TABLE `poll_votes` auto_increment = 1;
+ALTER TABLE `questions` auto_increment = 1;
+ALTER TABLE `question_votes` auto_increment = 1;
+ALTER TABLE `user_sessions` auto_increment = 1;
+ALTER TABLE `api_tokens` auto_increment = 1;
+ALTER TABLE `dns_registration_outbox` auto_increment = 1;
+ALTER TABLE `livecomment_edits` auto_increment = 1;
+ALTER TABLE `user_blocks` auto_increment = 1;
+ALTER TABLE `livestream_ban_logs` auto_increment = 1;
\ No newline at end of file